@@ -36,6 +36,35 @@ func (d *Daemon) AddProcessor(name string, pc backends.ProcessorConstructor) {
 	backends.Svc.AddProcessor(name, pc)
 }
 
+// AddContextProcessor adds a context-aware processor constructor to the backend.
+// name is the identifier to be used in the config. See backends docs for more info.
+func (d *Daemon) AddContextProcessor(name string, pc backends.ContextProcessorConstructor) {
+	backends.Svc.AddContextProcessor(name, pc)
+}
+
+// AddStreamProcessor adds a stream processor constructor to the backend.
+// name is the identifier to be used in the config. See backends docs for more info.
+func (d *Daemon) AddStreamProcessor(name string, pc backends.StreamProcessorConstructor) {
+	backends.Svc.AddStreamProcessor(name, pc)
+}
+
+// AddProcessorSchema describes the config options of a processor, so that the backend config can be
+// checked when it starts, and the options listed by the processors command. See backends.ConfigOptions
+func (d *Daemon) AddProcessorSchema(schema backends.ProcessorSchema) {
+	backends.Svc.AddSchema(schema)
+}
+
+// QueueStats returns the queue depth and other stats about the load of the backend.
+// ok is false if the daemon is not started or the backend does not report its load
+func (d *Daemon) QueueStats() (stats backends.QueueStats, ok bool) {
+	if g, isGuerrilla := d.g.(*guerrilla); isGuerrilla {
+		if lr, isReporter := g.backend().(backends.LoadReporter); isReporter {
+			return lr.QueueStats(), true
+		}
+	}
+	return stats, false
+}
+
 // Starts the daemon, initializing d.Config, d.Logger and d.Backend with defaults
 // can only be called once through the lifetime of the program
 func (d *Daemon) Start() (err error) {
@@ -775,3 +775,98 @@ func TestCustomBackendResult(t *testing.T) {
 	}
 
 }
+
+func TestNamedBackends(t *testing.T) {
+	if err := os.Truncate("tests/testlog", 0); err != nil {
+		t.Error(err)
+	}
+	newConfig := func(relayProcess string) AppConfig {
+		return AppConfig{
+			LogFile:      "tests/testlog",
+			AllowedHosts: []string{"grr.la"},
+			BackendConfig: backends.BackendConfig{
+				"save_process": "HeadersParser|Debugger",
+			},
+			Backends: map[string]backends.BackendConfig{
+				"relay": {"save_process": relayProcess},
+			},
+			Servers: []ServerConfig{
+				{ListenInterface: "127.0.0.1:2525", IsEnabled: true},
+				{ListenInterface: "127.0.0.1:2526", IsEnabled: true, Backend: "relay"},
+			},
+		}
+	}
+	cfg := newConfig("HeadersParser")
+	d := Daemon{Config: &cfg}
+	if err := d.Start(); err != nil {
+		t.Error(err)
+		return
+	}
+	defer d.Shutdown()
+	g := d.g.(*guerrilla)
+	mx, _ := g.findServer("127.0.0.1:2525")
+	relayServer, _ := g.findServer("127.0.0.1:2526")
+	defaultBackend, relay := g.backend(), g.namedBackend("relay")
+	if relay == nil || relay == defaultBackend {
+		t.Error("expecting the relay backend to be separate from the default")
+		return
+	}
+	if mx.backend() != defaultBackend || relayServer.backend() != relay {
+		t.Error("expecting each server to use its own backend")
+	}
+	if err := talkToServer("127.0.0.1:2526"); err != nil {
+		t.Error(err)
+	}
+
+	// only the relay backend should be restarted
+	if err := d.ReloadConfig(newConfig("HeadersParser|Debugger")); err != nil {
+		t.Error(err)
+	}
+	if g.backend() != defaultBackend {
+		t.Error("the default backend was restarted, but its config did not change")
+	}
+	if gw, ok := defaultBackend.(*backends.BackendGateway); ok && gw.State != backends.BackendStateRunning {
+		t.Error("expecting the default backend to still be running, it is", gw.State)
+	}
+	newRelay := g.namedBackend("relay")
+	if newRelay == nil || newRelay == relay {
+		t.Error("expecting the relay backend to be restarted")
+	}
+	if relayServer.backend() != newRelay || mx.backend() != defaultBackend {
+		t.Error("expecting the relay server to use the new relay backend")
+	}
+	if err := talkToServer("127.0.0.1:2526"); err != nil {
+		t.Error(err)
+	}
+
+	// remove the relay backend, moving its server to the default backend
+	cfg = newConfig("HeadersParser|Debugger")
+	cfg.Backends = nil
+	cfg.Servers[1].Backend = ""
+	if err := d.ReloadConfig(cfg); err != nil {
+		t.Error(err)
+	}
+	if g.namedBackend("relay") != nil {
+		t.Error("expecting the relay backend to be removed")
+	}
+	if relayServer.backend() != defaultBackend {
+		t.Error("expecting the relay server to use the default backend")
+	}
+	if gw, ok := newRelay.(*backends.BackendGateway); ok && gw.State != backends.BackendStateShuttered {
+		t.Error("expecting the removed backend to be shut down, it is", gw.State)
+	}
+}
+
+func TestNamedBackendNotFound(t *testing.T) {
+	cfg := AppConfig{
+		LogFile:      "tests/testlog",
+		AllowedHosts: []string{"grr.la"},
+		Servers: []ServerConfig{
+			{ListenInterface: "127.0.0.1:2525", IsEnabled: true, Backend: "relay"},
+		},
+	}
+	d := Daemon{}
+	if err := d.SetConfig(cfg); err == nil || !strings.Contains(err.Error(), "relay") {
+		t.Error("expecting an error about the relay backend, got", err)
+	}
+}
@@ -19,12 +19,24 @@ var (
 	// Store the constructor for making an new processor decorator.
 	processors map[string]ProcessorConstructor
 
+	// Store the constructor for making a new context processor decorator.
+	contextProcessors map[string]ContextProcessorConstructor
+
+	// Store the constructor for making a new stream processor decorator.
+	streamProcessors map[string]StreamProcessorConstructor
+
+	// Store the schema of each processor, see AddSchema
+	schemas map[string]ProcessorSchema
+
 	b Backend
 )
 
 func init() {
 	Svc = &service{}
 	processors = make(map[string]ProcessorConstructor)
+	contextProcessors = make(map[string]ContextProcessorConstructor)
+	streamProcessors = make(map[string]StreamProcessorConstructor)
+	schemas = make(map[string]ProcessorSchema)
 }
 
 type ProcessorConstructor func() Decorator
@@ -48,6 +60,25 @@ type Backend interface {
 	Start() error
 }
 
+// LoadReporter is implemented by backends that can tell when they are too busy to accept more work
+type LoadReporter interface {
+	// Busy returns true if new tasks would be rejected
+	Busy() bool
+	// QueueStats returns the queue depth and other stats about the load
+	QueueStats() QueueStats
+}
+
+// SessionValidator is implemented by backends that can validate the client before it sends an email.
+// Each method returns nil if the client may continue, or an error that SessionErrorResponse turns in to a reply
+type SessionValidator interface {
+	// ValidateConnect validates the client when it connects, using e.RemoteIP
+	ValidateConnect(e *mail.Envelope) error
+	// ValidateHelo validates e.Helo, after the HELO or EHLO command
+	ValidateHelo(e *mail.Envelope) error
+	// ValidateMailFrom validates e.MailFrom, after the MAIL FROM command
+	ValidateMailFrom(e *mail.Envelope) error
+}
+
 type BackendConfig map[string]interface{}
 
 // All config structs extend from this
@@ -150,11 +181,22 @@ func convertError(name string) error {
 	return fmt.Errorf("failed to load backend config (%s)", name)
 }
 
-type service struct {
+// processorScope has the initializers and shutdowners of a set of processors
+type processorScope struct {
 	initializers []processorInitializer
 	shutdowners  []processorShutdowner
+}
+
+type service struct {
+	processorScope
 	sync.Mutex
 	mainlog atomic.Value
+	// scope, when not nil, gets the initializers and shutdowners instead, see collect
+	scope *processorScope
+	// breakers, when not nil, has the circuit breakers of the gateway that is collecting
+	breakers *breakerSet
+	// collecting makes the gateways build their processors one at a time
+	collecting sync.Mutex
 }
 
 // Get loads the log.logger in an atomic operation. Returns a stderr logger if not able to load
@@ -174,6 +216,10 @@ func (s *service) SetMainlog(l log.Logger) {
 func (s *service) AddInitializer(i processorInitializer) {
 	s.Lock()
 	defer s.Unlock()
+	if s.scope != nil {
+		s.scope.initializers = append(s.scope.initializers, i)
+		return
+	}
 	s.initializers = append(s.initializers, i)
 }
 
@@ -181,49 +227,119 @@ func (s *service) AddInitializer(i processorInitializer) {
 func (s *service) AddShutdowner(sh processorShutdowner) {
 	s.Lock()
 	defer s.Unlock()
+	if s.scope != nil {
+		s.scope.shutdowners = append(s.scope.shutdowners, sh)
+		return
+	}
 	s.shutdowners = append(s.shutdowners, sh)
 }
 
+// collect calls build and returns the initializers and shutdowners that were added while it ran.
+// Each gateway keeps the ones of its own processors, so that it doesn't initialize or shut down
+// the processors of another gateway. The retry groups that build makes use the circuit breakers in breakers
+func (s *service) collect(breakers *breakerSet, build func() error) (*processorScope, error) {
+	s.collecting.Lock()
+	defer s.collecting.Unlock()
+	scope := &processorScope{}
+	s.Lock()
+	s.scope, s.breakers = scope, breakers
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		s.scope, s.breakers = nil, nil
+		s.Unlock()
+	}()
+	err := build()
+	return scope, err
+}
+
+// scopeBreakers returns the circuit breakers for the retry groups being made, see collect
+func (s *service) scopeBreakers() *breakerSet {
+	s.Lock()
+	defer s.Unlock()
+	if s.breakers == nil {
+		return looseBreakers
+	}
+	return s.breakers
+}
+
 // reset clears the initializers and Shutdowners
 func (s *service) reset() {
 	s.shutdowners = make([]processorShutdowner, 0)
 	s.initializers = make([]processorInitializer, 0)
 }
 
+// withConfig calls makeFunc, and the processors that it makes are initialized with the config
+// returned by configFor, instead of the backend config
+func (s *service) withConfig(configFor func(BackendConfig) (BackendConfig, error), makeFunc func()) {
+	inner := &processorScope{}
+	s.Lock()
+	outer := s.scope
+	s.scope = inner
+	s.Unlock()
+	makeFunc()
+	s.Lock()
+	s.scope = outer
+	s.Unlock()
+	for _, i := range inner.initializers {
+		i := i
+		s.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+			cfg, err := configFor(backendConfig)
+			if err != nil {
+				return err
+			}
+			return i.Initialize(cfg)
+		}))
+	}
+	for _, sh := range inner.shutdowners {
+		s.AddShutdowner(sh)
+	}
+}
+
 // Initialize initializes all the processors one-by-one and returns any errors.
 // Subsequent calls to Initialize will not call the initializer again unless it failed on the previous call
 // so Initialize may be called again to retry after getting errors
 func (s *service) initialize(backend BackendConfig) Errors {
 	s.Lock()
 	defer s.Unlock()
+	return s.processorScope.initialize(backend)
+}
+
+// Shutdown shuts down all the processors by calling their shutdowners (if any)
+// Subsequent calls to Shutdown will not call the shutdowners again unless it failed on the previous call
+// so Shutdown may be called again to retry after getting errors
+func (s *service) shutdown() Errors {
+	s.Lock()
+	defer s.Unlock()
+	return s.processorScope.shutdown()
+}
+
+// initialize calls the initializers, keeping the ones that failed
+func (ps *processorScope) initialize(backend BackendConfig) Errors {
 	var errors Errors
 	failed := make([]processorInitializer, 0)
-	for i := range s.initializers {
-		if err := s.initializers[i].Initialize(backend); err != nil {
+	for i := range ps.initializers {
+		if err := ps.initializers[i].Initialize(backend); err != nil {
 			errors = append(errors, err)
-			failed = append(failed, s.initializers[i])
+			failed = append(failed, ps.initializers[i])
 		}
 	}
 	// keep only the failed initializers
-	s.initializers = failed
+	ps.initializers = failed
 	return errors
 }
 
-// Shutdown shuts down all the processors by calling their shutdowners (if any)
-// Subsequent calls to Shutdown will not call the shutdowners again unless it failed on the previous call
-// so Shutdown may be called again to retry after getting errors
-func (s *service) shutdown() Errors {
-	s.Lock()
-	defer s.Unlock()
+// shutdown calls the shutdowners, keeping the ones that failed
+func (ps *processorScope) shutdown() Errors {
 	var errors Errors
 	failed := make([]processorShutdowner, 0)
-	for i := range s.shutdowners {
-		if err := s.shutdowners[i].Shutdown(); err != nil {
+	for i := range ps.shutdowners {
+		if err := ps.shutdowners[i].Shutdown(); err != nil {
 			errors = append(errors, err)
-			failed = append(failed, s.shutdowners[i])
+			failed = append(failed, ps.shutdowners[i])
 		}
 	}
-	s.shutdowners = failed
+	ps.shutdowners = failed
 	return errors
 }
 
@@ -237,10 +353,81 @@ func (s *service) AddProcessor(name string, p ProcessorConstructor) {
 	c = func() Decorator {
 		return p()
 	}
-	// add to our processors list
+	// add to our processors list, replacing any context processor with the same name
+	delete(contextProcessors, strings.ToLower(name))
 	processors[strings.ToLower(name)] = c
 }
 
+// AddContextProcessor adds a new processor that receives a context.Context, see ContextProcessor.
+// It becomes available to the backend_config.save_process and backend_config.validate_process options,
+// the same way as processors added with AddProcessor
+func (s *service) AddContextProcessor(name string, p ContextProcessorConstructor) {
+	// wrap in a constructor since we want to defer calling it
+	var c ContextProcessorConstructor
+	c = func() ContextDecorator {
+		return p()
+	}
+	// add to our context processors list, replacing any processor with the same name
+	delete(processors, strings.ToLower(name))
+	contextProcessors[strings.ToLower(name)] = c
+}
+
+// AddStreamProcessor adds a new stream processor, which becomes available to the
+// backend_config.stream_save_process option
+func (s *service) AddStreamProcessor(name string, p StreamProcessorConstructor) {
+	// wrap in a constructor since we want to defer calling it
+	var c StreamProcessorConstructor
+	c = func() StreamDecorator {
+		return p()
+	}
+	// add to our stream processors list
+	streamProcessors[strings.ToLower(name)] = c
+}
+
+// processorsKey is the backend config option that has the config blocks of the processors
+const processorsKey = "processors"
+
+// instanceConfig returns the config for a processor in a stack, where name is the processor's name
+// or the name of an instance of it, eg. "sql#archive". The config is the backend config, with the values
+// from the processor's block in the "processors" option on top. An instance must have a block
+func instanceConfig(backendConfig BackendConfig, name string) (BackendConfig, error) {
+	var block map[string]interface{}
+	var blocks map[string]interface{}
+	switch v := backendConfig[processorsKey].(type) {
+	case map[string]interface{}:
+		blocks = v
+	case BackendConfig:
+		blocks = v
+	}
+	for key, v := range blocks {
+		if strings.EqualFold(key, name) {
+			switch v := v.(type) {
+			case map[string]interface{}:
+				block = v
+			case BackendConfig:
+				block = v
+			default:
+				return nil, fmt.Errorf("the config of processor [%s] must be an object", name)
+			}
+			break
+		}
+	}
+	if block == nil {
+		if strings.Contains(name, "#") {
+			return nil, fmt.Errorf("processor [%s] has no config in the %s option", name, processorsKey)
+		}
+		return backendConfig, nil
+	}
+	cfg := make(BackendConfig, len(backendConfig)+len(block))
+	for k, v := range backendConfig {
+		cfg[k] = v
+	}
+	for k, v := range block {
+		cfg[k] = v
+	}
+	return cfg, nil
+}
+
 // extractConfig loads the backend config. It has already been unmarshalled
 // configData contains data from the main config file's "backend_config" value
 // configType is a Processor's specific config value.
@@ -0,0 +1,105 @@
+package backends
+
+import (
+	"context"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// ContextProcessor is like Processor, except that it also receives a context.Context.
+// The context has the deadline of the task, set by gw_save_timeout or gw_val_rcpt_timeout,
+// and carries the queued id of the envelope, see QueuedIDFromContext.
+// When the deadline passes, the client has already been told that there was a timeout,
+// so the processor should stop what it's doing and return ctx.Err()
+type ContextProcessor interface {
+	ProcessContext(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error)
+}
+
+// Signature of ContextProcessor
+type ProcessContextWith func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error)
+
+// Make ProcessContextWith will satisfy the ContextProcessor interface
+func (f ProcessContextWith) ProcessContext(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+	// delegate to the anonymous function
+	return f(ctx, e, task)
+}
+
+// ContextDecorator is what a decorator for a ContextProcessor looks like
+type ContextDecorator func(ContextProcessor) ContextProcessor
+
+type ContextProcessorConstructor func() ContextDecorator
+
+type contextKey int
+
+const queuedIDKey contextKey = iota
+
+// newTaskContext returns a new context for processing e, that expires after timeout
+func newTaskContext(e *mail.Envelope, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), queuedIDKey, e.QueuedId)
+	return context.WithTimeout(ctx, timeout)
+}
+
+// QueuedIDFromContext returns the queued id of the envelope that the task is for
+func QueuedIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(queuedIDKey).(string)
+	return id, ok
+}
+
+// AsDecorator converts d to a Decorator, for callers that stack the Decorators themselves.
+// The ContextProcessor gets a context without a deadline
+func AsDecorator(d ContextDecorator) Decorator {
+	return func(next Processor) Processor {
+		p := d(ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+			return next.Process(e, task)
+		}))
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			return p.ProcessContext(context.Background(), e, task)
+		})
+	}
+}
+
+// contextStack is a stack of processors that can have both Decorators and ContextDecorators.
+// A Decorator is not able to pass the context down to the next processor, so the stack keeps
+// the context on the side, where the ContextDecorators further down can get it.
+// This is safe since each stack is only used by one worker at a time.
+type contextStack struct {
+	ctx context.Context
+	top Processor
+}
+
+// Process runs the stack without a deadline
+func (s *contextStack) Process(e *mail.Envelope, task SelectTask) (Result, error) {
+	return s.ProcessContext(context.Background(), e, task)
+}
+
+// ProcessContext runs the stack with ctx
+func (s *contextStack) ProcessContext(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+	s.ctx = ctx
+	defer func() {
+		s.ctx = nil
+	}()
+	return s.top.Process(e, task)
+}
+
+// adapt converts d to a Decorator, so that it can be stacked with the Decorators
+func (s *contextStack) adapt(d ContextDecorator) Decorator {
+	return func(next Processor) Processor {
+		p := d(ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+			// the decorator may have derived a new context, use it for the rest of the stack
+			parent := s.ctx
+			s.ctx = ctx
+			defer func() {
+				s.ctx = parent
+			}()
+			return next.Process(e, task)
+		}))
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			ctx := s.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			return p.ProcessContext(ctx, e, task)
+		})
+	}
+}
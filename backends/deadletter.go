@@ -0,0 +1,248 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// Dead letters are envelopes that the save_process stack returned an error for.
+// When the dead_letter_dir config option is set, the gateway keeps a copy of each of them,
+// so that the failure can be looked in to, and the envelope saved again with Reinject once it's fixed.
+// Spooled envelopes become dead letters when the spool gives up on them.
+//
+// Like the spool, each dead letter is saved as 2 files: <id>.msg holds the message data and <id>.json
+// holds the DeadLetter. The .json file is written last, so a dead letter only exists once it's there.
+
+// DeadLetter describes an envelope that could not be saved
+type DeadLetter struct {
+	ID string `json:"id"`
+	// Time is when it failed
+	Time time.Time `json:"time"`
+	// Stack is the save_process stack that failed
+	Stack string `json:"stack"`
+	// Error is the error returned by the stack
+	Error string `json:"error"`
+	// Result is the reply that was given to the client, empty if it was spooled
+	Result   string             `json:"result,omitempty"`
+	Envelope *mail.EnvelopeMeta `json:"envelope"`
+}
+
+// DeadLetterer is implemented by backends that keep the envelopes that could not be saved
+type DeadLetterer interface {
+	// DeadLetters returns the dead letters, nil if they are not kept
+	DeadLetters() *DeadLetterStore
+	// Reinject saves the dead letter with the given id using the save_process stack,
+	// and removes it if it was saved
+	Reinject(id string) (Result, error)
+}
+
+// Injector is implemented by backends that can save an envelope that was kept outside of the backend
+type Injector interface {
+	Inject(meta *mail.EnvelopeMeta, data io.Reader) (Result, error)
+}
+
+// DeadLetterStore is a directory of dead letters
+type DeadLetterStore struct {
+	dir string
+}
+
+// deadLetterSeq makes dead letter ids unique when two envelopes fail in the same nanosecond
+var deadLetterSeq uint64
+
+// OpenDeadLetters opens the dead letters in dir, making it if it doesn't exist
+func OpenDeadLetters(dir string) (*DeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DeadLetterStore{dir: dir}, nil
+}
+
+// Dir returns the directory of the dead letters
+func (d *DeadLetterStore) Dir() string {
+	return d.dir
+}
+
+// add writes a dead letter for the envelope described by meta, with the message data from data
+func (d *DeadLetterStore) add(meta *mail.EnvelopeMeta, data io.Reader, stack string, result Result, reason error) (string, error) {
+	now := time.Now()
+	dl := &DeadLetter{
+		ID:       fmt.Sprintf("%d-%d", now.UnixNano(), atomic.AddUint64(&deadLetterSeq, 1)),
+		Time:     now,
+		Stack:    stack,
+		Envelope: meta,
+	}
+	if reason != nil {
+		dl.Error = reason.Error()
+	}
+	if result != nil {
+		dl.Result = strings.TrimSpace(result.String())
+	}
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return "", err
+	}
+	if err = writeFile(d.dir, dl.ID+spoolDataExt, data); err == nil {
+		if err = writeFile(d.dir, dl.ID+spoolMetaExt, bytes.NewReader(b)); err == nil {
+			err = syncDir(d.dir)
+		}
+	}
+	if err != nil {
+		_ = d.Remove(dl.ID)
+		return "", err
+	}
+	return dl.ID, nil
+}
+
+// List returns the dead letters, oldest first
+func (d *DeadLetterStore) List() ([]*DeadLetter, error) {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []*DeadLetter
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), spoolMetaExt) || strings.HasPrefix(f.Name(), spoolTempPrefix) {
+			continue
+		}
+		dl, err := d.Get(strings.TrimSuffix(f.Name(), spoolMetaExt))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, dl)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return spoolIdLess(list[i].ID, list[j].ID)
+	})
+	return list, nil
+}
+
+// Get returns the dead letter with the given id
+func (d *DeadLetterStore) Get(id string) (*DeadLetter, error) {
+	if err := checkDeadLetterID(id); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(d.dir, id+spoolMetaExt))
+	if err != nil {
+		return nil, err
+	}
+	dl := &DeadLetter{}
+	if err = json.Unmarshal(b, dl); err != nil {
+		return nil, fmt.Errorf("dead letter %s: %s", id, err)
+	}
+	if dl.Envelope == nil {
+		dl.Envelope = &mail.EnvelopeMeta{}
+	}
+	dl.ID = id
+	return dl, nil
+}
+
+// Data opens the message data of the dead letter with the given id
+func (d *DeadLetterStore) Data(id string) (io.ReadCloser, error) {
+	if err := checkDeadLetterID(id); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(d.dir, id+spoolDataExt))
+}
+
+// Remove deletes the dead letter with the given id
+func (d *DeadLetterStore) Remove(id string) error {
+	if err := checkDeadLetterID(id); err != nil {
+		return err
+	}
+	var errs Errors
+	for _, ext := range []string{spoolMetaExt, spoolDataExt} {
+		if err := os.Remove(filepath.Join(d.dir, id+ext)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkDeadLetterID makes sure that id cannot point outside of the directory
+func checkDeadLetterID(id string) error {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return fmt.Errorf("invalid dead letter id [%s]", id)
+	}
+	return nil
+}
+
+// DeadLetters returns the dead letters of the gateway, nil if dead_letter_dir is not set
+func (gw *BackendGateway) DeadLetters() *DeadLetterStore {
+	return gw.deadLetters
+}
+
+// Reinject loads the dead letter with the given id and saves it using the save_process stack, waiting for
+// a worker if they are busy. The dead letter is removed if it was saved, otherwise it's kept as it was
+func (gw *BackendGateway) Reinject(id string) (Result, error) {
+	if gw.deadLetters == nil {
+		return nil, errors.New("dead letters are not kept, dead_letter_dir is not set")
+	}
+	if gw.State != BackendStateRunning {
+		return nil, fmt.Errorf("cannot reinject because the backend is in %s state", gw.State)
+	}
+	dl, err := gw.deadLetters.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := gw.deadLetters.Data(id)
+	if err != nil {
+		return nil, err
+	}
+	result, err := gw.Inject(dl.Envelope, data)
+	_ = data.Close()
+	if err != nil {
+		return nil, err
+	}
+	if result.Code() < 300 {
+		if err := gw.deadLetters.Remove(id); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Inject saves an envelope that was kept outside of the backend, such as an .eml file written by the
+// EmlFile processor, using the save_process stack and waiting for a worker if they are busy.
+// meta describes the envelope and data has the message data, without the delivery header
+func (gw *BackendGateway) Inject(meta *mail.EnvelopeMeta, data io.Reader) (Result, error) {
+	if gw.State != BackendStateRunning {
+		return nil, fmt.Errorf("cannot inject because the backend is in %s state", gw.State)
+	}
+	e := mail.NewEnvelope("", 0)
+	e.SetMeta(meta)
+	// removes the temporary data file, if any, after the backend has finished
+	defer e.ResetTransaction()
+	if err := gw.loadData(e, data); err != nil {
+		return nil, err
+	}
+	return gw.process(e, true), nil
+}
+
+// deadLetter keeps e if dead letters are on. result is the reply the client got, and reason is the error
+// returned by the save_process stack
+func (gw *BackendGateway) deadLetter(e *mail.Envelope, result Result, reason error) {
+	if gw.deadLetters == nil {
+		return
+	}
+	id, err := gw.deadLetters.add(e.Meta(), e.DataReader(), gw.gwConfig.SaveProcess, result, reason)
+	if err != nil {
+		Log().WithError(err).Errorf("could not dead letter %s", e.QueuedId)
+		return
+	}
+	Log().Infof("kept %s as dead letter %s", e.QueuedId, id)
+}
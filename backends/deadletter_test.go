@@ -0,0 +1,162 @@
+package backends
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+func TestDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var down int32 = 1
+	var saved string
+	Svc.AddProcessor("DeadStore", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					if atomic.LoadInt32(&down) == 1 {
+						return nil, errors.New("storage is down")
+					}
+					saved = e.Data.String()
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "deadstore")
+	c := BackendConfig{
+		"save_process":    "HeadersParser|DeadStore",
+		"dead_letter_dir": dir,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	if result := gateway.Process(newSpoolTestEnvelope()); result.Code() != 554 {
+		t.Error("expecting 554, got", result)
+	}
+	list, err := gateway.DeadLetters().List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatal("expecting 1 dead letter, got", len(list))
+	}
+	dl := list[0]
+	if dl.Error != "storage is down" || dl.Stack != "HeadersParser|DeadStore" || dl.Result == "" || dl.Time.IsZero() {
+		t.Error("expecting the error, stack, result and time to be kept, got", dl)
+	}
+	if dl.Envelope.QueuedId != "abc12345" || len(dl.Envelope.RcptTo) != 1 || dl.Envelope.Helo != "helo.example.com" {
+		t.Error("expecting the envelope to be kept, got", dl.Envelope)
+	}
+
+	// still down, so it's kept
+	if result, err := gateway.Reinject(dl.ID); err != nil || result.Code() < 400 {
+		t.Error("expecting the reinject to fail, got", result, err)
+	}
+	if list, _ = gateway.DeadLetters().List(); len(list) != 1 {
+		t.Error("expecting the dead letter to be kept, without making another, got", len(list))
+	}
+
+	atomic.StoreInt32(&down, 0)
+	if result, err := gateway.Reinject(dl.ID); err != nil || result.Code() != 250 {
+		t.Error("expecting the reinject to succeed, got", result, err)
+	}
+	if saved != "Subject: Test\n\nThis is a test." {
+		t.Error("expecting the message data to be saved, got", saved)
+	}
+	if list, _ = gateway.DeadLetters().List(); len(list) != 0 {
+		t.Error("expecting the dead letter to be removed, got", len(list))
+	}
+	if _, err := gateway.Reinject("../" + dl.ID); err == nil {
+		t.Error("expecting an error for an id outside of the directory")
+	}
+}
+
+func TestSpoolDeadLetters(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "guerrilla-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+	dir, err := ioutil.TempDir("", "guerrilla-deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	Svc.AddProcessor("SpoolDeadStore", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					return nil, errors.New("storage is down")
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "spooldeadstore")
+	c := BackendConfig{
+		"save_process":        "SpoolDeadStore",
+		"spool_dir":           spoolDir,
+		"spool_max_retries":   2,
+		"spool_retry_backoff": "10ms",
+		"dead_letter_dir":     dir,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	if result := gateway.Process(newSpoolTestEnvelope()); result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+	var list []*DeadLetter
+	for i := 0; i < 100 && len(list) == 0; i++ {
+		time.Sleep(time.Millisecond * 20)
+		list, _ = gateway.DeadLetters().List()
+	}
+	if len(list) != 1 {
+		t.Fatal("expecting the spool to make a dead letter when it gives up, got", len(list))
+	}
+	if list[0].Envelope.QueuedId != "abc12345" || list[0].Result != "" {
+		t.Error("expecting the spooled envelope, without a result, got", list[0])
+	}
+	// the spooled files are removed after the dead letter is made
+	files := spoolFiles(t, spoolDir)
+	for i := 0; i < 100 && len(files) != 0; i++ {
+		time.Sleep(time.Millisecond * 20)
+		files = spoolFiles(t, spoolDir)
+	}
+	if len(files) != 0 {
+		t.Error("expecting the spooled files to be removed, got", files)
+	}
+}
@@ -1,10 +1,14 @@
 package backends
 
 import (
+	"context"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"runtime/debug"
@@ -17,19 +21,81 @@ import (
 
 var ErrProcessorNotFound error
 
+var (
+	// backendVars publishes the queue stats and circuit breakers of the running gateways using expvar
+	backendVars = expvar.NewMap("guerrilla_backend")
+	// running has the gateways that are running, by the name of their backend
+	running      = make(map[string]*BackendGateway)
+	runningGuard sync.Mutex
+)
+
+func init() {
+	// the default backend has its stats at the top, and the named backends under "backends"
+	backendVars.Set("queue", expvar.Func(func() interface{} {
+		if gw := runningGateway(""); gw != nil {
+			return gw.QueueStats()
+		}
+		return nil
+	}))
+	backendVars.Set("breakers", expvar.Func(func() interface{} {
+		if gw := runningGateway(""); gw != nil {
+			return gw.breakers.stats()
+		}
+		return nil
+	}))
+	backendVars.Set("backends", expvar.Func(func() interface{} {
+		runningGuard.Lock()
+		defer runningGuard.Unlock()
+		stats := make(map[string]interface{}, len(running))
+		for name, gw := range running {
+			if name == "" {
+				continue
+			}
+			stats[name] = map[string]interface{}{
+				"queue":    gw.QueueStats(),
+				"breakers": gw.breakers.stats(),
+			}
+		}
+		return stats
+	}))
+}
+
+// runningGateway returns the running gateway of the backend called name, or nil
+func runningGateway(name string) *BackendGateway {
+	runningGuard.Lock()
+	defer runningGuard.Unlock()
+	return running[name]
+}
+
 // A backend gateway is a proxy that implements the Backend interface.
 // It is used to start multiple goroutine workers for saving mail, and then distribute email saving to the workers
 // via a channel. Shutting down via Shutdown() will stop all workers.
 // The rest of this program always talks to the backend via this gateway.
 type BackendGateway struct {
-	// channel for distributing envelopes to workers
-	conveyor chan *workerMsg
+	// savePool has the workers for TaskSaveMail tasks
+	savePool *workerPool
+	// validatePool has the workers for TaskValidateRcpt tasks
+	validatePool *workerPool
+	// connectPool has the workers for TaskValidateConnect and TaskValidateHelo tasks,
+	// nil if validate_connect_process is not set
+	connectPool *workerPool
+	// senderPool has the workers for TaskValidateMailFrom tasks, nil if validate_sender_process is not set
+	senderPool *workerPool
 
 	// waits for backend workers to start/stop
-	wg           sync.WaitGroup
-	workStoppers []chan bool
-	processors   []Processor
-	validators   []Processor
+	wg sync.WaitGroup
+	// streamers holds the stream processor stacks that are not in use, nil if streaming is off
+	streamers chan StreamProcessor
+	// spool is the local queue for accepted email, nil if spooling is off
+	spool *spool
+	// deadLetters keeps the email that could not be saved, nil if it's off
+	deadLetters *DeadLetterStore
+	// processors has the initializers and shutdowners of the processors in the stacks
+	processors *processorScope
+	// breakers has the circuit breakers of the retry groups in the stacks
+	breakers *breakerSet
+	// name of the backend, "" for the default backend
+	name string
 
 	// controls access to state
 	sync.Mutex
@@ -39,16 +105,60 @@ type BackendGateway struct {
 }
 
 type GatewayConfig struct {
-	// WorkersSize controls how many concurrent workers to start. Defaults to 1
-	WorkersSize int `json:"save_workers_size,omitempty"`
+	// WorkersSize controls how many concurrent workers to start for saving email. Defaults to 1
+	WorkersSize int `json:"save_workers_size,omitempty" default:"1" desc:"Number of workers that save email"`
 	// SaveProcess controls which processors to chain in a stack for saving email tasks
-	SaveProcess string `json:"save_process,omitempty"`
+	SaveProcess string `json:"save_process,omitempty" desc:"The processor stack for saving email"`
 	// ValidateProcess is like ProcessorStack, but for recipient validation tasks
-	ValidateProcess string `json:"validate_process,omitempty"`
+	ValidateProcess string `json:"validate_process,omitempty" desc:"The processor stack for validating recipients"`
 	// TimeoutSave is duration before timeout when saving an email, eg "29s"
-	TimeoutSave string `json:"gw_save_timeout,omitempty"`
+	TimeoutSave string `json:"gw_save_timeout,omitempty" default:"30s" desc:"Time to wait for an email to be saved"`
 	// TimeoutValidateRcpt duration before timeout when validating a recipient, eg "1s"
-	TimeoutValidateRcpt string `json:"gw_val_rcpt_timeout,omitempty"`
+	TimeoutValidateRcpt string `json:"gw_val_rcpt_timeout,omitempty" default:"5s" desc:"Time to wait for a recipient to be validated"`
+	// ValidateConnectProcess is like ValidateProcess, but for validating the client when it connects,
+	// and its HELO or EHLO command
+	ValidateConnectProcess string `json:"validate_connect_process,omitempty" desc:"The processor stack for validating the client when it connects, and its HELO"`
+	// ValidateSenderProcess is like ValidateProcess, but for validating the MAIL FROM command
+	ValidateSenderProcess string `json:"validate_sender_process,omitempty" desc:"The processor stack for validating MAIL FROM"`
+	// TimeoutValidateConnect duration before timeout when validating a connection or HELO, eg "1s"
+	TimeoutValidateConnect string `json:"gw_val_connect_timeout,omitempty" default:"5s" desc:"Time to wait for a connection or HELO to be validated"`
+	// TimeoutValidateSender duration before timeout when validating MAIL FROM, eg "1s"
+	TimeoutValidateSender string `json:"gw_val_sender_timeout,omitempty" default:"5s" desc:"Time to wait for MAIL FROM to be validated"`
+	// StreamSaveProcess is like SaveProcess, but for stream processors that receive the data as it arrives.
+	// Streaming is turned on when this is set. The save_process stack runs after the data has been read
+	StreamSaveProcess string `json:"stream_save_process,omitempty" desc:"The stream processor stack, turns on streaming"`
+	// StreamSpillThreshold is the number of bytes of message data to keep in memory when streaming,
+	// anything larger is spilled to a temporary file. Defaults to 1 MiB, -1 never spills
+	StreamSpillThreshold int `json:"stream_spill_threshold,omitempty" default:"1048576" desc:"Bytes to keep in memory when streaming, -1 never spills"`
+	// StreamSpillDir is the directory for the temporary files. Defaults to os.TempDir()
+	StreamSpillDir string `json:"stream_spill_dir,omitempty" desc:"Directory for the spilled data, the default is the temp directory"`
+	// SpoolDir turns on spooling. Email is written to this directory before replying to the client,
+	// then saved in the background
+	SpoolDir string `json:"spool_dir,omitempty" desc:"Spool email to this directory before replying, then save in the background"`
+	// SpoolWorkersSize controls how many spooled envelopes are saved concurrently. Defaults to 1
+	SpoolWorkersSize int `json:"spool_workers_size,omitempty" default:"1" desc:"Number of workers that save spooled email"`
+	// SpoolMaxRetries is the number of attempts to save a spooled envelope before giving up. Defaults to 10
+	SpoolMaxRetries int `json:"spool_max_retries,omitempty" default:"10" desc:"Attempts to save a spooled email before giving up"`
+	// SpoolRetryBackoff is the duration to wait before the first retry, eg "1s". It doubles with each attempt
+	SpoolRetryBackoff string `json:"spool_retry_backoff,omitempty" default:"1s" desc:"Time to wait before the first retry, doubles with each attempt"`
+	// SpoolRetryMaxBackoff is the longest duration to wait between retries, eg "5m"
+	SpoolRetryMaxBackoff string `json:"spool_retry_max_backoff,omitempty" default:"5m" desc:"Longest time to wait between retries"`
+	// DeadLetterDir keeps a copy of the email that the save_process stack returned an error for in this directory.
+	// See the deadletters command of guerrillad
+	DeadLetterDir string `json:"dead_letter_dir,omitempty" desc:"Keep email that could not be saved in this directory"`
+	// QueueSize is how many emails can wait for a save worker. When full, new emails are rejected
+	// with a temporary failure. Defaults to the number of save workers
+	QueueSize int `json:"gw_queue_size,omitempty" desc:"Emails that can wait for a save worker, the default is the number of save workers"`
+	// QueueMaxWait rejects new emails when the estimated wait for a save worker is longer, eg "2s".
+	// The estimate is based on the average time the workers take. Off by default
+	QueueMaxWait string `json:"gw_queue_max_wait,omitempty" desc:"Reject email when the estimated wait for a save worker is longer"`
+	// ValidateWorkersSize controls how many concurrent workers to start for validating recipients.
+	// Defaults to the number of save workers
+	ValidateWorkersSize int `json:"validate_workers_size,omitempty" desc:"Number of workers that validate recipients, the default is the number of save workers"`
+	// ValidateQueueSize is like QueueSize, but for recipient validation
+	ValidateQueueSize int `json:"gw_val_queue_size,omitempty" desc:"Like gw_queue_size, for recipient validation"`
+	// ValidateQueueMaxWait is like QueueMaxWait, but for recipient validation
+	ValidateQueueMaxWait string `json:"gw_val_queue_max_wait,omitempty" desc:"Like gw_queue_max_wait, for recipient validation"`
 }
 
 // workerMsg is what get placed on the BackendGateway.saveMailChan channel
@@ -59,6 +169,8 @@ type workerMsg struct {
 	notifyMe chan *notifyMsg
 	// select the task type
 	task SelectTask
+	// ctx has the deadline of the task, and is passed to ContextProcessors
+	ctx context.Context
 }
 
 type backendState int
@@ -76,6 +188,8 @@ const (
 	// default timeout for validating rcpt to, if 'gw_val_rcpt_timeout' not present in config
 	validateRcptTimeout = time.Second * 5
 	defaultProcessor    = "Debugger"
+	// default number of bytes of message data to buffer in memory when streaming
+	streamSpillThreshold = 1 << 20
 )
 
 func (s backendState) String() string {
@@ -97,8 +211,14 @@ func (s backendState) String() string {
 // New makes a new default BackendGateway backend, and initializes it using
 // backendConfig and stores the logger
 func New(backendConfig BackendConfig, l log.Logger) (Backend, error) {
+	return NewNamed("", backendConfig, l)
+}
+
+// NewNamed is like New, but for a named backend. The name tells its stats and circuit breakers
+// apart from the ones of the other backends
+func NewNamed(name string, backendConfig BackendConfig, l log.Logger) (Backend, error) {
 	Svc.SetMainlog(l)
-	gateway := &BackendGateway{}
+	gateway := &BackendGateway{name: name}
 	err := gateway.Initialize(backendConfig)
 	if err != nil {
 		return nil, fmt.Errorf("error while initializing the backend: %s", err)
@@ -118,55 +238,70 @@ var workerMsgPool = sync.Pool{
 }
 
 // reset resets a workerMsg that has been borrowed from the pool
-func (w *workerMsg) reset(e *mail.Envelope, task SelectTask) {
+func (w *workerMsg) reset(ctx context.Context, e *mail.Envelope, task SelectTask) {
 	if w.notifyMe == nil {
 		w.notifyMe = make(chan *notifyMsg)
 	}
 	w.e = e
 	w.task = task
+	w.ctx = ctx
 }
 
-// Process distributes an envelope to one of the backend workers with a TaskSaveMail task
+// Process distributes an envelope to one of the backend workers with a TaskSaveMail task.
+// If spooling is on, the envelope is written to the spool instead, and saved in the background
 func (gw *BackendGateway) Process(e *mail.Envelope) Result {
 	if gw.State != BackendStateRunning {
 		return NewResult(response.Canned.FailBackendNotRunning, response.SP, gw.State)
 	}
+	if gw.spool != nil {
+		id, err := gw.spool.add(e)
+		if err != nil {
+			Log().WithError(err).Error("could not spool email")
+			return NewResult(response.Canned.FailBackendTransaction, response.SP, err)
+		}
+		Log().Debugf("spooled %s as %s", e.QueuedId, id)
+		return NewResult(response.Canned.SuccessMessageQueued, response.SP, id)
+	}
+	return gw.process(e, false)
+}
+
+// process is like Process, but it always waits for the envelope to be saved by one of the workers.
+// If block is false, the envelope is rejected when the backend is too busy
+func (gw *BackendGateway) process(e *mail.Envelope, block bool) Result {
+	result, _ := gw.save(e, block)
+	return result
+}
+
+// save is process, but it also returns the error that the processors returned, if any
+func (gw *BackendGateway) save(e *mail.Envelope, block bool) (Result, error) {
+	// the context expires when the client is told that saving has timed out
+	ctx, cancel := newTaskContext(e, gw.saveTimeout())
+	defer cancel()
 	// borrow a workerMsg from the pool
 	workerMsg := workerMsgPool.Get().(*workerMsg)
-	workerMsg.reset(e, TaskSaveMail)
+	workerMsg.reset(ctx, e, TaskSaveMail)
 	// place on the channel so that one of the save mail workers can pick it up
-	gw.conveyor <- workerMsg
+	if block {
+		gw.savePool.conveyor <- workerMsg
+	} else if !gw.savePool.enqueue(workerMsg) {
+		workerMsgPool.Put(workerMsg)
+		Log().Warn("backend is too busy, email was not accepted")
+		return NewResult(response.Canned.FailBackendBusy), nil
+	}
 	// wait for the save to complete
 	// or timeout
 	select {
 	case status := <-workerMsg.notifyMe:
 		// email saving transaction completed
-		if status.result == BackendResultOK && status.queuedID != "" {
-			return NewResult(response.Canned.SuccessMessageQueued, response.SP, status.queuedID)
-		}
-
-		// A custom result, there was probably an error, if so, log it
-		if status.result != nil {
-			if status.err != nil {
-				Log().Error(status.err)
-			}
-			return status.result
+		// if the processors marked any recipients, include the result of each recipient
+		result := newRcptResults(e, saveResult(status))
+		if status.err != nil && !block {
+			// the spool blocks, it keeps trying until it gives up, then makes a dead letter itself
+			gw.deadLetter(e, result, status.err)
 		}
+		return result, status.err
 
-		// if there was no result, but there's an error, then make a new result from the error
-		if status.err != nil {
-			if _, err := strconv.Atoi(status.err.Error()[:3]); err != nil {
-				return NewResult(response.Canned.FailBackendTransaction, response.SP, status.err)
-			}
-			return NewResult(status.err)
-		}
-
-		// both result & error are nil (should not happen)
-		err := errors.New("no response from backend - processor did not return a result or an error")
-		Log().Error(err)
-		return NewResult(response.Canned.FailBackendTransaction, response.SP, err)
-
-	case <-time.After(gw.saveTimeout()):
+	case <-ctx.Done():
 		Log().Error("Backend has timed out while saving email")
 		e.Lock() // lock the envelope - it's still processing here, we don't want the server to recycle it
 		go func() {
@@ -175,8 +310,102 @@ func (gw *BackendGateway) Process(e *mail.Envelope) Result {
 			e.Unlock()
 			workerMsgPool.Put(workerMsg)
 		}()
-		return NewResult(response.Canned.FailBackendTimeout)
+		return NewResult(response.Canned.FailBackendTimeout), ctx.Err()
+	}
+}
+
+// saveResult makes the result of a TaskSaveMail task from the status returned by the worker
+func saveResult(status *notifyMsg) Result {
+	if status.result == BackendResultOK && status.queuedID != "" {
+		return NewResult(response.Canned.SuccessMessageQueued, response.SP, status.queuedID)
+	}
+
+	// A custom result, there was probably an error, if so, log it
+	if status.result != nil {
+		if status.err != nil {
+			Log().Error(status.err)
+		}
+		return status.result
+	}
+
+	// if there was no result, but there's an error, then make a new result from the error
+	if status.err != nil {
+		if _, err := strconv.Atoi(status.err.Error()[:3]); err != nil {
+			return NewResult(response.Canned.FailBackendTransaction, response.SP, status.err)
+		}
+		return NewResult(status.err)
+	}
+
+	// both result & error are nil (should not happen)
+	err := errors.New("no response from backend - processor did not return a result or an error")
+	Log().Error(err)
+	return NewResult(response.Canned.FailBackendTransaction, response.SP, err)
+}
+
+// ProcessStream runs the stream_save_process stack, reading the message data from r as it arrives,
+// then passes the envelope to one of the backend workers with a TaskSaveMail task.
+// The stream stack runs on the caller's goroutine, r is usually the client's connection.
+// Callers should consume anything left in r after it returns.
+func (gw *BackendGateway) ProcessStream(r io.Reader, e *mail.Envelope) Result {
+	if gw.State != BackendStateRunning {
+		return NewResult(response.Canned.FailBackendNotRunning, response.SP, gw.State)
+	}
+	if gw.Busy() {
+		// don't bother reading the data if it will be rejected
+		gw.savePool.reject()
+		return NewResult(response.Canned.FailBackendBusy)
+	}
+	if gw.streamers == nil {
+		// streaming is not configured, buffer the data
+		if _, err := e.Data.ReadFrom(r); err != nil {
+			return NewResult(response.Canned.FailReadErrorDataCmd, response.SP, err)
+		}
+		return gw.Process(e)
+	}
+	result, err := gw.runStream(r, e)
+	if err != nil {
+		Log().WithError(err).Error("stream processing failed")
+		if result == nil {
+			result = NewResult(response.Canned.FailBackendTransaction, response.SP, err)
+		}
+		return result
 	}
+	if result != BackendResultOK {
+		// a stream processor returned a custom result, don't continue
+		return result
+	}
+	// the data has arrived, continue with the save_process stack
+	return gw.Process(e)
+}
+
+// runStream borrows a stream stack and uses it to process r.
+// The number of streams is limited to the number of workers. It waits for a stack up to gw_save_timeout,
+// then the email is rejected as if the backend was busy
+func (gw *BackendGateway) runStream(r io.Reader, e *mail.Envelope) (result Result, err error) {
+	ctx, cancel := newTaskContext(e, gw.saveTimeout())
+	defer cancel()
+	var stream StreamProcessor
+	select {
+	case stream = <-gw.streamers:
+	case <-ctx.Done():
+		gw.savePool.reject()
+		Log().Warn("backend is too busy, no stream processor is free, email was not accepted")
+		return NewResult(response.Canned.FailBackendBusy), nil
+	}
+	defer func() {
+		// processors may call arbitrary code, don't let a panic bring down the client's goroutine
+		if rec := recover(); rec != nil {
+			Log().Error("stream processor recovered from panic:", rec, string(debug.Stack()))
+			result, err = nil, errors.New("storage failed")
+		}
+		gw.streamers <- stream
+	}()
+	return stream.ProcessStream(r, e)
+}
+
+// StreamEnabled returns true if the stream_save_process config option was set
+func (gw *BackendGateway) StreamEnabled() bool {
+	return gw.streamers != nil
 }
 
 // ValidateRcpt asks one of the workers to validate the recipient
@@ -185,14 +414,54 @@ func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
 	if gw.State != BackendStateRunning {
 		return StorageNotAvailable
 	}
-	if _, ok := gw.validators[0].(NoopProcessor); ok {
+	if _, ok := gw.validatePool.stacks[0].(NoopProcessor); ok {
 		// no validator processors configured
 		return nil
 	}
-	// place on the channel so that one of the save mail workers can pick it up
+	return gw.validate(gw.validatePool, e, TaskValidateRcpt, gw.validateRcptTimeout())
+}
+
+// ValidateConnect asks one of the workers to validate the client that has just connected
+func (gw *BackendGateway) ValidateConnect(e *mail.Envelope) error {
+	if gw.connectPool == nil {
+		// validate_connect_process not set
+		return nil
+	}
+	return gw.validate(gw.connectPool, e, TaskValidateConnect, gw.validateConnectTimeout())
+}
+
+// ValidateHelo asks one of the workers to validate the HELO or EHLO command
+func (gw *BackendGateway) ValidateHelo(e *mail.Envelope) error {
+	if gw.connectPool == nil {
+		// validate_connect_process not set
+		return nil
+	}
+	return gw.validate(gw.connectPool, e, TaskValidateHelo, gw.validateConnectTimeout())
+}
+
+// ValidateMailFrom asks one of the workers to validate the MAIL FROM command
+func (gw *BackendGateway) ValidateMailFrom(e *mail.Envelope) error {
+	if gw.senderPool == nil {
+		// validate_sender_process not set
+		return nil
+	}
+	return gw.validate(gw.senderPool, e, TaskValidateMailFrom, gw.validateSenderTimeout())
+}
+
+// validate places a validation task on the pool's queue, then waits for it to complete or time out
+func (gw *BackendGateway) validate(pool *workerPool, e *mail.Envelope, task SelectTask, timeout time.Duration) RcptError {
+	if gw.State != BackendStateRunning {
+		return StorageNotAvailable
+	}
+	ctx, cancel := newTaskContext(e, timeout)
+	defer cancel()
+	// place on the channel so that one of the workers can pick it up
 	workerMsg := workerMsgPool.Get().(*workerMsg)
-	workerMsg.reset(e, TaskValidateRcpt)
-	gw.conveyor <- workerMsg
+	workerMsg.reset(ctx, e, task)
+	if !pool.enqueue(workerMsg) {
+		workerMsgPool.Put(workerMsg)
+		return StorageTooBusy
+	}
 	// wait for the validation to complete
 	// or timeout
 	select {
@@ -203,13 +472,13 @@ func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
 		}
 		return nil
 
-	case <-time.After(gw.validateRcptTimeout()):
+	case <-ctx.Done():
 		e.Lock()
 		go func() {
 			<-workerMsg.notifyMe
 			e.Unlock()
 			workerMsgPool.Put(workerMsg)
-			Log().Error("Backend has timed out while validating rcpt")
+			Log().Errorf("Backend has timed out while doing a %s task", task)
 		}()
 		return StorageTimeout
 	}
@@ -220,11 +489,25 @@ func (gw *BackendGateway) Shutdown() error {
 	gw.Lock()
 	defer gw.Unlock()
 	if gw.State != BackendStateShuttered {
+		if gw.spool != nil {
+			// the spool workers need the backend workers to finish, so stop them first
+			gw.spool.shutdown()
+		}
+		runningGuard.Lock()
+		if running[gw.name] == gw {
+			delete(running, gw.name)
+		}
+		runningGuard.Unlock()
 		// send a signal to all workers
 		gw.stopWorkers()
 		// wait for workers to stop
 		gw.wg.Wait()
 		// call shutdown on all processor shutdowners
+		if gw.processors != nil {
+			if err := gw.processors.shutdown(); err != nil {
+				return err
+			}
+		}
 		if err := Svc.shutdown(); err != nil {
 			return err
 		}
@@ -238,9 +521,6 @@ func (gw *BackendGateway) Reinitialize() error {
 	if gw.State != BackendStateShuttered {
 		return errors.New("backend must be in BackendStateshuttered state to Reinitialize")
 	}
-	// clear the Initializers and Shutdowners
-	Svc.reset()
-
 	err := gw.Initialize(gw.config)
 	if err != nil {
 		fmt.Println("reinitialize to ", gw.config, err)
@@ -253,27 +533,114 @@ func (gw *BackendGateway) Reinitialize() error {
 // newStack creates a new Processor by chaining multiple Processors in a call stack
 // Decorators are functions of Decorator type, source files prefixed with p_*
 // Each decorator does a specific task during the processing stage.
-// This function uses the config value save_process or validate_process to figure out which Decorator to use
-func (gw *BackendGateway) newStack(stackConfig string) (Processor, error) {
-	var decorators []Decorator
-	cfg := strings.ToLower(strings.TrimSpace(stackConfig))
-	if len(cfg) == 0 {
-		//cfg = strings.ToLower(defaultProcessor)
+// This function uses the config value save_process or validate_process to figure out which Decorator to use.
+// ContextDecorators are adapted so that they can be mixed with Decorators, and the returned stack
+// is also a ContextProcessor. The stack can also have branches and fan-outs, see stack.go for the syntax
+func newStack(stackConfig string) (Processor, error) {
+	if len(strings.TrimSpace(stackConfig)) == 0 {
 		return NoopProcessor{}, nil
 	}
-	items := strings.Split(cfg, "|")
-	for i := range items {
-		name := items[len(items)-1-i] // reverse order, since decorators are stacked
-		if makeFunc, ok := processors[name]; ok {
-			decorators = append(decorators, makeFunc())
-		} else {
-			ErrProcessorNotFound = fmt.Errorf("processor [%s] not found", name)
-			return nil, ErrProcessorNotFound
-		}
+	node, err := parseStackConfig(stackConfig)
+	if err != nil {
+		return nil, err
+	}
+	stack := &contextStack{}
+	decorators, err := node.decorators(stack)
+	if err != nil {
+		return nil, err
 	}
 	// build the call-stack of decorators
-	p := Decorate(DefaultProcessor{}, decorators...)
-	return p, nil
+	stack.top = Decorate(DefaultProcessor{}, decorators...)
+	return stack, nil
+}
+
+// newStacks makes n stacks using newStack, one for each worker
+func (gw *BackendGateway) newStacks(stackConfig string, n int) ([]Processor, error) {
+	stacks := make([]Processor, 0, n)
+	for i := 0; i < n; i++ {
+		p, err := newStack(stackConfig)
+		if err != nil {
+			return nil, err
+		}
+		stacks = append(stacks, p)
+	}
+	return stacks, nil
+}
+
+// stackConfigs returns the config of each processor stack that the gateway runs
+func (gw *BackendGateway) stackConfigs() []string {
+	return []string{
+		gw.gwConfig.SaveProcess,
+		gw.gwConfig.ValidateProcess,
+		gw.gwConfig.ValidateConnectProcess,
+		gw.gwConfig.ValidateSenderProcess,
+	}
+}
+
+// newStreamStack is like newStack, but for the stream_save_process config value.
+// The stack always ends with a DefaultStreamProcessor, which reads the data in to the envelope
+func (gw *BackendGateway) newStreamStack(stackConfig string) (StreamProcessor, error) {
+	var decorators []StreamDecorator
+	cfg := strings.ToLower(strings.TrimSpace(stackConfig))
+	if len(cfg) > 0 {
+		items := strings.Split(cfg, "|")
+		for i := range items {
+			name := items[len(items)-1-i] // reverse order, since decorators are stacked
+			if makeFunc, ok := streamProcessors[name]; ok {
+				decorators = append(decorators, makeFunc())
+			} else {
+				ErrProcessorNotFound = fmt.Errorf("stream processor [%s] not found", name)
+				return nil, ErrProcessorNotFound
+			}
+		}
+	}
+	last := DefaultStreamProcessor{
+		SpillThreshold: gw.streamSpillThreshold(),
+		SpillDir:       gw.gwConfig.StreamSpillDir,
+	}
+	return DecorateStream(last, decorators...), nil
+}
+
+// newSpool creates the spool using the spool_* config values
+func (gw *BackendGateway) newSpool() (*spool, error) {
+	s, err := newSpool(gw.gwConfig.SpoolDir)
+	if err != nil {
+		return nil, err
+	}
+	if gw.gwConfig.SpoolWorkersSize > 0 {
+		s.workers = gw.gwConfig.SpoolWorkersSize
+	}
+	if gw.gwConfig.SpoolMaxRetries > 0 {
+		s.maxRetries = gw.gwConfig.SpoolMaxRetries
+	}
+	if t, err := time.ParseDuration(gw.gwConfig.SpoolRetryBackoff); err == nil && t > 0 {
+		s.backoff = t
+	}
+	if t, err := time.ParseDuration(gw.gwConfig.SpoolRetryMaxBackoff); err == nil && t > 0 {
+		s.maxBackoff = t
+	}
+	s.deliver = func(e *mail.Envelope) (Result, error) {
+		// wait for a worker, rather than count it as a failed attempt
+		return gw.save(e, true)
+	}
+	s.load = gw.loadData
+	if gw.deadLetters != nil {
+		s.deadLetter = func(meta *mail.EnvelopeMeta, data io.Reader, err error) error {
+			id, dlErr := gw.deadLetters.add(meta, data, gw.gwConfig.SaveProcess, nil, err)
+			if dlErr == nil {
+				Log().Infof("kept spooled %s as dead letter %s", meta.QueuedId, id)
+			}
+			return dlErr
+		}
+	}
+	return s, nil
+}
+
+// loadData reads the message data of an envelope that was saved to disk
+func (gw *BackendGateway) loadData(e *mail.Envelope, r io.Reader) error {
+	// large messages are not loaded in to memory
+	_, err := e.ReadDataFrom(r, gw.streamSpillThreshold(), gw.gwConfig.StreamSpillDir)
+	return err
 }
 
 // loadConfig loads the config for the GatewayConfig
@@ -302,35 +669,86 @@ func (gw *BackendGateway) Initialize(cfg BackendConfig) error {
 		gw.State = BackendStateError
 		return err
 	}
+	if err := checkConfig(cfg, gw.stackConfigs(), []string{gw.gwConfig.StreamSaveProcess}); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
 	workersSize := gw.workersSize()
 	if workersSize < 1 {
 		gw.State = BackendStateError
 		return errors.New("must have at least 1 worker")
 	}
-	gw.processors = make([]Processor, 0)
-	gw.validators = make([]Processor, 0)
-	for i := 0; i < workersSize; i++ {
-		p, err := gw.newStack(gw.gwConfig.SaveProcess)
-		if err != nil {
+	if gw.breakers == nil {
+		// keep them when reinitialized, so an open breaker stays open
+		gw.breakers = newBreakerSet(gw.name)
+	}
+	var processors, validators, connectValidators, senderValidators []Processor
+	gw.processors, err = Svc.collect(gw.breakers, func() (err error) {
+		gw.streamers = nil
+		if strings.TrimSpace(gw.gwConfig.StreamSaveProcess) != "" {
+			gw.streamers = make(chan StreamProcessor, workersSize)
+			for i := 0; i < workersSize; i++ {
+				sp, err := gw.newStreamStack(gw.gwConfig.StreamSaveProcess)
+				if err != nil {
+					return err
+				}
+				gw.streamers <- sp
+			}
+		}
+		if processors, err = gw.newStacks(gw.gwConfig.SaveProcess, workersSize); err != nil {
+			return err
+		}
+		if validators, err = gw.newStacks(gw.gwConfig.ValidateProcess, gw.validateWorkersSize()); err != nil {
+			return err
+		}
+		if strings.TrimSpace(gw.gwConfig.ValidateConnectProcess) != "" {
+			if connectValidators, err = gw.newStacks(gw.gwConfig.ValidateConnectProcess, gw.validateWorkersSize()); err != nil {
+				return err
+			}
+		}
+		if strings.TrimSpace(gw.gwConfig.ValidateSenderProcess) != "" {
+			if senderValidators, err = gw.newStacks(gw.gwConfig.ValidateSenderProcess, gw.validateWorkersSize()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	gw.deadLetters = nil
+	if gw.gwConfig.DeadLetterDir != "" {
+		if gw.deadLetters, err = OpenDeadLetters(gw.gwConfig.DeadLetterDir); err != nil {
 			gw.State = BackendStateError
 			return err
 		}
-		gw.processors = append(gw.processors, p)
-
-		v, err := gw.newStack(gw.gwConfig.ValidateProcess)
-		if err != nil {
+	}
+	gw.spool = nil
+	if gw.gwConfig.SpoolDir != "" {
+		if gw.spool, err = gw.newSpool(); err != nil {
 			gw.State = BackendStateError
 			return err
 		}
-		gw.validators = append(gw.validators, v)
 	}
 	// initialize processors
+	if err := gw.processors.initialize(cfg); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	// and any that were added outside of a gateway
 	if err := Svc.initialize(cfg); err != nil {
 		gw.State = BackendStateError
 		return err
 	}
-	if gw.conveyor == nil {
-		gw.conveyor = make(chan *workerMsg, workersSize)
+	gw.savePool = newWorkerPool("save", processors, gw.queueSize(), gw.queueMaxWait())
+	gw.validatePool = newWorkerPool("validate", validators, gw.validateQueueSize(), gw.validateQueueMaxWait())
+	gw.connectPool, gw.senderPool = nil, nil
+	if connectValidators != nil {
+		gw.connectPool = newWorkerPool("connect", connectValidators, gw.validateQueueSize(), gw.validateQueueMaxWait())
+	}
+	if senderValidators != nil {
+		gw.senderPool = newWorkerPool("sender", senderValidators, gw.validateQueueSize(), gw.validateQueueMaxWait())
 	}
 	// ready to start
 	gw.State = BackendStateInitialized
@@ -343,32 +761,21 @@ func (gw *BackendGateway) Start() error {
 	defer gw.Unlock()
 	if gw.State == BackendStateInitialized || gw.State == BackendStateShuttered {
 		// we start our workers
-		workersSize := gw.workersSize()
-		// make our slice of channels for stopping
-		gw.workStoppers = make([]chan bool, 0)
-		// set the wait group
-		gw.wg.Add(workersSize)
-
-		for i := 0; i < workersSize; i++ {
-			stop := make(chan bool)
-			go func(workerId int, stop chan bool) {
-				// blocks here until the worker exits
-				for {
-					state := gw.workDispatcher(
-						gw.conveyor,
-						gw.processors[workerId],
-						gw.validators[workerId],
-						workerId+1,
-						stop)
-					// keep running after panic
-					if state != dispatcherStatePanic {
-						break
-					}
-				}
-				gw.wg.Done()
-			}(i, stop)
-			gw.workStoppers = append(gw.workStoppers, stop)
+		gw.startWorkers(gw.savePool)
+		gw.startWorkers(gw.validatePool)
+		gw.startWorkers(gw.connectPool)
+		gw.startWorkers(gw.senderPool)
+		if gw.spool != nil {
+			// replay anything left in the spool
+			if err := gw.spool.start(); err != nil {
+				gw.stopWorkers()
+				gw.wg.Wait()
+				return err
+			}
 		}
+		runningGuard.Lock()
+		running[gw.name] = gw
+		runningGuard.Unlock()
 		gw.State = BackendStateRunning
 		return nil
 	} else {
@@ -376,6 +783,38 @@ func (gw *BackendGateway) Start() error {
 	}
 }
 
+// startWorkers starts the worker goroutines for a pool
+func (gw *BackendGateway) startWorkers(pool *workerPool) {
+	if pool == nil {
+		// not configured
+		return
+	}
+	// make our slice of channels for stopping
+	pool.workStoppers = make([]chan bool, 0)
+	// set the wait group
+	gw.wg.Add(pool.size())
+
+	for i := 0; i < pool.size(); i++ {
+		stop := make(chan bool)
+		go func(workerId int, stop chan bool) {
+			// blocks here until the worker exits
+			for {
+				state := gw.workDispatcher(
+					pool,
+					pool.stacks[workerId],
+					workerId+1,
+					stop)
+				// keep running after panic
+				if state != dispatcherStatePanic {
+					break
+				}
+			}
+			gw.wg.Done()
+		}(i, stop)
+		pool.workStoppers = append(pool.workStoppers, stop)
+	}
+}
+
 // workersSize gets the number of workers to use for saving email by reading the save_workers_size config value
 // Returns 1 if no config value was set
 func (gw *BackendGateway) workersSize() int {
@@ -385,6 +824,59 @@ func (gw *BackendGateway) workersSize() int {
 	return gw.gwConfig.WorkersSize
 }
 
+// validateWorkersSize gets the number of workers to use for validating recipients by reading the
+// validate_workers_size config value. Returns the number of save workers if no config value was set
+func (gw *BackendGateway) validateWorkersSize() int {
+	if gw.gwConfig.ValidateWorkersSize <= 0 {
+		return gw.workersSize()
+	}
+	return gw.gwConfig.ValidateWorkersSize
+}
+
+// queueSize gets the number of emails that can wait for a save worker by reading the gw_queue_size config value
+// Returns the number of save workers if no config value was set
+func (gw *BackendGateway) queueSize() int {
+	if gw.gwConfig.QueueSize <= 0 {
+		return gw.workersSize()
+	}
+	return gw.gwConfig.QueueSize
+}
+
+// queueMaxWait returns the longest estimated wait for a save worker before new emails are rejected,
+// by reading the gw_queue_max_wait config value. Returns 0 if not set
+func (gw *BackendGateway) queueMaxWait() time.Duration {
+	if gw.gwConfig.QueueMaxWait == "" {
+		return 0
+	}
+	t, err := time.ParseDuration(gw.gwConfig.QueueMaxWait)
+	if err != nil {
+		return 0
+	}
+	return t
+}
+
+// validateQueueSize gets the number of recipients that can wait for a validate worker by reading the
+// gw_val_queue_size config value. Returns the number of validate workers if no config value was set
+func (gw *BackendGateway) validateQueueSize() int {
+	if gw.gwConfig.ValidateQueueSize <= 0 {
+		return gw.validateWorkersSize()
+	}
+	return gw.gwConfig.ValidateQueueSize
+}
+
+// validateQueueMaxWait returns the longest estimated wait for a validate worker before new recipients
+// are rejected, by reading the gw_val_queue_max_wait config value. Returns 0 if not set
+func (gw *BackendGateway) validateQueueMaxWait() time.Duration {
+	if gw.gwConfig.ValidateQueueMaxWait == "" {
+		return 0
+	}
+	t, err := time.ParseDuration(gw.gwConfig.ValidateQueueMaxWait)
+	if err != nil {
+		return 0
+	}
+	return t
+}
+
 // saveTimeout returns the maximum amount of seconds to wait before timing out a save processing task
 func (gw *BackendGateway) saveTimeout() time.Duration {
 	if gw.gwConfig.TimeoutSave == "" {
@@ -397,6 +889,19 @@ func (gw *BackendGateway) saveTimeout() time.Duration {
 	return t
 }
 
+// streamSpillThreshold returns how many bytes to buffer in memory when streaming, by reading the
+// stream_spill_threshold config value. Returns streamSpillThreshold if no config value was set
+func (gw *BackendGateway) streamSpillThreshold() int64 {
+	if gw.gwConfig.StreamSpillThreshold == 0 {
+		return streamSpillThreshold
+	}
+	if gw.gwConfig.StreamSpillThreshold < 0 {
+		// never spill
+		return 0
+	}
+	return int64(gw.gwConfig.StreamSpillThreshold)
+}
+
 // validateRcptTimeout returns the maximum amount of seconds to wait before timing out a recipient validation  task
 func (gw *BackendGateway) validateRcptTimeout() time.Duration {
 	if gw.gwConfig.TimeoutValidateRcpt == "" {
@@ -409,6 +914,32 @@ func (gw *BackendGateway) validateRcptTimeout() time.Duration {
 	return t
 }
 
+// validateConnectTimeout returns the maximum amount of time to wait before timing out a connection or
+// HELO validation task, by reading the gw_val_connect_timeout config value
+func (gw *BackendGateway) validateConnectTimeout() time.Duration {
+	if gw.gwConfig.TimeoutValidateConnect == "" {
+		return validateRcptTimeout
+	}
+	t, err := time.ParseDuration(gw.gwConfig.TimeoutValidateConnect)
+	if err != nil {
+		return validateRcptTimeout
+	}
+	return t
+}
+
+// validateSenderTimeout returns the maximum amount of time to wait before timing out a MAIL FROM
+// validation task, by reading the gw_val_sender_timeout config value
+func (gw *BackendGateway) validateSenderTimeout() time.Duration {
+	if gw.gwConfig.TimeoutValidateSender == "" {
+		return validateRcptTimeout
+	}
+	t, err := time.ParseDuration(gw.gwConfig.TimeoutValidateSender)
+	if err != nil {
+		return validateRcptTimeout
+	}
+	return t
+}
+
 type dispatcherState int
 
 const (
@@ -420,9 +951,8 @@ const (
 )
 
 func (gw *BackendGateway) workDispatcher(
-	workIn chan *workerMsg,
-	save Processor,
-	validate Processor,
+	pool *workerPool,
+	p Processor,
 	workerId int,
 	stop chan bool) (state dispatcherState) {
 
@@ -437,6 +967,7 @@ func (gw *BackendGateway) workDispatcher(
 			Log().Error("worker recovered from panic:", r, string(debug.Stack()))
 
 			if state == dispatcherStateWorking {
+				atomic.AddInt32(&pool.busyWorkers, -1)
 				msg.notifyMe <- &notifyMsg{err: errors.New("storage failed")}
 			}
 			state = dispatcherStatePanic
@@ -446,22 +977,24 @@ func (gw *BackendGateway) workDispatcher(
 
 	}()
 	state = dispatcherStateIdle
-	Log().Infof("processing worker started (#%d)", workerId)
+	Log().Infof("processing worker started (%s #%d)", pool.name, workerId)
 	for {
 		select {
 		case <-stop:
 			state = dispatcherStateStopped
-			Log().Infof("stop signal for worker (#%d)", workerId)
+			Log().Infof("stop signal for worker (%s #%d)", pool.name, workerId)
 			return
-		case msg = <-workIn:
+		case msg = <-pool.conveyor:
 			state = dispatcherStateWorking // recovers from panic if in this state
+			atomic.AddInt32(&pool.busyWorkers, 1)
+			start := time.Now()
+			result, err := gw.processMsg(p, msg)
+			pool.recordProcessTime(time.Since(start))
+			atomic.AddInt32(&pool.busyWorkers, -1)
+			state = dispatcherStateNotify
 			if msg.task == TaskSaveMail {
-				result, err := save.Process(msg.e, msg.task)
-				state = dispatcherStateNotify
 				msg.notifyMe <- &notifyMsg{err: err, result: result, queuedID: msg.e.QueuedId}
 			} else {
-				result, err := validate.Process(msg.e, msg.task)
-				state = dispatcherStateNotify
 				msg.notifyMe <- &notifyMsg{err: err, result: result}
 			}
 		}
@@ -469,9 +1002,48 @@ func (gw *BackendGateway) workDispatcher(
 	}
 }
 
+// processMsg runs the task with p. If the task's deadline has already passed while
+// it was waiting in the queue, it's not processed at all
+func (gw *BackendGateway) processMsg(p Processor, msg *workerMsg) (Result, error) {
+	ctx := msg.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return NewResult(response.Canned.FailBackendTimeout), err
+	}
+	if cp, ok := p.(ContextProcessor); ok {
+		return cp.ProcessContext(ctx, msg.e, msg.task)
+	}
+	return p.Process(msg.e, msg.task)
+}
+
 // stopWorkers sends a signal to all workers to stop
 func (gw *BackendGateway) stopWorkers() {
-	for i := range gw.workStoppers {
-		gw.workStoppers[i] <- true
+	gw.savePool.stopWorkers()
+	gw.validatePool.stopWorkers()
+	gw.connectPool.stopWorkers()
+	gw.senderPool.stopWorkers()
+}
+
+// Busy returns true when new emails would be rejected, because the save queue is full, the estimated wait
+// is longer than gw_queue_max_wait, or all of the stream processor stacks are in use
+func (gw *BackendGateway) Busy() bool {
+	if gw.State != BackendStateRunning {
+		return false
+	}
+	if gw.streamers != nil && len(gw.streamers) == 0 {
+		return true
+	}
+	return gw.savePool.busy()
+}
+
+// QueueStats returns the current queue depth, capacity and other stats about the load of each worker pool
+func (gw *BackendGateway) QueueStats() QueueStats {
+	return QueueStats{
+		Save:     gw.savePool.stats(),
+		Validate: gw.validatePool.stats(),
+		Connect:  gw.connectPool.stats(),
+		Sender:   gw.senderPool.stats(),
 	}
 }
@@ -1,13 +1,17 @@
 package backends
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/karngyan/go-guerrilla/log"
 	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
 )
 
 func TestStates(t *testing.T) {
@@ -22,7 +26,7 @@ func TestInitialize(t *testing.T) {
 	c := BackendConfig{
 		"save_process":       "HeadersParser|Debugger",
 		"log_received_mails": true,
-		"save_workers_size":  "1",
+		"save_workers_size":  1,
 	}
 
 	gateway := &BackendGateway{}
@@ -31,16 +35,16 @@ func TestInitialize(t *testing.T) {
 		t.Error("Gateway did not init because:", err)
 		t.Fail()
 	}
-	if gateway.processors == nil {
+	if gateway.savePool.stacks == nil {
 		t.Error("gateway.chains should not be nil")
-	} else if len(gateway.processors) != 1 {
-		t.Error("len(gateway.chains) should be 1, but got", len(gateway.processors))
+	} else if len(gateway.savePool.stacks) != 1 {
+		t.Error("len(gateway.chains) should be 1, but got", len(gateway.savePool.stacks))
 	}
 
-	if gateway.conveyor == nil {
+	if gateway.savePool.conveyor == nil {
 		t.Error("gateway.conveyor should not be nil")
-	} else if cap(gateway.conveyor) != gateway.workersSize() {
-		t.Error("gateway.conveyor channel buffer cap does not match worker size, cap was", cap(gateway.conveyor))
+	} else if cap(gateway.savePool.conveyor) != gateway.workersSize() {
+		t.Error("gateway.conveyor channel buffer cap does not match worker size, cap was", cap(gateway.savePool.conveyor))
 	}
 
 	if gateway.State != BackendStateInitialized {
@@ -87,7 +91,7 @@ func TestStartProcessStop(t *testing.T) {
 	e.Data.WriteString("Subject:Test\n\nThis is a test.")
 	notify := make(chan *notifyMsg)
 
-	gateway.conveyor <- &workerMsg{e, notify, TaskSaveMail}
+	gateway.savePool.conveyor <- &workerMsg{e: e, notifyMe: notify, task: TaskSaveMail}
 
 	// it should not produce any errors
 	// headers (subject) should be parsed.
@@ -112,3 +116,639 @@ func TestStartProcessStop(t *testing.T) {
 		t.Error("Gateway did not shutdown")
 	}
 }
+
+func TestStartProcessStreamStop(t *testing.T) {
+	c := BackendConfig{
+		"save_process":           "Debugger",
+		"stream_save_process":    "HeadersParser",
+		"stream_spill_threshold": 16,
+		"log_received_mails":     true,
+		"save_workers_size":      2,
+	}
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Error("Gateway did not init because:", err)
+		t.FailNow()
+	}
+	if !gateway.StreamEnabled() {
+		t.Error("gateway.StreamEnabled() should be true")
+	} else if cap(gateway.streamers) != gateway.workersSize() {
+		t.Error("gateway.streamers channel buffer cap does not match worker size, cap was", cap(gateway.streamers))
+	}
+	if err := gateway.Start(); err != nil {
+		t.Error("Gateway did not start because:", err)
+		t.FailNow()
+	}
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc12345"
+	e.MailFrom = mail.Address{User: "test", Host: "example.com"}
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	data := "Subject: Test\n\nThis is a test, longer than the spill threshold."
+
+	result := gateway.ProcessStream(strings.NewReader(data), e)
+	if result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+	// headers (subject) should be parsed by the stream processor
+	if e.Subject != "Test" {
+		t.Error("stream processing did not parse header, subject was", e.Subject)
+	}
+	if !e.DataSpilled() {
+		t.Error("data should have been spilled to a file")
+	}
+	if e.String() != data {
+		t.Error("data was not streamed in to the envelope, got", e.String())
+	}
+	e.ResetTransaction()
+
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+}
+
+func TestProcessStreamBusy(t *testing.T) {
+	c := BackendConfig{
+		"save_process":        "HeadersParser",
+		"stream_save_process": "HeadersParser",
+		"save_workers_size":   1,
+		"gw_save_timeout":     "50ms",
+	}
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	newEnvelope := func() *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = "abc12345"
+		e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+		return e
+	}
+	// a slow client holds the only stream stack
+	r, w := io.Pipe()
+	done := make(chan Result)
+	go func() {
+		done <- gateway.ProcessStream(r, newEnvelope())
+	}()
+	for i := 0; len(gateway.streamers) != 0; i++ {
+		if i == 100 {
+			t.Fatal("expecting the stream stack to be taken")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !gateway.Busy() {
+		t.Error("expecting the gateway to be busy while all the stream stacks are in use")
+	}
+	if result := gateway.ProcessStream(strings.NewReader("Subject: Test\n\nThis is a test."), newEnvelope()); result.Code() != 451 {
+		t.Error("expecting 451 while the gateway is busy, got", result)
+	}
+	// waiting for a stream stack is limited by gw_save_timeout
+	if result, err := gateway.runStream(strings.NewReader("Subject: Test\n\nThis is a test."), newEnvelope()); err != nil || result.Code() != 451 {
+		t.Error("expecting 451 when no stream stack is free, got", result, err)
+	}
+	if _, err := io.WriteString(w, "Subject: Test\n\nThis is a test."); err != nil {
+		t.Error(err)
+	}
+	_ = w.Close()
+	if result := <-done; result.Code() != 250 {
+		t.Error("expecting 250 for the slow client, got", result)
+	}
+	if gateway.Busy() {
+		t.Error("expecting the gateway not to be busy after the stream stack was returned")
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+}
+
+func TestStreamProcessorNotFound(t *testing.T) {
+	c := BackendConfig{
+		"save_process":        "Debugger",
+		"stream_save_process": "NoSuchStreamProcessor",
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err == nil {
+		t.Error("expecting an error for a missing stream processor")
+	}
+}
+
+func TestQueueAdmission(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	release := make(chan bool)
+	started := make(chan bool)
+	Svc.AddProcessor("Blocker", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				started <- true
+				<-release
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "blocker")
+	c := BackendConfig{
+		"save_process":       "Blocker",
+		"validate_process":   "Debugger",
+		"log_received_mails": false,
+		"save_workers_size":  1,
+		"gw_queue_size":      1,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	newEnvelope := func() *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+		e.Data.WriteString("Subject:Test\n\nThis is a test.")
+		return e
+	}
+	results := make(chan Result, 2)
+	// the first one keeps the worker busy
+	go func() { results <- gateway.Process(newEnvelope()) }()
+	<-started
+	// the second one waits in the queue
+	go func() { results <- gateway.Process(newEnvelope()) }()
+	for i := 0; i < 100 && len(gateway.savePool.conveyor) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !gateway.Busy() {
+		t.Error("gateway should be busy")
+	}
+	// the third one is rejected
+	if result := gateway.Process(newEnvelope()); result.Code() != 451 {
+		t.Error("expecting 451, got", result)
+	} else if !strings.Contains(result.String(), "4.3.2") {
+		t.Error("expecting 4.3.2, got", result)
+	}
+	// recipients are validated by a separate pool, so they are not held up by the saves
+	if err := gateway.ValidateRcpt(newEnvelope()); err != nil {
+		t.Error("expecting the recipient to be validated, got", err)
+	}
+	stats := gateway.QueueStats()
+	if stats.Save.Depth != 1 || stats.Save.Capacity != 1 || stats.Save.BusyWorkers != 1 || stats.Save.Rejected != 1 {
+		t.Error("unexpected save queue stats", stats.Save)
+	}
+	if stats.Validate.Depth != 0 || stats.Validate.BusyWorkers != 0 || stats.Validate.Rejected != 0 {
+		t.Error("unexpected validate queue stats", stats.Validate)
+	}
+	// let them finish
+	release <- true
+	<-started
+	release <- true
+	for i := 0; i < 2; i++ {
+		if result := <-results; result.Code() != 250 {
+			t.Error("expecting 250, got", result)
+		}
+	}
+	if gateway.Busy() {
+		t.Error("gateway should not be busy")
+	}
+	if stats = gateway.QueueStats(); stats.Save.AvgProcessTime == 0 {
+		t.Error("expecting the average process time to be recorded")
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+	Svc.reset()
+}
+
+func TestContextProcessor(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	type tagKey struct{}
+	cancelled := make(chan error, 1)
+	// Tagger derives a new context, which should reach Waiter through the legacy HeadersParser
+	Svc.AddContextProcessor("Tagger", func() ContextDecorator {
+		return func(p ContextProcessor) ContextProcessor {
+			return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+				return p.ProcessContext(context.WithValue(ctx, tagKey{}, "tagged"), e, task)
+			})
+		}
+	})
+	Svc.AddContextProcessor("Waiter", func() ContextDecorator {
+		return func(p ContextProcessor) ContextProcessor {
+			return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+				if id, ok := QueuedIDFromContext(ctx); !ok || id != e.QueuedId {
+					t.Error("expecting the queued id in the context, got", id)
+				}
+				if _, ok := ctx.Deadline(); !ok {
+					t.Error("expecting the context to have a deadline")
+				}
+				if tag, _ := ctx.Value(tagKey{}).(string); tag != "tagged" {
+					t.Error("expecting the context from Tagger, got", tag)
+				}
+				<-ctx.Done()
+				cancelled <- ctx.Err()
+				return NewResult(response.Canned.FailBackendTimeout), ctx.Err()
+			})
+		}
+	})
+	defer func() {
+		delete(contextProcessors, "tagger")
+		delete(contextProcessors, "waiter")
+	}()
+	c := BackendConfig{
+		"save_process":      "Tagger|HeadersParser|Waiter",
+		"save_workers_size": 1,
+		"gw_save_timeout":   "100ms",
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc123"
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	e.Data.WriteString("Subject:Test\n\nThis is a test.")
+	if result := gateway.Process(e); result.Code() != 554 {
+		t.Error("expecting 554 timeout, got", result)
+	}
+	select {
+	case err := <-cancelled:
+		if err != context.DeadlineExceeded {
+			t.Error("expecting context.DeadlineExceeded, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the processor's context was not cancelled")
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+	Svc.reset()
+}
+
+func TestAsDecorator(t *testing.T) {
+	// the constructors of the included processors still make Decorators
+	var _ []func() Decorator = []func() Decorator{SQL, Redis, GuerrillaDbRedis}
+
+	var calls []string
+	d := AsDecorator(func(p ContextProcessor) ContextProcessor {
+		return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+			if ctx == nil {
+				t.Error("expecting a context")
+			}
+			calls = append(calls, "context")
+			return p.ProcessContext(ctx, e, task)
+		})
+	})
+	last := Decorator(func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			calls = append(calls, "next")
+			return p.Process(e, task)
+		})
+	})
+	p := Decorate(DefaultProcessor{}, d, last)
+	if result, err := p.Process(mail.NewEnvelope("127.0.0.1", 1), TaskSaveMail); err != nil || result != BackendResultOK {
+		t.Error("expecting the result of the stack, got", result, err)
+	}
+	if len(calls) != 2 {
+		t.Error("expecting both processors to be called, got", calls)
+	}
+}
+
+func TestRcptResults(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	// Quota fails the recipients called "full", and defers "busy"
+	Svc.AddProcessor("Quota", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				for _, rcpt := range e.RcptTo {
+					if rcpt.User == "full" {
+						MarkRcptFailed(e, rcpt, NewResult("552 5.2.2 Mailbox full"))
+					} else if rcpt.User == "busy" {
+						MarkRcptDeferred(e, rcpt, nil)
+					}
+				}
+				DropFailedRcpts(e)
+				return p.Process(e, task)
+			})
+		}
+	})
+	var remaining []string
+	Svc.AddProcessor("Remaining", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				remaining = remaining[:0]
+				for _, rcpt := range e.RcptTo {
+					remaining = append(remaining, rcpt.User)
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer func() {
+		delete(processors, "quota")
+		delete(processors, "remaining")
+	}()
+	c := BackendConfig{
+		"save_process":      "Quota|Remaining",
+		"save_workers_size": 1,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	newEnvelope := func(users ...string) *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = "abc123"
+		for _, user := range users {
+			e.PushRcpt(mail.Address{User: user, Host: "example.com"})
+		}
+		e.Data.WriteString("Subject:Test\n\nThis is a test.")
+		return e
+	}
+
+	result := gateway.Process(newEnvelope("test", "full", "busy"))
+	if result.Code() != 451 {
+		t.Error("expecting 451 since busy was deferred, got", result)
+	}
+	if len(remaining) != 1 || remaining[0] != "test" {
+		t.Error("expecting the failed recipients to be dropped, got", remaining)
+	}
+	rr, ok := result.(*RcptResults)
+	if !ok {
+		t.Fatal("expecting *RcptResults, got", result)
+	}
+	expect := []struct {
+		user   string
+		status RcptStatus
+		code   int
+	}{{"test", RcptDelivered, 250}, {"full", RcptFailed, 552}, {"busy", RcptDeferred, 451}}
+	if len(rr.Rcpts) != len(expect) {
+		t.Fatal("expecting 3 recipient results, got", len(rr.Rcpts))
+	}
+	for i, want := range expect {
+		got := rr.Rcpts[i]
+		if got.Rcpt.User != want.user || got.Status != want.status || got.Result.Code() != want.code {
+			t.Errorf("expecting %s %s %d, got %s %s %s", want.user, want.status, want.code,
+				got.Rcpt.User, got.Status, got.Result)
+		}
+	}
+
+	// not delivered to anyone, so the temporary failure is the reply
+	if result = gateway.Process(newEnvelope("full", "busy")); result.Code() != 451 {
+		t.Error("expecting 451, got", result)
+	}
+	if result = gateway.Process(newEnvelope("full")); result.Code() != 552 {
+		t.Error("expecting 552, got", result)
+	}
+	// delivered to some, but the client has to bounce it for the failed recipient
+	if result = gateway.Process(newEnvelope("test", "full")); result.Code() != 552 {
+		t.Error("expecting 552, got", result)
+	}
+	// no recipients were marked
+	if result = gateway.Process(newEnvelope("test")); result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	} else if _, ok := result.(*RcptResults); ok {
+		t.Error("expecting a plain result when no recipients were marked")
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+	Svc.reset()
+}
+
+func TestSessionValidation(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	blocked := NewRcptError("sender blocked", &response.Response{
+		EnhancedCode: response.DeliveryNotAuthorized,
+		BasicCode:    550,
+		Class:        response.ClassPermanentFailure,
+		Comment:      "Sender blocked",
+	})
+	Svc.AddProcessor("Policy", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				switch {
+				case task == TaskValidateConnect && e.RemoteIP == "10.0.0.1":
+					return nil, errors.New("no rDNS")
+				case task == TaskValidateHelo && e.Helo == "bad.example.com":
+					return nil, errors.New("bad helo")
+				case task == TaskValidateMailFrom && e.MailFrom.User == "spammer":
+					return nil, blocked
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "policy")
+
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{"save_process": "HeadersParser"}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	// nothing to validate when the stacks are not configured
+	e := mail.NewEnvelope("10.0.0.1", 1)
+	if err := gateway.ValidateConnect(e); err != nil {
+		t.Error("expecting no error, got", err)
+	}
+	if stats := gateway.QueueStats(); stats.Connect.Workers != 0 || stats.Sender.Workers != 0 {
+		t.Error("expecting no connect or sender workers, got", stats)
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+	Svc.reset()
+
+	gateway = &BackendGateway{}
+	c := BackendConfig{
+		"save_process":             "HeadersParser",
+		"validate_connect_process": "Policy",
+		"validate_sender_process":  "Policy",
+		"validate_workers_size":    2,
+	}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	if err := gateway.ValidateConnect(e); err == nil || err.Error() != "no rDNS" {
+		t.Error("expecting the connection to be rejected, got", err)
+	}
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	if err := gateway.ValidateConnect(e); err != nil {
+		t.Error("expecting the connection to be accepted, got", err)
+	}
+	e.Helo = "bad.example.com"
+	if err := gateway.ValidateHelo(e); err == nil {
+		t.Error("expecting the helo to be rejected")
+	}
+	e.Helo = "mx.example.com"
+	if err := gateway.ValidateHelo(e); err != nil {
+		t.Error("expecting the helo to be accepted, got", err)
+	}
+	e.MailFrom = mail.Address{User: "spammer", Host: "example.com"}
+	if err := gateway.ValidateMailFrom(e); err != blocked {
+		t.Error("expecting the sender to be blocked, got", err)
+	}
+	e.MailFrom = mail.Address{User: "test", Host: "example.com"}
+	if err := gateway.ValidateMailFrom(e); err != nil {
+		t.Error("expecting the sender to be accepted, got", err)
+	}
+	if stats := gateway.QueueStats(); stats.Connect.Workers != 2 || stats.Sender.Workers != 2 {
+		t.Error("expecting 2 connect and sender workers, got", stats)
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+	Svc.reset()
+}
+
+func TestGatewayProcessorScope(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	// each stack made by ScopeCounter counts the shutdowns for the gateway it was made for
+	shutdowns := make(map[string]int)
+	Svc.AddProcessor("ScopeCounter", func() Decorator {
+		var name string
+		Svc.AddInitializer(InitializeWith(func(cfg BackendConfig) error {
+			name, _ = cfg["scope_name"].(string)
+			return nil
+		}))
+		Svc.AddShutdowner(ShutdownWith(func() error {
+			shutdowns[name]++
+			return nil
+		}))
+		return func(p Processor) Processor {
+			return p
+		}
+	})
+	defer delete(processors, "scopecounter")
+
+	newGateway := func(name string) Backend {
+		gw, err := New(BackendConfig{
+			"save_process":      "ScopeCounter",
+			"save_workers_size": 2,
+			"scope_name":        name,
+		}, mainlog)
+		if err != nil {
+			t.Fatal("gateway did not initialize", err)
+		}
+		if err := gw.Start(); err != nil {
+			t.Fatal("gateway did not start", err)
+		}
+		return gw
+	}
+	inbound, relay := newGateway("inbound"), newGateway("relay")
+
+	if err := relay.Shutdown(); err != nil {
+		t.Error(err)
+	}
+	// one for each of the two save workers
+	if shutdowns["relay"] != 2 || shutdowns["inbound"] != 0 {
+		t.Error("expecting only the relay processors to shut down, got", shutdowns)
+	}
+	// the relay can be started again, without touching the other gateway
+	if err := relay.Reinitialize(); err != nil {
+		t.Error(err)
+	}
+	if err := relay.Start(); err != nil {
+		t.Error(err)
+	}
+	if err := inbound.Shutdown(); err != nil {
+		t.Error(err)
+	}
+	if err := relay.Shutdown(); err != nil {
+		t.Error(err)
+	}
+	if shutdowns["relay"] != 4 || shutdowns["inbound"] != 2 {
+		t.Error("expecting each gateway to shut down its own processors, got", shutdowns)
+	}
+}
+
+func TestProcessorInstances(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	type taggerConfig struct {
+		Tag string `json:"tag_name"`
+	}
+	// Tagger adds its tag_name to the "tags" value
+	Svc.AddProcessor("Tagger", func() Decorator {
+		var config *taggerConfig
+		Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+			bcfg, err := Svc.ExtractConfig(backendConfig, &taggerConfig{})
+			if err != nil {
+				return err
+			}
+			config = bcfg.(*taggerConfig)
+			return nil
+		}))
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				tags, _ := e.Values["tags"].([]string)
+				e.Values["tags"] = append(tags, config.Tag)
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "tagger")
+
+	c := BackendConfig{
+		"save_process":      "Tagger#a|Tagger#B|Tagger",
+		"save_workers_size": 1,
+		"tag_name":          "flat",
+		"processors": map[string]interface{}{
+			"tagger#a": map[string]interface{}{"tag_name": "A"},
+			"Tagger#b": map[string]interface{}{"tag_name": "B"},
+		},
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+	if tags := fmt.Sprint(e.Values["tags"]); tags != "[A B flat]" {
+		t.Error("expecting each instance to have its own config, got", tags)
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error(err)
+	}
+
+	// an instance must have a config
+	c["save_process"] = "Tagger#c"
+	gateway = &BackendGateway{}
+	if err := gateway.Initialize(c); err == nil || !strings.Contains(err.Error(), "tagger#c") {
+		t.Error("expecting an error about the config of tagger#c, got", err)
+	}
+}
@@ -0,0 +1,55 @@
+package backends
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
+)
+
+// Helpers for the processors that deliver to files for each recipient, such as Maildir and mbox
+
+// errRcptPath is returned for a recipient that cannot be used in a path
+var errRcptPath = errors.New("the recipient cannot be used as a path name")
+
+// rcptPath returns the path for rcpt made from template, where {user} and {domain} are replaced with
+// the recipient's local part and domain, in lower case. When delim is not empty, the detail is removed
+// from the local part and returned, eg. for bob+lists the user is bob and the detail is lists
+func rcptPath(template string, rcpt mail.Address, delim string) (path string, detail string, err error) {
+	user := strings.ToLower(rcpt.User)
+	if delim != "" {
+		if pos := strings.Index(user, delim); pos > 0 {
+			user, detail = user[:pos], user[pos+len(delim):]
+		}
+	}
+	domain := strings.ToLower(rcpt.Host)
+	for _, s := range []string{user, domain} {
+		if !isPathElem(s) {
+			return "", "", errRcptPath
+		}
+	}
+	path = strings.NewReplacer("{user}", user, "{domain}", domain).Replace(template)
+	return filepath.Clean(path), detail, nil
+}
+
+// isPathElem returns true if s can be used as one element of a path
+func isPathElem(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, "/\\\x00")
+}
+
+// markDeliveryError marks rcpt as deferred or failed, depending on err
+func markDeliveryError(e *mail.Envelope, rcpt mail.Address, err error) {
+	switch {
+	case errors.Is(err, errRcptPath):
+		MarkRcptFailed(e, rcpt, NewResult(response.Canned.FailMailboxName))
+	case errors.Is(err, syscall.EDQUOT):
+		MarkRcptDeferred(e, rcpt, NewResult(response.Canned.FailMailboxFull))
+	case errors.Is(err, syscall.ENOSPC):
+		MarkRcptDeferred(e, rcpt, NewResult(response.Canned.FailStorageFull))
+	default:
+		MarkRcptDeferred(e, rcpt, nil)
+	}
+}
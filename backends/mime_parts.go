@@ -0,0 +1,122 @@
+package backends
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// mimePart is a part of a message that is not a multipart, with its content decoded
+type mimePart struct {
+	ContentType string
+	Charset     string
+	// Filename is from the Content-Disposition or the name of the Content-Type, decoded
+	Filename string
+	// Attachment is true if the part is an attachment, rather than the text or html of the message
+	Attachment bool
+	// Content is the decoded content. Text is converted to UTF-8 if mail.Dec has a CharsetReader
+	Content []byte
+}
+
+// mimeMaxDepth is how deep multiparts can be nested
+const mimeMaxDepth = 10
+
+var errMimeTooDeep = errors.New("multiparts are nested too deeply")
+
+// parseMimeParts reads the message from r, returning its header and its parts, in the order they appear
+func parseMimeParts(r io.Reader) (netmail.Header, []mimePart, error) {
+	msg, err := netmail.ReadMessage(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var parts []mimePart
+	err = walkMimeParts(textproto.MIMEHeader(msg.Header), msg.Body, 0, &parts)
+	return msg.Header, parts, err
+}
+
+// walkMimeParts adds the parts in body to parts
+func walkMimeParts(header textproto.MIMEHeader, body io.Reader, depth int, parts *[]mimePart) error {
+	if depth > mimeMaxDepth {
+		return errMimeTooDeep
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 says that the default is plain text
+		mediaType, params = "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = walkMimeParts(p.Header, p, depth+1, parts); err != nil {
+				return err
+			}
+		}
+	}
+	content, err := ioutil.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+	part := mimePart{ContentType: mediaType, Charset: params["charset"]}
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	part.Filename = dparams["filename"]
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	part.Filename = mail.MimeHeaderDecode(part.Filename)
+	part.Attachment = disposition == "attachment" || part.Filename != "" || !strings.HasPrefix(mediaType, "text/")
+	if !part.Attachment {
+		part.Content = toUTF8(part.Charset, content)
+	} else {
+		part.Content = content
+	}
+	*parts = append(*parts, part)
+	return nil
+}
+
+// decodeTransfer returns a reader that decodes the Content-Transfer-Encoding of r
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// the decoder skips the line breaks
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// toUTF8 converts text from charset to UTF-8, if mail.Dec can. The text is returned as it was otherwise
+func toUTF8(charset string, text []byte) []byte {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return text
+	}
+	if mail.Dec.CharsetReader == nil {
+		return text
+	}
+	r, err := mail.Dec.CharsetReader(charset, strings.NewReader(string(text)))
+	if err != nil {
+		return text
+	}
+	converted, err := ioutil.ReadAll(r)
+	if err != nil {
+		return text
+	}
+	return converted
+}
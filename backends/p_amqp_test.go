@@ -0,0 +1,309 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// fakeAMQP is a stand-in for an AMQP 0-9-1 broker. It does just enough for a publisher: it opens
+// connections and channels, and confirms each message. Messages with the routing key "unroutable"
+// are returned, and "nacked" are nacked
+type fakeAMQP struct {
+	sync.Mutex
+	l         net.Listener
+	published []fakeAMQPMessage
+	conns     []net.Conn
+}
+
+type fakeAMQPMessage struct {
+	exchange, routingKey string
+	body                 []byte
+}
+
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+)
+
+func newFakeAMQP(t *testing.T) *fakeAMQP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeAMQP{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.Lock()
+			f.conns = append(f.conns, conn)
+			f.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeAMQP) url() string {
+	return "amqp://guest:guest@" + f.l.Addr().String() + "/"
+}
+
+// restart drops the connections
+func (f *fakeAMQP) restart() {
+	f.Lock()
+	defer f.Unlock()
+	for _, conn := range f.conns {
+		_ = conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeAMQP) close() {
+	_ = f.l.Close()
+	f.restart()
+}
+
+// amqpArgs builds the arguments of a method
+type amqpArgs struct {
+	bytes.Buffer
+}
+
+func (a *amqpArgs) short(v uint16) *amqpArgs {
+	_ = binary.Write(a, binary.BigEndian, v)
+	return a
+}
+
+func (a *amqpArgs) long(v uint32) *amqpArgs {
+	_ = binary.Write(a, binary.BigEndian, v)
+	return a
+}
+
+func (a *amqpArgs) longlong(v uint64) *amqpArgs {
+	_ = binary.Write(a, binary.BigEndian, v)
+	return a
+}
+
+func (a *amqpArgs) octet(v byte) *amqpArgs {
+	a.WriteByte(v)
+	return a
+}
+
+func (a *amqpArgs) shortstr(s string) *amqpArgs {
+	a.WriteByte(byte(len(s)))
+	a.WriteString(s)
+	return a
+}
+
+func (a *amqpArgs) longstr(s string) *amqpArgs {
+	a.long(uint32(len(s)))
+	a.WriteString(s)
+	return a
+}
+
+func writeAMQPFrame(w io.Writer, typ byte, channel uint16, payload []byte) error {
+	frame := &amqpArgs{}
+	frame.octet(typ).short(channel).long(uint32(len(payload)))
+	frame.Write(payload)
+	frame.octet(amqpFrameEnd)
+	_, err := w.Write(frame.Bytes())
+	return err
+}
+
+func writeAMQPMethod(w io.Writer, channel uint16, class, method uint16, args *amqpArgs) error {
+	payload := &amqpArgs{}
+	payload.short(class).short(method)
+	if args != nil {
+		payload.Write(args.Bytes())
+	}
+	return writeAMQPFrame(w, amqpFrameMethod, channel, payload.Bytes())
+}
+
+func readAMQPFrame(r *bufio.Reader) (typ byte, channel uint16, payload []byte, err error) {
+	header := make([]byte, 7)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	typ = header[0]
+	channel = binary.BigEndian.Uint16(header[1:3])
+	payload = make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	return typ, channel, payload[:len(payload)-1], nil
+}
+
+// shortstr reads a short string from b at pos, returning it and the position after it
+func readAMQPShortstr(b []byte, pos int) (string, int) {
+	n := int(b[pos])
+	return string(b[pos+1 : pos+1+n]), pos + 1 + n
+}
+
+func (f *fakeAMQP) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	protocol := make([]byte, 8)
+	if _, err := io.ReadFull(r, protocol); err != nil || string(protocol) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+	// connection.start, with no server properties
+	if writeAMQPMethod(conn, 0, 10, 10, (&amqpArgs{}).octet(0).octet(9).long(0).longstr("PLAIN").longstr("en_US")) != nil {
+		return
+	}
+	var (
+		publish    *fakeAMQPMessage
+		bodySize   uint64
+		deliveries = make(map[uint16]uint64)
+	)
+	for {
+		typ, channel, payload, err := readAMQPFrame(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case amqpFrameHeartbeat:
+			continue
+		case amqpFrameHeader:
+			bodySize = binary.BigEndian.Uint64(payload[4:12])
+			if bodySize > 0 {
+				continue
+			}
+		case amqpFrameBody:
+			publish.body = append(publish.body, payload...)
+			if uint64(len(publish.body)) < bodySize {
+				continue
+			}
+		case amqpFrameMethod:
+			class, method := binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4])
+			switch {
+			case class == 10 && method == 11: // connection.start-ok
+				err = writeAMQPMethod(conn, 0, 10, 30, (&amqpArgs{}).short(0).long(131072).short(0))
+			case class == 10 && method == 40: // connection.open
+				err = writeAMQPMethod(conn, 0, 10, 41, (&amqpArgs{}).shortstr(""))
+			case class == 10 && method == 50: // connection.close
+				_ = writeAMQPMethod(conn, 0, 10, 51, nil)
+				return
+			case class == 20 && method == 10: // channel.open
+				err = writeAMQPMethod(conn, channel, 20, 11, (&amqpArgs{}).longstr(""))
+			case class == 20 && method == 40: // channel.close
+				err = writeAMQPMethod(conn, channel, 20, 41, nil)
+			case class == 85 && method == 10: // confirm.select
+				err = writeAMQPMethod(conn, channel, 85, 11, nil)
+			case class == 60 && method == 40: // basic.publish
+				exchange, pos := readAMQPShortstr(payload, 6)
+				routingKey, _ := readAMQPShortstr(payload, pos)
+				publish = &fakeAMQPMessage{exchange: exchange, routingKey: routingKey}
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+		// the whole message was read
+		deliveries[channel]++
+		switch publish.routingKey {
+		case "unroutable":
+			args := (&amqpArgs{}).short(312).shortstr("NO_ROUTE").shortstr(publish.exchange).shortstr(publish.routingKey)
+			header := (&amqpArgs{}).short(60).short(0).longlong(uint64(len(publish.body))).short(0)
+			if writeAMQPMethod(conn, channel, 60, 50, args) != nil ||
+				writeAMQPFrame(conn, amqpFrameHeader, channel, header.Bytes()) != nil ||
+				writeAMQPFrame(conn, amqpFrameBody, channel, publish.body) != nil {
+				return
+			}
+			err = writeAMQPMethod(conn, channel, 60, 80, (&amqpArgs{}).longlong(deliveries[channel]).octet(0))
+		case "nacked":
+			err = writeAMQPMethod(conn, channel, 60, 120, (&amqpArgs{}).longlong(deliveries[channel]).octet(0))
+		default:
+			f.Lock()
+			f.published = append(f.published, *publish)
+			f.Unlock()
+			err = writeAMQPMethod(conn, channel, 60, 80, (&amqpArgs{}).longlong(deliveries[channel]).octet(0))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestAMQP(t *testing.T) {
+	broker := newFakeAMQP(t)
+	defer broker.close()
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	c := BackendConfig{
+		"save_process":     "HeadersParser|AMQP",
+		"amqp_url":         broker.url(),
+		"amqp_exchange":    "mail",
+		"amqp_routing_key": "{rcpt_user}",
+		"amqp_pool_size":   1,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	e := newSpoolTestEnvelope()
+	e.RcptTo = []mail.Address{
+		{User: "alice", Host: "example.com"},
+		{User: "unroutable", Host: "example.com"},
+		{User: "nacked", Host: "example.com"},
+	}
+	result := gateway.Process(e)
+	if result.Code() != 451 {
+		t.Error("expecting 451 for the deferred recipients, got", result)
+	}
+	rr, ok := result.(*RcptResults)
+	if !ok || rr.Rcpts[0].Status != RcptDelivered || rr.Rcpts[1].Status != RcptDeferred || rr.Rcpts[2].Status != RcptDeferred {
+		t.Error("expecting alice to be delivered, and the others to be deferred, got", result)
+	}
+
+	// the connection is made again after the broker drops it
+	broker.restart()
+	e = newSpoolTestEnvelope()
+	e.QueuedId = "def67890"
+	e.RcptTo = []mail.Address{{User: "bob", Host: "example.com"}}
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting 250 after the restart, got", result)
+	}
+
+	broker.Lock()
+	defer broker.Unlock()
+	if len(broker.published) != 2 {
+		t.Fatal("expecting 2 messages, got", len(broker.published))
+	}
+	if broker.published[0].exchange != "mail" || broker.published[0].routingKey != "alice" || broker.published[1].routingKey != "bob" {
+		t.Error("expecting the messages for alice and bob, got", broker.published)
+	}
+	published := &PublishedEmail{}
+	if err := json.Unmarshal(broker.published[1].body, published); err != nil {
+		t.Fatal(err)
+	}
+	if published.QueuedId != "def67890" || string(published.Data) != "Subject: Test\n\nThis is a test." {
+		t.Errorf("expecting the email to bob, got %+v", published)
+	}
+}
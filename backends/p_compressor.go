@@ -26,6 +26,10 @@ import (
 //               : after being printed
 // ----------------------------------------------------------------------------------
 func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "compressor",
+		Description: "Compresses the email data and delivery header",
+	})
 	processors["compressor"] = func() Decorator {
 		return Compressor()
 	}
@@ -35,6 +39,8 @@ func init() {
 type DataCompressor struct {
 	ExtraHeaders []byte
 	Data         *bytes.Buffer
+	// spilled is read instead of Data when the envelope's data was spilled to a file
+	spilled io.Reader
 	// the pool is used to recycle buffers to ease up on the garbage collector
 	Pool *sync.Pool
 }
@@ -64,7 +70,7 @@ func (c *DataCompressor) set(b []byte, d *bytes.Buffer) {
 // Can only be called once!
 // This is because the compression buffer will be reset and compressor will be returned to the pool
 func (c *DataCompressor) String() string {
-	if c.Data == nil {
+	if c.Data == nil && c.spilled == nil {
 		return ""
 	}
 	//borrow a buffer form the pool
@@ -79,15 +85,31 @@ func (c *DataCompressor) String() string {
 	w, _ := zlib.NewWriterLevel(b, zlib.BestSpeed)
 	r = bytes.NewReader(c.ExtraHeaders)
 	_, _ = io.Copy(w, r)
-	_, _ = io.Copy(w, c.Data)
+	if c.spilled != nil {
+		_, _ = io.Copy(w, c.spilled)
+	} else {
+		_, _ = io.Copy(w, c.Data)
+	}
 	_ = w.Close()
 	return b.String()
 }
 
+// Branch returns a compressor for e, the copy of the envelope for a stack of a fan-out.
+// String can only be called once, so each stack needs its own
+func (c *DataCompressor) Branch(e *mail.Envelope) interface{} {
+	b := newCompressor()
+	b.set(c.ExtraHeaders, &e.Data)
+	if e.DataSpilled() {
+		b.spilled = e.DataReader()
+	}
+	return b
+}
+
 // clear it, without clearing the pool
 func (c *DataCompressor) clear() {
 	c.ExtraHeaders = []byte{}
 	c.Data = nil
+	c.spilled = nil
 }
 
 func Compressor() Decorator {
@@ -96,6 +118,10 @@ func Compressor() Decorator {
 			if task == TaskSaveMail {
 				compressor := newCompressor()
 				compressor.set([]byte(e.DeliveryHeader), &e.Data)
+				if e.DataSpilled() {
+					// the data was streamed to a file, e.Data is empty
+					compressor.spilled = e.DataReader()
+				}
 				// put the pointer in there for other processors to use later in the line
 				e.Values["zlib-compressor"] = compressor
 				// continue to the next Processor in the decorator stack
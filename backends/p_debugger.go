@@ -19,14 +19,19 @@ import (
 // Output        : none (only output to the log if enabled)
 // ----------------------------------------------------------------------------------
 func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "debugger",
+		Description: "Logs received email",
+		Options:     ConfigOptions(&debuggerConfig{}),
+	})
 	processors[strings.ToLower(defaultProcessor)] = func() Decorator {
 		return Debugger()
 	}
 }
 
 type debuggerConfig struct {
-	LogReceivedMails bool `json:"log_received_mails"`
-	SleepSec         int  `json:"sleep_seconds,omitempty"`
+	LogReceivedMails bool `json:"log_received_mails" desc:"Log each email that is received"`
+	SleepSec         int  `json:"sleep_seconds,omitempty" desc:"Sleep for this many seconds before saving, for testing"`
 }
 
 func Debugger() Decorator {
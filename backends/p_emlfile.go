@@ -0,0 +1,246 @@
+package backends
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: emlfile
+// ----------------------------------------------------------------------------------
+// Description   : Writes the email to <dir>/<layout>/<name>.eml with a JSON
+//               : sidecar, <name>.json, that has the envelope. The name is the
+//               : queued id, then the time and a sequence number, since a
+//               : connection can send more than one email with the same queued id
+// ----------------------------------------------------------------------------------
+// Config Options: eml_dir string - the directory to write to
+//               : eml_layout string - the sub-directories, where {yyyy}, {mm}, {dd}
+//               : and {hh} are replaced with the time the email is saved.
+//               : default "{yyyy}/{mm}/{dd}"
+//               : eml_compress bool - gzip the email, and name it .eml.gz
+// --------------:-------------------------------------------------------------------
+// Input         : e.QueuedId, e.DeliveryHeader, e.Data, the envelope for the sidecar
+// ----------------------------------------------------------------------------------
+// Output        : the files, which can be read back with ReadEmlFile. Sets
+//               : e.Values["eml_path"] to the path of the email
+// ----------------------------------------------------------------------------------
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "emlfile",
+		Description: "Writes the email to an .eml file with a JSON sidecar of the envelope",
+		Options:     ConfigOptions(&EmlFileProcessorConfig{}),
+	})
+	processors["emlfile"] = func() Decorator {
+		return EmlFile()
+	}
+}
+
+type EmlFileProcessorConfig struct {
+	Dir      string `json:"eml_dir" desc:"Directory to write the .eml files to"`
+	Layout   string `json:"eml_layout,omitempty" default:"{yyyy}/{mm}/{dd}" desc:"Sub-directories, {yyyy}, {mm}, {dd} and {hh} are replaced with the time"`
+	Compress bool   `json:"eml_compress,omitempty" desc:"Gzip the email, and name it .eml.gz"`
+}
+
+const (
+	emlExt     = ".eml"
+	emlGzipExt = ".eml.gz"
+	emlMetaExt = ".json"
+
+	// emlPathValue is the key of e.Values that has the path of the written email
+	emlPathValue = "eml_path"
+)
+
+// emlSeq makes the file names unique when two emails are written in the same nanosecond
+var emlSeq uint64
+
+// emlName returns a name for the files of e, written at t
+func emlName(e *mail.Envelope, t time.Time) (string, error) {
+	if !isPathElem(e.QueuedId) || strings.HasPrefix(e.QueuedId, ".") {
+		return "", fmt.Errorf("cannot make a file name from the queued id [%s]", e.QueuedId)
+	}
+	return fmt.Sprintf("%s-%d-%d", e.QueuedId, t.UnixNano(), atomic.AddUint64(&emlSeq, 1)), nil
+}
+
+// EmlMeta is the sidecar of an .eml file
+type EmlMeta struct {
+	*mail.EnvelopeMeta
+	// Time is when the file was written
+	Time   time.Time `json:"time"`
+	Hashes []string  `json:"hashes,omitempty"`
+	// Values has the values of e.Values that are strings, numbers or bools.
+	// They are not set when the email is injected again
+	Values map[string]interface{} `json:"values,omitempty"`
+}
+
+// emlValues returns the values that can be kept in the sidecar. Processors also keep things like
+// compressors and connections in e.Values, which are left out
+func emlValues(values map[string]interface{}) map[string]interface{} {
+	kept := make(map[string]interface{})
+	for k, v := range values {
+		switch v.(type) {
+		case string, bool, int, int32, int64, uint, uint32, uint64, float32, float64, []string:
+			kept[k] = v
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+// emlDir returns the directory for an email saved at t
+func emlDir(config *EmlFileProcessorConfig, t time.Time) string {
+	layout := strings.NewReplacer(
+		"{yyyy}", t.Format("2006"),
+		"{mm}", t.Format("01"),
+		"{dd}", t.Format("02"),
+		"{hh}", t.Format("15"),
+	).Replace(config.Layout)
+	return filepath.Join(config.Dir, layout)
+}
+
+// writeEml writes the email and then its sidecar to dir, naming them name. Returns the path of the email
+func writeEml(dir, name string, e *mail.Envelope, compress bool, t time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	meta, err := json.Marshal(&EmlMeta{
+		EnvelopeMeta: e.Meta(),
+		Time:         t,
+		Hashes:       e.Hashes,
+		Values:       emlValues(e.Values),
+	})
+	if err != nil {
+		return "", err
+	}
+	file := name + emlExt
+	if !compress {
+		err = writeFile(dir, file, e.NewReader())
+	} else {
+		file = name + emlGzipExt
+		pr, pw := io.Pipe()
+		go func() {
+			zw := gzip.NewWriter(pw)
+			_, err := io.Copy(zw, e.NewReader())
+			if closeErr := zw.Close(); err == nil {
+				err = closeErr
+			}
+			_ = pw.CloseWithError(err)
+		}()
+		err = writeFile(dir, file, pr)
+		// stops the goroutine if writeFile gave up early
+		_ = pr.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = writeFile(dir, name+emlMetaExt, bytes.NewReader(meta)); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, file), syncDir(dir)
+}
+
+// gzipFile closes the gzip reader and the file
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Reader.Close()
+	if closeErr := g.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadEmlFile reads the sidecar of an .eml or .eml.gz file written by the EmlFile processor, and opens the
+// email, decompressing it if needed. The email includes the delivery header, which is also in the sidecar
+func ReadEmlFile(path string) (*EmlMeta, io.ReadCloser, error) {
+	var base string
+	switch {
+	case strings.HasSuffix(path, emlGzipExt):
+		base = strings.TrimSuffix(path, emlGzipExt)
+	case strings.HasSuffix(path, emlExt):
+		base = strings.TrimSuffix(path, emlExt)
+	default:
+		return nil, nil, fmt.Errorf("%s is not an %s or %s file", path, emlExt, emlGzipExt)
+	}
+	b, err := ioutil.ReadFile(base + emlMetaExt)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &EmlMeta{}
+	if err = json.Unmarshal(b, meta); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", base+emlMetaExt, err)
+	}
+	if meta.EnvelopeMeta == nil {
+		meta.EnvelopeMeta = &mail.EnvelopeMeta{}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(path, emlGzipExt) {
+		return meta, f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return meta, &gzipFile{Reader: zr, f: f}, nil
+}
+
+// EmlFile writes each email to an .eml file, and the envelope to a JSON file next to it.
+// Each file is written to a temporary file first, then renamed
+func EmlFile() Decorator {
+	var config *EmlFileProcessorConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&EmlFileProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*EmlFileProcessorConfig)
+		if c.Layout == "" {
+			c.Layout = "{yyyy}/{mm}/{dd}"
+		}
+		if filepath.IsAbs(c.Layout) || strings.HasPrefix(filepath.Clean(c.Layout), "..") {
+			return fmt.Errorf("eml_layout [%s] must be inside of eml_dir", c.Layout)
+		}
+		config = c
+		return nil
+	}))
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			now := time.Now()
+			name, err := emlName(e, now)
+			var path string
+			if err == nil {
+				path, err = writeEml(emlDir(config, now), name, e, config.Compress, now)
+			}
+			if err != nil {
+				Log().WithError(err).Errorf("could not write %s to an eml file", e.QueuedId)
+				return NewResult(response.Canned.FailBackendTransaction), err
+			}
+			e.Values[emlPathValue] = path
+			return p.Process(e, task)
+		})
+	}
+}
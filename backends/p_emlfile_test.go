@@ -0,0 +1,127 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+func TestEmlFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	for _, compress := range []bool{false, true} {
+		c := BackendConfig{
+			"save_process": "HeadersParser|Hasher|Compressor|EmlFile",
+			"eml_dir":      dir,
+			"eml_layout":   "{yyyy}-{mm}/{dd}",
+			"eml_compress": compress,
+		}
+		gateway := &BackendGateway{}
+		if err := gateway.Initialize(c); err != nil {
+			t.Fatal("Gateway did not init because:", err)
+		}
+		if err := gateway.Start(); err != nil {
+			t.Fatal("Gateway did not start because:", err)
+		}
+
+		e := newSpoolTestEnvelope()
+		e.DeliveryHeader = "Delivered-To: test@example.com\n"
+		e.TLS = true
+		e.Auth.Username = "user"
+		e.Values["note"] = "kept"
+		if result := gateway.Process(e); result.Code() != 250 {
+			t.Error("expecting 250, got", result)
+		}
+
+		now := time.Now()
+		file, _ := e.Values[emlPathValue].(string)
+		if filepath.Dir(file) != filepath.Join(dir, now.Format("2006-01"), now.Format("02")) ||
+			compress != strings.HasSuffix(file, ".eml.gz") {
+			t.Error("expecting the path of the email, got", file)
+		}
+		meta, data, err := ReadEmlFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(data)
+		_ = data.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "Delivered-To: test@example.com\nSubject: Test\n\nThis is a test." {
+			t.Errorf("expecting the email with the delivery header, got %q", b)
+		}
+		if meta.QueuedId != "abc12345" || meta.Helo != "helo.example.com" || !meta.TLS || meta.AuthUsername != "user" ||
+			len(meta.RcptTo) != 1 || len(meta.Hashes) != 1 || meta.Values["note"] != "kept" || meta.Time.IsZero() {
+			t.Errorf("expecting the envelope in the sidecar, got %+v %+v", meta, meta.EnvelopeMeta)
+		}
+		if _, ok := meta.Values["zlib-compressor"]; ok {
+			t.Error("expecting only simple values in the sidecar")
+		}
+
+		// it can be injected again
+		if _, data, err = ReadEmlFile(file); err != nil {
+			t.Fatal(err)
+		}
+		meta.DeliveryHeader = ""
+		if result, err := gateway.Inject(meta.EnvelopeMeta, data); err != nil || result.Code() != 250 {
+			t.Error("expecting the email to be injected, got", result, err)
+		}
+		_ = data.Close()
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, _, err := ReadEmlFile(filepath.Join(dir, "missing.eml")); err == nil {
+		t.Error("expecting an error for a file without a sidecar")
+	}
+
+	// the emails of a connection have the same queued id, each gets its own file
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc12345"
+	now := time.Now()
+	var paths []string
+	for i := 0; i < 2; i++ {
+		name, err := emlName(e, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, err := writeEml(dir, name, e, false, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	if paths[0] == paths[1] || filepath.Dir(paths[0]) != dir {
+		t.Error("expecting a file in dir for each email, got", paths)
+	}
+	for _, path := range paths {
+		if !strings.HasPrefix(filepath.Base(path), "abc12345-") {
+			t.Error("expecting the name to start with the queued id, got", path)
+		}
+	}
+	if meta, data, err := ReadEmlFile(paths[1]); err != nil || meta.QueuedId != "abc12345" {
+		t.Error("expecting the queued id in the sidecar, got", meta, err)
+	} else {
+		_ = data.Close()
+	}
+	// the queued id can't add to the path
+	e.QueuedId = "../x"
+	if _, err := emlName(e, now); err == nil {
+		t.Error("expecting an error for a queued id that is not a file name")
+	}
+}
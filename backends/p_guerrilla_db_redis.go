@@ -2,6 +2,7 @@ package backends
 
 import (
 	"bytes"
+	"context"
 	"compress/zlib"
 	"database/sql"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
 )
 
 // ----------------------------------------------------------------------------------
@@ -25,11 +27,16 @@ import (
 // --------------:-------------------------------------------------------------------
 // Input         : envelope
 // ----------------------------------------------------------------------------------
-// Output        :
+// Output        : Gives up if the save times out (gw_save_timeout)
 // ----------------------------------------------------------------------------------
 func init() {
-	processors["guerrillaredisdb"] = func() Decorator {
-		return GuerrillaDbRedis()
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "guerrillaredisdb",
+		Description: "Saves the body to redis, meta data to SQL. Example only",
+		Options:     redisConfigOptions(&guerrillaDBAndRedisConfig{}),
+	})
+	contextProcessors["guerrillaredisdb"] = func() ContextDecorator {
+		return GuerrillaDbRedisContext()
 	}
 }
 
@@ -54,14 +61,17 @@ type GuerrillaDBAndRedisBackend struct {
 type stmtCache [GuerrillaDBAndRedisBatchMax]*sql.Stmt
 
 type guerrillaDBAndRedisConfig struct {
-	NumberOfWorkers    int    `json:"save_workers_size"`
-	Table              string `json:"mail_table"`
-	Driver             string `json:"sql_driver"`
-	DSN                string `json:"sql_dsn"`
-	RedisExpireSeconds int    `json:"redis_expire_seconds"`
-	RedisInterface     string `json:"redis_interface"`
-	PrimaryHost        string `json:"primary_mail_host"`
-	BatchTimeout       int    `json:"redis_sql_batch_timeout,omitempty"`
+	NumberOfWorkers    int    `json:"save_workers_size" desc:"Number of workers that save email"`
+	Table              string `json:"mail_table" desc:"The table for storing email"`
+	Driver             string `json:"sql_driver" desc:"The database driver name, eg. mysql"`
+	DSN                string `json:"sql_dsn" desc:"The driver-specific data source name"`
+	RedisExpireSeconds int    `json:"redis_expire_seconds" desc:"How many seconds until the body expires"`
+	RedisInterface     string `json:"redis_interface" desc:"The redis server, <host>:<port>, or the cluster nodes, comma separated"`
+	RedisMaxIdle       int    `json:"redis_max_idle,omitempty" default:"10" desc:"Idle redis connections to keep"`
+	RedisMaxActive     int    `json:"redis_max_active,omitempty" default:"0" desc:"Redis connections open at once, 0 for no limit"`
+	RedisIdleTimeout   string `json:"redis_idle_timeout,omitempty" default:"240s" desc:"How long until an idle redis connection is closed"`
+	PrimaryHost        string `json:"primary_mail_host" desc:"The primary host name"`
+	BatchTimeout       int    `json:"redis_sql_batch_timeout,omitempty" default:"3000000000" desc:"Time to wait before inserting a batch, in nanoseconds"`
 }
 
 // Load the backend config for the backend. It has already been unmarshalled
@@ -82,12 +92,6 @@ func (g *GuerrillaDBAndRedisBackend) getNumberOfWorkers() int {
 	return g.config.NumberOfWorkers
 }
 
-type redisClient struct {
-	isConnected bool
-	conn        RedisConn
-	time        int
-}
-
 // compressedData struct will be compressed using zlib when printed via fmt
 type compressedData struct {
 	extraHeaders []byte
@@ -332,32 +336,24 @@ func (g *GuerrillaDBAndRedisBackend) sqlConnect() (*sql.DB, error) {
 	}
 }
 
-func (c *redisClient) redisConnection(redisInterface string) (err error) {
-	if c.isConnected == false {
-		c.conn, err = RedisDialer("tcp", redisInterface)
-		if err != nil {
-			// handle error
-			return err
-		}
-		c.isConnected = true
-	}
-	return nil
-}
-
 type feedChan chan []interface{}
 
 // GuerrillaDbRedis is a specialized processor for Guerrilla mail. It is here as an example.
 // It's an example of a 'monolithic' processor.
 func GuerrillaDbRedis() Decorator {
+	return AsDecorator(GuerrillaDbRedisContext())
+}
+
+// GuerrillaDbRedisContext is GuerrillaDbRedis, where saving is cancelled when the task's deadline passes
+func GuerrillaDbRedisContext() ContextDecorator {
 
 	g := GuerrillaDBAndRedisBackend{}
-	redisClient := &redisClient{}
 
 	var (
-		db       *sql.DB
-		to, body string
-		redisErr error
-		feeders  []feedChan
+		db        *sql.DB
+		redisPool RedisPool
+		to, body  string
+		feeders   []feedChan
 	)
 
 	g.batcherStoppers = make([]chan bool, 0)
@@ -374,6 +370,14 @@ func GuerrillaDbRedis() Decorator {
 		if err != nil {
 			return err
 		}
+		poolConfig, err := redisPoolConfig(backendConfig, g.config.RedisMaxIdle, g.config.RedisMaxActive, g.config.RedisIdleTimeout)
+		if err != nil {
+			return err
+		}
+		// it's not checked that redis is up, since the body is saved to SQL when it's not
+		if redisPool, err = redisPoolFor(backendConfig, g.config.RedisInterface, poolConfig); err != nil {
+			return err
+		}
 		queryBatcherId++
 		// start the query SQL batching where we will send data via the feeder channel
 		stop := make(chan bool)
@@ -399,8 +403,8 @@ func GuerrillaDbRedis() Decorator {
 		} else {
 			Log().Infof("closed mysql")
 		}
-		if redisClient.conn != nil {
-			if err := redisClient.conn.Close(); err != nil {
+		if redisPool != nil {
+			if err := redisPool.Close(); err != nil {
 				Log().WithError(err).Error("close redis failed")
 			} else {
 				Log().Infof("closed redis")
@@ -418,8 +422,8 @@ func GuerrillaDbRedis() Decorator {
 	var vals []interface{}
 	data := newCompressedData()
 
-	return func(p Processor) Processor {
-		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+	return func(p ContextProcessor) ContextProcessor {
+		return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
 			if task == TaskSaveMail {
 				Log().Debug("Got mail from chan,", e.RemoteIP)
 				to = trimToLimit(strings.TrimSpace(e.RcptTo[0].User)+"@"+g.config.PrimaryHost, 255)
@@ -458,15 +462,15 @@ func GuerrillaDbRedis() Decorator {
 				// data will be written to redis - it implements the Stringer interface, redigo uses fmt to
 				// print the data to redis.
 
-				redisErr = redisClient.redisConnection(g.config.RedisInterface)
-				if redisErr == nil {
-					_, doErr := redisClient.conn.Do("SETEX", hash, g.config.RedisExpireSeconds, data)
-					if doErr == nil {
-						body = "redis" // the backend system will know to look in redis for the message data
-						data.clear()   // blank
-					}
+				_, doErr := redisPoolDo(ctx, redisPool, "SETEX", hash, g.config.RedisExpireSeconds, data)
+				if doErr != nil && doErr == ctx.Err() {
+					return NewResult(response.Canned.FailBackendTimeout), doErr
+				}
+				if doErr == nil {
+					body = "redis" // the backend system will know to look in redis for the message data
+					data.clear()   // blank
 				} else {
-					Log().WithError(redisErr).Warn("Error while connecting redis")
+					Log().WithError(doErr).Warn("Error while saving to redis")
 				}
 
 				vals = []interface{}{} // clear the vals
@@ -482,11 +486,15 @@ func GuerrillaDbRedis() Decorator {
 					trimToLimit(e.MailFrom.String(), 255),
 					e.TLS)
 				// give the values to a random query batcher
-				feeders[rand.Intn(len(feeders))] <- vals
-				return p.Process(e, task)
+				select {
+				case feeders[rand.Intn(len(feeders))] <- vals:
+				case <-ctx.Done():
+					return NewResult(response.Canned.FailBackendTimeout), ctx.Err()
+				}
+				return p.ProcessContext(ctx, e, task)
 
 			} else {
-				return p.Process(e, task)
+				return p.ProcessContext(ctx, e, task)
 			}
 		})
 	}
@@ -23,6 +23,10 @@ import (
 // Output        : Checksum stored in e.Hash
 // ----------------------------------------------------------------------------------
 func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "hasher",
+		Description: "Generates a unique md5 checksum id for an email",
+	})
 	processors["hasher"] = func() Decorator {
 		return Hasher()
 	}
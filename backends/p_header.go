@@ -8,7 +8,7 @@ import (
 )
 
 type HeaderConfig struct {
-	PrimaryHost string `json:"primary_mail_host"`
+	PrimaryHost string `json:"primary_mail_host" desc:"The host name for the Received header"`
 }
 
 // ----------------------------------------------------------------------------------
@@ -16,7 +16,7 @@ type HeaderConfig struct {
 // ----------------------------------------------------------------------------------
 // Description   : Adds delivery information headers to e.DeliveryHeader
 // ----------------------------------------------------------------------------------
-// Config Options: none
+// Config Options: primary_mail_host string - the host name for the Received header
 // --------------:-------------------------------------------------------------------
 // Input         : e.Helo
 //               : e.RemoteAddress
@@ -26,6 +26,11 @@ type HeaderConfig struct {
 // Output        : Sets e.DeliveryHeader with additional delivery info
 // ----------------------------------------------------------------------------------
 func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "header",
+		Description: "Adds delivery information headers to e.DeliveryHeader",
+		Options:     ConfigOptions(&HeaderConfig{}),
+	})
 	processors["header"] = func() Decorator {
 		return Header()
 	}
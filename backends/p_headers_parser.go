@@ -14,8 +14,14 @@ import (
 // Input         : envelope
 // ----------------------------------------------------------------------------------
 // Output        : Headers will be populated in e.Header
+//               : Nothing is done if the headers were already parsed, eg. by the
+//               : headersparser stream processor
 // ----------------------------------------------------------------------------------
 func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "headersparser",
+		Description: "Parses the header",
+	})
 	processors["headersparser"] = func() Decorator {
 		return HeadersParser()
 	}
@@ -24,7 +30,7 @@ func init() {
 func HeadersParser() Decorator {
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
-			if task == TaskSaveMail {
+			if task == TaskSaveMail && e.Header == nil {
 				if err := e.ParseHeaders(); err != nil {
 					Log().WithError(err).Error("parse headers error")
 				}
@@ -0,0 +1,140 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: kafka
+// ----------------------------------------------------------------------------------
+// Description   : Publishes the envelope and the email to a Kafka topic
+// ----------------------------------------------------------------------------------
+// Config Options: kafka_brokers string - comma separated list of brokers,
+//               : default "127.0.0.1:9092"
+//               : kafka_version string - version of the brokers, default "2.1.0"
+//               : kafka_topic string - where {queued_id}, {rcpt}, {rcpt_user},
+//               : {rcpt_domain} and {mail_from_domain} are replaced, default "mail"
+//               : kafka_payload string - inline, the email is published with the
+//               : envelope, or reference, for when an earlier processor stored
+//               : the email, such as S3. default inline
+//               : kafka_pool_size int - producers to keep, default 4
+//               : kafka_timeout string - how long to wait for all the in-sync
+//               : replicas to acknowledge, default "10s"
+// --------------:-------------------------------------------------------------------
+// Input         : the envelope, e.Data, e.Values
+// ----------------------------------------------------------------------------------
+// Output        : Recipients are marked with MarkRcptDeferred if publishing fails.
+//               : The key of the message is the id of the message, a hash of
+//               : the queued id, the recipients and the email, see publishID
+// ----------------------------------------------------------------------------------
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "kafka",
+		Description: "Publishes the email to a Kafka topic",
+		Options:     ConfigOptions(&KafkaProcessorConfig{}),
+	})
+	contextProcessors["kafka"] = func() ContextDecorator {
+		return Kafka()
+	}
+}
+
+type KafkaProcessorConfig struct {
+	Brokers  string `json:"kafka_brokers,omitempty" default:"127.0.0.1:9092" desc:"Comma separated list of brokers"`
+	Version  string `json:"kafka_version,omitempty" default:"2.1.0" desc:"Version of the brokers"`
+	Topic    string `json:"kafka_topic,omitempty" default:"mail" desc:"Topic to publish to, see the docs for what is replaced"`
+	Payload  string `json:"kafka_payload,omitempty" default:"inline" desc:"inline to publish the email, or reference for only the envelope"`
+	PoolSize int    `json:"kafka_pool_size,omitempty" default:"4" desc:"Producers to keep"`
+	Timeout  string `json:"kafka_timeout,omitempty" default:"10s" desc:"How long to wait for the brokers"`
+}
+
+// kafkaPublisher is a producer, which is connected to each of the brokers
+type kafkaPublisher struct {
+	producer sarama.SyncProducer
+}
+
+// kafkaMessage returns the message to produce for msg
+func kafkaMessage(topic string, msg *PublishMessage) *sarama.ProducerMessage {
+	m := &sarama.ProducerMessage{
+		Topic: topic,
+		// so that the same email goes to the same partition if it's published again
+		Key:   sarama.StringEncoder(msg.ID),
+		Value: sarama.ByteEncoder(msg.Body),
+	}
+	for k, v := range msg.Headers {
+		m.Headers = append(m.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+	return m
+}
+
+func (k *kafkaPublisher) Publish(ctx context.Context, topic string, msg *PublishMessage) error {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := k.producer.SendMessage(kafkaMessage(topic, msg))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if _, ok := err.(sarama.KError); ok {
+			// the broker replied with an error
+			return PublishRejected{err}
+		}
+		return err
+	case <-ctx.Done():
+		// the producer is closed since there's an error, which stops the send
+		return ctx.Err()
+	}
+}
+
+func (k *kafkaPublisher) Close() error {
+	return k.producer.Close()
+}
+
+// Kafka publishes each email to a Kafka topic, waiting for all the in-sync replicas to have it
+func Kafka() ContextDecorator {
+	return PublishWith("kafka", func(backendConfig BackendConfig) (*PublishConfig, PublishDialer, error) {
+		configType := BaseConfig(&KafkaProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return nil, nil, err
+		}
+		config := bcfg.(*KafkaProcessorConfig)
+		if config.Brokers == "" {
+			config.Brokers = "127.0.0.1:9092"
+		}
+		var brokers []string
+		for _, b := range strings.Split(config.Brokers, ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				brokers = append(brokers, b)
+			}
+		}
+		saramaConfig := sarama.NewConfig()
+		saramaConfig.ClientID = "guerrillad"
+		if config.Version != "" {
+			if saramaConfig.Version, err = sarama.ParseKafkaVersion(config.Version); err != nil {
+				return nil, nil, fmt.Errorf("kafka_version [%s]: %s", config.Version, err)
+			}
+		}
+		saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
+		saramaConfig.Producer.Return.Successes = true
+		if err = saramaConfig.Validate(); err != nil {
+			return nil, nil, err
+		}
+		dial := func() (Publisher, error) {
+			producer, err := sarama.NewSyncProducer(brokers, saramaConfig)
+			if err != nil {
+				return nil, err
+			}
+			return &kafkaPublisher{producer: producer}, nil
+		}
+		return &PublishConfig{
+			Subject:  config.Topic,
+			Payload:  config.Payload,
+			PoolSize: config.PoolSize,
+			Timeout:  config.Timeout,
+		}, dial, nil
+	})
+}
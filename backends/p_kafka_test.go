@@ -0,0 +1,80 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+func TestKafkaMessage(t *testing.T) {
+	m := kafkaMessage("mail", &PublishMessage{ID: "abc12345", Headers: map[string]string{"Queued-Id": "abc12345"}, Body: []byte("{}")})
+	if key, _ := m.Key.Encode(); string(key) != "abc12345" {
+		t.Error("expecting the queued id as the key, got", string(key))
+	}
+	if len(m.Headers) != 1 || string(m.Headers[0].Key) != "Queued-Id" || string(m.Headers[0].Value) != "abc12345" {
+		t.Error("expecting the headers, got", m.Headers)
+	}
+}
+
+func TestKafka(t *testing.T) {
+	// a stand-in for a broker, which leads a partition for each topic
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(t),
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("example.com", 0, broker.BrokerID()).
+			SetLeader("broken.com", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).
+			SetError("broken.com", 0, sarama.ErrNotEnoughReplicas),
+	})
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	c := BackendConfig{
+		"save_process":    "HeadersParser|Kafka",
+		"kafka_brokers":   broker.Addr(),
+		"kafka_topic":     "{rcpt_domain}",
+		"kafka_pool_size": 1,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	e := newSpoolTestEnvelope()
+	e.RcptTo = []mail.Address{{User: "alice", Host: "example.com"}, {User: "bob", Host: "broken.com"}}
+	result := gateway.Process(e)
+	if result.Code() != 451 {
+		t.Error("expecting 451 for the deferred recipient, got", result)
+	}
+	rr, ok := result.(*RcptResults)
+	if !ok || rr.Rcpts[0].Status != RcptDelivered || rr.Rcpts[1].Status != RcptDeferred {
+		t.Error("expecting alice to be delivered, and bob to be deferred, got", result)
+	}
+	var produced int
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			produced++
+			if req.RequiredAcks != sarama.WaitForAll {
+				t.Error("expecting the producer to wait for all the replicas, got", req.RequiredAcks)
+			}
+		}
+	}
+	// broken.com is retried by the producer
+	if produced < 2 {
+		t.Error("expecting the messages to be produced, got", produced)
+	}
+}
@@ -0,0 +1,199 @@
+package backends
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: maildir
+// ----------------------------------------------------------------------------------
+// Description   : Delivers a copy of the email to the Maildir of each recipient
+// ----------------------------------------------------------------------------------
+// Config Options: maildir_path string - path of the Maildir for a recipient, where
+//               : {user} and {domain} are replaced with the recipient's local part
+//               : and domain, in lower case, for example:
+//               : /var/mail/{domain}/{user}/Maildir
+//               : maildir_detail_folders bool - deliver user+detail@example.com to
+//               : the .detail folder of the user's Maildir, otherwise to the inbox
+//               : maildir_detail_delimiter string - separates the user from the
+//               : detail, default "+"
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo, e.DeliveryHeader, e.Data
+// ----------------------------------------------------------------------------------
+// Output        : Each recipient is marked with MarkRcptDelivered, MarkRcptDeferred if
+//               : the disk or the mailbox is full, or for other errors when writing,
+//               : or MarkRcptFailed if the recipient cannot be a path name
+// ----------------------------------------------------------------------------------
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "maildir",
+		Description: "Delivers the email to the Maildir of each recipient",
+		Options:     ConfigOptions(&MaildirProcessorConfig{}),
+	})
+	processors["maildir"] = func() Decorator {
+		return Maildir()
+	}
+}
+
+type MaildirProcessorConfig struct {
+	Path            string `json:"maildir_path" desc:"Path of the Maildir, {user} and {domain} are replaced with the recipient's"`
+	DetailFolders   bool   `json:"maildir_detail_folders,omitempty" desc:"Deliver user+detail to the .detail folder of the Maildir"`
+	DetailDelimiter string `json:"maildir_detail_delimiter,omitempty" default:"+" desc:"Separates the user from the detail"`
+}
+
+// maildirSeq makes the file names unique when many are delivered in the same microsecond
+var maildirSeq uint64
+
+// maildir delivers to the Maildirs made from a path template
+type maildir struct {
+	config   *MaildirProcessorConfig
+	hostname string
+}
+
+// folder returns the directory to deliver to for rcpt
+func (m *maildir) folder(rcpt mail.Address) (string, error) {
+	dir, detail, err := rcptPath(m.config.Path, rcpt, m.config.DetailDelimiter)
+	if err != nil {
+		return "", err
+	}
+	if m.config.DetailFolders && detail != "" {
+		// a Maildir++ folder, the . is the separator of sub-folders
+		if strings.ContainsAny(detail, "/\\\x00") {
+			return "", errRcptPath
+		}
+		dir = filepath.Join(dir, "."+detail)
+	}
+	return dir, nil
+}
+
+// makeFolder makes dir and its tmp, new and cur directories, if they don't exist
+func (m *maildir) makeFolder(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "tmp")); err == nil {
+		return nil
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	if strings.HasPrefix(filepath.Base(dir), ".") {
+		// marks a Maildir++ folder
+		f, err := os.OpenFile(filepath.Join(dir, "maildirfolder"), os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	return nil
+}
+
+// uniqueName returns a name for a new message file, as described in http://cr.yp.to/proto/maildir.html,
+// with the size added like Maildir++ does
+func (m *maildir) uniqueName(size int) string {
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d",
+		now.Unix(),
+		now.Nanosecond()/1000,
+		os.Getpid(),
+		atomic.AddUint64(&maildirSeq, 1),
+		m.hostname,
+		size)
+}
+
+// deliver writes the email to the tmp directory of dir, then moves it to new
+func (m *maildir) deliver(dir string, e *mail.Envelope) error {
+	if err := m.makeFolder(dir); err != nil {
+		return err
+	}
+	name := m.uniqueName(e.Len())
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, e.NewReader()); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, "new", name))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Join(dir, "new"))
+}
+
+// maildirHostname returns the host name to use in file names, with / and : escaped
+func maildirHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	return strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+}
+
+// Maildir delivers the email to a Maildir for each recipient. Recipients that share a Maildir folder
+// get one copy
+func Maildir() Decorator {
+	m := &maildir{}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MaildirProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*MaildirProcessorConfig)
+		if _, ok := backendConfig["maildir_detail_delimiter"]; !ok {
+			config.DetailDelimiter = "+"
+		}
+		if !strings.Contains(config.Path, "{user}") {
+			Log().Warnf("maildir_path [%s] has no {user}, all the recipients will share a Maildir", config.Path)
+		}
+		m.config = config
+		m.hostname = maildirHostname()
+		return nil
+	}))
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			tracker := trackRcpts(e)
+			// the result of each folder that was delivered to
+			delivered := make(map[string]error)
+			for _, rcpt := range e.RcptTo {
+				if tracker.dropped(rcpt) {
+					// an earlier processor deferred or failed it
+					continue
+				}
+				dir, err := m.folder(rcpt)
+				if err == nil {
+					var ok bool
+					if err, ok = delivered[dir]; !ok {
+						err = m.deliver(dir, e)
+						delivered[dir] = err
+					}
+				}
+				if err != nil {
+					Log().WithError(err).Errorf("could not deliver %s to the Maildir of <%s>", e.QueuedId, rcpt.String())
+					markDeliveryError(e, rcpt, err)
+					continue
+				}
+				MarkRcptDelivered(e, rcpt)
+			}
+			return p.Process(e, task)
+		})
+	}
+}
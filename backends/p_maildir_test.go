@@ -0,0 +1,159 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// maildirFiles returns the contents of the files in the given sub-directory of a Maildir folder
+func maildirFiles(t *testing.T, dir, sub string) []string {
+	files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, f := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, sub, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(f.Name(), ",S="+strconv.Itoa(len(b))) {
+			t.Error("expecting the size in the file name, got", f.Name())
+		}
+		contents = append(contents, string(b))
+	}
+	return contents
+}
+
+func TestMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	c := BackendConfig{
+		"save_process":           "Maildir",
+		"maildir_path":           filepath.Join(dir, "{domain}", "{user}", "Maildir"),
+		"maildir_detail_folders": true,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc123"
+	e.PushRcpt(mail.Address{User: "Bob", Host: "Example.com"})
+	e.PushRcpt(mail.Address{User: "bob+lists", Host: "example.com"})
+	e.PushRcpt(mail.Address{User: "bob", Host: "example.com"})
+	e.PushRcpt(mail.Address{User: "..", Host: "example.com"})
+	e.DeliveryHeader = "Delivered-To: bob@example.com\n"
+	e.Data.WriteString("Subject: Test\n\nThis is a test.")
+
+	result := gateway.Process(e)
+	if result.Code() != 550 {
+		t.Error("expecting 550, since the .. recipient failed, got", result)
+	}
+	rr, ok := result.(*RcptResults)
+	if !ok || len(rr.Rcpts) != 4 {
+		t.Fatal("expecting a result for each recipient, got", result)
+	}
+	for i := 0; i < 3; i++ {
+		if rr.Rcpts[i].Status != RcptDelivered {
+			t.Errorf("expecting %s to be delivered, got %s", rr.Rcpts[i].Rcpt.String(), rr.Rcpts[i].Status)
+		}
+	}
+	if rr.Rcpts[3].Status != RcptFailed || rr.Rcpts[3].Result.Code() != 550 {
+		t.Error("expecting the .. recipient to fail, got", rr.Rcpts[3].Status, rr.Rcpts[3].Result)
+	}
+
+	inbox := filepath.Join(dir, "example.com", "bob", "Maildir")
+	expect := "Delivered-To: bob@example.com\nSubject: Test\n\nThis is a test."
+	// Bob and bob share the inbox, so there's one copy
+	if files := maildirFiles(t, inbox, "new"); len(files) != 1 || files[0] != expect {
+		t.Error("expecting one email in the inbox, got", files)
+	}
+	if files := maildirFiles(t, filepath.Join(inbox, ".lists"), "new"); len(files) != 1 || files[0] != expect {
+		t.Error("expecting one email in the lists folder, got", files)
+	}
+	for _, sub := range []string{"tmp", "cur"} {
+		if files := maildirFiles(t, inbox, sub); len(files) != 0 {
+			t.Errorf("expecting nothing in %s, got %v", sub, files)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(inbox, ".lists", "maildirfolder")); err != nil {
+		t.Error("expecting the lists folder to be marked as a Maildir++ folder", err)
+	}
+}
+
+func TestMaildirErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	// the Maildir cannot be made under a file
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := BackendConfig{
+		"save_process": "Maildir",
+		"maildir_path": filepath.Join(file, "{user}"),
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "bob", Host: "example.com"})
+	e.Data.WriteString("Subject: Test\n\nThis is a test.")
+	if result := gateway.Process(e); result.Code() != 451 {
+		t.Error("expecting the recipient to be deferred, got", result)
+	}
+
+	for err, code := range map[error]int{
+		&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}: 452,
+		&os.PathError{Op: "write", Path: "x", Err: syscall.EDQUOT}: 452,
+		errRcptPath: 550,
+	} {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.PushRcpt(mail.Address{User: "bob", Host: "example.com"})
+		markDeliveryError(e, e.RcptTo[0], err)
+		if statuses := RcptStatuses(e); len(statuses) != 1 || statuses[0].Result.Code() != code {
+			t.Errorf("expecting %d for %s, got %v", code, err, statuses)
+		}
+	}
+}
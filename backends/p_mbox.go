@@ -0,0 +1,468 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: mbox
+// ----------------------------------------------------------------------------------
+// Description   : Appends the email to the mbox file of each recipient, in the
+//               : mboxrd format
+// ----------------------------------------------------------------------------------
+// Config Options: mbox_path string - path of the mbox file for a recipient, where
+//               : {user} and {domain} are replaced with the recipient's local part
+//               : and domain, in lower case, eg. /var/mail/{domain}/{user}
+//               : mbox_locking string - the locks to take, fcntl and dotlock
+//               : separated by a comma, or none. default "fcntl,dotlock", or
+//               : "dotlock" where fcntl is not supported
+//               : mbox_lock_timeout string - how long to wait for the locks,
+//               : default "10s"
+//               : mbox_rotate_size int - when the file is at least this many bytes,
+//               : it's renamed with the time added to the name, and a new one is
+//               : started. 0 never renames it
+//               : mbox_detail_delimiter string - separates the user from the
+//               : detail, which is removed. default "+"
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.DeliveryHeader, e.Data
+// ----------------------------------------------------------------------------------
+// Output        : Each recipient is marked with MarkRcptDelivered, MarkRcptDeferred if
+//               : the file could not be locked or written, or MarkRcptFailed if the
+//               : recipient cannot be a path name
+// ----------------------------------------------------------------------------------
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "mbox",
+		Description: "Appends the email to the mbox file of each recipient",
+		Options:     ConfigOptions(&MboxProcessorConfig{}),
+	})
+	processors["mbox"] = func() Decorator {
+		return Mbox()
+	}
+}
+
+type MboxProcessorConfig struct {
+	Path            string `json:"mbox_path" desc:"Path of the mbox file, {user} and {domain} are replaced with the recipient's"`
+	Locking         string `json:"mbox_locking,omitempty" default:"fcntl,dotlock" desc:"Locks to take, fcntl and dotlock separated by a comma, or none"`
+	LockTimeout     string `json:"mbox_lock_timeout,omitempty" default:"10s" desc:"How long to wait for the locks"`
+	RotateSize      int    `json:"mbox_rotate_size,omitempty" desc:"Start a new file when it's at least this many bytes, 0 never does"`
+	DetailDelimiter string `json:"mbox_detail_delimiter,omitempty" default:"+" desc:"Separates the user from the detail, which is removed"`
+}
+
+// mboxFromLine starts the line that separates the messages
+var mboxFromLine = []byte("From ")
+
+// errNoFcntl is returned when fcntl locks are not supported on the platform
+var errNoFcntl = errors.New("fcntl locks are not supported on your OS/platform")
+
+// errMboxLocked is returned when the locks could not be taken before the timeout
+var errMboxLocked = errors.New("timed out waiting for the mbox lock")
+
+const (
+	// mboxDateFormat is the date of the From line, like asctime
+	mboxDateFormat = "Mon Jan _2 15:04:05 2006"
+	// mboxStaleLock is the age of a dotlock that another process forgot to remove
+	mboxStaleLock = time.Minute * 5
+	// mboxLockRetry is how long to wait before trying to take a lock again
+	mboxLockRetry = time.Millisecond * 100
+)
+
+// mboxPathLock keeps the workers of this process from writing to the same mbox file at the same time.
+// The fcntl lock can't do it, since it's held by the process, not the goroutine
+type mboxPathLock struct {
+	// held has a value while the lock is taken
+	held chan struct{}
+	// refs is the number of goroutines that have the lock or are waiting for it
+	refs int
+}
+
+var (
+	// mboxPathLocks has the locks of the mbox files being delivered to, by path
+	mboxPathLocks      = make(map[string]*mboxPathLock)
+	mboxPathLocksGuard sync.Mutex
+)
+
+// lockPath takes the in-process lock of the mbox file at path, waiting until the deadline.
+// It returns a function that releases it
+func lockPath(path string, deadline time.Time) (unlock func(), err error) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	mboxPathLocksGuard.Lock()
+	l, ok := mboxPathLocks[path]
+	if !ok {
+		l = &mboxPathLock{held: make(chan struct{}, 1)}
+		mboxPathLocks[path] = l
+	}
+	l.refs++
+	mboxPathLocksGuard.Unlock()
+	release := func() {
+		mboxPathLocksGuard.Lock()
+		defer mboxPathLocksGuard.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(mboxPathLocks, path)
+		}
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case l.held <- struct{}{}:
+		return func() {
+			<-l.held
+			release()
+		}, nil
+	case <-timer.C:
+		release()
+		return nil, errMboxLocked
+	}
+}
+
+// mbox delivers to the mbox files made from a path template
+type mbox struct {
+	config  *MboxProcessorConfig
+	timeout time.Duration
+	fcntl   bool
+	dotlock bool
+}
+
+// mboxFile is an mbox file that's open and locked
+type mboxFile struct {
+	*os.File
+	path    string
+	fcntl   bool
+	dotlock bool
+}
+
+// configure checks config and sets up m
+func (m *mbox) configure(config *MboxProcessorConfig) error {
+	if config.Locking == "" {
+		config.Locking = "dotlock"
+		if fcntlSupported {
+			config.Locking = "fcntl,dotlock"
+		}
+	}
+	if config.LockTimeout == "" {
+		config.LockTimeout = "10s"
+	}
+	timeout, err := time.ParseDuration(config.LockTimeout)
+	if err != nil {
+		return fmt.Errorf("mbox_lock_timeout [%s] is not a duration: %s", config.LockTimeout, err)
+	}
+	m.fcntl, m.dotlock = false, false
+	for _, lock := range strings.Split(config.Locking, ",") {
+		switch strings.TrimSpace(lock) {
+		case "fcntl":
+			if !fcntlSupported {
+				return errNoFcntl
+			}
+			m.fcntl = true
+		case "dotlock":
+			m.dotlock = true
+		case "none":
+		default:
+			return fmt.Errorf("mbox_locking [%s] can only have fcntl, dotlock or none", config.Locking)
+		}
+	}
+	m.config, m.timeout = config, timeout
+	return nil
+}
+
+// open opens the mbox file at path for appending, making it if it doesn't exist, and locks it
+func (m *mbox) open(path string, deadline time.Time) (*mboxFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	mf := &mboxFile{path: path}
+	if m.dotlock {
+		if err := waitForLock(deadline, func() (bool, error) { return dotlock(path) }); err != nil {
+			return nil, err
+		}
+		mf.dotlock = true
+	}
+	if err := mf.openLocked(m.fcntl, deadline); err != nil {
+		_ = mf.close()
+		return nil, err
+	}
+	if m.config.RotateSize > 0 {
+		if err := mf.rotate(int64(m.config.RotateSize), deadline); err != nil {
+			_ = mf.close()
+			return nil, err
+		}
+	}
+	return mf, nil
+}
+
+// openLocked opens the file, and takes the fcntl lock if fcntl is true
+func (mf *mboxFile) openLocked(fcntl bool, deadline time.Time) error {
+	f, err := os.OpenFile(mf.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	mf.File = f
+	if fcntl {
+		if err := waitForLock(deadline, func() (bool, error) { return fcntlLock(f) }); err != nil {
+			return err
+		}
+		mf.fcntl = true
+	}
+	return nil
+}
+
+// rotate renames the file if it's at least size bytes, and opens a new one.
+// The dotlock, if taken, is for the path so it's kept
+func (mf *mboxFile) rotate(size int64, deadline time.Time) error {
+	info, err := mf.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < size {
+		return nil
+	}
+	name := mf.path + "." + time.Now().Format("20060102-150405")
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s.%s-%d", mf.path, time.Now().Format("20060102-150405"), i)
+	}
+	if err = os.Rename(mf.path, name); err != nil {
+		return err
+	}
+	Log().Infof("rotated mbox %s to %s", mf.path, name)
+	fcntl := mf.fcntl
+	if err = mf.unlock(); err != nil {
+		return err
+	}
+	return mf.openLocked(fcntl, deadline)
+}
+
+// unlock releases the fcntl lock and closes the file
+func (mf *mboxFile) unlock() error {
+	if mf.File == nil {
+		return nil
+	}
+	var errs Errors
+	if mf.fcntl {
+		if err := fcntlUnlock(mf.File); err != nil {
+			errs = append(errs, err)
+		}
+		mf.fcntl = false
+	}
+	if err := mf.File.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	mf.File = nil
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// close unlocks and closes the file, then removes the dotlock
+func (mf *mboxFile) close() error {
+	var errs Errors
+	if err := mf.unlock(); err != nil {
+		errs = append(errs, err)
+	}
+	if mf.dotlock {
+		if err := os.Remove(mf.path + ".lock"); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+		mf.dotlock = false
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// waitForLock calls try until it gets the lock, or returns errMboxLocked after the deadline
+func waitForLock(deadline time.Time, try func() (bool, error)) error {
+	for {
+		ok, err := try()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errMboxLocked
+		}
+		time.Sleep(mboxLockRetry)
+	}
+}
+
+// dotlock tries to make path.lock, the lock used by mail tools that don't trust fcntl, eg. over NFS.
+// Returns false if another process has it. A lock older than mboxStaleLock is removed
+func dotlock(path string) (bool, error) {
+	lock := path + ".lock"
+	f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(lock)
+			return false, err
+		}
+		return true, nil
+	}
+	if !os.IsExist(err) {
+		return false, err
+	}
+	if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > mboxStaleLock {
+		Log().Warnf("removing stale mbox lock %s", lock)
+		_ = os.Remove(lock)
+	}
+	return false, nil
+}
+
+// append writes the email to the end of the file and syncs it.
+// If that fails, the file is truncated to where it was, so that there's no partial message
+func (mf *mboxFile) append(e *mail.Envelope) error {
+	info, err := mf.Stat()
+	if err != nil {
+		return err
+	}
+	if err = writeMboxrd(mf.File, e.MailFrom, time.Now(), e.NewReader()); err == nil {
+		err = mf.Sync()
+	}
+	if err != nil {
+		if truncErr := mf.Truncate(info.Size()); truncErr != nil {
+			Log().WithError(truncErr).Errorf("could not remove the partial message from %s", mf.path)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeMboxrd writes the message in r to w in the mboxrd format: a From line with the sender and t, then
+// the message with CRLF changed to LF, and a > added to lines that start with From after any >'s,
+// then an empty line
+func writeMboxrd(w io.Writer, from mail.Address, t time.Time, r io.Reader) error {
+	sender := "MAILER-DAEMON"
+	if !from.IsEmpty() {
+		sender = strings.Join(strings.Fields(from.String()), "_")
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "%s%s %s\n", mboxFromLine, sender, t.Format(mboxDateFormat)); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	startOfLine, endsWithLF := true, true
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			if startOfLine && bytes.HasPrefix(bytes.TrimLeft(line, ">"), mboxFromLine) {
+				if err := bw.WriteByte('>'); err != nil {
+					return err
+				}
+			}
+			// a long line is read in parts, only the first part is at the start of a line
+			startOfLine = line[len(line)-1] == '\n'
+			if bytes.HasSuffix(line, []byte("\r\n")) {
+				line = append(line[:len(line)-2], '\n')
+			}
+			if _, err := bw.Write(line); err != nil {
+				return err
+			}
+			endsWithLF = startOfLine
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+	if !endsWithLF {
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	if err := bw.WriteByte('\n'); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// deliver appends the email to the mbox file at path. The other workers wait until it's done,
+// then the other processes wait for the fcntl lock and dotlock
+func (m *mbox) deliver(path string, e *mail.Envelope) error {
+	deadline := time.Now().Add(m.timeout)
+	unlock, err := lockPath(path, deadline)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	mf, err := m.open(path, deadline)
+	if err != nil {
+		return err
+	}
+	err = mf.append(e)
+	if closeErr := mf.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Mbox appends the email to an mbox file for each recipient. Recipients that share a file get one copy
+func Mbox() Decorator {
+	m := &mbox{}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MboxProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*MboxProcessorConfig)
+		if _, ok := backendConfig["mbox_detail_delimiter"]; !ok {
+			config.DetailDelimiter = "+"
+		}
+		return m.configure(config)
+	}))
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			tracker := trackRcpts(e)
+			// the result of each file that was delivered to
+			delivered := make(map[string]error)
+			for _, rcpt := range e.RcptTo {
+				if tracker.dropped(rcpt) {
+					// an earlier processor deferred or failed it
+					continue
+				}
+				path, _, err := rcptPath(m.config.Path, rcpt, m.config.DetailDelimiter)
+				if err == nil {
+					var ok bool
+					if err, ok = delivered[path]; !ok {
+						err = m.deliver(path, e)
+						delivered[path] = err
+					}
+				}
+				if err != nil {
+					Log().WithError(err).Errorf("could not deliver %s to the mbox of <%s>", e.QueuedId, rcpt.String())
+					markDeliveryError(e, rcpt, err)
+					continue
+				}
+				MarkRcptDelivered(e, rcpt)
+			}
+			return p.Process(e, task)
+		})
+	}
+}
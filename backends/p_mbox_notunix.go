@@ -0,0 +1,23 @@
+// +build !darwin
+// +build !dragonfly
+// +build !freebsd
+// +build !linux
+// +build !netbsd
+// +build !openbsd
+
+package backends
+
+import "os"
+
+// fcntlSupported is true if fcntlLock can lock files on this platform
+const fcntlSupported = false
+
+// fcntlLock is not supported, use a dotlock
+func fcntlLock(f *os.File) (bool, error) {
+	return false, errNoFcntl
+}
+
+// fcntlUnlock is not supported
+func fcntlUnlock(f *os.File) error {
+	return errNoFcntl
+}
@@ -0,0 +1,219 @@
+package backends
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+func TestWriteMboxrd(t *testing.T) {
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var b bytes.Buffer
+	data := "Subject: Test\r\n\r\nFrom here\r\n>From there\r\n From the start\r\nno newline"
+	if err := writeMboxrd(&b, mail.Address{User: "test", Host: "example.com"}, when, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	expect := "From test@example.com Thu Jan  2 03:04:05 2020\n" +
+		"Subject: Test\n\n>From here\n>>From there\n From the start\nno newline\n\n"
+	if b.String() != expect {
+		t.Errorf("expecting\n%q\ngot\n%q", expect, b.String())
+	}
+
+	b.Reset()
+	if err := writeMboxrd(&b, mail.Address{NullPath: true}, when, strings.NewReader("a\n")); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "From MAILER-DAEMON Thu Jan  2 03:04:05 2020\na\n\n" {
+		t.Errorf("expecting MAILER-DAEMON for the null sender, got %q", b.String())
+	}
+}
+
+func TestMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	c := BackendConfig{
+		"save_process":      "Mbox",
+		"mbox_path":         filepath.Join(dir, "{domain}", "{user}"),
+		"mbox_lock_timeout": "300ms",
+		"mbox_rotate_size":  100,
+	}
+	if fcntlSupported {
+		c["mbox_locking"] = "fcntl,dotlock"
+	} else {
+		c["mbox_locking"] = "dotlock"
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	newEnvelope := func(rcpts ...string) *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = "abc123"
+		e.MailFrom = mail.Address{User: "sender", Host: "example.org"}
+		for _, rcpt := range rcpts {
+			pos := strings.Index(rcpt, "@")
+			e.PushRcpt(mail.Address{User: rcpt[:pos], Host: rcpt[pos+1:]})
+		}
+		e.DeliveryHeader = "Delivered-To: bob@example.com\n"
+		e.Data.WriteString("Subject: Test\n\nFrom me.")
+		return e
+	}
+
+	// bob and bob+lists share the file, so there's one copy
+	result := gateway.Process(newEnvelope("bob@example.com", "bob+lists@example.com", "alice@example.com"))
+	if result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+	file := filepath.Join(dir, "example.com", "bob")
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(b), "\nFrom ") != 0 || !strings.HasPrefix(string(b), "From sender@example.org ") ||
+		!strings.HasSuffix(string(b), "\nDelivered-To: bob@example.com\nSubject: Test\n\n>From me.\n\n") {
+		t.Errorf("expecting one message, got %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com", "alice")); err != nil {
+		t.Error("expecting alice's mbox", err)
+	}
+	if _, err := os.Stat(file + ".lock"); !os.IsNotExist(err) {
+		t.Error("expecting the dotlock to be removed", err)
+	}
+
+	// the file is over 100 bytes, so it's rotated
+	gateway.Process(newEnvelope("bob@example.com"))
+	if matches, _ := filepath.Glob(file + ".*"); len(matches) != 1 {
+		t.Error("expecting the mbox to be rotated, got", matches)
+	}
+	if b, _ = ioutil.ReadFile(file); strings.Count(string(b), "From ") != 2 {
+		t.Errorf("expecting one message in the new mbox, got %q", b)
+	}
+
+	// another tool has the lock, so the recipient is deferred
+	if err := ioutil.WriteFile(file+".lock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	result = gateway.Process(newEnvelope("bob@example.com", "alice@example.com"))
+	rr, ok := result.(*RcptResults)
+	if !ok || len(rr.Rcpts) != 2 {
+		t.Fatal("expecting a result for each recipient, got", result)
+	}
+	if rr.Rcpts[0].Status != RcptDeferred || rr.Rcpts[0].Result.Code() != 451 {
+		t.Error("expecting bob to be deferred, got", rr.Rcpts[0].Status, rr.Rcpts[0].Result)
+	}
+	if rr.Rcpts[1].Status != RcptDelivered {
+		t.Error("expecting alice to be delivered, got", rr.Rcpts[1].Status)
+	}
+	if _, err := os.Stat(file + ".lock"); err != nil {
+		t.Error("expecting the other tool's dotlock to be kept", err)
+	}
+}
+
+func TestMboxPathLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	// without the locks of other processes, the workers still take turns
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "Mbox",
+		"save_workers_size": 2,
+		"mbox_path":         filepath.Join(dir, "{user}"),
+		"mbox_locking":      "none",
+		"mbox_lock_timeout": "100ms",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+	process := func() Result {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.MailFrom = mail.Address{User: "sender", Host: "example.org"}
+		e.PushRcpt(mail.Address{User: "bob", Host: "example.com"})
+		e.Data.WriteString("Subject: Test\n\nThis is a test.")
+		return gateway.Process(e)
+	}
+
+	// another worker is writing to bob's mbox
+	unlock, err := lockPath(filepath.Join(dir, "bob"), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := process(); result.Code() != 451 {
+		t.Error("expecting bob to be deferred while the mbox is in use, got", result)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if result := process(); result.Code() != 250 {
+			t.Error("expecting bob to be delivered once the mbox is free, got", result)
+		}
+	}()
+	time.Sleep(time.Millisecond * 20)
+	unlock()
+	wg.Wait()
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "bob")); strings.Count(string(b), "From sender@example.org ") != 1 {
+		t.Errorf("expecting one message, got %q", b)
+	}
+	mboxPathLocksGuard.Lock()
+	defer mboxPathLocksGuard.Unlock()
+	if len(mboxPathLocks) != 0 {
+		t.Error("expecting the locks to be removed once they are released, got", mboxPathLocks)
+	}
+}
+
+func TestMboxConfig(t *testing.T) {
+	for _, config := range []*MboxProcessorConfig{
+		{Locking: "flock"},
+		{LockTimeout: "10"},
+	} {
+		m := &mbox{}
+		if err := m.configure(config); err == nil {
+			t.Errorf("expecting an error for %+v", config)
+		}
+	}
+	m := &mbox{}
+	if err := m.configure(&MboxProcessorConfig{Locking: "none"}); err != nil || m.fcntl || m.dotlock {
+		t.Error("expecting no locks, got", m.fcntl, m.dotlock, err)
+	}
+	if err := m.configure(&MboxProcessorConfig{}); err != nil || m.fcntl != fcntlSupported || !m.dotlock {
+		t.Error("expecting the default locks, got", m.fcntl, m.dotlock, err)
+	}
+}
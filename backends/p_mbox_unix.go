@@ -0,0 +1,28 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package backends
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// fcntlSupported is true if fcntlLock can lock files on this platform
+const fcntlSupported = true
+
+// fcntlLock tries to take a write lock on f, like other mail tools do. Returns false if another process has it
+func fcntlLock(f *os.File) (bool, error) {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// fcntlUnlock releases the lock taken by fcntlLock
+func fcntlUnlock(f *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_UNLCK, Whence: io.SeekStart}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+}
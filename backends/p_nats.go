@@ -0,0 +1,137 @@
+package backends
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: nats
+// ----------------------------------------------------------------------------------
+// Description   : Publishes the envelope and the email to NATS, or to a JetStream
+//               : stream
+// ----------------------------------------------------------------------------------
+// Config Options: nats_url string - the server, or a comma separated list of them,
+//               : default "nats://127.0.0.1:4222"
+//               : nats_credentials string - path of a credentials file
+//               : nats_jetstream bool - publish to JetStream, and wait for it to
+//               : acknowledge that it stored the message. Otherwise, it waits
+//               : for the server to get it
+//               : nats_subject string - where {queued_id}, {rcpt}, {rcpt_user},
+//               : {rcpt_domain} and {mail_from_domain} are replaced, default "mail"
+//               : nats_payload string - inline, the email is published with the
+//               : envelope, or reference, for when an earlier processor stored
+//               : the email, such as S3. default inline
+//               : nats_pool_size int - connections to keep, default 4
+//               : nats_timeout string - how long to wait, default "10s"
+// --------------:-------------------------------------------------------------------
+// Input         : the envelope, e.Data, e.Values
+// ----------------------------------------------------------------------------------
+// Output        : Recipients are marked with MarkRcptDeferred if publishing fails
+// ----------------------------------------------------------------------------------
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "nats",
+		Description: "Publishes the email to NATS or JetStream",
+		Options:     ConfigOptions(&NATSProcessorConfig{}),
+	})
+	contextProcessors["nats"] = func() ContextDecorator {
+		return NATS()
+	}
+}
+
+type NATSProcessorConfig struct {
+	URL         string `json:"nats_url,omitempty" default:"nats://127.0.0.1:4222" desc:"The server, or a comma separated list of them"`
+	Credentials string `json:"nats_credentials,omitempty" desc:"Path of a credentials file"`
+	JetStream   bool   `json:"nats_jetstream,omitempty" desc:"Publish to JetStream, and wait for it to store the message"`
+	Subject     string `json:"nats_subject,omitempty" default:"mail" desc:"Subject to publish to, see the docs for what is replaced"`
+	Payload     string `json:"nats_payload,omitempty" default:"inline" desc:"inline to publish the email, or reference for only the envelope"`
+	PoolSize    int    `json:"nats_pool_size,omitempty" default:"4" desc:"Connections to keep"`
+	Timeout     string `json:"nats_timeout,omitempty" default:"10s" desc:"How long to wait for the server"`
+}
+
+// natsPublisher is a connection to a NATS server
+type natsPublisher struct {
+	conn *nats.Conn
+	// js is set if publishing to JetStream
+	js jetstream.JetStream
+}
+
+func (n *natsPublisher) Publish(ctx context.Context, subject string, msg *PublishMessage) error {
+	m := nats.NewMsg(subject)
+	m.Data = msg.Body
+	for k, v := range msg.Headers {
+		m.Header.Set(k, v)
+	}
+	if n.js != nil {
+		// JetStream drops a message with the same id as one that it already has
+		ack, err := n.js.PublishMsg(ctx, m, jetstream.WithMsgID(msg.ID))
+		var jsErr jetstream.JetStreamError
+		if errors.As(err, &jsErr) {
+			// such as when there's no stream for the subject
+			return PublishRejected{err}
+		}
+		if err != nil {
+			return err
+		}
+		if ack.Duplicate {
+			// it was published before, such as when the ack of an earlier try was lost
+			Log().Infof("stream %s already has message %s of %s, it was not stored again",
+				ack.Stream, msg.ID, msg.Headers["Queued-Id"])
+		}
+		return nil
+	}
+	if err := n.conn.PublishMsg(m); err != nil {
+		return err
+	}
+	// core NATS doesn't acknowledge, but after the flush, the server has it
+	return n.conn.FlushWithContext(ctx)
+}
+
+func (n *natsPublisher) Close() error {
+	n.conn.Close()
+	return nil
+}
+
+// NATS publishes each email to NATS. The connections reconnect by themselves, and are replaced
+// if they fail
+func NATS() ContextDecorator {
+	return PublishWith("nats", func(backendConfig BackendConfig) (*PublishConfig, PublishDialer, error) {
+		configType := BaseConfig(&NATSProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return nil, nil, err
+		}
+		config := bcfg.(*NATSProcessorConfig)
+		if config.URL == "" {
+			config.URL = nats.DefaultURL
+		}
+		options := []nats.Option{nats.Name("guerrillad")}
+		if config.Credentials != "" {
+			options = append(options, nats.UserCredentials(config.Credentials))
+		}
+		dial := func() (Publisher, error) {
+			conn, err := nats.Connect(config.URL, options...)
+			if err != nil {
+				return nil, err
+			}
+			n := &natsPublisher{conn: conn}
+			if config.JetStream {
+				if n.js, err = jetstream.New(conn); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return n, nil
+		}
+		return &PublishConfig{
+			Subject:  config.Subject,
+			Payload:  config.Payload,
+			PoolSize: config.PoolSize,
+			Timeout:  config.Timeout,
+		}, dial, nil
+	})
+}
@@ -0,0 +1,184 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// runNATSServer starts an embedded NATS server, with JetStream
+func runNATSServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	return s
+}
+
+func TestNATS(t *testing.T) {
+	s := runNATSServer(t)
+	defer s.Shutdown()
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: "MAIL", Subjects: []string{"mail.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := BackendConfig{
+		"save_process":   "HeadersParser|NATS",
+		"nats_url":       s.ClientURL(),
+		"nats_jetstream": true,
+		"nats_subject":   "mail.{rcpt_domain}",
+		"nats_timeout":   "2s",
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// there is no stream for nostream.com
+	e := newSpoolTestEnvelope()
+	e.RcptTo = []mail.Address{{User: "alice", Host: "example.com"}, {User: "bob", Host: "nostream.com"}}
+	result := gateway.Process(e)
+	if result.Code() != 451 {
+		t.Error("expecting 451 for the deferred recipient, got", result)
+	}
+	if rr, ok := result.(*RcptResults); !ok || rr.Rcpts[1].Status != RcptDeferred {
+		t.Error("expecting bob to be deferred, got", result)
+	}
+	// publishing it again is a duplicate, which JetStream drops
+	e.RcptTo = e.RcptTo[:1]
+	delete(e.Values, rcptStatusKey)
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting 250 for the duplicate, got", result)
+	}
+	// the next email of the connection has the same queued id, but it's not a duplicate
+	next := newSpoolTestEnvelope()
+	next.RcptTo = e.RcptTo
+	next.Data.Reset()
+	next.Data.WriteString("Subject: Test\n\nThis is another test.")
+	if result := gateway.Process(next); result.Code() != 250 {
+		t.Error("expecting 250 for the next email, got", result)
+	}
+
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 2 {
+		t.Error("expecting two messages in the stream, got", info.State.Msgs)
+	}
+	msg, err := stream.GetMsg(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := publishID(e, e.RcptTo)
+	if msg.Header.Get("Queued-Id") != "abc12345" || msg.Header.Get(jetstream.MsgIDHeader) != id {
+		t.Error("expecting the queued id and message id in the headers, got", msg.Header)
+	}
+	published := &PublishedEmail{}
+	if err := json.Unmarshal(msg.Data, published); err != nil {
+		t.Fatal(err)
+	}
+	if len(published.RcptTo) != 1 || published.RcptTo[0].User != "alice" || string(published.Data) != "Subject: Test\n\nThis is a test." {
+		t.Errorf("expecting the email to alice, got %+v", published)
+	}
+}
+
+func TestNATSCore(t *testing.T) {
+	s := runNATSServer(t)
+	defer s.Shutdown()
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	sub, err := nc.SubscribeSync("inbound.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := BackendConfig{
+		"save_process":   "HeadersParser|NATS",
+		"nats_url":       s.ClientURL(),
+		"nats_subject":   "inbound.{rcpt_domain}",
+		"nats_payload":   "reference",
+		"nats_pool_size": 1,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	e := newSpoolTestEnvelope()
+	e.Values[s3KeyValue] = "2020/01/02/abc12345"
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := &PublishedEmail{}
+	if err := json.Unmarshal(msg.Data, published); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "inbound.example.com" || published.Data != nil || published.Values[s3KeyValue] != "2020/01/02/abc12345" {
+		t.Errorf("expecting only the reference to the email, got %s %+v", msg.Subject, published)
+	}
+}
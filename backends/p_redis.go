@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/karngyan/go-guerrilla/mail"
@@ -16,45 +17,63 @@ import (
 // ----------------------------------------------------------------------------------
 // Config Options: redis_expire_seconds int - how many seconds to expiry
 //               : redis_interface string - <host>:<port> eg, 127.0.0.1:6379
+//               : redis_max_idle int - idle connections to keep, default 10
+//               : redis_max_active int - connections open at once, default 0,
+//               : which is no limit
+//               : redis_idle_timeout string - how long until an idle connection
+//               : is closed, default "240s"
+//               : and the options of RedisConnectionConfig, for AUTH, TLS,
+//               : sentinel and cluster
 // --------------:-------------------------------------------------------------------
 // Input         : e.Data
 //               : e.DeliveryHeader generated by Header() processor
 //               :
 // ----------------------------------------------------------------------------------
 // Output        : Sets e.QueuedId with the first item fromHashes[0]
+//               : The command is cancelled if the save times out (gw_save_timeout)
 // ----------------------------------------------------------------------------------
 func init() {
 
-	processors["redis"] = func() Decorator {
-		return Redis()
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "redis",
+		Description: "Saves the email in redis",
+		Options:     redisConfigOptions(&RedisProcessorConfig{}),
+	})
+	contextProcessors["redis"] = func() ContextDecorator {
+		return RedisContext()
 	}
 }
 
 type RedisProcessorConfig struct {
-	RedisExpireSeconds int    `json:"redis_expire_seconds"`
-	RedisInterface     string `json:"redis_interface"`
+	RedisExpireSeconds int    `json:"redis_expire_seconds" desc:"How many seconds until the email expires"`
+	RedisInterface     string `json:"redis_interface" desc:"The redis server, <host>:<port>, or the cluster nodes, comma separated"`
+	RedisMaxIdle       int    `json:"redis_max_idle,omitempty" default:"10" desc:"Idle connections to keep"`
+	RedisMaxActive     int    `json:"redis_max_active,omitempty" default:"0" desc:"Connections open at once, 0 for no limit"`
+	RedisIdleTimeout   string `json:"redis_idle_timeout,omitempty" default:"240s" desc:"How long until an idle connection is closed"`
 }
 
+// RedisProcessor has the connections to redis, which are shared by the workers
 type RedisProcessor struct {
-	isConnected bool
-	conn        RedisConn
+	pool RedisPool
 }
 
-func (r *RedisProcessor) redisConnection(redisInterface string) (err error) {
-	if r.isConnected == false {
-		r.conn, err = RedisDialer("tcp", redisInterface)
-		if err != nil {
-			// handle error
-			return err
-		}
-		r.isConnected = true
+func (r *RedisProcessor) connect(backendConfig BackendConfig, config *RedisProcessorConfig) (err error) {
+	poolConfig, err := redisPoolConfig(backendConfig, config.RedisMaxIdle, config.RedisMaxActive, config.RedisIdleTimeout)
+	if err != nil {
+		return err
 	}
-	return nil
+	r.pool, err = newRedisPool(backendConfig, config.RedisInterface, poolConfig)
+	return err
 }
 
 // The redis decorator stores the email data in redis
 
 func Redis() Decorator {
+	return AsDecorator(RedisContext())
+}
+
+// RedisContext is Redis, where the commands are cancelled when the task's deadline passes
+func RedisContext() ContextDecorator {
 
 	var config *RedisProcessorConfig
 	redisClient := &RedisProcessor{}
@@ -66,24 +85,18 @@ func Redis() Decorator {
 			return err
 		}
 		config = bcfg.(*RedisProcessorConfig)
-		if redisErr := redisClient.redisConnection(config.RedisInterface); redisErr != nil {
-			err := fmt.Errorf("redis cannot connect, check your settings: %s", redisErr)
-			return err
-		}
-		return nil
+		return redisClient.connect(backendConfig, config)
 	}))
 	// When shutting down
 	Svc.AddShutdowner(ShutdownWith(func() error {
-		if redisClient.isConnected {
-			return redisClient.conn.Close()
+		if redisClient.pool != nil {
+			return redisClient.pool.Close()
 		}
 		return nil
 	}))
 
-	var redisErr error
-
-	return func(p Processor) Processor {
-		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+	return func(p ContextProcessor) ContextProcessor {
+		return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
 
 			if task == TaskSaveMail {
 				hash := ""
@@ -97,13 +110,11 @@ func Redis() Decorator {
 					} else {
 						stringer = e
 					}
-					redisErr = redisClient.redisConnection(config.RedisInterface)
-					if redisErr != nil {
-						Log().WithError(redisErr).Warn("Error while connecting to redis")
-						result := NewResult(response.Canned.FailBackendTransaction)
-						return result, redisErr
+					_, doErr := redisPoolDo(ctx, redisClient.pool, "SETEX", hash, config.RedisExpireSeconds, stringer)
+					if doErr != nil && doErr == ctx.Err() {
+						Log().WithError(doErr).Warn("SETEX to redis was cancelled")
+						return NewResult(response.Canned.FailBackendTimeout), doErr
 					}
-					_, doErr := redisClient.conn.Do("SETEX", hash, config.RedisExpireSeconds, stringer)
 					if doErr != nil {
 						Log().WithError(doErr).Warn("Error while SETEX to redis")
 						result := NewResult(response.Canned.FailBackendTransaction)
@@ -116,10 +127,10 @@ func Redis() Decorator {
 					return result, StorageError
 				}
 
-				return p.Process(e, task)
+				return p.ProcessContext(ctx, e, task)
 			} else {
 				// nothing to do for this task
-				return p.Process(e, task)
+				return p.ProcessContext(ctx, e, task)
 			}
 
 		})
@@ -0,0 +1,172 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: redisstream
+// ----------------------------------------------------------------------------------
+// Description   : Adds an entry for the email to a redis stream, so that consumers
+//               : can read the stream as a queue. The entry has the envelope and a
+//               : reference to the body, which was saved by an earlier processor
+// ----------------------------------------------------------------------------------
+// Config Options: redis_interface string - <host>:<port> eg, 127.0.0.1:6379
+//               : redis_stream string - the key of the stream, default "mail"
+//               : redis_stream_maxlen int - the stream is trimmed to about this
+//               : many entries, 0 to not trim. default 100000
+//               : redis_max_idle int - idle connections to keep, default 10
+//               : redis_max_active int - connections open at once, default 0,
+//               : which is no limit
+//               : redis_idle_timeout string - how long until an idle connection
+//               : is closed, default "240s"
+//               : and the options of RedisConnectionConfig, for AUTH, TLS,
+//               : sentinel and cluster
+// --------------:-------------------------------------------------------------------
+// Input         : the envelope, e.Hashes, e.Values
+//               : e.Values["redis"] when the Redis processor saved the body
+// ----------------------------------------------------------------------------------
+// Output        : Sets e.Values["redis_stream_id"] to the id of the entry.
+//               : The fields of the entry are queued_id, mail_from, rcpt_to, remote_ip,
+//               : helo, subject, tls, auth_username, size, hashes, body_key and values.
+//               : body_key is the key the Redis processor saved the body under, and
+//               : values is a JSON object of e.Values, such as eml_path or s3_key
+// ----------------------------------------------------------------------------------
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "redisstream",
+		Description: "Adds the envelope and a reference to the email to a redis stream",
+		Options:     redisConfigOptions(&RedisStreamProcessorConfig{}),
+	})
+	contextProcessors["redisstream"] = func() ContextDecorator {
+		return RedisStream()
+	}
+}
+
+type RedisStreamProcessorConfig struct {
+	RedisInterface   string `json:"redis_interface" desc:"The redis server, <host>:<port>, or the cluster nodes, comma separated"`
+	Stream           string `json:"redis_stream,omitempty" default:"mail" desc:"The key of the stream"`
+	MaxLen           int    `json:"redis_stream_maxlen,omitempty" default:"100000" desc:"Trim the stream to about this many entries, 0 to not trim"`
+	RedisMaxIdle     int    `json:"redis_max_idle,omitempty" default:"10" desc:"Idle connections to keep"`
+	RedisMaxActive   int    `json:"redis_max_active,omitempty" default:"0" desc:"Connections open at once, 0 for no limit"`
+	RedisIdleTimeout string `json:"redis_idle_timeout,omitempty" default:"240s" desc:"How long until an idle connection is closed"`
+}
+
+// redisStreamIDValue is the key of e.Values that has the id of the stream entry
+const redisStreamIDValue = "redis_stream_id"
+
+// redisStreamArgs returns the arguments of XADD for e
+func redisStreamArgs(config *RedisStreamProcessorConfig, e *mail.Envelope) ([]interface{}, error) {
+	args := []interface{}{config.Stream}
+	if config.MaxLen > 0 {
+		// ~ lets redis trim whole nodes, which is much cheaper
+		args = append(args, "MAXLEN", "~", config.MaxLen)
+	}
+	var rcpts []string
+	tracker := trackRcpts(e)
+	for _, rcpt := range e.RcptTo {
+		if !tracker.dropped(rcpt) {
+			rcpts = append(rcpts, rcpt.String())
+		}
+	}
+	args = append(args, "*",
+		"queued_id", e.QueuedId,
+		"mail_from", e.MailFrom.String(),
+		"rcpt_to", strings.Join(rcpts, ","),
+		"remote_ip", e.RemoteIP,
+		"helo", e.Helo,
+		"subject", e.Subject,
+		"tls", strconv.FormatBool(e.TLS),
+		"auth_username", e.Auth.Username,
+		"size", strconv.Itoa(e.Len()),
+		"hashes", strings.Join(e.Hashes, ","),
+	)
+	if _, ok := e.Values["redis"]; ok {
+		// the Redis processor saved the body under the queued id
+		args = append(args, "body_key", e.QueuedId)
+	}
+	if values := emlValues(e.Values); values != nil {
+		b, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "values", string(b))
+	}
+	return args, nil
+}
+
+// RedisStream adds an entry for each email to a redis stream
+func RedisStream() ContextDecorator {
+	var (
+		config *RedisStreamProcessorConfig
+		pool   RedisPool
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&RedisStreamProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*RedisStreamProcessorConfig)
+		if config.Stream == "" {
+			config.Stream = "mail"
+		}
+		if _, ok := backendConfig["redis_stream_maxlen"]; !ok {
+			config.MaxLen = 100000
+		}
+		poolConfig, err := redisPoolConfig(backendConfig, config.RedisMaxIdle, config.RedisMaxActive, config.RedisIdleTimeout)
+		if err != nil {
+			return err
+		}
+		pool, err = newRedisPool(backendConfig, config.RedisInterface, poolConfig)
+		return err
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if pool != nil {
+			return pool.Close()
+		}
+		return nil
+	}))
+
+	return func(p ContextProcessor) ContextProcessor {
+		return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.ProcessContext(ctx, e, task)
+			}
+			args, err := redisStreamArgs(config, e)
+			if err != nil {
+				Log().WithError(err).Error("could not make the redis stream entry")
+				return NewResult(response.Canned.FailBackendTransaction), err
+			}
+			reply, err := redisPoolDo(ctx, pool, "XADD", args...)
+			if err != nil && err == ctx.Err() {
+				Log().WithError(err).Warn("XADD to redis was cancelled")
+				return NewResult(response.Canned.FailBackendTimeout), err
+			}
+			if err != nil {
+				Log().WithError(err).Warn("Error while XADD to redis")
+				return NewResult(response.Canned.FailBackendTransaction), err
+			}
+			switch id := reply.(type) {
+			case []byte:
+				e.Values[redisStreamIDValue] = string(id)
+			case string:
+				e.Values[redisStreamIDValue] = id
+			case nil:
+				// the mock driver
+			default:
+				err = fmt.Errorf("unexpected reply to XADD: %v", reply)
+				Log().WithError(err).Warn("Error while XADD to redis")
+				return NewResult(response.Canned.FailBackendTransaction), err
+			}
+			return p.ProcessContext(ctx, e, task)
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/karngyan/go-guerrilla/log"
+)
+
+// recordingRedisPool records the commands, and how many connections are in use
+type recordingRedisPool struct {
+	sync.Mutex
+	commands [][]interface{}
+	inUse    int
+	closed   bool
+}
+
+type recordingRedisConn struct {
+	pool *recordingRedisPool
+}
+
+func (p *recordingRedisPool) Get(ctx context.Context) (RedisConn, error) {
+	p.Lock()
+	defer p.Unlock()
+	p.inUse++
+	return &recordingRedisConn{pool: p}, nil
+}
+
+func (p *recordingRedisPool) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (c *recordingRedisConn) Close() error {
+	c.pool.Lock()
+	defer c.pool.Unlock()
+	c.pool.inUse--
+	return nil
+}
+
+func (c *recordingRedisConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	c.pool.Lock()
+	defer c.pool.Unlock()
+	c.pool.commands = append(c.pool.commands, append([]interface{}{commandName}, args...))
+	switch commandName {
+	case "XADD":
+		return []byte(fmt.Sprintf("1700000000000-%d", len(c.pool.commands))), nil
+	case "PING":
+		return "PONG", nil
+	}
+	return "OK", nil
+}
+
+func TestRedisStream(t *testing.T) {
+	pool := &recordingRedisPool{}
+	pooler := RedisPooler
+	RedisPooler = func(network, address string, config RedisPoolConfig, options ...RedisDialOption) RedisPool {
+		if config.MaxIdle != 10 || config.MaxActive != 2 {
+			t.Errorf("expecting the pool config, got %+v", config)
+		}
+		return pool
+	}
+	defer func() {
+		RedisPooler = pooler
+	}()
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	c := BackendConfig{
+		"save_process":         "HeadersParser|Hasher|Redis|RedisStream",
+		"redis_interface":      "127.0.0.1:6379",
+		"redis_expire_seconds": 7200,
+		"redis_stream":         "inbound",
+		"redis_stream_maxlen":  1000,
+		"redis_max_active":     2,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+
+	e := newSpoolTestEnvelope()
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error(err)
+	}
+
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.inUse != 0 || !pool.closed {
+		t.Error("expecting the connections to be returned, and the pool closed, in use:", pool.inUse)
+	}
+	var xadd []interface{}
+	for _, cmd := range pool.commands {
+		if cmd[0] == "XADD" {
+			xadd = cmd
+		}
+	}
+	if len(xadd) < 6 {
+		t.Fatal("expecting XADD, got", pool.commands)
+	}
+	if xadd[1] != "inbound" || xadd[2] != "MAXLEN" || xadd[3] != "~" || xadd[4] != 1000 || xadd[5] != "*" {
+		t.Error("expecting XADD inbound MAXLEN ~ 1000 *, got", xadd[:6])
+	}
+	fields := make(map[string]interface{})
+	for i := 6; i+1 < len(xadd); i += 2 {
+		fields[xadd[i].(string)] = xadd[i+1]
+	}
+	if fields["queued_id"] != e.QueuedId || fields["body_key"] != e.QueuedId || e.QueuedId != e.Hashes[0] {
+		t.Error("expecting the body to be referenced by the hash, got", fields)
+	}
+	if fields["rcpt_to"] != "test@example.com" || fields["subject"] != "Test" {
+		t.Error("expecting the envelope, got", fields)
+	}
+	values := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(fields["values"].(string)), &values); err != nil {
+		t.Fatal(err)
+	}
+	if values["redis"] != "redis" {
+		t.Error("expecting the values, got", values)
+	}
+	// after the PINGs of Redis and RedisStream, and the SETEX
+	if e.Values[redisStreamIDValue] != "1700000000000-4" {
+		t.Error("expecting the id of the entry, got", e.Values[redisStreamIDValue])
+	}
+}
+
+func TestRedisStreamNoTrim(t *testing.T) {
+	e := newSpoolTestEnvelope()
+	args, err := redisStreamArgs(&RedisStreamProcessorConfig{Stream: "mail"}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args[0] != "mail" || args[1] != "*" {
+		t.Error("expecting no MAXLEN, got", args[:2])
+	}
+}
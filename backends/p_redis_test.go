@@ -1,10 +1,13 @@
 package backends
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/karngyan/go-guerrilla/log"
 	"github.com/karngyan/go-guerrilla/mail"
@@ -61,3 +64,65 @@ func TestRedisGeneric(t *testing.T) {
 	}
 
 }
+
+// blockingRedisConn blocks in Do until it's closed
+type blockingRedisConn struct {
+	closed chan bool
+}
+
+func (c *blockingRedisConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func (c *blockingRedisConn) Do(commandName string, args ...interface{}) (reply interface{}, err error) {
+	<-c.closed
+	return nil, errors.New("use of closed connection")
+}
+
+func TestRedisDoContext(t *testing.T) {
+	conn := &blockingRedisConn{closed: make(chan bool)}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := redisDoContext(ctx, conn, "SETEX", "key", 10, "value"); err != context.DeadlineExceeded {
+		t.Error("expecting context.DeadlineExceeded, got", err)
+	}
+	// already cancelled, so it shouldn't call Do
+	if _, err := redisDoContext(ctx, new(RedisMockConn), "SETEX", "key", 10, "value"); err != context.DeadlineExceeded {
+		t.Error("expecting context.DeadlineExceeded, got", err)
+	}
+	if _, err := redisDoContext(context.Background(), new(RedisMockConn), "SETEX", "key", 10, "value"); err != nil {
+		t.Error("expecting no error, got", err)
+	}
+}
+
+func TestRedisDialOptions(t *testing.T) {
+	options, err := redisDialOptions(BackendConfig{
+		"redis_username":        "mailer",
+		"redis_password":        "secret",
+		"redis_db":              2,
+		"redis_tls":             true,
+		"redis_sentinel_master": "mymaster",
+		"redis_sentinel_addrs":  "10.0.0.1:26379, 10.0.0.2:26379",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := NewRedisDialOptions(options...)
+	if do.Username != "mailer" || do.Password != "secret" || do.DB != 2 || do.TLSConfig == nil || do.Cluster {
+		t.Errorf("expecting the options, got %+v", do)
+	}
+	if do.SentinelMaster != "mymaster" || len(do.SentinelAddrs) != 2 || do.SentinelAddrs[1] != "10.0.0.2:26379" {
+		t.Error("expecting the sentinels, got", do.SentinelAddrs)
+	}
+	for _, bad := range []BackendConfig{
+		{"redis_cluster": true, "redis_db": 1},
+		{"redis_cluster": true, "redis_sentinel_master": "mymaster", "redis_sentinel_addrs": "10.0.0.1:26379"},
+		{"redis_sentinel_master": "mymaster"},
+		{"redis_tls": true, "redis_tls_ca_file": "/does/not/exist.pem"},
+	} {
+		if _, err := redisDialOptions(bad); err == nil {
+			t.Error("expecting an error for", bad)
+		}
+	}
+}
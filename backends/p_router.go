@@ -0,0 +1,317 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: router
+// ----------------------------------------------------------------------------------
+// Description   : Routes each recipient to its own processor stack, chosen by the
+//               : recipient's domain from a transport table
+// ----------------------------------------------------------------------------------
+// Config Options: router_table string - routes separated by ; where each route is
+//               : pattern=stack, for example:
+//               : example.com=HeadersParser|Hasher|SQL;*=HeadersParser|Debugger
+//               : The pattern is one of
+//               :   example.com    - the domain
+//               :   *.example.com  - any subdomain of example.com
+//               :   /^mx[0-9]+\./  - a regular expression, matched against the domain
+//               :   *              - the default route
+//               : Domains are matched first, then the wildcards, longest first,
+//               : then the regular expressions in the order given, then the default
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo, and anything that the stacks of the routes use
+// ----------------------------------------------------------------------------------
+// Output        : Each recipient is marked with the result of its stack, see
+//               : MarkRcptDelivered. Recipients without a route are marked as failed
+// ----------------------------------------------------------------------------------
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "router",
+		Description: "Routes each recipient to a processor stack for its domain",
+		Options:     ConfigOptions(&RouterProcessorConfig{}),
+	})
+	contextProcessors["router"] = func() ContextDecorator {
+		return Router()
+	}
+}
+
+type RouterProcessorConfig struct {
+	Table string `json:"router_table" desc:"Routes separated by ;, each is pattern=stack"`
+}
+
+// errNoRoute is returned when validating a recipient that has no route
+var errNoRoute = NewRcptError("no route for the recipient's domain", response.Canned.FailNoRoute)
+
+// route is a wildcard or regular expression route of the transport table
+type route struct {
+	pattern string
+	re      *regexp.Regexp
+	stack   string
+}
+
+// transportTable finds the stack for a domain
+type transportTable struct {
+	domains map[string]string
+	// wildcards has the part after the *, eg. ".example.com", longest first
+	wildcards  []route
+	regexps    []route
+	defaultRte string
+}
+
+// parseTransportTable parses the router_table config value
+func parseTransportTable(table string) (*transportTable, error) {
+	t := &transportTable{domains: make(map[string]string)}
+	for _, line := range strings.Split(table, ";") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		// the stack has no =, but a regular expression could
+		pos := strings.LastIndex(line, "=")
+		if pos < 1 {
+			return nil, fmt.Errorf("invalid route [%s], expecting pattern=stack", line)
+		}
+		pattern, stack := strings.TrimSpace(line[:pos]), strings.TrimSpace(line[pos+1:])
+		if stack == "" {
+			return nil, fmt.Errorf("route [%s] has no stack", pattern)
+		}
+		node, err := parseStackConfig(stack)
+		if err != nil {
+			return nil, fmt.Errorf("route [%s] has an invalid stack: %s", pattern, err)
+		}
+		if node.uses("router") {
+			return nil, fmt.Errorf("route [%s] cannot use the router processor", pattern)
+		}
+		switch {
+		case pattern == "*":
+			t.defaultRte = stack
+		case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("route [%s] has an invalid regular expression: %s", pattern, err)
+			}
+			t.regexps = append(t.regexps, route{pattern: pattern, re: re, stack: stack})
+		case strings.HasPrefix(pattern, "*."):
+			t.wildcards = append(t.wildcards, route{pattern: strings.ToLower(pattern[1:]), stack: stack})
+		default:
+			t.domains[strings.ToLower(pattern)] = stack
+		}
+	}
+	sort.SliceStable(t.wildcards, func(i, j int) bool {
+		return len(t.wildcards[i].pattern) > len(t.wildcards[j].pattern)
+	})
+	return t, nil
+}
+
+// lookup returns the stack for domain, ok is false if there's no route
+func (t *transportTable) lookup(domain string) (stack string, ok bool) {
+	domain = strings.ToLower(domain)
+	if stack, ok := t.domains[domain]; ok {
+		return stack, true
+	}
+	for i := range t.wildcards {
+		if strings.HasSuffix(domain, t.wildcards[i].pattern) {
+			return t.wildcards[i].stack, true
+		}
+	}
+	for i := range t.regexps {
+		if t.regexps[i].re.MatchString(domain) {
+			return t.regexps[i].stack, true
+		}
+	}
+	return t.defaultRte, t.defaultRte != ""
+}
+
+// stacks returns each stack used by the table, once
+func (t *transportTable) stacks() []string {
+	seen := make(map[string]bool)
+	var stacks []string
+	add := func(stack string) {
+		if stack != "" && !seen[stack] {
+			seen[stack] = true
+			stacks = append(stacks, stack)
+		}
+	}
+	for _, stack := range t.domains {
+		add(stack)
+	}
+	for i := range t.wildcards {
+		add(t.wildcards[i].stack)
+	}
+	for i := range t.regexps {
+		add(t.regexps[i].stack)
+	}
+	add(t.defaultRte)
+	return stacks
+}
+
+// routeGroup is a group of recipients that go to the same stack
+type routeGroup struct {
+	stack string
+	// index of each recipient in e.RcptTo
+	rcpts []int
+}
+
+// Router sends the recipients of an envelope to a processor stack for their domain.
+// It should be the last processor of the stack, since the processors that come after
+// it see all the recipients again
+func Router() ContextDecorator {
+	var (
+		table  *transportTable
+		stacks map[string]Processor
+		// the initializers and shutdowners of the processors in the stacks
+		scope *processorScope
+		// the retry groups of the stacks use the circuit breakers of the gateway
+		breakers = Svc.scopeBreakers()
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&RouterProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*RouterProcessorConfig)
+		t, err := parseTransportTable(config.Table)
+		if err != nil {
+			return err
+		}
+		made := make(map[string]Processor)
+		s, err := Svc.collect(breakers, func() error {
+			for _, stackConfig := range t.stacks() {
+				p, err := newStack(stackConfig)
+				if err != nil {
+					return err
+				}
+				made[stackConfig] = p
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if errs := s.initialize(backendConfig); errs != nil {
+			// don't leave the ones that were initialized open
+			_ = s.shutdown()
+			return errs
+		}
+		table, stacks, scope = t, made, s
+		return nil
+	}))
+
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if scope == nil {
+			return nil
+		}
+		if errs := scope.shutdown(); errs != nil {
+			return errs
+		}
+		return nil
+	}))
+
+	// runStack runs the stack for a route, passing on ctx
+	runStack := func(ctx context.Context, stack string, e *mail.Envelope, task SelectTask) (Result, error) {
+		if cp, ok := stacks[stack].(ContextProcessor); ok {
+			return cp.ProcessContext(ctx, e, task)
+		}
+		return stacks[stack].Process(e, task)
+	}
+
+	return func(p ContextProcessor) ContextProcessor {
+		return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+			switch task {
+			case TaskValidateRcpt:
+				if len(e.RcptTo) == 0 {
+					break
+				}
+				// the recipient being validated is the last one
+				stack, ok := table.lookup(e.RcptTo[len(e.RcptTo)-1].Host)
+				if !ok {
+					return NewResult(response.Canned.FailNoRoute), errNoRoute
+				}
+				if result, err := runStack(ctx, stack, e, task); err != nil {
+					return result, err
+				}
+			case TaskSaveMail:
+				tracker := trackRcpts(e)
+				var groups []*routeGroup
+				for i := range e.RcptTo {
+					if tracker.dropped(e.RcptTo[i]) {
+						// an earlier processor deferred or failed it
+						continue
+					}
+					stack, ok := table.lookup(e.RcptTo[i].Host)
+					if !ok {
+						MarkRcptFailed(e, e.RcptTo[i], NewResult(response.Canned.FailNoRoute))
+						continue
+					}
+					var group *routeGroup
+					for _, g := range groups {
+						if g.stack == stack {
+							group = g
+							break
+						}
+					}
+					if group == nil {
+						group = &routeGroup{stack: stack}
+						groups = append(groups, group)
+					}
+					group.rcpts = append(group.rcpts, i)
+				}
+				rcpts, hashes := e.RcptTo, e.Hashes
+				values, queuedID, deliveryHeader := e.Values, e.QueuedId, e.DeliveryHeader
+				for _, group := range groups {
+					// each stack starts with the values of the envelope as they were before the router,
+					// so that what one stack sets doesn't leak in to the next
+					e.Values = make(map[string]interface{}, len(values))
+					for k, v := range values {
+						e.Values[k] = v
+					}
+					e.QueuedId, e.DeliveryHeader = queuedID, deliveryHeader
+					// each stack only sees its own recipients, and their hashes if there's one for each
+					e.RcptTo = make([]mail.Address, 0, len(group.rcpts))
+					if len(hashes) == len(rcpts) {
+						e.Hashes = make([]string, 0, len(group.rcpts))
+					}
+					for _, i := range group.rcpts {
+						e.RcptTo = append(e.RcptTo, rcpts[i])
+						if len(hashes) == len(rcpts) {
+							e.Hashes = append(e.Hashes, hashes[i])
+						}
+					}
+					r, err := runStack(ctx, group.stack, e, task)
+					result := saveResult(&notifyMsg{err: err, result: r, queuedID: e.QueuedId})
+					// the stack may have marked its recipients, otherwise they get the result of the stack
+					for _, i := range group.rcpts {
+						if tracker.isMarked(rcpts[i]) {
+							continue
+						}
+						switch code := result.Code(); {
+						case code < 300:
+							MarkRcptDelivered(e, rcpts[i])
+						case code < 500:
+							MarkRcptDeferred(e, rcpts[i], result)
+						default:
+							MarkRcptFailed(e, rcpts[i], result)
+						}
+					}
+					e.RcptTo, e.Hashes = rcpts, hashes
+					e.Values, e.QueuedId, e.DeliveryHeader = values, queuedID, deliveryHeader
+					if ctx.Err() != nil {
+						// timed out, the client was already told
+						return NewResult(response.Canned.FailBackendTimeout), ctx.Err()
+					}
+				}
+			}
+			return p.ProcessContext(ctx, e, task)
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package backends
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+func TestTransportTable(t *testing.T) {
+	table, err := parseTransportTable(
+		"example.com=A; *.example.org=B; *.sub.example.org=C; /^mx[0-9]+\\.test$/=D; *=E")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, expect := range map[string]string{
+		"example.com":         "A",
+		"EXAMPLE.com":         "A",
+		"www.example.com":     "E",
+		"a.example.org":       "B",
+		"a.sub.example.org":   "C",
+		"example.org":         "E",
+		"mx12.test":           "D",
+		"mx.test":             "E",
+		"somewhere-else.test": "E",
+	} {
+		if stack, _ := table.lookup(domain); stack != expect {
+			t.Errorf("expecting %s to route to %s, got %s", domain, expect, stack)
+		}
+	}
+
+	table, _ = parseTransportTable("example.com=A")
+	if _, ok := table.lookup("example.net"); ok {
+		t.Error("expecting no route without a default")
+	}
+	for _, bad := range []string{"example.com", "example.com=", "/[/=A", "*=HeadersParser|Router", "*=(Debugger & Router)"} {
+		if _, err := parseTransportTable(bad); err == nil {
+			t.Errorf("expecting an error for [%s]", bad)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var saved []string
+	Svc.AddProcessor("RouteSaver", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				for _, rcpt := range e.RcptTo {
+					saved = append(saved, rcpt.String())
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	Svc.AddProcessor("RouteFailer", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskValidateRcpt {
+					return NewResult("550 5.1.1 no such user"), NoSuchUser
+				}
+				return NewResult("554 5.3.0 Error: storage failed"), errors.New("storage failed")
+			})
+		}
+	})
+	defer func() {
+		delete(processors, "routesaver")
+		delete(processors, "routefailer")
+	}()
+	c := BackendConfig{
+		"save_process":      "HeadersParser|Router",
+		"validate_process":  "Router",
+		"save_workers_size": 1,
+		"router_table":      "a.com=HeadersParser|RouteSaver; *.b.com=RouteFailer",
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc123"
+	e.PushRcpt(mail.Address{User: "x", Host: "a.com"})
+	e.PushRcpt(mail.Address{User: "y", Host: "mx.b.com"})
+	e.PushRcpt(mail.Address{User: "z", Host: "c.com"})
+	e.Data.WriteString("Subject:Test\n\nThis is a test.")
+
+	if err := gateway.ValidateRcpt(e); err != errNoRoute {
+		t.Error("expecting errNoRoute for z@c.com, got", err)
+	}
+	result := gateway.Process(e)
+	if result.Code() != 554 {
+		t.Error("expecting the 554 of y@mx.b.com, even though x@a.com was delivered, got", result)
+	}
+	if len(saved) != 1 || saved[0] != "x@a.com" {
+		t.Error("expecting only x@a.com to reach RouteSaver, got", saved)
+	}
+	rr, ok := result.(*RcptResults)
+	if !ok || len(rr.Rcpts) != 3 {
+		t.Fatal("expecting a result for each recipient, got", result)
+	}
+	if rr.Rcpts[0].Status != RcptDelivered {
+		t.Error("expecting x@a.com to be delivered, got", rr.Rcpts[0].Status)
+	}
+	if rr.Rcpts[1].Status != RcptFailed || rr.Rcpts[1].Result.Code() != 554 {
+		t.Error("expecting y@mx.b.com to fail with 554, got", rr.Rcpts[1].Status, rr.Rcpts[1].Result)
+	}
+	if rr.Rcpts[2].Status != RcptFailed || rr.Rcpts[2].Result.Code() != 550 {
+		t.Error("expecting z@c.com to fail with no route, got", rr.Rcpts[2].Status, rr.Rcpts[2].Result)
+	}
+	if len(e.RcptTo) != 3 {
+		t.Error("expecting the recipients to be restored, got", e.RcptTo)
+	}
+}
+
+func TestRouterEnvelopeState(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var seen []string
+	Svc.AddProcessor("RouteStamper", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					stamp, _ := e.Values["stamp"].(string)
+					seen = append(seen, stamp+"|"+e.QueuedId+"|"+e.DeliveryHeader)
+					e.Values["stamp"] = e.RcptTo[0].Host
+					e.QueuedId = "changed"
+					e.DeliveryHeader = "X-Changed: " + e.RcptTo[0].Host + "\n"
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "routestamper")
+	c := BackendConfig{
+		"save_process":      "Router",
+		"save_workers_size": 1,
+		"router_table":      "a.com=RouteStamper; b.com=HeadersParser|RouteStamper",
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc123"
+	e.DeliveryHeader = "X-Original: yes\n"
+	e.PushRcpt(mail.Address{User: "x", Host: "a.com"})
+	e.PushRcpt(mail.Address{User: "y", Host: "b.com"})
+	e.Data.WriteString("Subject:Test\n\nThis is a test.")
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+	// the second stack doesn't see what the first one changed
+	expect := "|abc123|X-Original: yes\n"
+	if len(seen) != 2 || seen[0] != expect || seen[1] != expect {
+		t.Errorf("expecting each stack to start with the original envelope, got %q", seen)
+	}
+	if _, ok := e.Values["stamp"]; ok || e.QueuedId != "abc123" || e.DeliveryHeader != "X-Original: yes\n" {
+		t.Errorf("expecting the envelope to be restored, got %v %s %q", e.Values, e.QueuedId, e.DeliveryHeader)
+	}
+}
@@ -0,0 +1,216 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: s3
+// ----------------------------------------------------------------------------------
+// Description   : Uploads the email, with e.DeliveryHeader, to an S3 bucket, or to
+//               : a server with an S3 compatible API such as MinIO
+// ----------------------------------------------------------------------------------
+// Config Options: s3_bucket string - the bucket
+//               : s3_region string - default "us-east-1"
+//               : s3_endpoint string - URL of the server, default
+//               : https://s3.<region>.amazonaws.com
+//               : s3_path_style bool - put the bucket in the path of the URL
+//               : instead of the host name, needed for MinIO
+//               : s3_access_key, s3_secret_key string - the credentials, default
+//               : AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY from the environment
+//               : s3_key_template string - the key of the object, where these are
+//               : replaced: {hash} the first of e.Hashes, or the id of the message
+//               : if there are none, {queued_id}, {yyyy}, {mm}, {dd}, {hh}, and {rcpt},
+//               : {rcpt_user}, {rcpt_domain} of the first recipient.
+//               : default "{yyyy}/{mm}/{dd}/{hash}"
+//               : s3_part_size int - emails bigger than this are uploaded in parts
+//               : of this many bytes, at least 5 MiB. default 8 MiB
+//               : s3_sse string - server-side encryption, AES256 or aws:kms
+//               : s3_sse_kms_key_id string - the KMS key, for aws:kms
+// --------------:-------------------------------------------------------------------
+// Input         : e.Hashes, e.QueuedId, e.RcptTo, e.DeliveryHeader, e.Data
+// ----------------------------------------------------------------------------------
+// Output        : Sets e.Values["s3_key"] to the key of the object, so that the next
+//               : processors know where the email is
+//               : The upload is cancelled if the save times out (gw_save_timeout)
+// ----------------------------------------------------------------------------------
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "s3",
+		Description: "Uploads the email to S3 or an S3 compatible server",
+		Options:     ConfigOptions(&S3ProcessorConfig{}),
+	})
+	contextProcessors["s3"] = func() ContextDecorator {
+		return S3()
+	}
+}
+
+type S3ProcessorConfig struct {
+	Bucket      string `json:"s3_bucket" desc:"The bucket to upload to"`
+	Region      string `json:"s3_region,omitempty" default:"us-east-1" desc:"The region of the bucket"`
+	Endpoint    string `json:"s3_endpoint,omitempty" default:"https://s3.<region>.amazonaws.com" desc:"URL of the S3 server"`
+	PathStyle   bool   `json:"s3_path_style,omitempty" desc:"Put the bucket in the path of the URL instead of the host name, for MinIO"`
+	AccessKey   string `json:"s3_access_key,omitempty" default:"$AWS_ACCESS_KEY_ID" desc:"The access key id"`
+	SecretKey   string `json:"s3_secret_key,omitempty" default:"$AWS_SECRET_ACCESS_KEY" desc:"The secret access key"`
+	KeyTemplate string `json:"s3_key_template,omitempty" default:"{yyyy}/{mm}/{dd}/{hash}" desc:"Key of the object, see the docs for what is replaced"`
+	PartSize    int    `json:"s3_part_size,omitempty" default:"8388608" desc:"Upload emails bigger than this many bytes in parts, at least 5 MiB"`
+	SSE         string `json:"s3_sse,omitempty" desc:"Server-side encryption, AES256 or aws:kms"`
+	SSEKMSKeyID string `json:"s3_sse_kms_key_id,omitempty" desc:"The KMS key id, for aws:kms"`
+}
+
+const (
+	// s3MinPartSize is the smallest part that S3 accepts, other than the last part
+	s3MinPartSize = 5 * 1024 * 1024
+	// s3KeyValue is the key of e.Values that has the key of the uploaded object
+	s3KeyValue = "s3_key"
+)
+
+// newS3Client checks config, filling in the defaults, and returns a client for it
+func newS3Client(config *S3ProcessorConfig) (*s3Client, error) {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	if config.AccessKey == "" {
+		config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if config.SecretKey == "" {
+		config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if config.KeyTemplate == "" {
+		config.KeyTemplate = "{yyyy}/{mm}/{dd}/{hash}"
+	}
+	if config.PartSize == 0 {
+		config.PartSize = 8 * 1024 * 1024
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, fmt.Errorf("s3 needs s3_access_key and s3_secret_key, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if config.PartSize < s3MinPartSize {
+		return nil, fmt.Errorf("s3_part_size must be at least %d", s3MinPartSize)
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("s3_endpoint [%s] is not an http or https URL", config.Endpoint)
+	}
+	headers := http.Header{}
+	switch config.SSE {
+	case "":
+	case "AES256":
+		headers.Set("x-amz-server-side-encryption", config.SSE)
+	case "aws:kms":
+		headers.Set("x-amz-server-side-encryption", config.SSE)
+		if config.SSEKMSKeyID != "" {
+			headers.Set("x-amz-server-side-encryption-aws-kms-key-id", config.SSEKMSKeyID)
+		}
+	default:
+		return nil, fmt.Errorf("s3_sse [%s] must be AES256 or aws:kms", config.SSE)
+	}
+	return &s3Client{
+		signer: s3Signer{
+			accessKey:    config.AccessKey,
+			secretKey:    config.SecretKey,
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			region:       config.Region,
+		},
+		endpoint:  endpoint,
+		bucket:    config.Bucket,
+		pathStyle: config.PathStyle,
+		headers:   headers,
+		client:    &http.Client{},
+	}, nil
+}
+
+// s3Key makes the key of the object for e from template
+func s3Key(template string, e *mail.Envelope, t time.Time) (string, error) {
+	// the values are from the client, so they can't add to the path
+	clean := strings.NewReplacer("/", "_", "\\", "_").Replace
+	var hash string
+	if len(e.Hashes) > 0 {
+		hash = e.Hashes[0]
+	} else if strings.Contains(template, "{hash}") {
+		// not the queued id, since it's the same for each email sent on a connection
+		var err error
+		if hash, err = publishID(e, e.RcptTo); err != nil {
+			return "", err
+		}
+	}
+	var rcpt, user, domain string
+	if len(e.RcptTo) > 0 {
+		rcpt = strings.ToLower(e.RcptTo[0].String())
+		user = strings.ToLower(e.RcptTo[0].User)
+		domain = strings.ToLower(e.RcptTo[0].Host)
+	}
+	return strings.NewReplacer(
+		"{hash}", clean(hash),
+		"{queued_id}", clean(e.QueuedId),
+		"{yyyy}", t.Format("2006"),
+		"{mm}", t.Format("01"),
+		"{dd}", t.Format("02"),
+		"{hh}", t.Format("15"),
+		"{rcpt}", clean(rcpt),
+		"{rcpt_user}", clean(user),
+		"{rcpt_domain}", clean(domain),
+	).Replace(template), nil
+}
+
+// S3 uploads each email to an S3 bucket, and sets e.Values["s3_key"] to its key
+func S3() ContextDecorator {
+	var (
+		config *S3ProcessorConfig
+		client *s3Client
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&S3ProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*S3ProcessorConfig)
+		if client, err = newS3Client(c); err != nil {
+			return err
+		}
+		config = c
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if client != nil {
+			client.client.CloseIdleConnections()
+		}
+		return nil
+	}))
+	return func(p ContextProcessor) ContextProcessor {
+		return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.ProcessContext(ctx, e, task)
+			}
+			key, err := s3Key(config.KeyTemplate, e, time.Now())
+			if err != nil {
+				Log().WithError(err).Errorf("could not make the s3 key of %s", e.QueuedId)
+				return NewResult(response.Canned.FailBackendTransaction), err
+			}
+			if err := client.upload(ctx, key, e.NewReader(), config.PartSize); err != nil {
+				if ctx.Err() != nil {
+					Log().WithError(err).Warn("upload to s3 was cancelled")
+					return NewResult(response.Canned.FailBackendTimeout), ctx.Err()
+				}
+				Log().WithError(err).Errorf("could not upload %s to s3", e.QueuedId)
+				return NewResult(response.Canned.FailBackendTransaction), err
+			}
+			// the next processor will know to look in s3 for the message data
+			e.Values[s3KeyValue] = key
+			return p.ProcessContext(ctx, e, task)
+		})
+	}
+}
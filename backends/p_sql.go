@@ -1,9 +1,12 @@
 package backends
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/karngyan/go-guerrilla/mail"
@@ -32,30 +35,46 @@ import (
 //               : idle connection pool. The default is 2
 //               : sql_max_conn_lifetime - sets the maximum amount of time
 //               : a connection may be reused
+//               : sql_batch_max int - most rows to insert with one INSERT, the rows
+//               : of all the workers are batched. 1 to not batch. default 1
+//               : sql_batch_timeout string - longest a row waits for its batch to
+//               : fill up before it's inserted, default "50ms"
 // --------------:-------------------------------------------------------------------
 // Input         : e.Data
 //               : e.DeliveryHeader generated by ParseHeader() processor
 //               : e.MailFrom
 //               : e.Subject - generated by by ParseHeader() processor
+//               : e.Values["s3_key"] - set by the S3 processor, saved in place of the
+//               : data, with 's3' in the body column
 // ----------------------------------------------------------------------------------
 // Output        : Sets e.QueuedId with the first item fromHashes[0]
+//               : Returns after the batch with the rows of the email is inserted.
+//               : If the batch fails, its rows are inserted one at a time.
+//               : The insert is cancelled if the save times out (gw_save_timeout)
 // ----------------------------------------------------------------------------------
 func init() {
-	processors["sql"] = func() Decorator {
-		return SQL()
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "sql",
+		Description: "Saves the email in an SQL database",
+		Options:     ConfigOptions(&SQLProcessorConfig{}),
+	})
+	contextProcessors["sql"] = func() ContextDecorator {
+		return SQLContext()
 	}
 }
 
 type SQLProcessorConfig struct {
-	Table           string `json:"mail_table"`
-	Driver          string `json:"sql_driver"`
-	DSN             string `json:"sql_dsn"`
-	SQLInsert       string `json:"sql_insert,omitempty"`
-	SQLValues       string `json:"sql_values,omitempty"`
-	PrimaryHost     string `json:"primary_mail_host"`
-	MaxConnLifetime string `json:"sql_max_conn_lifetime,omitempty"`
-	MaxOpenConns    int    `json:"sql_max_open_conns,omitempty"`
-	MaxIdleConns    int    `json:"sql_max_idle_conns,omitempty"`
+	Table           string `json:"mail_table" desc:"The table for storing email"`
+	Driver          string `json:"sql_driver" desc:"The database driver name, eg. mysql"`
+	DSN             string `json:"sql_dsn" desc:"The driver-specific data source name"`
+	SQLInsert       string `json:"sql_insert,omitempty" desc:"The INSERT statement, up to the VALUES"`
+	SQLValues       string `json:"sql_values,omitempty" desc:"The VALUES placeholders of the INSERT statement"`
+	PrimaryHost     string `json:"primary_mail_host" desc:"The primary host name"`
+	MaxConnLifetime string `json:"sql_max_conn_lifetime,omitempty" desc:"Longest time a connection may be reused, eg. 1h"`
+	MaxOpenConns    int    `json:"sql_max_open_conns,omitempty" default:"0" desc:"Most open connections to the database, 0 is unlimited"`
+	MaxIdleConns    int    `json:"sql_max_idle_conns,omitempty" default:"2" desc:"Most connections in the idle connection pool"`
+	BatchMax        int    `json:"sql_batch_max,omitempty" default:"1" desc:"Most rows to insert at once, 1 to insert each row on its own"`
+	BatchTimeout    string `json:"sql_batch_timeout,omitempty" default:"50ms" desc:"Longest a row waits for its batch to fill up"`
 }
 
 type SQLProcessor struct {
@@ -139,7 +158,7 @@ func (s *SQLProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
 	return stmt
 }
 
-func (s *SQLProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]interface{}) (execErr error) {
+func (s *SQLProcessor) doQuery(ctx context.Context, c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]interface{}) (execErr error) {
 	defer func() {
 		if r := recover(); r != nil {
 			Log().Error("Recovered form panic:", r, string(debug.Stack()))
@@ -155,13 +174,190 @@ func (s *SQLProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]
 	}()
 	// prepare the query used to insert when rows reaches batchMax
 	insertStmt = s.prepareInsertQuery(c, db)
-	_, execErr = insertStmt.Exec(*vals...)
+	_, execErr = insertStmt.ExecContext(ctx, *vals...)
 	if execErr != nil {
 		Log().WithError(execErr).Error("There was a problem the insert")
 	}
 	return
 }
 
+// insert inserts rows with one INSERT. A panic while preparing or inserting is returned as an error,
+// since the batcher can't let it take down the server
+func (s *SQLProcessor) insert(ctx context.Context, db *sql.DB, rows []*sqlRow) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("insert of %d rows failed: %v", len(rows), r)
+		}
+	}()
+	var vals []interface{}
+	for _, row := range rows {
+		vals = append(vals, row.vals...)
+	}
+	return s.doQuery(ctx, len(rows), db, nil, &vals)
+}
+
+// sqlRow is a row that waits in the batcher to be inserted
+type sqlRow struct {
+	ctx  context.Context
+	vals []interface{}
+	// done gets the result of the insert
+	done chan error
+}
+
+// sqlBatcher inserts the rows of all the workers, batchMax rows at a time. A batch is inserted when it's
+// full, or batchTimeout after its first row came in
+type sqlBatcher struct {
+	s            *SQLProcessor
+	db           *sql.DB
+	batchMax     int
+	batchTimeout time.Duration
+	rows         chan *sqlRow
+	stop         chan struct{}
+	wg           sync.WaitGroup
+	// key and refs are for sqlBatchers
+	key  string
+	refs int
+}
+
+var errSQLBatcherStopped = errors.New("the sql batcher was stopped")
+
+// sqlBatchers has the batchers in use. Each worker has its own instance of the processor, so the
+// instances with the same settings share a batcher, which has its own database connection
+var sqlBatchers = struct {
+	sync.Mutex
+	m map[string]*sqlBatcher
+}{m: make(map[string]*sqlBatcher)}
+
+// acquireSQLBatcher returns the batcher for config, starting it if it's the first to use it
+func acquireSQLBatcher(config *SQLProcessorConfig, batchTimeout time.Duration) (*sqlBatcher, error) {
+	sqlBatchers.Lock()
+	defer sqlBatchers.Unlock()
+	key := fmt.Sprintf("%+v", *config)
+	if b, ok := sqlBatchers.m[key]; ok {
+		b.refs++
+		return b, nil
+	}
+	s := &SQLProcessor{config: config}
+	db, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	b := &sqlBatcher{
+		s:            s,
+		db:           db,
+		batchMax:     config.BatchMax,
+		batchTimeout: batchTimeout,
+		rows:         make(chan *sqlRow),
+		stop:         make(chan struct{}),
+		key:          key,
+		refs:         1,
+	}
+	b.wg.Add(1)
+	go b.run()
+	sqlBatchers.m[key] = b
+	return b, nil
+}
+
+// release stops the batcher when the last instance that uses it is shut down. The rows that are
+// waiting are inserted, then the database connection is closed
+func (b *sqlBatcher) release() error {
+	sqlBatchers.Lock()
+	defer sqlBatchers.Unlock()
+	if b.refs--; b.refs > 0 {
+		return nil
+	}
+	delete(sqlBatchers.m, b.key)
+	close(b.stop)
+	b.wg.Wait()
+	return b.db.Close()
+}
+
+func (b *sqlBatcher) run() {
+	defer b.wg.Done()
+	var (
+		batch []*sqlRow
+		timeo <-chan time.Time
+	)
+	for {
+		select {
+		case row := <-b.rows:
+			batch = append(batch, row)
+			if len(batch) == 1 {
+				timeo = time.After(b.batchTimeout)
+			}
+			if len(batch) < b.batchMax {
+				continue
+			}
+		case <-timeo:
+		case <-b.stop:
+			b.flush(batch)
+			return
+		}
+		b.flush(batch)
+		batch, timeo = nil, nil
+	}
+}
+
+// flush inserts the batch, and if that fails, each of its rows on its own
+func (b *sqlBatcher) flush(batch []*sqlRow) {
+	// the rows that timed out are not inserted, their worker has given up
+	var rows []*sqlRow
+	for _, row := range batch {
+		if err := row.ctx.Err(); err != nil {
+			row.done <- err
+		} else {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == 0 {
+		return
+	}
+	if len(rows) > 1 {
+		ctx, cancel := batchContext(rows)
+		err := b.s.insert(ctx, b.db, rows)
+		cancel()
+		if err == nil {
+			for _, row := range rows {
+				row.done <- nil
+			}
+			return
+		}
+		Log().WithError(err).Warnf("insert of a batch of %d rows failed, inserting them one at a time", len(rows))
+	}
+	for _, row := range rows {
+		row.done <- b.s.insert(row.ctx, b.db, []*sqlRow{row})
+	}
+}
+
+// batchContext returns a context that ends with the last of the rows, so that the batch isn't cancelled
+// because one of its rows is
+func batchContext(rows []*sqlRow) (context.Context, context.CancelFunc) {
+	var last time.Time
+	for _, row := range rows {
+		deadline, ok := row.ctx.Deadline()
+		if !ok {
+			return context.WithCancel(context.Background())
+		}
+		if deadline.After(last) {
+			last = deadline
+		}
+	}
+	return context.WithDeadline(context.Background(), last)
+}
+
+// add gives the row to the batcher, and returns a channel that gets the result of its insert
+func (b *sqlBatcher) add(ctx context.Context, vals []interface{}) (*sqlRow, error) {
+	row := &sqlRow{ctx: ctx, vals: vals, done: make(chan error, 1)}
+	select {
+	case b.rows <- row:
+		return row, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-b.stop:
+		return nil, errSQLBatcherStopped
+	}
+}
+
 // for storing ip addresses in the ip_addr column
 func (s *SQLProcessor) ip2bint(ip string) *big.Int {
 	bint := big.NewInt(0)
@@ -186,9 +382,14 @@ func (s *SQLProcessor) fillAddressFromHeader(e *mail.Envelope, headerKey string)
 }
 
 func SQL() Decorator {
+	return AsDecorator(SQLContext())
+}
+
+// SQLContext is SQL, where the inserts are cancelled when the task's deadline passes
+func SQLContext() ContextDecorator {
 	var config *SQLProcessorConfig
-	var vals []interface{}
 	var db *sql.DB
+	var batcher *sqlBatcher
 	s := &SQLProcessor{}
 
 	// open the database connection (it will also check if we can select the table)
@@ -200,6 +401,20 @@ func SQL() Decorator {
 		}
 		config = bcfg.(*SQLProcessorConfig)
 		s.config = config
+		if config.BatchMax > GuerrillaDBAndRedisBatchMax {
+			return fmt.Errorf("sql_batch_max cannot be more than %d", GuerrillaDBAndRedisBatchMax)
+		}
+		if config.BatchTimeout == "" {
+			config.BatchTimeout = "50ms"
+		}
+		batchTimeout, err := time.ParseDuration(config.BatchTimeout)
+		if err != nil {
+			return fmt.Errorf("sql_batch_timeout [%s] is not a duration: %s", config.BatchTimeout, err)
+		}
+		if config.BatchMax > 1 {
+			batcher, err = acquireSQLBatcher(config, batchTimeout)
+			return err
+		}
 		db, err = s.connect()
 		if err != nil {
 			return err
@@ -207,16 +422,21 @@ func SQL() Decorator {
 		return nil
 	}))
 
-	// shutdown will close the database connection
+	// shutdown will close the database connection, or stop using the batcher
 	Svc.AddShutdowner(ShutdownWith(func() error {
+		if batcher != nil {
+			err := batcher.release()
+			batcher = nil
+			return err
+		}
 		if db != nil {
 			return db.Close()
 		}
 		return nil
 	}))
 
-	return func(p Processor) Processor {
-		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+	return func(p ContextProcessor) ContextProcessor {
+		return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
 
 			if task == TaskSaveMail {
 				var to, body string
@@ -237,7 +457,13 @@ func SQL() Decorator {
 				if _, ok := e.Values["redis"]; ok {
 					body = "redis"
 				}
+				// was uploaded by the S3 processor, the mail column has the key
+				objectKey, inS3 := e.Values[s3KeyValue].(string)
+				if inS3 {
+					body = "s3"
+				}
 
+				var rows []*sqlRow
 				for i := range e.RcptTo {
 
 					// use the To header, otherwise rcpt to
@@ -262,17 +488,19 @@ func SQL() Decorator {
 					}
 
 					// build the values for the query
-					vals = []interface{}{} // clear the vals
+					vals := make([]interface{}, 0, 15)
 					vals = append(vals,
 						to,
 						trimToLimit(e.MailFrom.String(), 255), // from
 						trimToLimit(e.Subject, 255),
-						body, // body describes how to interpret the data, eg 'redis' means stored in redis, and 'gzip' stored in mysql, using gzip compression
+						body, // body describes how to interpret the data, eg 'redis' means stored in redis, 's3' in s3, and 'gzip' stored in mysql, using gzip compression
 					)
 					// `mail` column
 					if body == "redis" {
 						// data already saved in redis
 						vals = append(vals, "")
+					} else if inS3 {
+						vals = append(vals, objectKey)
 					} else if co != nil {
 						// use a compressor (automatically adds e.DeliveryHeader)
 						vals = append(vals, co.String())
@@ -296,15 +524,48 @@ func SQL() Decorator {
 						sender,
 					)
 
+					if batcher != nil {
+						// the batcher inserts it with the rows of the other workers
+						row, err := batcher.add(ctx, vals)
+						if err != nil && err == ctx.Err() {
+							return NewResult(response.Canned.FailBackendTimeout), err
+						}
+						if err != nil {
+							return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+						}
+						rows = append(rows, row)
+						continue
+					}
 					stmt := s.prepareInsertQuery(1, db)
-					err := s.doQuery(1, db, stmt, &vals)
+					err := s.doQuery(ctx, 1, db, stmt, &vals)
+					if ctx.Err() != nil {
+						return NewResult(response.Canned.FailBackendTimeout), ctx.Err()
+					}
 					if err != nil {
 						return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
 					}
 				}
+				// wait for the batches with the rows to be inserted
+				var batchErr error
+				for _, row := range rows {
+					select {
+					case err := <-row.done:
+						if err != nil && batchErr == nil {
+							batchErr = err
+						}
+					case <-ctx.Done():
+						return NewResult(response.Canned.FailBackendTimeout), ctx.Err()
+					}
+				}
+				if batchErr != nil && batchErr == ctx.Err() {
+					return NewResult(response.Canned.FailBackendTimeout), batchErr
+				}
+				if batchErr != nil {
+					return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+				}
 
 				// continue to the next Processor in the decorator chain
-				return p.Process(e, task)
+				return p.ProcessContext(ctx, e, task)
 			} else if task == TaskValidateRcpt {
 				// if you need to validate the e.Rcpt then change to:
 				if len(e.RcptTo) > 0 {
@@ -317,9 +578,9 @@ func SQL() Decorator {
 					}
 				}
 				// continue to the next processor
-				return p.Process(e, task)
+				return p.ProcessContext(ctx, e, task)
 			} else {
-				return p.Process(e, task)
+				return p.ProcessContext(ctx, e, task)
 			}
 
 		})
@@ -2,10 +2,15 @@ package backends
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -93,3 +98,198 @@ func findRows(hash string) ([]string, error) {
 	}
 	return results, nil
 }
+
+// fakeSQL is a database/sql driver that records the INSERTs. An INSERT fails if one of its values
+// is bad@example.com
+type fakeSQL struct {
+	sync.Mutex
+	// inserts has the number of rows of each INSERT, negative if it failed
+	inserts []int
+}
+
+type fakeSQLConn struct {
+	f *fakeSQL
+}
+
+type fakeSQLStmt struct {
+	f     *fakeSQL
+	query string
+}
+
+type fakeSQLRows struct{}
+
+var fakeSQLDB = &fakeSQL{}
+
+func init() {
+	sql.Register("fakesql", fakeSQLDB)
+}
+
+func (f *fakeSQL) Open(name string) (driver.Conn, error) {
+	return &fakeSQLConn{f: f}, nil
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{f: c.f, query: query}, nil
+}
+
+func (c *fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("no transactions")
+}
+
+func (s *fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (s *fakeSQLStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.f.Lock()
+	defer s.f.Unlock()
+	// each row has 14 values
+	rows := len(args) / 14
+	for _, arg := range args {
+		if arg == "bad@example.com" {
+			s.f.inserts = append(s.f.inserts, -rows)
+			return nil, errors.New("bad row")
+		}
+	}
+	s.f.inserts = append(s.f.inserts, rows)
+	return driver.RowsAffected(rows), nil
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeSQLRows{}, nil
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return []string{"mail_id"}
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	return io.EOF
+}
+
+func TestSQLBatch(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	fakeSQLDB.Lock()
+	fakeSQLDB.inserts = nil
+	fakeSQLDB.Unlock()
+
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "sql",
+		"save_workers_size": 3,
+		"mail_table":        "mail",
+		"primary_mail_host": "example.com",
+		"sql_driver":        "fakesql",
+		"sql_dsn":           "test",
+		"sql_batch_max":     3,
+		// the batches fill up before this
+		"sql_batch_timeout": "10s",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// process sends an email to each of users at once
+	process := func(users ...string) []int {
+		codes := make([]int, len(users))
+		var wg sync.WaitGroup
+		for i, user := range users {
+			wg.Add(1)
+			go func(i int, user string) {
+				defer wg.Done()
+				e := mail.NewEnvelope("127.0.0.1", uint64(i))
+				e.RcptTo = []mail.Address{{User: user, Host: "example.com"}}
+				e.Hashes = []string{fmt.Sprintf("hash%d", i)}
+				codes[i] = gateway.Process(e).Code()
+			}(i, user)
+		}
+		wg.Wait()
+		return codes
+	}
+
+	if codes := process("alice", "bob", "carol"); codes[0] != 250 || codes[1] != 250 || codes[2] != 250 {
+		t.Error("expecting 250 for each email, got", codes)
+	}
+	// the bad row fails the batch, then the rows are inserted on their own
+	if codes := process("dave", "bad", "erin"); codes[0] != 250 || codes[1] != 554 || codes[2] != 250 {
+		t.Error("expecting 554 for the bad row only, got", codes)
+	}
+
+	fakeSQLDB.Lock()
+	defer fakeSQLDB.Unlock()
+	inserts := fakeSQLDB.inserts
+	if len(inserts) == 5 {
+		// the rows of a batch can be in any order
+		sort.Ints(inserts[2:])
+	}
+	if fmt.Sprint(inserts) != "[3 -3 -1 1 1]" {
+		t.Error("expecting a batch, then a failed batch that's inserted a row at a time, got", fakeSQLDB.inserts)
+	}
+}
+
+func TestSQLBatchTimeout(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "sql",
+		"mail_table":        "mail",
+		"primary_mail_host": "example.com",
+		"sql_driver":        "fakesql",
+		"sql_dsn":           "test",
+		"sql_batch_max":     50,
+		"sql_batch_timeout": "20ms",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// the batch doesn't fill up, so it's inserted after the timeout
+	e := newSpoolTestEnvelope()
+	e.Hashes = []string{"abc12345"}
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "other", Host: "example.com"})
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+
+	big := &BackendGateway{}
+	err := big.Initialize(BackendConfig{
+		"save_process":      "sql",
+		"mail_table":        "mail",
+		"primary_mail_host": "example.com",
+		"sql_driver":        "fakesql",
+		"sql_dsn":           "test",
+		"sql_batch_max":     51,
+	})
+	if err == nil || !strings.Contains(err.Error(), "sql_batch_max") {
+		t.Error("expecting an error for a batch bigger than the statement cache, got", err)
+	}
+}
@@ -0,0 +1,414 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
+
+	_ "modernc.org/sqlite" // the pure go sqlite driver, so that no cgo is needed
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: sqlite
+// ----------------------------------------------------------------------------------
+// Description   : Saves the email in a SQLite file, with its recipients, headers
+//               : and attachments in their own tables. No database server is needed
+// ----------------------------------------------------------------------------------
+// Config Options: sqlite_path string - the database file, made if it doesn't exist
+//               : sqlite_busy_timeout string - how long to wait for another process
+//               : that is writing to the file, default "5s"
+// --------------:-------------------------------------------------------------------
+// Input         : e.QueuedId, e.DeliveryHeader, e.Data, the envelope
+//               : e.Subject - set by the HeadersParser, or read from the header
+//               : e.Hashes - the first hash is saved if the Hasher processor ran
+// ----------------------------------------------------------------------------------
+// Output        : Sets e.Values["sqlite_id"] to the id of the row in messages.
+//               : The schema is migrated to the latest version when the processor is
+//               : initialized, and the versions applied are in schema_migrations.
+//               : The file is in WAL mode, so it can be read while the workers write.
+//               : The workers share a connection, and each email is saved in one
+//               : transaction. The emails sent on one connection share a queued id,
+//               : so it's not unique
+// ----------------------------------------------------------------------------------
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "sqlite",
+		Description: "Saves the email, its recipients, headers and attachments in a SQLite file",
+		Options:     ConfigOptions(&SQLiteProcessorConfig{}),
+	})
+	contextProcessors["sqlite"] = func() ContextDecorator {
+		return SQLite()
+	}
+}
+
+type SQLiteProcessorConfig struct {
+	Path        string `json:"sqlite_path" desc:"The database file, it's made if it doesn't exist"`
+	BusyTimeout string `json:"sqlite_busy_timeout,omitempty" default:"5s" desc:"How long to wait for another process that is writing to the file"`
+}
+
+// sqliteIDValue is the key of e.Values that has the id of the saved message
+const sqliteIDValue = "sqlite_id"
+
+// sqliteMigrations are the statements of each version of the schema, the first is version 1.
+// A migration is never changed once it's released, a new version is added instead
+var sqliteMigrations = [][]string{
+	// 1: messages, with their recipients, headers and attachments
+	{
+		`CREATE TABLE messages (
+			id INTEGER PRIMARY KEY,
+			queued_id TEXT NOT NULL,
+			received_at INTEGER NOT NULL,
+			remote_ip TEXT NOT NULL,
+			helo TEXT NOT NULL,
+			mail_from TEXT NOT NULL,
+			auth_username TEXT NOT NULL,
+			tls INTEGER NOT NULL,
+			subject TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			text TEXT,
+			html TEXT,
+			data BLOB NOT NULL
+		)`,
+		`CREATE INDEX messages_received_at ON messages (received_at)`,
+		`CREATE INDEX messages_queued_id ON messages (queued_id)`,
+		`CREATE TABLE recipients (
+			message_id INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+			address TEXT NOT NULL COLLATE NOCASE,
+			user TEXT NOT NULL,
+			host TEXT NOT NULL COLLATE NOCASE,
+			PRIMARY KEY (message_id, address)
+		) WITHOUT ROWID`,
+		`CREATE INDEX recipients_address ON recipients (address)`,
+		`CREATE TABLE headers (
+			message_id INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			name TEXT NOT NULL COLLATE NOCASE,
+			value TEXT NOT NULL,
+			PRIMARY KEY (message_id, position)
+		) WITHOUT ROWID`,
+		`CREATE TABLE attachments (
+			message_id INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			filename TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			content BLOB NOT NULL,
+			PRIMARY KEY (message_id, position)
+		)`,
+	},
+}
+
+// sqliteDB is a database file that is used by the processor instances of all the workers
+type sqliteDB struct {
+	db *sql.DB
+	// key and refs are for sqliteDBs
+	key  string
+	refs int
+}
+
+// sqliteDBs has the database files in use, by their absolute path
+var sqliteDBs = struct {
+	sync.Mutex
+	m map[string]*sqliteDB
+}{m: make(map[string]*sqliteDB)}
+
+// acquireSQLiteDB returns the database of the file at path, opening and migrating it if it's the first to use it
+func acquireSQLiteDB(path string, busyTimeout time.Duration) (*sqliteDB, error) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	sqliteDBs.Lock()
+	defer sqliteDBs.Unlock()
+	if s, ok := sqliteDBs.m[key]; ok {
+		s.refs++
+		return s, nil
+	}
+	db, err := openSQLite(key, busyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err = migrateSQLite(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	s := &sqliteDB{db: db, key: key, refs: 1}
+	sqliteDBs.m[key] = s
+	return s, nil
+}
+
+// release closes the database when the last instance that uses it is shut down
+func (s *sqliteDB) release() error {
+	sqliteDBs.Lock()
+	defer sqliteDBs.Unlock()
+	if s.refs--; s.refs > 0 {
+		return nil
+	}
+	delete(sqliteDBs.m, s.key)
+	return s.db.Close()
+}
+
+// openSQLite opens the file in WAL mode, with foreign keys on
+func openSQLite(path string, busyTimeout time.Duration) (*sql.DB, error) {
+	if strings.ContainsAny(path, "?#") {
+		return nil, fmt.Errorf("sqlite_path [%s] cannot have a ? or #", path)
+	}
+	// the pragmas are run for each connection that is opened. _txlock=immediate takes the write lock
+	// at BEGIN, so that a transaction doesn't fail with SQLITE_BUSY half way when another process writes
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(%d)&_pragma=foreign_keys(1)"+
+		"&_pragma=synchronous(NORMAL)&_txlock=immediate", path, busyTimeout/time.Millisecond)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite has one writer at a time, so the workers take turns with one connection
+	// rather than waiting on each other's locks
+	db.SetMaxOpenConns(1)
+	var mode string
+	if err = db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("cannot open sqlite database [%s]: %s", path, err)
+	}
+	if !strings.EqualFold(mode, "wal") {
+		_ = db.Close()
+		return nil, fmt.Errorf("sqlite database [%s] is in %s mode, not WAL", path, mode)
+	}
+	return db, nil
+}
+
+// migrateSQLite applies the migrations that are newer than the version of the schema, each in its own transaction
+func migrateSQLite(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+	for v := 1; v <= len(sqliteMigrations); v++ {
+		if err := migrateSQLiteTo(db, v); err != nil {
+			return fmt.Errorf("sqlite migration %d failed: %s", v, err)
+		}
+	}
+	return nil
+}
+
+// migrateSQLiteTo applies migration v if the schema is at v-1. The version is read in the transaction,
+// since another process could be migrating the same file
+func migrateSQLiteTo(db *sql.DB, v int) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var version int
+	if err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("the schema is at version %d, which is newer than this build knows of", version)
+	}
+	if version >= v {
+		return tx.Rollback()
+	}
+	for _, stmt := range sqliteMigrations[v-1] {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", v, time.Now().Unix()); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	Log().Infof("sqlite schema migrated to version %d", v)
+	return nil
+}
+
+// sqliteHeader is a header field of a message, in the order it appears
+type sqliteHeader struct {
+	name, value string
+}
+
+// readHeaderFields reads the header of a message, keeping the order and the repeated fields.
+// Folded lines are unfolded, and encoded words are decoded
+func readHeaderFields(r io.Reader) []sqliteHeader {
+	tp := textproto.NewReader(bufio.NewReader(r))
+	var fields []sqliteHeader
+	for {
+		line, err := tp.ReadContinuedLine()
+		if line == "" {
+			// the end of the header, or of the message
+			return fields
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			fields = append(fields, sqliteHeader{
+				name:  textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i])),
+				value: mail.MimeHeaderDecode(strings.TrimSpace(line[i+1:])),
+			})
+		}
+		if err != nil {
+			return fields
+		}
+	}
+}
+
+var errSQLiteNoQueuedId = errors.New("the envelope has no queued id")
+
+// saveSQLite saves e in one transaction, returning the id of its row in messages
+func saveSQLite(ctx context.Context, db *sql.DB, e *mail.Envelope) (id int64, err error) {
+	if e.QueuedId == "" {
+		return 0, errSQLiteNoQueuedId
+	}
+	data, err := ioutil.ReadAll(e.NewReader())
+	if err != nil {
+		return 0, err
+	}
+	// the email is saved even if its mime parts can't be read, the data has all of it
+	_, parts, mimeErr := parseMimeParts(bytes.NewReader(data))
+	if mimeErr != nil {
+		Log().WithError(mimeErr).Debugf("could not read all the mime parts of [%s]", e.QueuedId)
+	}
+	var text, html sql.NullString
+	var attachments []mimePart
+	for _, part := range parts {
+		switch {
+		case part.Attachment:
+			attachments = append(attachments, part)
+		case part.ContentType == "text/html" && !html.Valid:
+			html = sql.NullString{String: string(part.Content), Valid: true}
+		case part.ContentType != "text/html" && !text.Valid:
+			text = sql.NullString{String: string(part.Content), Valid: true}
+		}
+	}
+	hash := ""
+	if len(e.Hashes) > 0 {
+		hash = e.Hashes[0]
+	}
+	headers := readHeaderFields(bytes.NewReader(data))
+	subject := e.Subject
+	if subject == "" {
+		// the HeadersParser processor didn't run
+		for _, h := range headers {
+			if h.name == "Subject" {
+				subject = h.value
+				break
+			}
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	res, err := tx.ExecContext(ctx, `INSERT INTO messages
+		(queued_id, received_at, remote_ip, helo, mail_from, auth_username, tls, subject, hash, size, text, html, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.QueuedId, time.Now().Unix(), e.RemoteIP, e.Helo, e.MailFrom.String(), e.Auth.Username, e.TLS,
+		subject, hash, len(data), text, html, data)
+	if err != nil {
+		return 0, err
+	}
+	if id, err = res.LastInsertId(); err != nil {
+		return 0, err
+	}
+	tracker := trackRcpts(e)
+	for _, rcpt := range e.RcptTo {
+		if tracker.dropped(rcpt) {
+			// an earlier processor deferred or failed it
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO recipients (message_id, address, user, host) VALUES (?, ?, ?, ?)",
+			id, rcpt.String(), rcpt.User, rcpt.Host); err != nil {
+			return 0, err
+		}
+	}
+	for i, h := range headers {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO headers (message_id, position, name, value) VALUES (?, ?, ?, ?)",
+			id, i, h.name, h.value); err != nil {
+			return 0, err
+		}
+	}
+	for i, a := range attachments {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO attachments (message_id, position, filename, content_type, size, content) VALUES (?, ?, ?, ?, ?, ?)",
+			id, i, a.Filename, a.ContentType, len(a.Content), a.Content); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+func SQLite() ContextDecorator {
+	var config *SQLiteProcessorConfig
+	var db *sqliteDB
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SQLiteProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*SQLiteProcessorConfig)
+		if config.Path == "" {
+			return errors.New("sqlite_path is not set")
+		}
+		if config.BusyTimeout == "" {
+			config.BusyTimeout = "5s"
+		}
+		busyTimeout, err := time.ParseDuration(config.BusyTimeout)
+		if err != nil {
+			return fmt.Errorf("sqlite_busy_timeout [%s] is not a duration: %s", config.BusyTimeout, err)
+		}
+		db, err = acquireSQLiteDB(config.Path, busyTimeout)
+		return err
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if db != nil {
+			err := db.release()
+			db = nil
+			return err
+		}
+		return nil
+	}))
+
+	return func(p ContextProcessor) ContextProcessor {
+		return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.ProcessContext(ctx, e, task)
+			}
+			id, err := saveSQLite(ctx, db.db, e)
+			if err != nil && ctx.Err() != nil {
+				Log().WithError(err).Warn("saving to sqlite was cancelled")
+				return NewResult(response.Canned.FailBackendTimeout), ctx.Err()
+			}
+			if err != nil {
+				Log().WithError(err).Error("could not save email to sqlite")
+				return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
+			}
+			e.Values[sqliteIDValue] = id
+			return p.ProcessContext(ctx, e, task)
+		})
+	}
+}
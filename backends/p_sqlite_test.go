@@ -0,0 +1,233 @@
+package backends
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+const sqliteTestMultipart = "Subject: =?UTF-8?Q?Caf=C3=A9?=\r\n" +
+	"Received: from a\r\n" +
+	" by b\r\n" +
+	"Received: from c\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Hello</p>\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0=\r\n" +
+	"--b1--\r\n"
+
+func TestSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mail.db")
+	const workers, emails = 4, 20
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "sqlite",
+		"save_workers_size": workers,
+		"sqlite_path":       path,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+
+	// the workers save at the same time
+	var wg sync.WaitGroup
+	codes := make([]int, emails)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < emails; i += workers {
+				e := mail.NewEnvelope("127.0.0.1", uint64(i))
+				e.QueuedId = fmt.Sprintf("queued%d", i)
+				e.MailFrom = mail.Address{User: "sender", Host: "example.com"}
+				e.PushRcpt(mail.Address{User: fmt.Sprintf("user%d", i), Host: "example.com"})
+				e.PushRcpt(mail.Address{User: "all", Host: "example.com"})
+				e.Data.WriteString(sqliteTestMultipart)
+				codes[i] = gateway.Process(e).Code()
+			}
+		}(w)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != 250 {
+			t.Errorf("expecting 250 for email %d, got %d", i, code)
+		}
+	}
+	// two emails sent on one connection share the envelope and its queued id, both are saved
+	e := mail.NewEnvelope("127.0.0.1", 100)
+	e.QueuedId = "same"
+	for _, user := range []string{"first", "second"} {
+		e.ResetTransaction()
+		e.PushRcpt(mail.Address{User: user, Host: "example.com"})
+		e.Data.WriteString("Subject: " + user + "\r\n\r\nHello\r\n")
+		if result := gateway.Process(e); result.Code() != 250 {
+			t.Errorf("expecting 250 for the %s email of the connection, got %s", user, result)
+		}
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error(err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	count := func(query string, args ...interface{}) int {
+		var n int
+		if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count("SELECT COUNT(*) FROM messages WHERE queued_id != 'same'"); n != emails {
+		t.Errorf("expecting %d messages, got %d", emails, n)
+	}
+	for _, user := range []string{"first", "second"} {
+		if n := count("SELECT COUNT(*) FROM messages m JOIN recipients r ON r.message_id = m.id WHERE m.queued_id = 'same' AND m.subject = ? AND r.address = ?",
+			user, user+"@example.com"); n != 1 {
+			t.Errorf("expecting the %s email of the connection to be saved, got %d", user, n)
+		}
+	}
+	if n := count("SELECT COUNT(*) FROM recipients WHERE address = 'ALL@example.com'"); n != emails {
+		t.Errorf("expecting each message to have the recipient all, got %d", n)
+	}
+	var (
+		id                int64
+		subject, text, ht string
+	)
+	if err := db.QueryRow("SELECT m.id, m.subject, m.text, m.html FROM messages m JOIN recipients r ON r.message_id = m.id WHERE r.address = ?",
+		"user3@example.com").Scan(&id, &subject, &text, &ht); err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Café" || text != "Hello" || ht != "<p>Hello</p>" {
+		t.Errorf("expecting the subject, text and html, got %q %q %q", subject, text, ht)
+	}
+	rows, err := db.Query("SELECT name, value FROM headers WHERE message_id = ? ORDER BY position", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headers []string
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, name+": "+value)
+	}
+	_ = rows.Close()
+	if len(headers) != 5 || headers[0] != "Subject: Café" || headers[1] != "Received: from a by b" || headers[2] != "Received: from c" {
+		t.Error("expecting the headers in order, unfolded, got", headers)
+	}
+	var (
+		filename string
+		content  []byte
+	)
+	if err := db.QueryRow("SELECT filename, content FROM attachments WHERE message_id = ?", id).Scan(&filename, &content); err != nil {
+		t.Fatal(err)
+	}
+	if filename != "report.pdf" || string(content) != "%PDF-" {
+		t.Errorf("expecting the decoded attachment, got %s %q", filename, content)
+	}
+	// deleting a message deletes the rest of it
+	if _, err := db.Exec("PRAGMA foreign_keys = ON; DELETE FROM messages WHERE id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+	if n := count("SELECT COUNT(*) FROM headers WHERE message_id = ?", id); n != 0 {
+		t.Error("expecting the headers to be deleted with the message, got", n)
+	}
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Error("expecting the file to be in WAL mode, got", mode, err)
+	}
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mail.db")
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	versions := func() []int {
+		db, err := acquireSQLiteDB(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.release(); err != nil {
+				t.Error(err)
+			}
+		}()
+		rows, err := db.db.QueryContext(context.Background(), "SELECT version FROM schema_migrations ORDER BY version")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var v []int
+		for rows.Next() {
+			var version int
+			if err := rows.Scan(&version); err != nil {
+				t.Fatal(err)
+			}
+			v = append(v, version)
+		}
+		return v
+	}
+	if v := versions(); len(v) != len(sqliteMigrations) || v[len(v)-1] != len(sqliteMigrations) {
+		t.Error("expecting each migration to be applied, got", v)
+	}
+	// opening it again doesn't apply them again
+	if v := versions(); len(v) != len(sqliteMigrations) {
+		t.Error("expecting the migrations to be applied once, got", v)
+	}
+
+	// a file from a newer build is not used
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, 0)", len(sqliteMigrations)+1); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Close()
+	if _, err := acquireSQLiteDB(path, 0); err == nil {
+		t.Error("expecting an error for a schema that is newer")
+	}
+}
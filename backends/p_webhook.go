@@ -0,0 +1,404 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: webhook
+// ----------------------------------------------------------------------------------
+// Description   : POSTs the email to a URL
+// ----------------------------------------------------------------------------------
+// Config Options: webhook_url string - the URL, {domain} is replaced with the
+//               : domain of the recipient, and recipients with the same URL are
+//               : sent together
+//               : webhook_format string - json, the envelope, headers, text and
+//               : html parts and base64 attachments, or multipart, a form with
+//               : the envelope as json and the email as a file. default json
+//               : webhook_secret string - if set, the body is signed with it, see
+//               : the X-Webhook-Signature header
+//               : webhook_timeout string - timeout of each request, default "10s"
+//               : webhook_retries int - times to retry after a 5xx reply or an
+//               : error, default 2
+//               : webhook_retry_backoff string - wait before the first retry,
+//               : doubled for each retry, default "1s"
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo, e.DeliveryHeader, e.Data and the envelope
+// ----------------------------------------------------------------------------------
+// Output        : Each recipient is marked with MarkRcptDelivered after a 2xx reply,
+//               : MarkRcptFailed after a 4xx reply, or MarkRcptDeferred after a 5xx
+//               : reply, an error or a timeout
+// ----------------------------------------------------------------------------------
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        "webhook",
+		Description: "POSTs the email to a URL",
+		Options:     ConfigOptions(&WebhookProcessorConfig{}),
+	})
+	contextProcessors["webhook"] = func() ContextDecorator {
+		return Webhook()
+	}
+}
+
+type WebhookProcessorConfig struct {
+	URL          string `json:"webhook_url" desc:"URL to POST to, {domain} is replaced with the recipient's domain"`
+	Format       string `json:"webhook_format,omitempty" default:"json" desc:"json, or multipart for a form with the raw email"`
+	Secret       string `json:"webhook_secret,omitempty" desc:"Secret for signing the body with HMAC-SHA256"`
+	Timeout      string `json:"webhook_timeout,omitempty" default:"10s" desc:"Timeout of each request"`
+	Retries      int    `json:"webhook_retries,omitempty" default:"2" desc:"Times to retry after a 5xx reply or an error"`
+	RetryBackoff string `json:"webhook_retry_backoff,omitempty" default:"1s" desc:"Wait before the first retry, doubled for each retry"`
+}
+
+const (
+	webhookJSON      = "json"
+	webhookMultipart = "multipart"
+
+	// webhookTimestampHeader has the unix time when the request was signed
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	// webhookSignatureHeader has sha256=<hex HMAC-SHA256 of the timestamp, a dot, then the body>
+	webhookSignatureHeader = "X-Webhook-Signature"
+	// webhookIDHeader has the id of the message, which is the same when a request is retried
+	webhookIDHeader = "X-Webhook-Id"
+)
+
+// WebhookMessage is the body of a request in the json format. In the multipart format, the envelope form
+// field has it without the headers, parts and attachments
+type WebhookMessage struct {
+	// ID is the same when the email is sent again to the same recipients, see publishID.
+	// The queued id is not, since it's the same for each email sent on a connection
+	ID           string              `json:"id"`
+	QueuedID     string              `json:"queued_id"`
+	RemoteIP     string              `json:"remote_ip"`
+	Helo         string              `json:"helo"`
+	MailFrom     string              `json:"mail_from"`
+	RcptTo       []string            `json:"rcpt_to"`
+	TLS          bool                `json:"tls"`
+	AuthUsername string              `json:"auth_username,omitempty"`
+	Subject      string              `json:"subject"`
+	Headers      map[string][]string `json:"headers,omitempty"`
+	// Parts has the text and html parts
+	Parts       []WebhookPart       `json:"parts,omitempty"`
+	Attachments []WebhookAttachment `json:"attachments,omitempty"`
+}
+
+// WebhookPart is a text part of the email, converted to UTF-8
+type WebhookPart struct {
+	ContentType string `json:"content_type"`
+	Charset     string `json:"charset,omitempty"`
+	Content     string `json:"content"`
+}
+
+// WebhookAttachment is an attachment of the email. The content is base64 encoded in the json
+type WebhookAttachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Content     []byte `json:"content"`
+}
+
+// webhook POSTs emails
+type webhook struct {
+	config  *WebhookProcessorConfig
+	timeout time.Duration
+	backoff time.Duration
+	client  *http.Client
+}
+
+// configure checks config, filling in the defaults
+func (w *webhook) configure(config *WebhookProcessorConfig, backendConfig BackendConfig) error {
+	if config.Format == "" {
+		config.Format = webhookJSON
+	}
+	if config.Format != webhookJSON && config.Format != webhookMultipart {
+		return fmt.Errorf("webhook_format [%s] must be %s or %s", config.Format, webhookJSON, webhookMultipart)
+	}
+	if _, ok := backendConfig["webhook_retries"]; !ok {
+		config.Retries = 2
+	}
+	if config.Retries < 0 {
+		return fmt.Errorf("webhook_retries cannot be negative")
+	}
+	u, err := url.Parse(strings.Replace(config.URL, "{domain}", "example.com", -1))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("webhook_url [%s] is not an http or https URL", config.URL)
+	}
+	if config.Timeout == "" {
+		config.Timeout = "10s"
+	}
+	if w.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+		return fmt.Errorf("webhook_timeout [%s] is not a duration: %s", config.Timeout, err)
+	}
+	if config.RetryBackoff == "" {
+		config.RetryBackoff = "1s"
+	}
+	if w.backoff, err = time.ParseDuration(config.RetryBackoff); err != nil {
+		return fmt.Errorf("webhook_retry_backoff [%s] is not a duration: %s", config.RetryBackoff, err)
+	}
+	w.config = config
+	w.client = &http.Client{
+		// a redirect is not followed, since it would turn the POST in to a GET
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return nil
+}
+
+// webhookURL returns the URL for rcpt
+func (w *webhook) webhookURL(rcpt mail.Address) string {
+	return strings.Replace(w.config.URL, "{domain}", url.PathEscape(strings.ToLower(rcpt.Host)), -1)
+}
+
+// newWebhookMessage returns the envelope of e, without the recipients. If parse is true, the email is
+// parsed for the headers, parts and attachments. If that fails, the envelope is returned with the error
+func newWebhookMessage(e *mail.Envelope, parse bool) (*WebhookMessage, error) {
+	msg := &WebhookMessage{
+		QueuedID:     e.QueuedId,
+		RemoteIP:     e.RemoteIP,
+		Helo:         e.Helo,
+		MailFrom:     e.MailFrom.String(),
+		TLS:          e.TLS,
+		AuthUsername: e.Auth.Username,
+		Subject:      e.Subject,
+	}
+	if !parse {
+		return msg, nil
+	}
+	header, parts, err := parseMimeParts(e.NewReader())
+	if header == nil {
+		return msg, err
+	}
+	msg.Headers = make(map[string][]string, len(header))
+	for k, values := range header {
+		for _, v := range values {
+			msg.Headers[k] = append(msg.Headers[k], mail.MimeHeaderDecode(v))
+		}
+	}
+	if msg.Subject == "" {
+		msg.Subject = mail.MimeHeaderDecode(header.Get("Subject"))
+	}
+	for _, p := range parts {
+		if p.Attachment {
+			msg.Attachments = append(msg.Attachments, WebhookAttachment{
+				Filename:    p.Filename,
+				ContentType: p.ContentType,
+				Size:        len(p.Content),
+				Content:     p.Content,
+			})
+			continue
+		}
+		msg.Parts = append(msg.Parts, WebhookPart{
+			ContentType: p.ContentType,
+			Charset:     p.Charset,
+			Content:     string(p.Content),
+		})
+	}
+	return msg, err
+}
+
+// body returns the body of the request for msg, and its content type
+func (w *webhook) body(msg *WebhookMessage, e *mail.Envelope) ([]byte, string, error) {
+	if w.config.Format == webhookJSON {
+		b, err := json.Marshal(msg)
+		return b, "application/json", err
+	}
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	envelope, err := json.Marshal(msg)
+	if err != nil {
+		return nil, "", err
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="envelope"`)
+	h.Set("Content-Type", "application/json")
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = pw.Write(envelope); err != nil {
+		return nil, "", err
+	}
+	h = textproto.MIMEHeader{}
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="message"; filename="%s.eml"`, msg.ID))
+	h.Set("Content-Type", "message/rfc822")
+	if pw, err = mw.CreatePart(h); err != nil {
+		return nil, "", err
+	}
+	if _, err = io.Copy(pw, e.NewReader()); err != nil {
+		return nil, "", err
+	}
+	if err = mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mw.FormDataContentType(), nil
+}
+
+// sign returns the signature of body at the time ts
+func (w *webhook) sign(ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.config.Secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post POSTs body to u, retrying after a 5xx reply or an error. Returns the status code of the last reply
+func (w *webhook) post(ctx context.Context, u string, id string, body []byte, contentType string) (int, error) {
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		status, err := w.postOnce(ctx, u, id, body, contentType)
+		if (err == nil && status < 500) || attempt >= w.config.Retries {
+			return status, err
+		}
+		if err != nil {
+			Log().WithError(err).Warnf("webhook %s failed, attempt %d", u, attempt+1)
+		} else {
+			Log().Warnf("webhook %s replied with %d, attempt %d", u, status, attempt+1)
+		}
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w *webhook) postOnce(ctx context.Context, u string, id string, body []byte, contentType string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(webhookIDHeader, id)
+	if w.config.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, ts)
+		req.Header.Set(webhookSignatureHeader, w.sign(ts, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// read some of the body so the connection can be used again
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// markWebhookResult marks rcpt with the result of the request
+func markWebhookResult(e *mail.Envelope, rcpt mail.Address, status int, err error) {
+	switch {
+	case err != nil:
+		MarkRcptDeferred(e, rcpt, nil)
+	case status >= 200 && status < 300:
+		MarkRcptDelivered(e, rcpt)
+	case status >= 400 && status < 500:
+		MarkRcptFailed(e, rcpt, nil)
+	default:
+		MarkRcptDeferred(e, rcpt, nil)
+	}
+}
+
+// webhookGroup is the recipients that are sent to the same URL
+type webhookGroup struct {
+	url   string
+	rcpts []mail.Address
+}
+
+// Webhook POSTs each email to a URL, once for each URL made for the recipients
+func Webhook() ContextDecorator {
+	w := &webhook{}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&WebhookProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		return w.configure(bcfg.(*WebhookProcessorConfig), backendConfig)
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if w.client != nil {
+			w.client.CloseIdleConnections()
+		}
+		return nil
+	}))
+	return func(p ContextProcessor) ContextProcessor {
+		return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.ProcessContext(ctx, e, task)
+			}
+			tracker := trackRcpts(e)
+			var groups []*webhookGroup
+			for _, rcpt := range e.RcptTo {
+				if tracker.dropped(rcpt) {
+					// an earlier processor deferred or failed it
+					continue
+				}
+				u := w.webhookURL(rcpt)
+				var group *webhookGroup
+				for _, g := range groups {
+					if g.url == u {
+						group = g
+						break
+					}
+				}
+				if group == nil {
+					group = &webhookGroup{url: u}
+					groups = append(groups, group)
+				}
+				group.rcpts = append(group.rcpts, rcpt)
+			}
+			if len(groups) == 0 {
+				return p.ProcessContext(ctx, e, task)
+			}
+			msg, err := newWebhookMessage(e, w.config.Format == webhookJSON)
+			if err != nil {
+				Log().WithError(err).Warnf("could not parse %s, not all of its parts are sent to the webhook", e.QueuedId)
+			}
+			for _, group := range groups {
+				msg.RcptTo = msg.RcptTo[:0]
+				for _, rcpt := range group.rcpts {
+					msg.RcptTo = append(msg.RcptTo, rcpt.String())
+				}
+				if msg.ID, err = publishID(e, group.rcpts); err != nil {
+					return NewResult(response.Canned.FailBackendTransaction), err
+				}
+				body, contentType, err := w.body(msg, e)
+				if err != nil {
+					return NewResult(response.Canned.FailBackendTransaction), err
+				}
+				status, err := w.post(ctx, group.url, msg.ID, body, contentType)
+				for _, rcpt := range group.rcpts {
+					markWebhookResult(e, rcpt, status, err)
+				}
+				if ctx.Err() != nil {
+					// timed out, the client was already told
+					return NewResult(response.Canned.FailBackendTimeout), ctx.Err()
+				}
+			}
+			return p.ProcessContext(ctx, e, task)
+		})
+	}
+}
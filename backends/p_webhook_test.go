@@ -0,0 +1,229 @@
+package backends
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+const webhookTestEmail = "Subject: =?utf-8?q?Caf=C3=A9?=\r\n" +
+	"From: sender@example.org\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=C3=A9 au lait\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Cafe</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+	"Content-Disposition: attachment; filename=\"data.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"AwQ=\r\n" +
+	"--outer--\r\n"
+
+func TestParseMimeParts(t *testing.T) {
+	header, parts, err := parseMimeParts(strings.NewReader(webhookTestEmail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("From") != "sender@example.org" {
+		t.Error("expecting the header, got", header)
+	}
+	if len(parts) != 3 {
+		t.Fatal("expecting 3 parts, got", len(parts))
+	}
+	if parts[0].ContentType != "text/plain" || parts[0].Attachment || string(parts[0].Content) != "Café au lait" {
+		t.Errorf("expecting the decoded text part, got %+v %q", parts[0], parts[0].Content)
+	}
+	if parts[1].ContentType != "text/html" || string(parts[1].Content) != "<p>Cafe</p>" {
+		t.Errorf("expecting the html part, got %+v %q", parts[1], parts[1].Content)
+	}
+	if !parts[2].Attachment || parts[2].Filename != "data.bin" || string(parts[2].Content) != "\x00\x01\x02\x03\x04" {
+		t.Errorf("expecting the decoded attachment, got %+v %q", parts[2], parts[2].Content)
+	}
+}
+
+// webhookRequest is a request received by the test server
+type webhookRequest struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []webhookRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, webhookRequest{path: r.URL.Path, header: r.Header, body: body})
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/inbound/rejected.com":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		case "/inbound/broken.com":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/inbound/slow.com":
+			time.Sleep(time.Millisecond * 200)
+		}
+	}))
+	defer server.Close()
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	for _, format := range []string{"json", "multipart"} {
+		requests = nil
+		c := BackendConfig{
+			"save_process":          "HeadersParser|Webhook",
+			"webhook_url":           server.URL + "/inbound/{domain}",
+			"webhook_format":        format,
+			"webhook_secret":        "secret",
+			"webhook_timeout":       "100ms",
+			"webhook_retries":       1,
+			"webhook_retry_backoff": "10ms",
+		}
+		gateway := &BackendGateway{}
+		if err := gateway.Initialize(c); err != nil {
+			t.Fatal("Gateway did not init because:", err)
+		}
+		if err := gateway.Start(); err != nil {
+			t.Fatal("Gateway did not start because:", err)
+		}
+
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = "abc123"
+		e.MailFrom = mail.Address{User: "sender", Host: "example.org"}
+		for _, rcpt := range []string{"alice@example.com", "bob@rejected.com", "carol@broken.com", "dave@slow.com", "erin@example.com"} {
+			at := strings.Index(rcpt, "@")
+			e.PushRcpt(mail.Address{User: rcpt[:at], Host: rcpt[at+1:]})
+		}
+		e.Data.WriteString(webhookTestEmail)
+		result := gateway.Process(e)
+		if result.Code() != 451 {
+			t.Error("expecting 451 for the deferred recipients, got", result)
+		}
+		rr, ok := result.(*RcptResults)
+		if !ok || len(rr.Rcpts) != 5 {
+			t.Fatal("expecting a result for each recipient, got", result)
+		}
+		for i, expect := range []struct {
+			status RcptStatus
+			code   int
+		}{
+			{RcptDelivered, 250},
+			{RcptFailed, 550},
+			{RcptDeferred, 451},
+			{RcptDeferred, 451},
+			{RcptDelivered, 250},
+		} {
+			if rr.Rcpts[i].Status != expect.status || rr.Rcpts[i].Result.Code() != expect.code {
+				t.Errorf("expecting %s to be %s with %d, got %s %s", rr.Rcpts[i].Rcpt.String(),
+					expect.status, expect.code, rr.Rcpts[i].Status, rr.Rcpts[i].Result)
+			}
+		}
+		// the next email on the connection has the same queued id
+		e.ResetTransaction()
+		e.PushRcpt(mail.Address{User: "alice", Host: "example.com"})
+		e.Data.WriteString("Subject: Next\r\n\r\nThis is the next email.\r\n")
+		if result := gateway.Process(e); result.Code() != 250 {
+			t.Error("expecting 250 for the next email, got", result)
+		}
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		count := make(map[string]int)
+		ids := make(map[string][]string)
+		for _, r := range requests {
+			count[r.path]++
+			ids[r.path] = append(ids[r.path], r.header.Get("X-Webhook-Id"))
+		}
+		// the 5xx and the timeout are retried once
+		if count["/inbound/example.com"] != 2 || count["/inbound/rejected.com"] != 1 ||
+			count["/inbound/broken.com"] != 2 || count["/inbound/slow.com"] != 2 {
+			t.Error("expecting one request for each domain, and a retry for the failures, got", count)
+		}
+		req := requests[0]
+		mu.Unlock()
+		if ids["/inbound/broken.com"][0] != ids["/inbound/broken.com"][1] {
+			t.Error("expecting the retry to have the same id, got", ids["/inbound/broken.com"])
+		}
+		if ids["/inbound/example.com"][0] == ids["/inbound/example.com"][1] {
+			t.Error("expecting each email of the connection to have its own id, got", ids["/inbound/example.com"])
+		}
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(req.header.Get("X-Webhook-Timestamp") + "."))
+		mac.Write(req.body)
+		if !hmac.Equal([]byte(req.header.Get("X-Webhook-Signature")), []byte("sha256="+hex.EncodeToString(mac.Sum(nil)))) {
+			t.Error("expecting the signature to match, got", req.header.Get("X-Webhook-Signature"))
+		}
+		if req.path != "/inbound/example.com" || len(req.header.Get("X-Webhook-Id")) != 64 {
+			t.Error("expecting the id of the message, got", req.path, req.header.Get("X-Webhook-Id"))
+		}
+
+		msg := &WebhookMessage{}
+		mediaType, params, _ := mime.ParseMediaType(req.header.Get("Content-Type"))
+		if format == "json" {
+			if err := json.Unmarshal(req.body, msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Subject != "Café" || len(msg.Parts) != 2 || len(msg.Attachments) != 1 ||
+				msg.Parts[0].Content != "Café au lait" || string(msg.Attachments[0].Content) != "\x00\x01\x02\x03\x04" {
+				t.Errorf("expecting the parsed email, got %+v", msg)
+			}
+			if len(msg.Headers["From"]) != 1 {
+				t.Error("expecting the headers, got", msg.Headers)
+			}
+		} else {
+			if mediaType != "multipart/form-data" {
+				t.Fatal("expecting a form, got", mediaType)
+			}
+			form, err := multipart.NewReader(strings.NewReader(string(req.body)), params["boundary"]).ReadForm(1 << 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(form.Value["envelope"][0]), msg); err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.Parts) != 0 || len(form.File["message"]) != 1 || form.File["message"][0].Size != int64(len(webhookTestEmail)) {
+				t.Errorf("expecting the envelope and the email, got %+v %v", msg, form.File)
+			} else if form.File["message"][0].Filename != msg.ID+".eml" {
+				t.Error("expecting the email to be named after the id, got", form.File["message"][0].Filename)
+			}
+		}
+		if msg.ID != req.header.Get("X-Webhook-Id") || msg.QueuedID != "abc123" || msg.MailFrom != "sender@example.org" || len(msg.RcptTo) != 2 ||
+			msg.RcptTo[0] != "alice@example.com" || msg.RcptTo[1] != "erin@example.com" {
+			t.Errorf("expecting the envelope with the recipients for the URL, got %+v", msg)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package backends
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// workerPool is a group of workers that process one type of task, such as TaskSaveMail.
+// Each pool has its own queue, so that a burst of slow tasks of one type does not hold up
+// tasks of another type.
+type workerPool struct {
+	// avgProcessNs is a moving average of how long the workers take for each task, in nanoseconds.
+	// Kept at the start of the struct since it's accessed atomically
+	avgProcessNs int64
+	// rejected counts the tasks that were not admitted to the queue
+	rejected uint64
+	// busyWorkers is the number of workers processing a task
+	busyWorkers int32
+
+	// name is used for logging, eg "save"
+	name string
+	// channel for distributing envelopes to the workers
+	conveyor chan *workerMsg
+	// stacks holds a processor stack for each worker
+	stacks       []Processor
+	workStoppers []chan bool
+	// maxWait rejects new tasks when the estimated wait is longer, 0 means no limit
+	maxWait time.Duration
+}
+
+// PoolStats describes the load of a worker pool
+type PoolStats struct {
+	// Depth is the number of tasks waiting for a worker
+	Depth int `json:"depth"`
+	// Capacity is how many tasks can wait for a worker
+	Capacity int `json:"capacity"`
+	// Workers is the number of workers
+	Workers int `json:"workers"`
+	// BusyWorkers is the number of workers processing a task
+	BusyWorkers int `json:"busy_workers"`
+	// AvgProcessTime is a moving average of the time taken for each task
+	AvgProcessTime time.Duration `json:"avg_process_time"`
+	// EstimatedWait is how long a new task would wait for a worker
+	EstimatedWait time.Duration `json:"estimated_wait"`
+	// Rejected counts the tasks that were rejected because the pool was too busy
+	Rejected uint64 `json:"rejected"`
+}
+
+// QueueStats describes the load of the backend, for each of its worker pools
+type QueueStats struct {
+	// Save is for the workers that save email
+	Save PoolStats `json:"save"`
+	// Validate is for the workers that validate recipients
+	Validate PoolStats `json:"validate"`
+	// Connect is for the workers that validate connections and HELO, if validate_connect_process is set
+	Connect PoolStats `json:"connect"`
+	// Sender is for the workers that validate MAIL FROM, if validate_sender_process is set
+	Sender PoolStats `json:"sender"`
+}
+
+// newWorkerPool makes a pool for len(stacks) workers, with room for queueSize tasks to wait
+func newWorkerPool(name string, stacks []Processor, queueSize int, maxWait time.Duration) *workerPool {
+	return &workerPool{
+		name:     name,
+		conveyor: make(chan *workerMsg, queueSize),
+		stacks:   stacks,
+		maxWait:  maxWait,
+	}
+}
+
+// size returns the number of workers
+func (p *workerPool) size() int {
+	return len(p.stacks)
+}
+
+// enqueue places msg on the conveyor without blocking. It's not admitted if the queue is full,
+// or if the estimated wait is longer than maxWait. Returns false if not admitted
+func (p *workerPool) enqueue(msg *workerMsg) bool {
+	if !p.overloaded() {
+		select {
+		case p.conveyor <- msg:
+			return true
+		default:
+		}
+	}
+	p.reject()
+	return false
+}
+
+// reject counts a task that was not admitted
+func (p *workerPool) reject() {
+	atomic.AddUint64(&p.rejected, 1)
+}
+
+// overloaded returns true if the estimated wait is longer than maxWait
+func (p *workerPool) overloaded() bool {
+	return p.maxWait > 0 && p.estimatedWait() > p.maxWait
+}
+
+// busy returns true when new tasks would be rejected, because the queue is full or the estimated wait
+// is longer than maxWait
+func (p *workerPool) busy() bool {
+	return len(p.conveyor) >= cap(p.conveyor) || p.overloaded()
+}
+
+// estimatedWait returns how long a new task would wait for a worker, based on the average
+// time the workers take and the number of tasks ahead of it
+func (p *workerPool) estimatedWait() time.Duration {
+	workers := p.size()
+	if workers == 0 {
+		return 0
+	}
+	ahead := len(p.conveyor) + int(atomic.LoadInt32(&p.busyWorkers)) - workers + 1
+	if ahead <= 0 {
+		// a worker is free
+		return 0
+	}
+	avg := atomic.LoadInt64(&p.avgProcessNs)
+	return time.Duration(int64(ahead) * avg / int64(workers))
+}
+
+// recordProcessTime updates the moving average of the time taken to process a task
+func (p *workerPool) recordProcessTime(d time.Duration) {
+	for {
+		old := atomic.LoadInt64(&p.avgProcessNs)
+		avg := int64(d)
+		if old > 0 {
+			// each new sample has a weight of 1/8
+			avg = old + (avg-old)/8
+		}
+		if atomic.CompareAndSwapInt64(&p.avgProcessNs, old, avg) {
+			return
+		}
+	}
+}
+
+// stats returns the current queue depth, capacity and other stats about the load of the pool
+func (p *workerPool) stats() PoolStats {
+	if p == nil {
+		// not initialized
+		return PoolStats{}
+	}
+	return PoolStats{
+		Depth:          len(p.conveyor),
+		Capacity:       cap(p.conveyor),
+		Workers:        p.size(),
+		BusyWorkers:    int(atomic.LoadInt32(&p.busyWorkers)),
+		AvgProcessTime: time.Duration(atomic.LoadInt64(&p.avgProcessNs)),
+		EstimatedWait:  p.estimatedWait(),
+		Rejected:       atomic.LoadUint64(&p.rejected),
+	}
+}
+
+// stopWorkers sends a signal to all workers to stop
+func (p *workerPool) stopWorkers() {
+	if p == nil {
+		return
+	}
+	for i := range p.workStoppers {
+		p.workStoppers[i] <- true
+	}
+	p.workStoppers = nil
+}
@@ -0,0 +1,43 @@
+package backends
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoolAdmission(t *testing.T) {
+	pool := newWorkerPool("test", []Processor{NoopProcessor{}, NoopProcessor{}}, 2, time.Second)
+	pool.recordProcessTime(time.Second)
+	if w := pool.estimatedWait(); w != 0 {
+		t.Error("expecting no wait when the workers are free, got", w)
+	}
+	pool.busyWorkers = 2
+	if !pool.enqueue(&workerMsg{}) {
+		t.Error("expecting the task to be admitted")
+	}
+	// 2 tasks ahead, 2 workers, 1s each
+	if w := pool.estimatedWait(); w != time.Second {
+		t.Error("expecting a 1s wait, got", w)
+	}
+	if pool.busy() {
+		t.Error("the pool should not be busy yet")
+	}
+	if !pool.enqueue(&workerMsg{}) {
+		t.Error("expecting the task to be admitted")
+	}
+	// 3 tasks ahead
+	if !pool.overloaded() || !pool.busy() {
+		t.Error("expecting the pool to be overloaded")
+	}
+	if pool.enqueue(&workerMsg{}) {
+		t.Error("expecting the task to be rejected")
+	}
+	stats := pool.stats()
+	if stats.Depth != 2 || stats.Capacity != 2 || stats.Workers != 2 || stats.Rejected != 1 {
+		t.Error("unexpected stats", stats)
+	}
+	pool.recordProcessTime(0)
+	if avg := time.Duration(pool.avgProcessNs); avg != time.Second*7/8 {
+		t.Error("expecting the average to move by 1/8, got", avg)
+	}
+}
@@ -9,6 +9,12 @@ type SelectTask int
 const (
 	TaskSaveMail SelectTask = iota
 	TaskValidateRcpt
+	// TaskValidateConnect is for validating the client when it connects, e.RemoteIP is set
+	TaskValidateConnect
+	// TaskValidateHelo is for validating the HELO or EHLO command, e.Helo is set
+	TaskValidateHelo
+	// TaskValidateMailFrom is for validating the MAIL FROM command, e.MailFrom is set
+	TaskValidateMailFrom
 )
 
 func (o SelectTask) String() string {
@@ -17,6 +23,12 @@ func (o SelectTask) String() string {
 		return "save mail"
 	case TaskValidateRcpt:
 		return "validate recipient"
+	case TaskValidateConnect:
+		return "validate connect"
+	case TaskValidateHelo:
+		return "validate helo"
+	case TaskValidateMailFrom:
+		return "validate mail from"
 	}
 	return "[unnamed task]"
 }
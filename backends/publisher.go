@@ -0,0 +1,372 @@
+package backends
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
+)
+
+// Publisher publishes messages to a message broker. The nats, kafka and amqp processors each have one.
+// A Publisher is used by one goroutine at a time
+type Publisher interface {
+	// Publish sends msg to subject, which is the subject, topic or routing key, depending on the broker.
+	// It returns when the broker has confirmed that it has the message, or ctx is done
+	Publish(ctx context.Context, subject string, msg *PublishMessage) error
+	// Close closes the connection to the broker
+	Close() error
+}
+
+// PublishMessage is a message to publish
+type PublishMessage struct {
+	// ID is the same each time the email is published again to the same recipients, see publishID.
+	// Brokers that can, use it to drop duplicates
+	ID      string
+	Headers map[string]string
+	// Body is a PublishedEmail, in json
+	Body []byte
+}
+
+// PublishDialer connects to a broker, returning a Publisher
+type PublishDialer func() (Publisher, error)
+
+// PublishedEmail is what is published for each email
+type PublishedEmail struct {
+	*mail.EnvelopeMeta
+	Subject string   `json:"subject"`
+	Hashes  []string `json:"hashes,omitempty"`
+	// Data is the email with its delivery header. It's not set when the payload is a reference
+	Data []byte `json:"data,omitempty"`
+	// Values has the values of e.Values that are strings, numbers or bools. When the payload is a reference,
+	// the consumer finds the email with them, for example, s3_key, set by the S3 processor, or eml_path
+	Values map[string]interface{} `json:"values,omitempty"`
+}
+
+// PublishRejected is returned by a Publisher when the broker refused the message. Unlike other errors,
+// the connection is still good, so it's kept
+type PublishRejected struct {
+	error
+}
+
+var errPublishNacked = PublishRejected{errors.New("the broker did not confirm the message")}
+
+const (
+	// publishInline publishes the email with the envelope
+	publishInline = "inline"
+	// publishReference publishes only the envelope, for when an earlier processor stored the email
+	publishReference = "reference"
+)
+
+// PublishConfig is the config that the processors that publish have in common.
+// Each has these options with its own prefix, such as nats_subject
+type PublishConfig struct {
+	// Subject is a template, where {queued_id}, {rcpt}, {rcpt_user}, {rcpt_domain} and
+	// {mail_from_domain} are replaced. default "mail"
+	Subject string
+	// Payload is inline, to publish the email with the envelope, or reference. default inline
+	Payload string
+	// PoolSize is how many connections to keep. default 4
+	PoolSize int
+	// Timeout is how long to wait for the broker to confirm. default "10s"
+	Timeout string
+}
+
+// publisherPool keeps up to size connections to a broker. A connection that fails is closed, and a new
+// one is dialed when it's needed again, so the processors reconnect after the broker goes away
+type publisherPool struct {
+	dial PublishDialer
+	idle chan Publisher
+	sem  chan struct{}
+}
+
+func newPublisherPool(size int, dial PublishDialer) *publisherPool {
+	return &publisherPool{
+		dial: dial,
+		idle: make(chan Publisher, size),
+		sem:  make(chan struct{}, size),
+	}
+}
+
+// get returns an idle connection, or dials a new one. It waits if all the connections are being used.
+// reused is true if the connection was used before, so it may have been closed by the broker since
+func (p *publisherPool) get(ctx context.Context) (pub Publisher, reused bool, err error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	select {
+	case pub = <-p.idle:
+		return pub, true, nil
+	default:
+	}
+	if pub, err = p.dial(); err != nil {
+		<-p.sem
+		return nil, false, err
+	}
+	return pub, false, nil
+}
+
+// put returns pub to the pool. If err is not nil, and not a PublishRejected, the connection is closed instead
+func (p *publisherPool) put(pub Publisher, err error) {
+	if _, rejected := err.(PublishRejected); err != nil && !rejected {
+		if closeErr := pub.Close(); closeErr != nil {
+			Log().WithError(closeErr).Debug("could not close connection to broker")
+		}
+	} else {
+		p.idle <- pub
+	}
+	<-p.sem
+}
+
+// close closes the idle connections
+func (p *publisherPool) close() error {
+	var errs Errors
+	for {
+		select {
+		case pub := <-p.idle:
+			if err := pub.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		default:
+			if len(errs) == 0 {
+				return nil
+			}
+			return errs
+		}
+	}
+}
+
+// publish publishes msg with a connection from the pool. If a connection that was used before fails,
+// it tries again with a new connection, since the broker may have closed the old one. It doesn't try
+// again if the broker rejected the message
+func (p *publisherPool) publish(ctx context.Context, subject string, msg *PublishMessage) error {
+	for {
+		pub, reused, err := p.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = pub.Publish(ctx, subject, msg)
+		p.put(pub, err)
+		if _, rejected := err.(PublishRejected); err == nil || rejected || !reused || ctx.Err() != nil {
+			return err
+		}
+		Log().WithError(err).Debug("publishing failed, trying again with a new connection")
+	}
+}
+
+// publishSubject makes the subject from template for rcpt
+func publishSubject(template string, e *mail.Envelope, rcpt mail.Address) string {
+	// the values are from the client, so only allow what every broker allows
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+				return r
+			}
+			return '_'
+		}, strings.ToLower(s))
+	}
+	return strings.NewReplacer(
+		"{queued_id}", clean(e.QueuedId),
+		"{rcpt}", clean(rcpt.String()),
+		"{rcpt_user}", clean(rcpt.User),
+		"{rcpt_domain}", clean(rcpt.Host),
+		"{mail_from_domain}", clean(e.MailFrom.Host),
+	).Replace(template)
+}
+
+// publishGroup is the recipients that are published to the same subject
+type publishGroup struct {
+	subject string
+	rcpts   []mail.Address
+}
+
+// broker is what the processors that publish have in common
+type broker struct {
+	name    string
+	subject string
+	inline  bool
+	timeout time.Duration
+	pool    *publisherPool
+}
+
+// configure checks config, filling in the defaults, and connects to the broker to check that it can
+func (b *broker) configure(config *PublishConfig, dial PublishDialer) error {
+	prefix := b.name + "_"
+	if config.Subject == "" {
+		config.Subject = "mail"
+	}
+	switch config.Payload {
+	case "":
+		config.Payload = publishInline
+	case publishInline, publishReference:
+	default:
+		return fmt.Errorf("%spayload [%s] must be %s or %s", prefix, config.Payload, publishInline, publishReference)
+	}
+	if config.PoolSize == 0 {
+		config.PoolSize = 4
+	}
+	if config.PoolSize < 0 {
+		return fmt.Errorf("%spool_size cannot be negative", prefix)
+	}
+	if config.Timeout == "" {
+		config.Timeout = "10s"
+	}
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return fmt.Errorf("%stimeout [%s] is not a duration: %s", prefix, config.Timeout, err)
+	}
+	b.subject = config.Subject
+	b.inline = config.Payload == publishInline
+	b.timeout = timeout
+	b.pool = newPublisherPool(config.PoolSize, dial)
+	// connect now, so that a wrong config is found when starting
+	pub, _, err := b.pool.get(context.Background())
+	if err != nil {
+		return fmt.Errorf("could not connect to %s: %s", b.name, err)
+	}
+	b.pool.put(pub, nil)
+	return nil
+}
+
+func (b *broker) shutdown() error {
+	if b.pool == nil {
+		return nil
+	}
+	return b.pool.close()
+}
+
+// message returns the message to publish for e, to rcpts
+func (b *broker) message(e *mail.Envelope, rcpts []mail.Address) (*PublishMessage, error) {
+	published := &PublishedEmail{
+		EnvelopeMeta: e.Meta(),
+		Subject:      e.Subject,
+		Hashes:       e.Hashes,
+		Values:       emlValues(e.Values),
+	}
+	published.RcptTo = rcpts
+	if b.inline {
+		data, err := ioutil.ReadAll(e.NewReader())
+		if err != nil {
+			return nil, err
+		}
+		published.Data = data
+	} else if published.Values == nil {
+		Log().Warnf("published %s as a reference, but no processor set where it's stored", e.QueuedId)
+	}
+	body, err := json.Marshal(published)
+	if err != nil {
+		return nil, err
+	}
+	id, err := publishID(e, rcpts)
+	if err != nil {
+		return nil, err
+	}
+	return &PublishMessage{
+		ID: id,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"Queued-Id":    e.QueuedId,
+		},
+		Body: body,
+	}, nil
+}
+
+// publishID returns the id of the message for e, to rcpts. It's a hash of the queued id, the recipients
+// and the email, rather than the queued id, since the emails sent on one connection share a queued id
+func publishID(e *mail.Envelope, rcpts []mail.Address) (string, error) {
+	h := sha256.New()
+	_, _ = io.WriteString(h, e.QueuedId)
+	for _, rcpt := range rcpts {
+		_, _ = io.WriteString(h, "\x00"+rcpt.String())
+	}
+	_, _ = io.WriteString(h, "\x00")
+	if _, err := io.Copy(h, e.DataReader()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// process publishes e, once for each subject made for its recipients. The recipients are deferred if
+// publishing to their subject fails. Returns a nil Result if the next processor should be called
+func (b *broker) process(ctx context.Context, e *mail.Envelope) (Result, error) {
+	tracker := trackRcpts(e)
+	var groups []*publishGroup
+	for _, rcpt := range e.RcptTo {
+		if tracker.dropped(rcpt) {
+			// an earlier processor deferred or failed it
+			continue
+		}
+		subject := publishSubject(b.subject, e, rcpt)
+		var group *publishGroup
+		for _, g := range groups {
+			if g.subject == subject {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			group = &publishGroup{subject: subject}
+			groups = append(groups, group)
+		}
+		group.rcpts = append(group.rcpts, rcpt)
+	}
+	for _, group := range groups {
+		msg, err := b.message(e, group.rcpts)
+		if err != nil {
+			return NewResult(response.Canned.FailBackendTransaction), err
+		}
+		pctx, cancel := context.WithTimeout(ctx, b.timeout)
+		err = b.pool.publish(pctx, group.subject, msg)
+		cancel()
+		if ctx.Err() != nil {
+			// timed out, the client was already told
+			return NewResult(response.Canned.FailBackendTimeout), ctx.Err()
+		}
+		if err != nil {
+			Log().WithError(err).Errorf("could not publish %s to %s [%s]", e.QueuedId, b.name, group.subject)
+			for _, rcpt := range group.rcpts {
+				MarkRcptDeferred(e, rcpt, nil)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// PublishWith returns a processor that publishes each email with a Publisher. The nats, kafka and amqp
+// processors are made with it. configure is called when the backend is initialized, to get the config
+// that they have in common, and the dialer for the broker
+func PublishWith(name string, configure func(BackendConfig) (*PublishConfig, PublishDialer, error)) ContextDecorator {
+	b := &broker{name: name}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		config, dial, err := configure(backendConfig)
+		if err != nil {
+			return err
+		}
+		return b.configure(config, dial)
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		return b.shutdown()
+	}))
+	return func(p ContextProcessor) ContextProcessor {
+		return ProcessContextWith(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.ProcessContext(ctx, e, task)
+			}
+			if result, err := b.process(ctx, e); result != nil {
+				return result, err
+			}
+			return p.ProcessContext(ctx, e, task)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// fakeBroker is a stand-in for a broker. Restarting it breaks the connections that were made before
+type fakeBroker struct {
+	sync.Mutex
+	published map[string][]*PublishMessage
+	dials     int
+	restarts  int
+	// fail is the subjects that the broker doesn't confirm
+	fail map[string]bool
+}
+
+type fakePublisher struct {
+	b        *fakeBroker
+	restarts int
+	closed   bool
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, subject string, msg *PublishMessage) error {
+	f.b.Lock()
+	defer f.b.Unlock()
+	if f.closed || f.restarts != f.b.restarts {
+		return errors.New("connection reset by peer")
+	}
+	if f.b.fail[subject] {
+		return errPublishNacked
+	}
+	f.b.published[subject] = append(f.b.published[subject], msg)
+	return nil
+}
+
+func (f *fakePublisher) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (b *fakeBroker) dial() (Publisher, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.dials++
+	return &fakePublisher{b: b, restarts: b.restarts}, nil
+}
+
+func TestPublishSubject(t *testing.T) {
+	e := newSpoolTestEnvelope()
+	e.MailFrom = mail.Address{User: "sender", Host: "Example.org"}
+	rcpt := mail.Address{User: "Bob*>", Host: "example.com"}
+	if s := publishSubject("mail.{rcpt_domain}.{rcpt_user}.{mail_from_domain}.{queued_id}", e, rcpt); s != "mail.example.com.bob__.example.org.abc12345" {
+		t.Error("expecting the values to be replaced and cleaned, got", s)
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	b := &fakeBroker{published: make(map[string][]*PublishMessage), fail: map[string]bool{"mail.broken.com": true}}
+	Svc.AddContextProcessor("FakePublisher", func() ContextDecorator {
+		return PublishWith("fake", func(backendConfig BackendConfig) (*PublishConfig, PublishDialer, error) {
+			payload, _ := backendConfig["fake_payload"].(string)
+			return &PublishConfig{Subject: "mail.{rcpt_domain}", Payload: payload, PoolSize: 2}, b.dial, nil
+		})
+	})
+	defer delete(contextProcessors, "fakepublisher")
+
+	for _, payload := range []string{publishInline, publishReference} {
+		c := BackendConfig{
+			"save_process": "HeadersParser|FakePublisher",
+			"fake_payload": payload,
+		}
+		gateway := &BackendGateway{}
+		if err := gateway.Initialize(c); err != nil {
+			t.Fatal("Gateway did not init because:", err)
+		}
+		if err := gateway.Start(); err != nil {
+			t.Fatal("Gateway did not start because:", err)
+		}
+		b.Lock()
+		b.published = make(map[string][]*PublishMessage)
+		if b.dials != 1 {
+			t.Error("expecting a connection to be made when starting, got", b.dials)
+		}
+		// the connection made when starting is broken, so it's replaced
+		b.restarts++
+		b.Unlock()
+
+		e := newSpoolTestEnvelope()
+		e.RcptTo = []mail.Address{{User: "alice", Host: "example.com"}, {User: "bob", Host: "broken.com"}, {User: "carol", Host: "example.com"}}
+		e.Values[s3KeyValue] = "2020/01/02/abc12345"
+		result := gateway.Process(e)
+		if result.Code() != 451 {
+			t.Error("expecting 451 for the deferred recipient, got", result)
+		}
+		rr, ok := result.(*RcptResults)
+		if !ok || rr.Rcpts[1].Status != RcptDeferred || rr.Rcpts[1].Result.Code() != 451 || rr.Rcpts[0].Status != RcptDelivered {
+			t.Error("expecting bob to be deferred, got", result)
+		}
+
+		b.Lock()
+		if b.dials != 2 {
+			t.Error("expecting a new connection after the broken one, got", b.dials, "dials")
+		}
+		msgs := b.published["mail.example.com"]
+		id, _ := publishID(e, []mail.Address{e.RcptTo[0], e.RcptTo[2]})
+		if len(b.published) != 1 || len(msgs) != 1 || msgs[0].ID != id {
+			t.Fatal("expecting one message for example.com, got", b.published)
+		}
+		b.dials = 0
+		b.restarts = 0
+		b.Unlock()
+
+		published := &PublishedEmail{}
+		if err := json.Unmarshal(msgs[0].Body, published); err != nil {
+			t.Fatal(err)
+		}
+		if published.QueuedId != "abc12345" || len(published.RcptTo) != 2 || published.RcptTo[1].User != "carol" ||
+			published.Subject != "Test" || published.Values[s3KeyValue] != "2020/01/02/abc12345" {
+			t.Errorf("expecting the envelope with alice and carol, got %+v", published)
+		}
+		if payload == publishInline && string(published.Data) != "Subject: Test\n\nThis is a test." {
+			t.Errorf("expecting the email, got %q", published.Data)
+		}
+		if payload == publishReference && published.Data != nil {
+			t.Errorf("expecting only the reference, got %q", published.Data)
+		}
+		if err := gateway.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package backends
+
+import (
+	"strings"
+
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
+)
+
+// RcptStatus is the outcome of processing an envelope, for one of its recipients
+type RcptStatus int
+
+const (
+	// RcptDelivered means that the email was saved for the recipient
+	RcptDelivered RcptStatus = iota
+	// RcptDeferred means there was a temporary failure, the recipient may be tried again later
+	RcptDeferred
+	// RcptFailed means there was a permanent failure
+	RcptFailed
+)
+
+func (s RcptStatus) String() string {
+	switch s {
+	case RcptDelivered:
+		return "delivered"
+	case RcptDeferred:
+		return "deferred"
+	case RcptFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// RcptResult is the result of processing an envelope for one recipient
+type RcptResult struct {
+	Rcpt   mail.Address
+	Status RcptStatus
+	// Result is the reply for the recipient, for example, a reply to send to an LMTP client
+	Result Result
+}
+
+// RcptResults is a Result that also has the result for each recipient.
+// The gateway returns it from Process when the processors marked any of the recipients with
+// MarkRcptDelivered, MarkRcptDeferred or MarkRcptFailed.
+// The embedded Result is for the whole envelope, and is what the SMTP client gets as a reply to DATA.
+// It's a temporary failure if any recipient was deferred, otherwise a permanent failure if any recipient
+// failed, so that the client bounces the email to the sender. It's a success only if the email was
+// delivered to all of the recipients.
+type RcptResults struct {
+	Result
+	// Rcpts has a result for each recipient, in the order they were given by the client
+	Rcpts []RcptResult
+}
+
+// the key of the recipient statuses in e.Values
+const rcptStatusKey = "rcpt-status"
+
+// rcptTracker keeps the statuses of the recipients while the envelope is processed.
+// It remembers all the recipients, so they are still known after DropFailedRcpts removes them from e.RcptTo
+type rcptTracker struct {
+	rcpts  []RcptResult
+	marked []bool
+	// changed is true for the recipients that were marked since the tracker was made or cloned
+	changed []bool
+}
+
+// trackRcpts returns the rcptTracker of e, or makes a new one
+func trackRcpts(e *mail.Envelope) *rcptTracker {
+	if t, ok := e.Values[rcptStatusKey].(*rcptTracker); ok {
+		return t
+	}
+	t := &rcptTracker{
+		rcpts:   make([]RcptResult, len(e.RcptTo)),
+		marked:  make([]bool, len(e.RcptTo)),
+		changed: make([]bool, len(e.RcptTo)),
+	}
+	for i := range e.RcptTo {
+		t.rcpts[i].Rcpt = e.RcptTo[i]
+	}
+	e.Values[rcptStatusKey] = t
+	return t
+}
+
+// mark sets the status of rcpt. Returns false if rcpt is not a recipient of the envelope
+func (t *rcptTracker) mark(rcpt mail.Address, status RcptStatus, result Result) bool {
+	for i := range t.rcpts {
+		if sameRcpt(t.rcpts[i].Rcpt, rcpt) {
+			t.rcpts[i].Status = status
+			t.rcpts[i].Result = result
+			t.marked[i], t.changed[i] = true, true
+			return true
+		}
+	}
+	return false
+}
+
+// Branch returns a copy of t, for a stack of a fan-out. None of its recipients are changed yet
+func (t *rcptTracker) Branch(*mail.Envelope) interface{} {
+	return &rcptTracker{
+		rcpts:   append([]RcptResult(nil), t.rcpts...),
+		marked:  append([]bool(nil), t.marked...),
+		changed: make([]bool, len(t.rcpts)),
+	}
+}
+
+// dropped returns true if rcpt was marked as deferred or failed
+func (t *rcptTracker) dropped(rcpt mail.Address) bool {
+	for i := range t.rcpts {
+		if t.marked[i] && t.rcpts[i].Status != RcptDelivered && sameRcpt(t.rcpts[i].Rcpt, rcpt) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMarked returns true if rcpt was given a status
+func (t *rcptTracker) isMarked(rcpt mail.Address) bool {
+	for i := range t.rcpts {
+		if t.marked[i] && sameRcpt(t.rcpts[i].Rcpt, rcpt) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameRcpt compares two recipients. The host part is case-insensitive
+func sameRcpt(a, b mail.Address) bool {
+	return a.User == b.User && strings.EqualFold(a.Host, b.Host)
+}
+
+// MarkRcptDelivered marks the email as delivered for rcpt
+func MarkRcptDelivered(e *mail.Envelope, rcpt mail.Address) {
+	markRcpt(e, rcpt, RcptDelivered, NewResult(response.Canned.SuccessMessageQueued, response.SP, e.QueuedId))
+}
+
+// MarkRcptDeferred marks rcpt as having a temporary failure. The result is the reply for the recipient,
+// if nil, a 451 reply is used
+func MarkRcptDeferred(e *mail.Envelope, rcpt mail.Address, result Result) {
+	if result == nil {
+		result = NewResult(response.Canned.FailRcptDeferred)
+	}
+	markRcpt(e, rcpt, RcptDeferred, result)
+}
+
+// MarkRcptFailed marks rcpt as having a permanent failure, for example, when the mailbox is over quota.
+// The result is the reply for the recipient, if nil, a 550 reply is used
+func MarkRcptFailed(e *mail.Envelope, rcpt mail.Address, result Result) {
+	if result == nil {
+		result = NewResult(response.Canned.FailRcptDelivery)
+	}
+	markRcpt(e, rcpt, RcptFailed, result)
+}
+
+func markRcpt(e *mail.Envelope, rcpt mail.Address, status RcptStatus, result Result) {
+	if !trackRcpts(e).mark(rcpt, status, result) {
+		Log().Warnf("cannot mark <%s> as %s, not a recipient of the envelope", rcpt.String(), status)
+	}
+}
+
+// RcptStatuses returns the recipients that were marked so far
+func RcptStatuses(e *mail.Envelope) []RcptResult {
+	t, ok := e.Values[rcptStatusKey].(*rcptTracker)
+	if !ok {
+		return nil
+	}
+	var rcpts []RcptResult
+	for i := range t.rcpts {
+		if t.marked[i] {
+			rcpts = append(rcpts, t.rcpts[i])
+		}
+	}
+	return rcpts
+}
+
+// DropFailedRcpts removes the recipients that were marked as deferred or failed from e.RcptTo,
+// so that the processors that come next will not deliver to them.
+// Their results are kept and still returned by RcptStatuses
+func DropFailedRcpts(e *mail.Envelope) {
+	t, ok := e.Values[rcptStatusKey].(*rcptTracker)
+	if !ok {
+		return
+	}
+	rcpts := e.RcptTo[:0]
+	for i := range e.RcptTo {
+		if !t.dropped(e.RcptTo[i]) {
+			rcpts = append(rcpts, e.RcptTo[i])
+		}
+	}
+	e.RcptTo = rcpts
+}
+
+// newRcptResults makes a RcptResults from the result of processing e. The recipients that were not
+// marked by the processors get the result of the envelope. Returns result unchanged if none were marked.
+// The result of the envelope is a temporary failure if any recipient was deferred, or the failure of
+// the first recipient that failed
+func newRcptResults(e *mail.Envelope, result Result) Result {
+	t, ok := e.Values[rcptStatusKey].(*rcptTracker)
+	if !ok {
+		return result
+	}
+	rr := &RcptResults{Result: result, Rcpts: make([]RcptResult, len(t.rcpts))}
+	var deferred, failed Result
+	for i := range t.rcpts {
+		r := t.rcpts[i]
+		if !t.marked[i] {
+			r.Result = result
+			switch code := result.Code(); {
+			case code < 300:
+				r.Status = RcptDelivered
+			case code < 500:
+				r.Status = RcptDeferred
+			default:
+				r.Status = RcptFailed
+			}
+		}
+		switch r.Status {
+		case RcptDeferred:
+			if deferred == nil {
+				deferred = r.Result
+			}
+		case RcptFailed:
+			if failed == nil {
+				failed = r.Result
+			}
+		}
+		rr.Rcpts[i] = r
+	}
+	if deferred != nil {
+		// the client won't try again after a success, so the deferred recipients would be lost.
+		// It tries all of them again, so the delivered recipients can get it twice, which is better
+		rr.Result = deferred
+	} else if failed != nil {
+		// there's no bounce sent from here, so the client has to send one to the sender, or the email
+		// to the failed recipients would be lost. The recipients it was delivered to have it already
+		rr.Result = failed
+	}
+	return rr
+}
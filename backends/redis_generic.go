@@ -1,7 +1,14 @@
 package backends
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -9,6 +16,9 @@ func init() {
 	RedisDialer = func(network, address string, options ...RedisDialOption) (RedisConn, error) {
 		return new(RedisMockConn), nil
 	}
+	RedisPooler = func(network, address string, config RedisPoolConfig, options ...RedisDialOption) RedisPool {
+		return new(RedisMockPool)
+	}
 }
 
 // RedisConn interface provides a generic way to access Redis via drivers
@@ -17,6 +27,32 @@ type RedisConn interface {
 	Do(commandName string, args ...interface{}) (reply interface{}, err error)
 }
 
+// RedisContextConn is a RedisConn that can give up on a command when ctx is done, without being closed.
+// The connections of a RedisPool should be RedisContextConns, since closing them returns them to the pool
+type RedisContextConn interface {
+	RedisConn
+	DoContext(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error)
+}
+
+// RedisPool is a pool of connections to redis, shared by the workers
+type RedisPool interface {
+	// Get returns a connection from the pool, or a new one. If MaxActive connections are in use,
+	// it waits for one to be returned until ctx is done. Closing the connection returns it to the pool
+	Get(ctx context.Context) (RedisConn, error)
+	// Close closes the idle connections, and the connections in use when they are returned
+	Close() error
+}
+
+// RedisPoolConfig is how many connections a RedisPool keeps
+type RedisPoolConfig struct {
+	// MaxIdle is how many idle connections to keep
+	MaxIdle int
+	// MaxActive is how many connections can be open at once, 0 for no limit
+	MaxActive int
+	// IdleTimeout is how long a connection can be idle before it's closed, 0 to keep it
+	IdleTimeout time.Duration
+}
+
 type RedisMockConn struct{}
 
 func (m *RedisMockConn) Close() error {
@@ -28,18 +64,266 @@ func (m *RedisMockConn) Do(commandName string, args ...interface{}) (reply inter
 	return nil, nil
 }
 
-type dialOptions struct {
-	readTimeout  time.Duration
-	writeTimeout time.Duration
-	dial         func(network, addr string) (net.Conn, error)
-	db           int
-	password     string
+// RedisMockPool is the pool used when no driver is loaded, it gets RedisMockConns
+type RedisMockPool struct{}
+
+func (m *RedisMockPool) Get(ctx context.Context) (RedisConn, error) {
+	return new(RedisMockConn), ctx.Err()
+}
+
+func (m *RedisMockPool) Close() error {
+	return nil
+}
+
+// redisDoContext is like conn.Do, but gives up when ctx is done. If conn is not a RedisContextConn,
+// there is no way to cancel a command, so conn is closed to unblock it. If ctx.Err() is returned,
+// conn has been closed and the caller needs to connect again
+func redisDoContext(ctx context.Context, conn RedisConn, commandName string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c, ok := conn.(RedisContextConn); ok {
+		reply, err := c.DoContext(ctx, commandName, args...)
+		if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+			_ = conn.Close()
+			return nil, ctxErr
+		}
+		return reply, err
+	}
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+	reply, err := conn.Do(commandName, args...)
+	close(done)
+	if <-closed {
+		return nil, ctx.Err()
+	}
+	return reply, err
+}
+
+// redisPoolDo runs a command with a connection from pool, and returns the connection to the pool
+func redisPoolDo(ctx context.Context, pool RedisPool, commandName string, args ...interface{}) (interface{}, error) {
+	conn, err := pool.Get(ctx)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	reply, err := redisDoContext(ctx, conn, commandName, args...)
+	if err != nil && err == ctx.Err() {
+		// redisDoContext closed it
+		return nil, err
+	}
+	if closeErr := conn.Close(); closeErr != nil {
+		Log().WithError(closeErr).Debug("could not return the connection to the redis pool")
+	}
+	return reply, err
+}
+
+// redisPoolConfig reads the redis_max_idle, redis_max_active and redis_idle_timeout settings of a processor.
+// redis_max_idle defaults to 10 and redis_idle_timeout to 240s if they're not in backendConfig
+func redisPoolConfig(backendConfig BackendConfig, maxIdle, maxActive int, idleTimeout string) (RedisPoolConfig, error) {
+	config := RedisPoolConfig{MaxIdle: maxIdle, MaxActive: maxActive}
+	if _, ok := backendConfig["redis_max_idle"]; !ok {
+		config.MaxIdle = 10
+	}
+	if idleTimeout == "" {
+		idleTimeout = "240s"
+	}
+	var err error
+	if config.IdleTimeout, err = time.ParseDuration(idleTimeout); err != nil {
+		return config, fmt.Errorf("redis_idle_timeout [%s] is not a duration: %s", idleTimeout, err)
+	}
+	return config, nil
+}
+
+// newRedisPool makes a pool with RedisPooler, and checks that it can connect to the server
+func newRedisPool(backendConfig BackendConfig, address string, config RedisPoolConfig) (RedisPool, error) {
+	pool, err := redisPoolFor(backendConfig, address, config)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if _, err := redisPoolDo(ctx, pool, "PING"); err != nil {
+		_ = pool.Close()
+		return nil, fmt.Errorf("redis cannot connect, check your settings: %s", err)
+	}
+	return pool, nil
+}
+
+// redisPoolFor makes a pool with RedisPooler, with the connection settings of backendConfig
+func redisPoolFor(backendConfig BackendConfig, address string, config RedisPoolConfig) (RedisPool, error) {
+	options, err := redisDialOptions(backendConfig)
+	if err != nil {
+		return nil, err
+	}
+	return RedisPooler("tcp", address, config, options...), nil
+}
+
+// RedisConnectionConfig has how to connect to redis. It's shared by all the processors that use redis,
+// add its options to the schema with redisConfigOptions
+type RedisConnectionConfig struct {
+	Username         string `json:"redis_username,omitempty" desc:"Username to AUTH with, for redis 6 ACLs"`
+	Password         string `json:"redis_password,omitempty" desc:"Password to AUTH with"`
+	DB               int    `json:"redis_db,omitempty" default:"0" desc:"Database to SELECT, it must be 0 for a cluster"`
+	TLS              bool   `json:"redis_tls,omitempty" desc:"Connect with TLS"`
+	TLSCAFile        string `json:"redis_tls_ca_file,omitempty" desc:"PEM file of the CAs that signed the server certificate, the system CAs if not set"`
+	TLSSkipVerify    bool   `json:"redis_tls_skip_verify,omitempty" desc:"Don't verify the server certificate"`
+	SentinelMaster   string `json:"redis_sentinel_master,omitempty" desc:"Name of the master to ask the sentinels for"`
+	SentinelAddrs    string `json:"redis_sentinel_addrs,omitempty" desc:"Comma separated list of sentinels, <host>:<port>"`
+	SentinelPassword string `json:"redis_sentinel_password,omitempty" desc:"Password of the sentinels"`
+	Cluster          bool   `json:"redis_cluster,omitempty" desc:"redis_interface is a comma separated list of cluster nodes"`
+}
+
+// redisConfigOptions returns the options of configType and the redis connection options, for a schema
+func redisConfigOptions(configType BaseConfig) []ConfigOption {
+	return append(ConfigOptions(configType), ConfigOptions(&RedisConnectionConfig{})...)
+}
+
+// redisDialOptions returns the dial options of the connection settings in backendConfig
+func redisDialOptions(backendConfig BackendConfig) ([]RedisDialOption, error) {
+	bcfg, err := Svc.ExtractConfig(backendConfig, &RedisConnectionConfig{})
+	if err != nil {
+		return nil, err
+	}
+	config := bcfg.(*RedisConnectionConfig)
+	var options []RedisDialOption
+	if config.Password != "" {
+		options = append(options, RedisDialPassword(config.Username, config.Password))
+	}
+	if config.DB != 0 {
+		if config.Cluster {
+			return nil, errors.New("redis_db cannot be set for a cluster, it only has database 0")
+		}
+		options = append(options, RedisDialDatabase(config.DB))
+	}
+	if config.TLS {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.TLSSkipVerify}
+		if config.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(config.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("redis_tls_ca_file: %s", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("redis_tls_ca_file [%s] has no certificates", config.TLSCAFile)
+			}
+		}
+		options = append(options, RedisDialTLS(tlsConfig))
+	}
+	if config.SentinelMaster != "" || config.SentinelAddrs != "" {
+		if config.Cluster {
+			return nil, errors.New("redis_sentinel_master and redis_cluster cannot both be set")
+		}
+		addrs := splitRedisAddrs(config.SentinelAddrs)
+		if config.SentinelMaster == "" || len(addrs) == 0 {
+			return nil, errors.New("redis_sentinel_master and redis_sentinel_addrs need to be set for sentinel")
+		}
+		options = append(options, RedisDialSentinel(config.SentinelMaster, addrs, config.SentinelPassword))
+	}
+	if config.Cluster {
+		options = append(options, RedisDialCluster())
+	}
+	return options, nil
+}
+
+// splitRedisAddrs splits a comma separated list of addresses
+func splitRedisAddrs(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// RedisDialOptions are the settings of RedisDialOption, which the driver reads with NewRedisDialOptions
+type RedisDialOptions struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	Dial         func(network, addr string) (net.Conn, error)
+	DB           int
+	Username     string
+	Password     string
+	// TLSConfig is set to connect with TLS
+	TLSConfig *tls.Config
+	// SentinelMaster is set when the address of the master is asked from the SentinelAddrs.
+	// The address given to RedisDialer or RedisPooler is not used then
+	SentinelMaster   string
+	SentinelAddrs    []string
+	SentinelPassword string
+	// Cluster is true if the address is a comma separated list of cluster nodes, and the commands
+	// are sent to the node that has the slot of the key
+	Cluster bool
+}
+
+// NewRedisDialOptions returns the settings of options
+func NewRedisDialOptions(options ...RedisDialOption) *RedisDialOptions {
+	do := &RedisDialOptions{}
+	for _, option := range options {
+		option.f(do)
+	}
+	return do
 }
 
 type RedisDialOption struct {
-	f func(*dialOptions)
+	f func(*RedisDialOptions)
+}
+
+// RedisDialPassword sets the password to AUTH with, and the username for redis 6 ACLs, which can be empty
+func RedisDialPassword(username, password string) RedisDialOption {
+	return RedisDialOption{func(do *RedisDialOptions) {
+		do.Username = username
+		do.Password = password
+	}}
+}
+
+// RedisDialDatabase sets the database to SELECT
+func RedisDialDatabase(db int) RedisDialOption {
+	return RedisDialOption{func(do *RedisDialOptions) {
+		do.DB = db
+	}}
+}
+
+// RedisDialTLS connects with TLS, using config
+func RedisDialTLS(config *tls.Config) RedisDialOption {
+	return RedisDialOption{func(do *RedisDialOptions) {
+		do.TLSConfig = config
+	}}
+}
+
+// RedisDialSentinel connects to the master named master, asking one of the sentinels at addrs where it is
+func RedisDialSentinel(master string, addrs []string, password string) RedisDialOption {
+	return RedisDialOption{func(do *RedisDialOptions) {
+		do.SentinelMaster = master
+		do.SentinelAddrs = addrs
+		do.SentinelPassword = password
+	}}
+}
+
+// RedisDialCluster connects to a cluster, the address is a comma separated list of some of its nodes
+func RedisDialCluster() RedisDialOption {
+	return RedisDialOption{func(do *RedisDialOptions) {
+		do.Cluster = true
+	}}
 }
 
 type redisDial func(network, address string, options ...RedisDialOption) (RedisConn, error)
 
 var RedisDialer redisDial
+
+type redisPool func(network, address string, config RedisPoolConfig, options ...RedisDialOption) RedisPool
+
+// RedisPooler makes a RedisPool. Like RedisDialer, it's set by the driver, see backends/storage/redigo
+var RedisPooler redisPool
@@ -0,0 +1,381 @@
+package backends
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+	"github.com/karngyan/go-guerrilla/response"
+)
+
+// retryGroup is the keyword of a retry group in a stack, eg. (retry SQL), see retryDecorator
+const retryGroup = "retry"
+
+func init() {
+	Svc.AddSchema(ProcessorSchema{
+		Name:        retryGroup,
+		Description: "Retries the stack in the group, and stops trying it for a while when it keeps failing",
+		Options:     ConfigOptions(&RetryConfig{}),
+	})
+}
+
+type RetryConfig struct {
+	// MaxAttempts is the number of times to try the stack, including the first. Defaults to 3
+	MaxAttempts int `json:"retry_max_attempts,omitempty" default:"3" desc:"Times to try the stack, including the first"`
+	// Backoff is the duration to wait before the first retry, eg "100ms". It doubles with each attempt
+	Backoff string `json:"retry_backoff,omitempty" default:"100ms" desc:"Time to wait before the first retry, doubles with each attempt"`
+	// MaxBackoff is the longest duration to wait between retries, eg "2s"
+	MaxBackoff string `json:"retry_max_backoff,omitempty" default:"2s" desc:"Longest time to wait between retries"`
+	// BreakerThreshold is the number of failures in a row that opens the circuit breaker. -1 never opens it
+	BreakerThreshold int `json:"breaker_threshold,omitempty" default:"5" desc:"Failures in a row that open the circuit breaker, -1 never opens it"`
+	// BreakerCooldown is how long the breaker stays open before a task is let through to probe, eg "30s"
+	BreakerCooldown string `json:"breaker_cooldown,omitempty" default:"30s" desc:"Time the breaker stays open before a task is let through to probe"`
+}
+
+const (
+	retryMaxAttempts      = 3
+	retryBackoff          = time.Millisecond * 100
+	retryMaxBackoff       = time.Second * 2
+	retryBreakerThreshold = 5
+	retryBreakerCooldown  = time.Second * 30
+)
+
+// errBreakerOpen is returned without trying the stack, while its circuit breaker is open
+var errBreakerOpen = NewRcptError("circuit breaker is open", response.Canned.FailBackendUnavailable)
+
+// retrySettings is a RetryConfig with the defaults filled in and the durations parsed
+type retrySettings struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets all tasks through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails the tasks straight away
+	BreakerOpen
+	// BreakerHalfOpen lets one task through, to probe if the stack has recovered
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerEvent is passed to the breaker listeners when a circuit breaker changes its state
+type BreakerEvent struct {
+	// Backend is the name of the backend that has the breaker, "" for the default backend
+	Backend string
+	// Name of the breaker, the retry group and its processors, eg. "retry sql"
+	Name  string
+	State BreakerState
+	// Failures is the number of failures in a row
+	Failures int
+}
+
+// circuitBreaker counts the failures of a retry group. It's shared by all the stacks of a gateway
+// that have the same retry group, so that the workers stop trying together
+type circuitBreaker struct {
+	sync.Mutex
+	backend   string
+	name      string
+	threshold int
+	cooldown  time.Duration
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	// probing is true while the task let through in the half-open state is running
+	probing bool
+}
+
+// breakerSet has the breakers of a gateway, one for each retry group, by name
+type breakerSet struct {
+	sync.Mutex
+	// backend is the name of the gateway's backend
+	backend  string
+	breakers map[string]*circuitBreaker
+}
+
+func newBreakerSet(backend string) *breakerSet {
+	return &breakerSet{backend: backend, breakers: make(map[string]*circuitBreaker)}
+}
+
+// looseBreakers has the breakers of the stacks that were not made by a gateway
+var looseBreakers = newBreakerSet("")
+
+var (
+	listenersGuard   sync.Mutex
+	breakerListeners = make(map[int]func(BreakerEvent))
+	nextListener     int
+)
+
+// AddBreakerListener calls fn each time a circuit breaker of a retry group changes its state.
+// It returns a function that removes the listener
+func (s *service) AddBreakerListener(fn func(BreakerEvent)) (remove func()) {
+	listenersGuard.Lock()
+	defer listenersGuard.Unlock()
+	id := nextListener
+	nextListener++
+	breakerListeners[id] = fn
+	return func() {
+		listenersGuard.Lock()
+		defer listenersGuard.Unlock()
+		delete(breakerListeners, id)
+	}
+}
+
+// get returns the breaker called name, making it if it doesn't exist
+func (bs *breakerSet) get(name string) *circuitBreaker {
+	bs.Lock()
+	defer bs.Unlock()
+	b, ok := bs.breakers[name]
+	if !ok {
+		b = &circuitBreaker{backend: bs.backend, name: name}
+		bs.breakers[name] = b
+	}
+	return b
+}
+
+// notifyBreaker passes ev to the breaker listeners
+func notifyBreaker(ev BreakerEvent) {
+	listenersGuard.Lock()
+	listeners := make([]func(BreakerEvent), 0, len(breakerListeners))
+	for _, fn := range breakerListeners {
+		listeners = append(listeners, fn)
+	}
+	listenersGuard.Unlock()
+	name := ev.Name
+	if ev.Backend != "" {
+		name = ev.Backend + " " + name
+	}
+	if ev.State == BreakerClosed {
+		Log().Infof("circuit breaker [%s] closed", name)
+	} else {
+		Log().Warnf("circuit breaker [%s] is %s after %d failures", name, ev.State, ev.Failures)
+	}
+	for _, fn := range listeners {
+		fn(ev)
+	}
+}
+
+// stats returns the state of each breaker, for expvar
+func (bs *breakerSet) stats() map[string]interface{} {
+	bs.Lock()
+	list := make([]*circuitBreaker, 0, len(bs.breakers))
+	for _, b := range bs.breakers {
+		list = append(list, b)
+	}
+	bs.Unlock()
+	stats := make(map[string]interface{}, len(list))
+	for _, b := range list {
+		b.Lock()
+		stats[b.name] = map[string]interface{}{
+			"state":    b.state.String(),
+			"failures": b.failures,
+		}
+		b.Unlock()
+	}
+	return stats
+}
+
+// configure sets the threshold and cooldown, they can change when the config is reloaded
+func (b *circuitBreaker) configure(threshold int, cooldown time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.threshold, b.cooldown = threshold, cooldown
+}
+
+// allow returns true if a task can try the stack
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.Unlock()
+			return false
+		}
+		b.state, b.probing = BreakerHalfOpen, true
+		ev := BreakerEvent{Backend: b.backend, Name: b.name, State: b.state, Failures: b.failures}
+		b.Unlock()
+		notifyBreaker(ev)
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			b.Unlock()
+			return false
+		}
+		b.probing = true
+	}
+	b.Unlock()
+	return true
+}
+
+// success closes the breaker
+func (b *circuitBreaker) success() {
+	b.Lock()
+	b.failures, b.probing = 0, false
+	if b.state == BreakerClosed {
+		b.Unlock()
+		return
+	}
+	b.state = BreakerClosed
+	ev := BreakerEvent{Backend: b.backend, Name: b.name, State: b.state}
+	b.Unlock()
+	notifyBreaker(ev)
+}
+
+// failure counts a failure, and opens the breaker if the probe failed or there were too many failures
+func (b *circuitBreaker) failure() {
+	b.Lock()
+	b.failures++
+	b.probing = false
+	if b.state == BreakerOpen || b.state == BreakerClosed && (b.threshold < 0 || b.failures < b.threshold) {
+		b.Unlock()
+		return
+	}
+	b.state, b.openedAt = BreakerOpen, time.Now()
+	ev := BreakerEvent{Backend: b.backend, Name: b.name, State: b.state, Failures: b.failures}
+	b.Unlock()
+	notifyBreaker(ev)
+}
+
+// runRetryStack runs the stack of a retry group. If it panics, the worker recovers it, so the failure is
+// counted on the way out. Otherwise a probe would keep the breaker half-open, and it would never let
+// another task through
+func runRetryStack(p Processor, breaker *circuitBreaker, e *mail.Envelope, task SelectTask) (result Result, err error) {
+	returned := false
+	defer func() {
+		if !returned {
+			breaker.failure()
+		}
+	}()
+	result, err = p.Process(e, task)
+	returned = true
+	return result, err
+}
+
+// newRetrySettings fills in the defaults of config
+func newRetrySettings(config *RetryConfig) (settings retrySettings, threshold int, cooldown time.Duration, err error) {
+	settings = retrySettings{attempts: config.MaxAttempts, backoff: retryBackoff, maxBackoff: retryMaxBackoff}
+	if settings.attempts < 1 {
+		settings.attempts = retryMaxAttempts
+	}
+	if config.Backoff != "" {
+		if settings.backoff, err = time.ParseDuration(config.Backoff); err != nil {
+			return
+		}
+	}
+	if config.MaxBackoff != "" {
+		if settings.maxBackoff, err = time.ParseDuration(config.MaxBackoff); err != nil {
+			return
+		}
+	}
+	threshold, cooldown = config.BreakerThreshold, retryBreakerCooldown
+	if threshold == 0 {
+		threshold = retryBreakerThreshold
+	}
+	if config.BreakerCooldown != "" {
+		if cooldown, err = time.ParseDuration(config.BreakerCooldown); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// retryDecorator returns a decorator that runs the stack of a retry group, then the next processor if it succeeded.
+// The stack is tried again if it returned an error, waiting twice as long after each attempt, as long as there is
+// time left before the deadline of the task. Errors that are a verdict, such as NoSuchUser, are not retried.
+// When it still fails, the failure is counted by a circuit breaker. After breaker_threshold failures in a row the
+// breaker opens, and the tasks fail with a 451 without trying the stack. After breaker_cooldown one task is let
+// through to probe, and the breaker closes if it succeeds. The stack runs on its own, so it should only have
+// processors that can be run again, such as ones that save the email
+func (n *stepNode) retryDecorator(s *contextStack) (Decorator, error) {
+	decorators, err := n.retry.decorators(s)
+	if err != nil {
+		return nil, err
+	}
+	name := n.retryName + " " + strings.Join(n.retry.names(), "|")
+	breakers := Svc.scopeBreakers()
+	var (
+		settings retrySettings
+		breaker  *circuitBreaker
+	)
+	// the config can be for an instance, eg. retry#sql
+	configFor := func(backendConfig BackendConfig) (BackendConfig, error) {
+		return instanceConfig(backendConfig, n.retryName)
+	}
+	Svc.withConfig(configFor, func() {
+		Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+			bcfg, err := Svc.ExtractConfig(backendConfig, &RetryConfig{})
+			if err != nil {
+				return err
+			}
+			rs, threshold, cooldown, err := newRetrySettings(bcfg.(*RetryConfig))
+			if err != nil {
+				return err
+			}
+			settings, breaker = rs, breakers.get(name)
+			breaker.configure(threshold, cooldown)
+			return nil
+		}))
+	})
+	return func(next Processor) Processor {
+		p := Decorate(DefaultProcessor{}, decorators...)
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if !breaker.allow() {
+				return NewResult(response.Canned.FailBackendUnavailable), errBreakerOpen
+			}
+			ctx := s.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			backoff := settings.backoff
+			for attempt := 1; ; attempt++ {
+				result, err := runRetryStack(p, breaker, e, task)
+				if err == nil {
+					breaker.success()
+					if result != nil && result.Code() >= 400 {
+						// the stack rejected it, so don't carry on
+						return result, nil
+					}
+					return next.Process(e, task)
+				}
+				if isVerdict(err) {
+					// the stack is working, it just said no
+					breaker.success()
+					return result, err
+				}
+				deadline, hasDeadline := ctx.Deadline()
+				if attempt >= settings.attempts || ctx.Err() != nil ||
+					hasDeadline && time.Until(deadline) < backoff {
+					breaker.failure()
+					return result, err
+				}
+				Log().WithError(err).Warnf("[%s] attempt %d failed, trying again in %s", name, attempt, backoff)
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					breaker.failure()
+					return result, err
+				}
+				if backoff *= 2; backoff > settings.maxBackoff {
+					backoff = settings.maxBackoff
+				}
+			}
+		})
+	}, nil
+}
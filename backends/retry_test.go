@@ -0,0 +1,441 @@
+package backends
+
+import (
+	"errors"
+	"expvar"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+func TestRetry(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var attempts, after int
+	Svc.AddProcessor("Flaky", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					if attempts++; attempts < 3 {
+						return nil, errors.New("connection reset")
+					}
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	Svc.AddProcessor("After", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				after++
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer func() {
+		delete(processors, "flaky")
+		delete(processors, "after")
+	}()
+	c := BackendConfig{
+		"save_process":      "HeadersParser|(retry Flaky)|After",
+		"save_workers_size": 1,
+		"retry_backoff":     "1ms",
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc123"
+	e.Data.WriteString("Subject:Test\n\nThis is a test.")
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting 250 after retrying, got", result)
+	}
+	if attempts != 3 {
+		t.Error("expecting 3 attempts, got", attempts)
+	}
+	if after != 1 {
+		t.Error("expecting the rest of the stack to run once, got", after)
+	}
+}
+
+func TestRetryStorageError(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var attempts int
+	var verdict error
+	Svc.AddProcessor("StorageFlaky", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task != TaskSaveMail {
+					return p.Process(e, task)
+				}
+				attempts++
+				if verdict != nil {
+					return NewResult(RcptErrorResponse(verdict)), verdict
+				}
+				if attempts < 3 {
+					// like the SQL processor when the database is down
+					return NewResult("554 Error: could not save email"), StorageError
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "storageflaky")
+	c := BackendConfig{
+		"save_process":       "(retry StorageFlaky)",
+		"save_workers_size":  1,
+		"retry_max_attempts": 3,
+		"retry_backoff":      "1ms",
+		"breaker_threshold":  1,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	process := func() Result {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = "abc123"
+		e.Data.WriteString("Subject:Test\n\nThis is a test.")
+		return gateway.Process(e)
+	}
+	if result := process(); result.Code() != 250 {
+		t.Error("expecting 250 after retrying the storage error, got", result)
+	}
+	if attempts != 3 {
+		t.Error("expecting the storage error to be retried, got attempts:", attempts)
+	}
+
+	// a verdict is not retried, and doesn't count as a failure of the store
+	attempts, verdict = 0, NoSuchUser
+	for i := 0; i < 2; i++ {
+		if result := process(); result.Code() != 550 {
+			t.Error("expecting the verdict, got", result)
+		}
+	}
+	if attempts != 2 {
+		t.Error("expecting each verdict to be tried once, with the breaker closed, got attempts:", attempts)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var (
+		mu       sync.Mutex
+		attempts int
+		down     = true
+		states   []BreakerState
+	)
+	Svc.AddProcessor("Store", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				mu.Lock()
+				attempts++
+				failing := down
+				mu.Unlock()
+				if failing {
+					return nil, errors.New("store is down")
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "store")
+	remove := Svc.AddBreakerListener(func(ev BreakerEvent) {
+		if ev.Name == "retry store" {
+			mu.Lock()
+			states = append(states, ev.State)
+			mu.Unlock()
+		}
+	})
+	defer remove()
+	c := BackendConfig{
+		"save_process":       "(retry Store)",
+		"save_workers_size":  1,
+		"retry_max_attempts": 1,
+		"breaker_threshold":  2,
+		"breaker_cooldown":   "50ms",
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	process := func() Result {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = "abc123"
+		e.Data.WriteString("Subject:Test\n\nThis is a test.")
+		return gateway.Process(e)
+	}
+	for i := 0; i < 2; i++ {
+		if result := process(); result.Code() != 554 {
+			t.Error("expecting the store error, got", result)
+		}
+	}
+	if result := process(); result.Code() != 451 {
+		t.Error("expecting 451 while the breaker is open, got", result)
+	}
+	if attempts != 2 {
+		t.Error("expecting the store not to be tried while the breaker is open, got attempts:", attempts)
+	}
+	if stats := gateway.breakers.stats()["retry store"]; stats == nil || stats.(map[string]interface{})["state"] != "open" {
+		t.Error("expecting the breaker stats to show it's open, got", stats)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	if result := process(); result.Code() != 250 {
+		t.Error("expecting the probe to succeed, got", result)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expect := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(states) != len(expect) {
+		t.Fatal("expecting the breaker to open, probe, then close, got", states)
+	}
+	for i := range expect {
+		if states[i] != expect[i] {
+			t.Error("expecting the breaker to open, probe, then close, got", states)
+			break
+		}
+	}
+}
+
+func TestCircuitBreakerPerBackend(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var (
+		mu     sync.Mutex
+		opened []string
+	)
+	// the store is down for the email to backend a
+	Svc.AddProcessor("HalfStore", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if e.QueuedId == "a" {
+					return nil, errors.New("store is down")
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "halfstore")
+	remove := Svc.AddBreakerListener(func(ev BreakerEvent) {
+		if ev.State == BreakerOpen {
+			mu.Lock()
+			opened = append(opened, ev.Backend+" "+ev.Name)
+			mu.Unlock()
+		}
+	})
+	defer remove()
+	c := BackendConfig{
+		"save_process":       "(retry HalfStore)",
+		"save_workers_size":  1,
+		"retry_max_attempts": 1,
+		"breaker_threshold":  1,
+	}
+	gateways := make(map[string]*BackendGateway)
+	for _, name := range []string{"a", "b"} {
+		b, err := NewNamed(name, c, mainlog)
+		if err != nil {
+			t.Fatal("Gateway did not init because:", err)
+		}
+		if err := b.Start(); err != nil {
+			t.Fatal("Gateway did not start because:", err)
+		}
+		defer func() {
+			_ = b.Shutdown()
+		}()
+		gateways[name] = b.(*BackendGateway)
+	}
+	process := func(name string) Result {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = name
+		e.Data.WriteString("Subject:Test\n\nThis is a test.")
+		return gateways[name].Process(e)
+	}
+	if result := process("a"); result.Code() != 554 {
+		t.Error("expecting the store error, got", result)
+	}
+	if result := process("a"); result.Code() != 451 {
+		t.Error("expecting 451 while the breaker of a is open, got", result)
+	}
+	// the same retry group of the other backend has its own breaker
+	if result := process("b"); result.Code() != 250 {
+		t.Error("expecting backend b to save, got", result)
+	}
+	mu.Lock()
+	if len(opened) != 1 || opened[0] != "a retry halfstore" {
+		t.Error("expecting the breaker of backend a to open, got", opened)
+	}
+	mu.Unlock()
+
+	stats, ok := backendVars.Get("backends").(expvar.Func)().(map[string]interface{})
+	if !ok || stats["a"] == nil || stats["b"] == nil {
+		t.Fatal("expecting the stats of both backends, got", stats)
+	}
+	breakers := stats["a"].(map[string]interface{})["breakers"].(map[string]interface{})
+	if state := breakers["retry halfstore"].(map[string]interface{})["state"]; state != "open" {
+		t.Error("expecting the breaker of backend a to be open, got", state)
+	}
+	breakers = stats["b"].(map[string]interface{})["breakers"].(map[string]interface{})
+	if state := breakers["retry halfstore"].(map[string]interface{})["state"]; state != "closed" {
+		t.Error("expecting the breaker of backend b to be closed, got", state)
+	}
+}
+
+func TestRetryBreakerOpenInside(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var attempts int
+	Svc.AddProcessor("DownStore", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				attempts++
+				return nil, errors.New("store is down")
+			})
+		}
+	})
+	defer delete(processors, "downstore")
+	if isVerdict(errBreakerOpen) {
+		t.Error("expecting an open breaker not to be a verdict")
+	}
+	c := BackendConfig{
+		"save_process":      "(retry#outer (retry#inner DownStore))",
+		"save_workers_size": 1,
+		"processors": map[string]interface{}{
+			"retry#outer": map[string]interface{}{"retry_max_attempts": 3, "retry_backoff": "1ms"},
+			"retry#inner": map[string]interface{}{"retry_max_attempts": 1, "breaker_threshold": 1, "breaker_cooldown": "1h"},
+		},
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc123"
+	e.Data.WriteString("Subject:Test\n\nThis is a test.")
+	if result := gateway.Process(e); result.Code() != 451 {
+		t.Error("expecting 451 from the open breaker inside, got", result)
+	}
+	if attempts != 1 {
+		t.Error("expecting the store to be tried once, before the inner breaker opened, got", attempts)
+	}
+	// the outer group kept trying, and counted it as a failure
+	for name, stats := range gateway.breakers.stats() {
+		if !strings.HasPrefix(name, "retry#outer") {
+			continue
+		}
+		if failures := stats.(map[string]interface{})["failures"]; failures != 1 {
+			t.Error("expecting the outer breaker to count a failure, got", failures)
+		}
+		return
+	}
+	t.Error("expecting the stats of the outer breaker, got", gateway.breakers.stats())
+}
+
+func TestCircuitBreakerProbePanic(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var (
+		mu    sync.Mutex
+		state = "down"
+	)
+	Svc.AddProcessor("PanickyStore", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				mu.Lock()
+				s := state
+				mu.Unlock()
+				switch s {
+				case "down":
+					return nil, errors.New("store is down")
+				case "panic":
+					panic("store panicked")
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "panickystore")
+	c := BackendConfig{
+		"save_process":       "(retry PanickyStore)",
+		"save_workers_size":  1,
+		"retry_max_attempts": 1,
+		"breaker_threshold":  1,
+		"breaker_cooldown":   "20ms",
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() {
+		_ = gateway.Shutdown()
+	}()
+	process := func() Result {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = "abc123"
+		e.Data.WriteString("Subject:Test\n\nThis is a test.")
+		return gateway.Process(e)
+	}
+	setState := func(s string) {
+		mu.Lock()
+		state = s
+		mu.Unlock()
+	}
+	if result := process(); result.Code() != 554 {
+		t.Error("expecting the store error, got", result)
+	}
+	// the probe panics
+	time.Sleep(time.Millisecond * 30)
+	setState("panic")
+	if result := process(); result.Code() < 400 {
+		t.Error("expecting the probe to fail, got", result)
+	}
+	// the breaker lets another probe through after the cooldown
+	time.Sleep(time.Millisecond * 30)
+	setState("up")
+	if result := process(); result.Code() != 250 {
+		t.Error("expecting the next probe to succeed, got", result)
+	}
+}
@@ -0,0 +1,337 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A small client for the S3 API, enough to upload objects to AWS S3 or a compatible server such as MinIO.
+// Requests are signed with AWS Signature Version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+
+const (
+	s3Algorithm   = "AWS4-HMAC-SHA256"
+	s3DateFormat  = "20060102T150405Z"
+	s3ContentType = "message/rfc822"
+)
+
+// s3Signer signs requests with AWS Signature Version 4
+type s3Signer struct {
+	accessKey string
+	secretKey string
+	// sessionToken is for temporary credentials, can be empty
+	sessionToken string
+	region       string
+}
+
+// s3UriEncode encodes s like S3 expects: everything except the unreserved characters is percent-encoded,
+// and / is kept when encoding a path
+func s3UriEncode(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && path:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes the query string in the canonical form, sorted by key
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3UriEncode(k, false)+"="+s3UriEncode(v, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3Sha256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds the x-amz-date, x-amz-content-sha256 and Authorization headers to req.
+// payloadHash is the hex sha256 of the body. All the headers that were set on req are signed
+func (s *s3Signer) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format(s3DateFormat)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3UriEncode(path, true),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	day := amzDate[:8]
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		s3Sha256([]byte(canonicalRequest)),
+	}, "\n")
+	key := s3Hmac([]byte("AWS4"+s.secretKey), day)
+	key = s3Hmac(key, s.region)
+	key = s3Hmac(key, "s3")
+	key = s3Hmac(key, "aws4_request")
+	signature := hex.EncodeToString(s3Hmac(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Error is the error returned by the S3 API
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// s3Client uploads objects to a bucket
+type s3Client struct {
+	signer   s3Signer
+	endpoint *url.URL
+	bucket   string
+	// pathStyle puts the bucket in the path instead of the host name, needed for most S3 compatible servers
+	pathStyle bool
+	// headers are added to the requests that make objects, eg. for server-side encryption
+	headers http.Header
+	client  *http.Client
+}
+
+// objectURL returns the URL of the object with the given key
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	path := "/" + key
+	if c.pathStyle {
+		path = "/" + c.bucket + path
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = s3UriEncode(u.Path, true)
+	u.RawQuery = s3Query(query)
+	return &u
+}
+
+// do sends a signed request, and returns the response if it's a 2xx, otherwise the error from the body
+func (c *s3Client) do(ctx context.Context, method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.signer.sign(req, s3Sha256(body), time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, readS3Error(resp.StatusCode, resp.Body)
+}
+
+// readS3Error reads the <Error> document from r
+func readS3Error(status int, r io.Reader) error {
+	e := &s3Error{StatusCode: status}
+	b, _ := ioutil.ReadAll(io.LimitReader(r, 64*1024))
+	if err := xml.Unmarshal(b, e); err != nil || e.Code == "" {
+		e.Code = http.StatusText(status)
+		e.Message = strings.TrimSpace(string(b))
+	}
+	return e
+}
+
+// objectHeaders returns the headers for making an object
+func (c *s3Client) objectHeaders() http.Header {
+	h := http.Header{}
+	for k, v := range c.headers {
+		h[k] = v
+	}
+	h.Set("Content-Type", s3ContentType)
+	return h
+}
+
+// put uploads an object in one request
+func (c *s3Client) put(ctx context.Context, key string, data []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, c.objectURL(key, nil), c.objectHeaders(), data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// upload uploads the object from r. If it's bigger than partSize, it's uploaded in parts of partSize,
+// so only one part is in memory at a time
+func (c *s3Client) upload(ctx context.Context, key string, r io.Reader, partSize int) error {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(partSize)))
+	if err != nil {
+		return err
+	}
+	if len(buf) < partSize {
+		return c.put(ctx, key, buf)
+	}
+	uploadID, err := c.createMultipart(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err = c.uploadParts(ctx, key, uploadID, r, buf); err != nil {
+		// don't leave the parts behind, they are charged for
+		if abortErr := c.abortMultipart(key, uploadID); abortErr != nil {
+			Log().WithError(abortErr).Warnf("could not abort the multipart upload of %s", key)
+		}
+		return err
+	}
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// uploadParts uploads buf, which is full, and then the rest of r in parts, then completes the upload
+func (c *s3Client) uploadParts(ctx context.Context, key, uploadID string, r io.Reader, buf []byte) error {
+	var parts []s3Part
+	n := len(buf)
+	for {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(len(parts) + 1)},
+			"uploadId":   {uploadID},
+		}
+		resp, err := c.do(ctx, http.MethodPut, c.objectURL(key, query), nil, buf[:n])
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		parts = append(parts, s3Part{PartNumber: len(parts) + 1, ETag: resp.Header.Get("ETag")})
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, c.objectURL(key, url.Values{"uploadId": {uploadID}}), nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// the response can be a 200 with an error, if the upload failed after it started
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		return readS3Error(resp.StatusCode, bytes.NewReader(b))
+	}
+	return nil
+}
+
+// createMultipart starts a multipart upload, returning its id
+func (c *s3Client) createMultipart(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, c.objectURL(key, url.Values{"uploads": {""}}), c.objectHeaders(), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("s3: no upload id for %s", key)
+	}
+	return result.UploadID, nil
+}
+
+// abortMultipart removes the parts of an upload. It's not cancelled with the task, since it cleans up after it
+func (c *s3Client) abortMultipart(key, uploadID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodDelete, c.objectURL(key, url.Values{"uploadId": {uploadID}}), nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,76 @@
+package backends
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Stream Processor Name: headersparser
+// ----------------------------------------------------------------------------------
+// Description   : Parses the header while the data is streaming in, using
+//               : e.ParseHeaderBlock(), so it's available before the data is saved
+// ----------------------------------------------------------------------------------
+// Config Options: none
+// --------------:-------------------------------------------------------------------
+// Input         : message data stream
+// ----------------------------------------------------------------------------------
+// Output        : Headers will be populated in e.Header
+// ----------------------------------------------------------------------------------
+func init() {
+	streamProcessors["headersparser"] = func() StreamDecorator {
+		return StreamHeadersParser()
+	}
+}
+
+// headerChunkSize is the most data that will be looked at to find the header
+const headerChunkSize = 1 + (4 << 10) // 4KB
+
+// headerSniffer copies the start of the data to buf as it's read, until the end of the header
+type headerSniffer struct {
+	r    io.Reader
+	e    *mail.Envelope
+	buf  bytes.Buffer
+	done bool
+}
+
+func (h *headerSniffer) Read(p []byte) (n int, err error) {
+	n, err = h.r.Read(p)
+	if !h.done && n > 0 {
+		remaining := headerChunkSize - h.buf.Len()
+		if remaining > n {
+			remaining = n
+		}
+		h.buf.Write(p[:remaining])
+		if bytes.Contains(h.buf.Bytes(), []byte{'\n', '\n'}) || h.buf.Len() >= headerChunkSize {
+			h.parse()
+		}
+	}
+	if err == io.EOF && !h.done {
+		h.parse()
+	}
+	return
+}
+
+func (h *headerSniffer) parse() {
+	h.done = true
+	if err := h.e.ParseHeaderBlock(h.buf.Bytes()); err != nil {
+		Log().WithError(err).Error("parse headers error")
+	}
+	h.buf.Reset()
+}
+
+func StreamHeadersParser() StreamDecorator {
+	return func(sp StreamProcessor) StreamProcessor {
+		return StreamProcessWith(func(r io.Reader, e *mail.Envelope) (Result, error) {
+			if e.Header != nil {
+				// already parsed
+				return sp.ProcessStream(r, e)
+			}
+			// next processor
+			return sp.ProcessStream(&headerSniffer{r: r, e: e}, e)
+		})
+	}
+}
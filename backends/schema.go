@@ -0,0 +1,358 @@
+package backends
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigOption describes an option that is read from the backend config
+type ConfigOption struct {
+	Key string
+	// Type is string, int or bool
+	Type     string
+	Required bool
+	// Default is the value used when the option is not set, for the user to read
+	Default     string
+	Description string
+}
+
+// ProcessorSchema describes a processor and the options it reads from the backend config
+type ProcessorSchema struct {
+	Name        string
+	Description string
+	Options     []ConfigOption
+}
+
+// ProcessorInfo describes a registered processor
+type ProcessorInfo struct {
+	ProcessorSchema
+	// Kind is "processor", "context processor", "stream processor" or "stack group"
+	Kind string
+	// HasSchema is false if the processor did not register a schema,
+	// then the options are not known
+	HasSchema bool
+}
+
+// GatewaySchema describes the options of the gateway
+var GatewaySchema = ProcessorSchema{
+	Name:        "gateway",
+	Description: "Runs the processor stacks using pools of workers",
+	Options:     ConfigOptions(&GatewayConfig{}),
+}
+
+// ConfigOptions returns the options of a config struct, the kind that is given to Svc.ExtractConfig.
+// The key comes from the json tag, and an option is required unless the tag has omitempty.
+// The description and default come from the desc and default tags
+func ConfigOptions(configType BaseConfig) []ConfigOption {
+	t := reflect.TypeOf(configType).Elem()
+	options := make([]ConfigOption, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		option := ConfigOption{
+			Key:         field.Name,
+			Type:        field.Type.Name(),
+			Required:    true,
+			Default:     field.Tag.Get("default"),
+			Description: field.Tag.Get("desc"),
+		}
+		if tag := field.Tag.Get("json"); len(tag) > 0 {
+			split := strings.Split(tag, ",")
+			option.Key = split[0]
+			if len(split) > 1 && split[1] == "omitempty" {
+				option.Required = false
+			}
+		}
+		options = append(options, option)
+	}
+	return options
+}
+
+// AddSchema registers the schema of a processor, so that its config can be checked when the backend
+// is initialized. The name is the same as the one given to AddProcessor
+func (s *service) AddSchema(schema ProcessorSchema) {
+	s.Lock()
+	defer s.Unlock()
+	schemas[strings.ToLower(schema.Name)] = schema
+}
+
+// Processors returns the registered processors, sorted by name
+func (s *service) Processors() []ProcessorInfo {
+	s.Lock()
+	defer s.Unlock()
+	var list []ProcessorInfo
+	add := func(name string, kind string) {
+		info := ProcessorInfo{ProcessorSchema: ProcessorSchema{Name: name}, Kind: kind}
+		if schema, ok := schemas[name]; ok {
+			info.ProcessorSchema = schema
+			info.HasSchema = true
+		}
+		list = append(list, info)
+	}
+	for name := range processors {
+		add(name, "processor")
+	}
+	for name := range contextProcessors {
+		add(name, "context processor")
+	}
+	for name := range streamProcessors {
+		add(name, "stream processor")
+	}
+	add(retryGroup, "stack group")
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name == list[j].Name {
+			return list[i].Kind < list[j].Kind
+		}
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+	return list
+}
+
+// checkConfig checks cfg against the schemas of the gateway and the processors named in the stacks.
+// It returns an error for each option that is missing, or has the wrong type. Options that are not in
+// any schema are errors too, but only when every registered processor has a schema, otherwise the
+// option could be for a processor that didn't tell us about its options
+func checkConfig(cfg BackendConfig, stacks []string, streamStacks []string) error {
+	Svc.Lock()
+	defer Svc.Unlock()
+	var errs Errors
+	var names []string
+	for _, stack := range stacks {
+		if strings.TrimSpace(stack) == "" {
+			continue
+		}
+		node, err := parseStackConfig(stack)
+		if err != nil {
+			// the error is reported when the stack is built
+			continue
+		}
+		names = append(names, node.names()...)
+	}
+	for _, stack := range streamStacks {
+		for _, name := range strings.Split(stack, "|") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	errs = append(errs, checkOptions(cfg, "", GatewaySchema.Options)...)
+	checked := make(map[string]bool)
+	for _, name := range names {
+		schema, ok := schemas[processorName(name)]
+		if !ok || checked[name] {
+			continue
+		}
+		checked[name] = true
+		instanceCfg, err := instanceConfig(cfg, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, checkOptions(instanceCfg, name, schema.Options)...)
+	}
+	if strict := allHaveSchemas(); strict {
+		known := knownOptions()
+		for key := range cfg {
+			if !known[key] {
+				errs = append(errs, unknownOptionError(key, "", known))
+			}
+		}
+	}
+	errs = append(errs, checkBlocks(cfg)...)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkBlocks checks the config blocks in the processors option
+func checkBlocks(cfg BackendConfig) Errors {
+	v, ok := cfg[processorsKey]
+	if !ok {
+		return nil
+	}
+	var blocks map[string]interface{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		blocks = v
+	case BackendConfig:
+		blocks = v
+	default:
+		return Errors{fmt.Errorf("the %s option must be an object", processorsKey)}
+	}
+	var errs Errors
+	for name, v := range blocks {
+		var block map[string]interface{}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			block = v
+		case BackendConfig:
+			block = v
+		default:
+			errs = append(errs, fmt.Errorf("the config of processor [%s] must be an object", name))
+			continue
+		}
+		base := processorName(strings.ToLower(name))
+		_, isProcessor := processors[base]
+		_, isContextProcessor := contextProcessors[base]
+		if !isProcessor && !isContextProcessor && base != retryGroup {
+			errs = append(errs, fmt.Errorf("the %s option has config for [%s], which is not a processor", processorsKey, name))
+			continue
+		}
+		schema, ok := schemas[base]
+		if !ok {
+			continue
+		}
+		known := make(map[string]bool)
+		for _, option := range schema.Options {
+			known[option.Key] = true
+		}
+		for key, value := range block {
+			if !known[key] {
+				errs = append(errs, unknownOptionError(key, name, known))
+			} else if err := checkType(key, name, value, schema.Options); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// checkOptions checks that the options are set if required, and have the right type
+func checkOptions(cfg BackendConfig, name string, options []ConfigOption) Errors {
+	var errs Errors
+	for _, option := range options {
+		value, ok := cfg[option.Key]
+		if !ok {
+			if option.Required {
+				errs = append(errs, fmt.Errorf("%s needs the [%s] option", describe(name), option.Key))
+			}
+			continue
+		}
+		if err := checkType(option.Key, name, value, options); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// checkType checks that the value of key has the type from options
+func checkType(key string, name string, value interface{}, options []ConfigOption) error {
+	for _, option := range options {
+		if option.Key != key {
+			continue
+		}
+		valid := true
+		switch option.Type {
+		case "string":
+			_, valid = value.(string)
+		case "bool":
+			_, valid = value.(bool)
+		case "int":
+			switch v := value.(type) {
+			case int:
+			case float64:
+				// in json, there is no int, only floats...
+				valid = v == float64(int64(v))
+			default:
+				valid = false
+			}
+		}
+		if !valid {
+			return fmt.Errorf("option [%s] of %s must be a %s, got %v (%T)", key, describe(name), option.Type, value, value)
+		}
+	}
+	return nil
+}
+
+// describe names the owner of an option for an error message
+func describe(name string) string {
+	if name == "" {
+		return "the backend"
+	}
+	return "processor [" + name + "]"
+}
+
+// allHaveSchemas returns true if all the processors have a schema
+func allHaveSchemas() bool {
+	for name := range processors {
+		if _, ok := schemas[name]; !ok {
+			return false
+		}
+	}
+	for name := range contextProcessors {
+		if _, ok := schemas[name]; !ok {
+			return false
+		}
+	}
+	for name := range streamProcessors {
+		if _, ok := schemas[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// knownOptions returns the keys of all the options of the gateway and processors
+func knownOptions() map[string]bool {
+	known := map[string]bool{processorsKey: true}
+	for _, option := range GatewaySchema.Options {
+		known[option.Key] = true
+	}
+	for _, schema := range schemas {
+		for _, option := range schema.Options {
+			known[option.Key] = true
+		}
+	}
+	return known
+}
+
+// unknownOptionError returns an error for an unknown key, suggesting a known key if it's close
+func unknownOptionError(key string, name string, known map[string]bool) error {
+	where := "the backend config"
+	if name != "" {
+		where = "the config of processor [" + name + "]"
+	}
+	best, bestDistance := "", 3
+	for k := range known {
+		if d := editDistance(key, k); d < bestDistance || d == bestDistance && best != "" && k < best {
+			best, bestDistance = k, d
+		}
+	}
+	if best != "" {
+		return fmt.Errorf("unknown option [%s] in %s, did you mean [%s]?", key, where, best)
+	}
+	return fmt.Errorf("unknown option [%s] in %s", key, where)
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
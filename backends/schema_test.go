@@ -0,0 +1,99 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigOptions(t *testing.T) {
+	options := ConfigOptions(&SQLProcessorConfig{})
+	byKey := make(map[string]ConfigOption)
+	for _, option := range options {
+		byKey[option.Key] = option
+	}
+	if o := byKey["mail_table"]; !o.Required || o.Type != "string" || o.Description == "" {
+		t.Error("expecting mail_table to be a required string with a description, got", o)
+	}
+	if o := byKey["sql_max_idle_conns"]; o.Required || o.Type != "int" || o.Default != "2" {
+		t.Error("expecting sql_max_idle_conns to be an optional int with a default of 2, got", o)
+	}
+
+	found := false
+	for _, info := range Svc.Processors() {
+		if info.Name == "sql" {
+			found = info.HasSchema && info.Kind == "context processor" && len(info.Options) == len(options)
+		}
+	}
+	if !found {
+		t.Error("expecting the sql processor to be listed with its schema")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	check := func(c BackendConfig, expect ...string) {
+		t.Helper()
+		gateway := &BackendGateway{}
+		err := gateway.Initialize(c)
+		if len(expect) == 0 {
+			if err != nil {
+				t.Error("expecting no error, got", err)
+			}
+			_ = gateway.Shutdown()
+			return
+		}
+		if err == nil {
+			t.Error("expecting an error with", expect)
+			return
+		}
+		for _, e := range expect {
+			if !strings.Contains(err.Error(), e) {
+				t.Errorf("expecting the error to have [%s], got [%s]", e, err)
+			}
+		}
+	}
+	check(BackendConfig{
+		"save_process":       "HeadersParser|Header|Debugger",
+		"save_workers_size":  1.0,
+		"log_received_mails": true,
+		"primary_mail_host":  "example.com",
+		"gw_save_timeout":    "10s",
+	})
+	check(BackendConfig{
+		"save_process":      "HeadersParser|Header|Debugger",
+		"save_workers_size": 1.5,
+		"primary_mail_host": 5,
+	},
+		"option [save_workers_size] of the backend must be a int",
+		"processor [debugger] needs the [log_received_mails] option",
+		"option [primary_mail_host] of processor [header] must be a string",
+	)
+	check(BackendConfig{
+		"save_process":       "Debugger",
+		"log_received_mails": true,
+		"gw_save_timout":     "10s",
+	}, "unknown option [gw_save_timout] in the backend config, did you mean [gw_save_timeout]?")
+	check(BackendConfig{
+		"save_process":       "(if tls then Debugger#tls)",
+		"log_received_mails": true,
+		processorsKey: map[string]interface{}{
+			"debugger#tls": map[string]interface{}{"log_received_mail": false},
+			"nosuch":       map[string]interface{}{},
+		},
+	},
+		"unknown option [log_received_mail] in the config of processor [debugger#tls], did you mean [log_received_mails]?",
+		"has config for [nosuch], which is not a processor",
+	)
+
+	// an option could be for a processor that doesn't have a schema, so it's not unknown
+	Svc.AddProcessor("NoSchema", func() Decorator {
+		return func(p Processor) Processor {
+			return p
+		}
+	})
+	defer delete(processors, "noschema")
+	check(BackendConfig{
+		"save_process":       "NoSchema|Debugger",
+		"log_received_mails": true,
+		"no_schema_option":   "x",
+	})
+}
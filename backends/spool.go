@@ -0,0 +1,460 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// The spool is a local write-ahead queue for accepted email.
+// When the spool_dir config option is set, the gateway writes each envelope to the spool directory
+// and syncs it to disk before replying to the client. Spool workers then feed the spooled
+// envelopes through the save_process stack in the background, retrying with a backoff if it fails.
+// Anything left in the spool directory is replayed when the backend starts.
+//
+// Each envelope is saved as 2 files: <id>.msg holds the message data and <id>.json holds the meta-data.
+// The .json file is written last, so an envelope is only considered to be spooled once it exists.
+// Envelopes that fail after spool_max_retries attempts are renamed with a .failed suffix, or moved to the
+// dead letters if dead_letter_dir is set. Envelopes that are rejected with a 5xx, rather than failing with
+// an error or a 4xx, are not retried
+
+const (
+	spoolDataExt    = ".msg"
+	spoolMetaExt    = ".json"
+	spoolFailedExt  = ".failed"
+	spoolTempPrefix = ".tmp-"
+
+	// default number of attempts before giving up on a spooled envelope
+	spoolMaxRetries = 10
+	// default time to wait before the first retry. It doubles with each attempt
+	spoolRetryBackoff = time.Second
+	// default limit for the time between retries
+	spoolRetryMaxBackoff = time.Minute * 5
+)
+
+// spoolSeq makes spool ids unique when two envelopes are spooled in the same nanosecond
+var spoolSeq uint64
+
+type spool struct {
+	dir        string
+	workers    int
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// deliver processes an envelope loaded from the spool, returning the error of the processors, if any
+	deliver func(e *mail.Envelope) (Result, error)
+	// load is used to read the message data in to the envelope
+	load func(e *mail.Envelope, r io.Reader) error
+	// deadLetter, if set, keeps an envelope that is given up on
+	deadLetter func(meta *mail.EnvelopeMeta, data io.Reader, err error) error
+
+	added chan string
+	work  chan string
+	done  chan spoolResult
+	stop  chan bool
+	wg    sync.WaitGroup
+}
+
+type spoolResult struct {
+	id  string
+	err error
+}
+
+// spoolPermanentError is a failure that won't go away by trying again, so the envelope is given up on
+type spoolPermanentError struct {
+	error
+}
+
+// spoolRetry tracks the attempts of an envelope that failed to deliver
+type spoolRetry struct {
+	attempts int
+	next     time.Time
+}
+
+func newSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &spool{
+		dir:        dir,
+		workers:    1,
+		maxRetries: spoolMaxRetries,
+		backoff:    spoolRetryBackoff,
+		maxBackoff: spoolRetryMaxBackoff,
+	}, nil
+}
+
+// add writes e to the spool and syncs it to disk, then hands it to the dispatcher.
+// Returns the spool id of the envelope
+func (s *spool) add(e *mail.Envelope) (string, error) {
+	id := fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddUint64(&spoolSeq, 1))
+	if err := writeFile(s.dir, id+spoolDataExt, e.DataReader()); err != nil {
+		return "", err
+	}
+	meta, err := e.MarshalMeta()
+	if err == nil {
+		err = writeFile(s.dir, id+spoolMetaExt, bytes.NewReader(meta))
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		s.remove(id)
+		return "", err
+	}
+	if s.added != nil {
+		select {
+		case s.added <- id:
+		case <-s.stop:
+			// not running, it will be replayed on the next start
+		}
+	}
+	return id, nil
+}
+
+// writeFile writes r to a temporary file in dir, syncs it, then renames it to name
+func writeFile(dir string, name string, r io.Reader) error {
+	f, err := ioutil.TempFile(dir, spoolTempPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// syncDir syncs dir so that the renames are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		// some platforms cannot sync a directory
+		return err
+	}
+	return nil
+}
+
+// remove deletes the spooled files for id
+func (s *spool) remove(id string) {
+	for _, ext := range []string{spoolMetaExt, spoolDataExt} {
+		if err := os.Remove(filepath.Join(s.dir, id+ext)); err != nil && !os.IsNotExist(err) {
+			Log().WithError(err).Errorf("could not remove spooled file %s%s", id, ext)
+		}
+	}
+}
+
+// fail renames the spooled files for id so that they will not be replayed
+func (s *spool) fail(id string) {
+	for _, ext := range []string{spoolMetaExt, spoolDataExt} {
+		name := filepath.Join(s.dir, id+ext)
+		if err := os.Rename(name, name+spoolFailedExt); err != nil && !os.IsNotExist(err) {
+			Log().WithError(err).Errorf("could not rename spooled file %s%s", id, ext)
+		}
+	}
+}
+
+// giveUp moves the envelope to the dead letters, or marks it as failed if there are no dead letters
+func (s *spool) giveUp(id string, reason error) {
+	if s.deadLetter == nil {
+		s.fail(id)
+		return
+	}
+	err := func() error {
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, id+spoolMetaExt))
+		if err != nil {
+			return err
+		}
+		meta := &mail.EnvelopeMeta{}
+		if err = json.Unmarshal(b, meta); err != nil {
+			return err
+		}
+		f, err := os.Open(filepath.Join(s.dir, id+spoolDataExt))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return s.deadLetter(meta, f, reason)
+	}()
+	if err != nil {
+		Log().WithError(err).Errorf("could not dead letter spooled envelope %s", id)
+		s.fail(id)
+		return
+	}
+	s.remove(id)
+}
+
+// scan returns the ids of the envelopes in the spool directory, oldest first.
+// Temporary files and data files without meta-data were left by an interrupted add, so they are removed
+func (s *spool) scan() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]bool)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), spoolMetaExt) {
+			meta[strings.TrimSuffix(f.Name(), spoolMetaExt)] = true
+		}
+	}
+	var ids []string
+	for _, f := range files {
+		name := f.Name()
+		switch {
+		case strings.HasPrefix(name, spoolTempPrefix):
+			_ = os.Remove(filepath.Join(s.dir, name))
+		case strings.HasSuffix(name, spoolDataExt):
+			id := strings.TrimSuffix(name, spoolDataExt)
+			if meta[id] {
+				ids = append(ids, id)
+			} else {
+				_ = os.Remove(filepath.Join(s.dir, name))
+			}
+		}
+	}
+	// ids start with a timestamp
+	sort.Slice(ids, func(i, j int) bool {
+		return spoolIdLess(ids[i], ids[j])
+	})
+	return ids, nil
+}
+
+// spoolIdLess compares the timestamp part of two spool ids, then the sequence
+func spoolIdLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// open loads the envelope with the given id from the spool
+func (s *spool) open(id string) (*mail.Envelope, error) {
+	meta, err := ioutil.ReadFile(filepath.Join(s.dir, id+spoolMetaExt))
+	if err != nil {
+		return nil, err
+	}
+	e := mail.NewEnvelope("", 0)
+	if err = e.UnmarshalMeta(meta); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(s.dir, id+spoolDataExt))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = s.load(e, f); err != nil {
+		e.ResetTransaction()
+		return nil, err
+	}
+	return e, nil
+}
+
+// start replays the spool directory and starts the dispatcher and the spool workers
+func (s *spool) start() error {
+	ids, err := s.scan()
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		Log().Infof("replaying %d envelope(s) from the spool", len(ids))
+	}
+	s.added = make(chan string, s.workers)
+	s.work = make(chan string)
+	s.done = make(chan spoolResult)
+	s.stop = make(chan bool)
+	s.wg.Add(s.workers + 1)
+	go s.dispatch(ids)
+	for i := 0; i < s.workers; i++ {
+		go s.worker()
+	}
+	return nil
+}
+
+// shutdown stops the dispatcher and waits for the workers to finish what they are delivering.
+// The envelopes that were not delivered stay in the spool
+func (s *spool) shutdown() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// dispatch hands the spooled envelopes to the workers, and schedules the retries
+func (s *spool) dispatch(pending []string) {
+	defer s.wg.Done()
+	retries := make(map[string]*spoolRetry)
+	for {
+		// find the first envelope that is ready to be delivered, or when the next retry is due
+		var out chan string
+		var wake <-chan time.Time
+		var next, i = "", 0
+		var due time.Time
+		now := time.Now()
+		for ; i < len(pending); i++ {
+			r, ok := retries[pending[i]]
+			if !ok || !r.next.After(now) {
+				next, out = pending[i], s.work
+				break
+			}
+			if due.IsZero() || r.next.Before(due) {
+				due = r.next
+			}
+		}
+		if out == nil && !due.IsZero() {
+			wake = time.After(due.Sub(now))
+		}
+		select {
+		case out <- next:
+			pending = append(pending[:i], pending[i+1:]...)
+		case id := <-s.added:
+			pending = append(pending, id)
+		case res := <-s.done:
+			if res.err == nil {
+				delete(retries, res.id)
+				continue
+			}
+			r, ok := retries[res.id]
+			if !ok {
+				r = &spoolRetry{}
+				retries[res.id] = r
+			}
+			r.attempts++
+			if _, permanent := res.err.(spoolPermanentError); permanent {
+				Log().WithError(res.err).Errorf("giving up on spooled envelope %s, it was rejected", res.id)
+				delete(retries, res.id)
+				s.giveUp(res.id, res.err)
+				continue
+			}
+			if r.attempts >= s.maxRetries {
+				Log().WithError(res.err).Errorf("giving up on spooled envelope %s after %d attempts", res.id, r.attempts)
+				delete(retries, res.id)
+				s.giveUp(res.id, res.err)
+				continue
+			}
+			r.next = time.Now().Add(s.retryBackoff(r.attempts))
+			Log().WithError(res.err).Warnf("spooled envelope %s failed, attempt %d, retrying at %s",
+				res.id, r.attempts, r.next.Format(time.RFC3339))
+			pending = append(pending, res.id)
+		case <-wake:
+			// a retry is due
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// retryBackoff returns how long to wait after the given number of attempts
+func (s *spool) retryBackoff(attempts int) time.Duration {
+	d := s.backoff
+	for i := 1; i < attempts && d < s.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.maxBackoff {
+		d = s.maxBackoff
+	}
+	return d
+}
+
+// worker delivers the spooled envelopes given to it by the dispatcher
+func (s *spool) worker() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case id := <-s.work:
+			res := spoolResult{id: id, err: s.process(id)}
+			if res.err == nil {
+				// remove it now, in case the dispatcher has stopped
+				s.remove(id)
+			}
+			select {
+			case s.done <- res:
+			case <-s.stop:
+				return
+			}
+		}
+	}
+}
+
+// process loads the envelope and delivers it, returning an error if it needs to be retried
+func (s *spool) process(id string) error {
+	e, err := s.open(id)
+	if err != nil {
+		return err
+	}
+	// removes the temporary data file, if any, after the backend has finished
+	defer e.ResetTransaction()
+	result, err := s.deliver(e)
+	code := result.Code()
+	if code >= 500 && (err == nil || isVerdict(err)) {
+		// the stack rejected it, rather than failed to save it
+		return spoolPermanentError{errors.New(result.String())}
+	}
+	if rr, ok := result.(*RcptResults); ok && code >= 400 && code < 500 {
+		// the next attempt is only for the recipients that were deferred
+		if err := s.keepDeferred(id, rr); err != nil {
+			Log().WithError(err).Errorf("could not update the recipients of spooled envelope %s", id)
+		}
+	}
+	if code >= 300 {
+		return errors.New(result.String())
+	}
+	return nil
+}
+
+// keepDeferred changes the recipients of the spooled envelope to the ones that were deferred, so the
+// recipients that it was delivered to don't get it again, and the failed ones are not tried again
+func (s *spool) keepDeferred(id string, rr *RcptResults) error {
+	var rcpts []mail.Address
+	for _, r := range rr.Rcpts {
+		if r.Status == RcptDeferred {
+			rcpts = append(rcpts, r.Rcpt)
+		}
+	}
+	if len(rcpts) == 0 || len(rcpts) == len(rr.Rcpts) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, id+spoolMetaExt))
+	if err != nil {
+		return err
+	}
+	// the meta-data that was spooled, rather than the envelope, which the processors have changed
+	meta := &mail.EnvelopeMeta{}
+	if err = json.Unmarshal(b, meta); err != nil {
+		return err
+	}
+	meta.RcptTo = rcpts
+	if b, err = json.Marshal(meta); err != nil {
+		return err
+	}
+	if err = writeFile(s.dir, id+spoolMetaExt, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
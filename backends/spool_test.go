@@ -0,0 +1,318 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/log"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// spoolFiles returns the names of the files in the spool dir
+func spoolFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+// waitForSpool waits until the spool dir has n files
+func waitForSpool(t *testing.T, dir string, n int) []string {
+	var names []string
+	for i := 0; i < 100; i++ {
+		if names = spoolFiles(t, dir); len(names) == n {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	return names
+}
+
+func newSpoolTestEnvelope() *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc12345"
+	e.Helo = "helo.example.com"
+	e.MailFrom = mail.Address{User: "test", Host: "example.com"}
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	e.Data.WriteString("Subject: Test\n\nThis is a test.")
+	return e
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var saved int32
+	Svc.AddProcessor("SpoolCounter", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					if e.Subject != "Test" || len(e.RcptTo) != 1 || e.Helo != "helo.example.com" {
+						return nil, errors.New("envelope was not loaded from the spool")
+					}
+					atomic.AddInt32(&saved, 1)
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "spoolcounter")
+	c := BackendConfig{
+		"save_process":      "HeadersParser|SpoolCounter",
+		"save_workers_size": 2,
+		"spool_dir":         dir,
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+
+	// spooled before starting, these will be replayed
+	for i := 0; i < 2; i++ {
+		if _, err := gateway.spool.add(newSpoolTestEnvelope()); err != nil {
+			t.Error("could not spool:", err)
+		}
+	}
+	// files left from an interrupted write should be cleaned up
+	_ = ioutil.WriteFile(filepath.Join(dir, spoolTempPrefix+"123"), []byte("test"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, "1-1"+spoolDataExt), []byte("test"), 0600)
+	if names := spoolFiles(t, dir); len(names) != 6 {
+		t.Error("expecting 6 files in the spool, got", names)
+	}
+
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	result := gateway.Process(newSpoolTestEnvelope())
+	if result.Code() != 250 || !strings.Contains(result.String(), "queued as") {
+		t.Error("expecting 250 queued as, got", result)
+	}
+	if names := waitForSpool(t, dir, 0); len(names) != 0 {
+		t.Error("spool was not emptied, it has", names)
+	}
+	if n := atomic.LoadInt32(&saved); n != 3 {
+		t.Error("expecting 3 envelopes to be saved, got", n)
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+	Svc.reset()
+}
+
+func TestSpoolRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var attempts int32
+	Svc.AddProcessor("SpoolFailer", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					atomic.AddInt32(&attempts, 1)
+					return nil, errors.New("storage is down")
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "spoolfailer")
+	c := BackendConfig{
+		"save_process":            "SpoolFailer",
+		"spool_dir":               dir,
+		"spool_max_retries":       3,
+		"spool_retry_backoff":     "10ms",
+		"spool_retry_max_backoff": "20ms",
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	// the client is told that the email was accepted, even though storage is down
+	result := gateway.Process(newSpoolTestEnvelope())
+	if result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+	// after giving up, the files are kept, but not replayed
+	names := waitForSpool(t, dir, 2)
+	for i := 0; i < 100 && !strings.HasSuffix(names[0], spoolFailedExt); i++ {
+		time.Sleep(time.Millisecond * 50)
+		names = spoolFiles(t, dir)
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, spoolFailedExt) {
+			t.Error("expecting the spooled files to be marked as failed, got", names)
+			break
+		}
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Error("expecting 3 attempts, got", n)
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+	Svc.reset()
+}
+
+func TestSpoolRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var attempts int32
+	Svc.AddProcessor("SpoolRejecter", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					atomic.AddInt32(&attempts, 1)
+					return NewResult("550 5.7.1 Rejected"), nil
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "spoolrejecter")
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":        "SpoolRejecter",
+		"spool_dir":           dir,
+		"spool_max_retries":   3,
+		"spool_retry_backoff": "10ms",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	if result := gateway.Process(newSpoolTestEnvelope()); result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+	names := waitForSpool(t, dir, 2)
+	for i := 0; i < 100 && !strings.HasSuffix(names[0], spoolFailedExt); i++ {
+		time.Sleep(time.Millisecond * 10)
+		names = spoolFiles(t, dir)
+	}
+	if !strings.HasSuffix(names[0], spoolFailedExt) {
+		t.Error("expecting the rejected email to be given up on, got", names)
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+	// it's not tried again after the rejection
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Error("expecting 1 attempt, got", n)
+	}
+	Svc.reset()
+}
+
+func TestSpoolDeferredRcpts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+
+	var (
+		mu       sync.Mutex
+		attempts [][]string
+	)
+	// bob's mailbox is busy the first time
+	Svc.AddProcessor("SpoolDeferrer", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task != TaskSaveMail {
+					return p.Process(e, task)
+				}
+				mu.Lock()
+				var rcpts []string
+				for _, rcpt := range e.RcptTo {
+					rcpts = append(rcpts, rcpt.User)
+				}
+				attempts = append(attempts, rcpts)
+				first := len(attempts) == 1
+				mu.Unlock()
+				for _, rcpt := range e.RcptTo {
+					if rcpt.User == "bob" && first {
+						MarkRcptDeferred(e, rcpt, nil)
+					} else {
+						MarkRcptDelivered(e, rcpt)
+					}
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "spooldeferrer")
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":        "SpoolDeferrer",
+		"spool_dir":           dir,
+		"spool_retry_backoff": "10ms",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	e := newSpoolTestEnvelope()
+	e.RcptTo = []mail.Address{{User: "alice", Host: "example.com"}, {User: "bob", Host: "example.com"}}
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting 250, got", result)
+	}
+	waitForSpool(t, dir, 0)
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(attempts) != "[[alice bob] [bob]]" {
+		t.Error("expecting only bob to be tried again, got", attempts)
+	}
+	Svc.reset()
+}
+
+func TestSpoolRetryBackoff(t *testing.T) {
+	s := &spool{backoff: time.Second, maxBackoff: time.Second * 5}
+	expect := []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5}
+	for i, d := range expect {
+		if b := s.retryBackoff(i + 1); b != d {
+			t.Error("attempt", i+1, "expecting backoff", d, "got", b)
+		}
+	}
+}
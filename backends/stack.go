@@ -0,0 +1,653 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"net/textproto"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// The stack syntax used by save_process, validate_process and the other stack options.
+// A stack is a list of processors separated by |. A processor can be named as an instance with
+// its own config, eg. sql#archive, see instanceConfig. A processor can be replaced by a group
+// in brackets, which is either a branch, a fan-out or a retry:
+//
+//   HeadersParser|(if header:X-Spam-Flag=YES then Quarantine else Hasher|SQL)|Debugger
+//   HeadersParser|Hasher|(SQL & EmlFile)
+//   HeadersParser|Hasher|(retry SQL)|Debugger
+//
+// A branch runs the stack after "then" if the condition matches, otherwise the stack after "else",
+// if any. Both carry on to the rest of the stack. A fan-out runs each of its stacks at the same time,
+// and carries on only if all of them succeeded. Each stack gets its own copy of the envelope, and only
+// the values and recipient statuses they set are kept, so anything else that changes the envelope
+// should come before the fan-out.
+// A retry runs its stack again if it fails, and stops trying it for a while when it keeps failing,
+// see retryDecorator.
+//
+// A condition is one or more terms joined by "and" or "or", where "and" comes first.
+// A term is "not" (optional), then a field, then an optional operator and value:
+//
+//   field          - true if the field is not empty
+//   field=value    - the field is equal to the value, ignoring case
+//   field!=value   - the field is not equal to the value
+//   field~regexp   - the field matches the regular expression
+//
+// The fields are from, rcpt (any of the recipients), helo, ip, tls, auth (the username, if any),
+// subject, header:Name (needs the HeadersParser processor before the branch) and value:key
+// (a value that an earlier processor set in e.Values). Values that have spaces or any of |&()
+// can be put in double quotes, for example subject~"^\[(spam|bulk)\]"
+
+// stackToken is a token of the stack syntax
+type stackToken struct {
+	// text of the token, one of |&() or a word
+	text string
+	// quoted is true if any part of a word was in quotes, so it cannot be a keyword
+	quoted bool
+}
+
+// isKeyword returns true if the token is the keyword kw
+func (t stackToken) isKeyword(kw string) bool {
+	return !t.quoted && strings.EqualFold(t.text, kw)
+}
+
+// isSymbol returns true if the token is one of |&()
+func (t stackToken) isSymbol(sym string) bool {
+	return !t.quoted && t.text == sym
+}
+
+// lexStack splits a stack config in to tokens
+func lexStack(config string) ([]stackToken, error) {
+	var tokens []stackToken
+	var word strings.Builder
+	inWord, quoted := false, false
+	endWord := func() {
+		if inWord {
+			tokens = append(tokens, stackToken{text: word.String(), quoted: quoted})
+			word.Reset()
+			inWord, quoted = false, false
+		}
+	}
+	runes := []rune(config)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			endWord()
+		case r == '|' || r == '&' || r == '(' || r == ')':
+			endWord()
+			tokens = append(tokens, stackToken{text: string(r)})
+		case r == '"':
+			inWord, quoted = true, true
+			closed := false
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && runes[i+1] == '"' {
+					i++
+				} else if runes[i] == '"' {
+					closed = true
+					break
+				}
+				word.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("missing closing quote in [%s]", config)
+			}
+		default:
+			inWord = true
+			word.WriteRune(r)
+		}
+	}
+	endWord()
+	return tokens, nil
+}
+
+// stackNode is a list of steps, where each step is a processor, a branch or a fan-out
+type stackNode struct {
+	steps []*stepNode
+}
+
+type stepNode struct {
+	// name of the processor, if the step is a processor
+	name string
+	// cond, then and els are set if the step is a branch, els may be nil
+	cond      *condition
+	then, els *stackNode
+	// fanOut has the stacks of a fan-out
+	fanOut []*stackNode
+	// retry is set if the step is a retry, retryName is "retry" or an instance, eg. retry#sql
+	retry     *stackNode
+	retryName string
+}
+
+// stackParser parses tokens from lexStack
+type stackParser struct {
+	tokens []stackToken
+	pos    int
+}
+
+func (p *stackParser) peek() (stackToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return stackToken{}, false
+}
+
+func (p *stackParser) next() (stackToken, bool) {
+	t, ok := p.peek()
+	if ok {
+		p.pos++
+	}
+	return t, ok
+}
+
+// parseStackConfig parses a stack config
+func parseStackConfig(config string) (*stackNode, error) {
+	tokens, err := lexStack(config)
+	if err != nil {
+		return nil, err
+	}
+	p := &stackParser{tokens: tokens}
+	stack, err := p.parseStack()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected [%s] in stack [%s]", t.text, config)
+	}
+	return stack, nil
+}
+
+// parseStack parses steps separated by |
+func (p *stackParser) parseStack() (*stackNode, error) {
+	stack := &stackNode{}
+	for {
+		step, err := p.parseStep()
+		if err != nil {
+			return nil, err
+		}
+		stack.steps = append(stack.steps, step)
+		if t, ok := p.peek(); !ok || !t.isSymbol("|") {
+			return stack, nil
+		}
+		p.next()
+	}
+}
+
+// parseStep parses a processor name, or a group in brackets
+func (p *stackParser) parseStep() (*stepNode, error) {
+	t, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("expecting a processor at the end of the stack")
+	}
+	if t.isSymbol("(") {
+		step, err := p.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.next(); !ok || !t.isSymbol(")") {
+			return nil, fmt.Errorf("missing ) in stack")
+		}
+		return step, nil
+	}
+	if t.quoted || t.isSymbol("|") || t.isSymbol("&") || t.isSymbol(")") ||
+		t.isKeyword("if") || t.isKeyword("then") || t.isKeyword("else") {
+		return nil, fmt.Errorf("expecting a processor, got [%s]", t.text)
+	}
+	return &stepNode{name: strings.ToLower(t.text)}, nil
+}
+
+// parseGroup parses what's in brackets, a branch, a fan-out or a retry
+func (p *stackParser) parseGroup() (*stepNode, error) {
+	if t, ok := p.peek(); ok && !t.quoted && processorName(strings.ToLower(t.text)) == retryGroup {
+		p.next()
+		stack, err := p.parseStack()
+		if err != nil {
+			return nil, err
+		}
+		return &stepNode{retry: stack, retryName: strings.ToLower(t.text)}, nil
+	}
+	if t, ok := p.peek(); ok && t.isKeyword("if") {
+		p.next()
+		cond, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		step := &stepNode{cond: cond}
+		if step.then, err = p.parseStack(); err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); ok && t.isKeyword("else") {
+			p.next()
+			if step.els, err = p.parseStack(); err != nil {
+				return nil, err
+			}
+		}
+		return step, nil
+	}
+	step := &stepNode{}
+	for {
+		stack, err := p.parseStack()
+		if err != nil {
+			return nil, err
+		}
+		step.fanOut = append(step.fanOut, stack)
+		if t, ok := p.peek(); !ok || !t.isSymbol("&") {
+			return step, nil
+		}
+		p.next()
+	}
+}
+
+// parseCondition parses the terms of a condition, up to the "then" keyword
+func (p *stackParser) parseCondition() (*condition, error) {
+	cond := &condition{}
+	var and []*condTerm
+	for {
+		t, ok := p.next()
+		if !ok {
+			return nil, fmt.Errorf("expecting a condition after if")
+		}
+		not := false
+		if t.isKeyword("not") {
+			not = true
+			if t, ok = p.next(); !ok {
+				return nil, fmt.Errorf("expecting a condition after not")
+			}
+		}
+		if !t.quoted && (len(t.text) == 1 && strings.ContainsAny(t.text, "|&()") || t.isKeyword("then")) {
+			return nil, fmt.Errorf("expecting a condition, got [%s]", t.text)
+		}
+		term, err := parseCondTerm(t.text)
+		if err != nil {
+			return nil, err
+		}
+		term.not = not
+		and = append(and, term)
+		if t, ok = p.next(); !ok {
+			return nil, fmt.Errorf("expecting then after the condition")
+		}
+		switch {
+		case t.isKeyword("then"):
+			cond.or = append(cond.or, and)
+			return cond, nil
+		case t.isKeyword("or"):
+			cond.or = append(cond.or, and)
+			and = nil
+		case !t.isKeyword("and"):
+			return nil, fmt.Errorf("expecting and, or, then, got [%s]", t.text)
+		}
+	}
+}
+
+// condition matches an envelope. It's a list of terms that are or'ed, where each is a list of terms that are and'ed
+type condition struct {
+	or [][]*condTerm
+}
+
+type condTerm struct {
+	not   bool
+	field string
+	// key is the header name for header: or the key for value:
+	key   string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+// parseCondTerm parses a term such as header:X-Spam-Flag=YES
+func parseCondTerm(text string) (*condTerm, error) {
+	term := &condTerm{}
+	field := text
+	// find the first operator
+	if pos := strings.IndexAny(text, "=~"); pos != -1 {
+		field, term.op, term.value = text[:pos], text[pos:pos+1], text[pos+1:]
+		if term.op == "=" && pos > 0 && text[pos-1] == '!' {
+			field, term.op = text[:pos-1], "!="
+		}
+	}
+	if pos := strings.Index(field, ":"); pos != -1 {
+		field, term.key = field[:pos], field[pos+1:]
+	}
+	term.field = strings.ToLower(field)
+	switch term.field {
+	case "from", "rcpt", "helo", "ip", "tls", "auth", "subject":
+		if term.key != "" {
+			return nil, fmt.Errorf("field [%s] does not take a key, in [%s]", term.field, text)
+		}
+	case "header", "value":
+		if term.key == "" {
+			return nil, fmt.Errorf("field [%s] needs a key, eg. %s:name, in [%s]", term.field, term.field, text)
+		}
+		if term.field == "header" {
+			term.key = textproto.CanonicalMIMEHeaderKey(term.key)
+		}
+	default:
+		return nil, fmt.Errorf("unknown field [%s] in condition [%s]", field, text)
+	}
+	if term.op == "~" {
+		re, err := regexp.Compile(term.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression in condition [%s]: %s", text, err)
+		}
+		term.re = re
+	}
+	return term, nil
+}
+
+// match returns true if e matches the condition
+func (c *condition) match(e *mail.Envelope) bool {
+	for _, and := range c.or {
+		matched := true
+		for _, term := range and {
+			if !term.match(e) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// values returns the values of the term's field
+func (t *condTerm) values(e *mail.Envelope) []string {
+	switch t.field {
+	case "from":
+		return []string{e.MailFrom.String()}
+	case "rcpt":
+		rcpts := make([]string, len(e.RcptTo))
+		for i := range e.RcptTo {
+			rcpts[i] = e.RcptTo[i].String()
+		}
+		return rcpts
+	case "helo":
+		return []string{e.Helo}
+	case "ip":
+		return []string{e.RemoteIP}
+	case "tls":
+		if e.TLS {
+			return []string{"true"}
+		}
+		return []string{""}
+	case "auth":
+		return []string{e.Auth.Username}
+	case "subject":
+		return []string{e.Subject}
+	case "header":
+		if e.Header != nil {
+			return e.Header[t.key]
+		}
+	case "value":
+		if v, ok := e.Values[t.key]; ok && v != nil {
+			return []string{fmt.Sprint(v)}
+		}
+	}
+	return nil
+}
+
+// match returns true if any of the values of the field match, or none of them if the operator is !=
+func (t *condTerm) match(e *mail.Envelope) bool {
+	matched := false
+	for _, v := range t.values(e) {
+		switch t.op {
+		case "":
+			matched = v != ""
+		case "=", "!=":
+			matched = strings.EqualFold(v, t.value)
+		case "~":
+			matched = t.re.MatchString(v)
+		}
+		if matched {
+			break
+		}
+	}
+	if t.op == "!=" {
+		matched = !matched
+	}
+	return matched != t.not
+}
+
+// processorName returns the name of the processor, without the instance name. Eg. sql for sql#archive
+func processorName(name string) string {
+	if pos := strings.Index(name, "#"); pos != -1 {
+		return name[:pos]
+	}
+	return name
+}
+
+// uses returns true if the processor called name is anywhere in the stack
+func (n *stackNode) uses(name string) bool {
+	for _, step := range n.steps {
+		if step.name != "" && processorName(step.name) == name ||
+			step.then != nil && step.then.uses(name) ||
+			step.els != nil && step.els.uses(name) ||
+			step.retry != nil && step.retry.uses(name) {
+			return true
+		}
+		for _, stack := range step.fanOut {
+			if stack.uses(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// names returns the name of each processor in the stack, including the ones in groups
+func (n *stackNode) names() []string {
+	var names []string
+	for _, step := range n.steps {
+		if step.name != "" {
+			names = append(names, step.name)
+		}
+		if step.then != nil {
+			names = append(names, step.then.names()...)
+		}
+		if step.els != nil {
+			names = append(names, step.els.names()...)
+		}
+		for _, stack := range step.fanOut {
+			names = append(names, stack.names()...)
+		}
+		if step.retry != nil {
+			names = append(names, step.retryName)
+			names = append(names, step.retry.names()...)
+		}
+	}
+	return names
+}
+
+// decorators returns the decorators for the stack, ready for Decorate. s is the stack that they will be in
+func (n *stackNode) decorators(s *contextStack) ([]Decorator, error) {
+	decorators := make([]Decorator, 0, len(n.steps))
+	// reverse order, since decorators are stacked
+	for i := len(n.steps) - 1; i >= 0; i-- {
+		d, err := n.steps[i].decorator(s)
+		if err != nil {
+			return nil, err
+		}
+		decorators = append(decorators, d)
+	}
+	return decorators, nil
+}
+
+// decorator returns the decorator for the step
+func (n *stepNode) decorator(s *contextStack) (Decorator, error) {
+	switch {
+	case n.name != "":
+		var d Decorator
+		// the processor gets its own config, if there is any for it in the processors option
+		configFor := func(backendConfig BackendConfig) (BackendConfig, error) {
+			return instanceConfig(backendConfig, n.name)
+		}
+		if makeFunc, ok := contextProcessors[processorName(n.name)]; ok {
+			Svc.withConfig(configFor, func() {
+				d = s.adapt(makeFunc())
+			})
+			return d, nil
+		} else if makeFunc, ok := processors[processorName(n.name)]; ok {
+			Svc.withConfig(configFor, func() {
+				d = makeFunc()
+			})
+			return d, nil
+		}
+		ErrProcessorNotFound = fmt.Errorf("processor [%s] not found", n.name)
+		return nil, ErrProcessorNotFound
+	case n.cond != nil:
+		return n.branch(s)
+	case n.retry != nil:
+		return n.retryDecorator(s)
+	}
+	return n.fanOutDecorator(s)
+}
+
+// branch returns a decorator that runs the then or else stack before the next processor
+func (n *stepNode) branch(s *contextStack) (Decorator, error) {
+	then, err := n.then.decorators(s)
+	if err != nil {
+		return nil, err
+	}
+	var els []Decorator
+	if n.els != nil {
+		if els, err = n.els.decorators(s); err != nil {
+			return nil, err
+		}
+	}
+	cond := n.cond
+	return func(next Processor) Processor {
+		thenP, elseP := Decorate(next, then...), Decorate(next, els...)
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if cond.match(e) {
+				return thenP.Process(e, task)
+			}
+			return elseP.Process(e, task)
+		})
+	}, nil
+}
+
+// BranchValue is a value of e.Values that can't be shared by the stacks of a fan-out, which run at the
+// same time, such as the compressor that can only be read once. Each stack gets the value returned by
+// Branch, for its copy of the envelope
+type BranchValue interface {
+	Branch(e *mail.Envelope) interface{}
+}
+
+// fanOutDecorator returns a decorator that runs the stacks of a fan-out at the same time,
+// then the next processor if they all succeeded. Each stack gets its own copy of the envelope,
+// see mail.Envelope.Branch, with its own copy of each BranchValue. Once they are done, the values
+// that they set and the recipients that they marked are copied to the envelope, in the order of the stacks
+func (n *stepNode) fanOutDecorator(s *contextStack) (Decorator, error) {
+	// each has its own stack, since a stack can only be used by one goroutine at a time
+	stacks := make([]*contextStack, len(n.fanOut))
+	for i := range n.fanOut {
+		stacks[i] = &contextStack{}
+		decorators, err := n.fanOut[i].decorators(stacks[i])
+		if err != nil {
+			return nil, err
+		}
+		stacks[i].top = Decorate(DefaultProcessor{}, decorators...)
+	}
+	return func(next Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			ctx := s.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			branches := make([]*mail.Envelope, len(stacks))
+			copies := make([]map[string]interface{}, len(stacks))
+			for i := range stacks {
+				branches[i] = e.Branch()
+				copies[i] = branchValues(branches[i])
+			}
+			results := make([]Result, len(stacks))
+			errs := make([]error, len(stacks))
+			var wg sync.WaitGroup
+			wg.Add(len(stacks))
+			for i := range stacks {
+				go func(i int) {
+					defer wg.Done()
+					results[i], errs[i] = stacks[i].ProcessContext(ctx, branches[i], task)
+				}(i)
+			}
+			wg.Wait()
+			before := make(map[string]interface{}, len(e.Values))
+			for k, v := range e.Values {
+				before[k] = v
+			}
+			for i := range branches {
+				mergeBranch(e, branches[i], before, copies[i])
+			}
+			for i := range stacks {
+				if errs[i] != nil || results[i] != nil && results[i].Code() >= 400 {
+					return results[i], errs[i]
+				}
+			}
+			return next.Process(e, task)
+		})
+	}, nil
+}
+
+// branchValues gives the branch b its own copy of each BranchValue. Returns the copies
+func branchValues(b *mail.Envelope) map[string]interface{} {
+	copies := make(map[string]interface{})
+	for k, v := range b.Values {
+		if bv, ok := v.(BranchValue); ok {
+			b.Values[k] = bv.Branch(b)
+			copies[k] = b.Values[k]
+		}
+	}
+	return copies
+}
+
+// mergeBranch copies the values that were set in the branch b of e, and the recipients that were marked.
+// before has the values of e before the branches ran, and copies has the BranchValues made for b,
+// which were not set by its stack unless it changed them
+func mergeBranch(e, b *mail.Envelope, before, copies map[string]interface{}) {
+	for k, v := range b.Values {
+		if k == rcptStatusKey {
+			continue
+		}
+		if c, ok := copies[k]; ok && !changedValue(c, v) {
+			continue
+		}
+		if old, ok := before[k]; !ok || changedValue(old, v) {
+			e.Values[k] = v
+		}
+	}
+	t, ok := b.Values[rcptStatusKey].(*rcptTracker)
+	if !ok {
+		return
+	}
+	for i := range t.rcpts {
+		if t.changed[i] {
+			markRcpt(e, t.rcpts[i].Rcpt, t.rcpts[i].Status, t.rcpts[i].Result)
+		}
+	}
+}
+
+// changedValue returns true if v is not the value old. Values that can't be compared,
+// such as structs with a slice, are taken as changed
+func changedValue(old, v interface{}) bool {
+	ov, vv := reflect.ValueOf(old), reflect.ValueOf(v)
+	if !ov.IsValid() || !vv.IsValid() {
+		return ov.IsValid() != vv.IsValid()
+	}
+	if ov.Type() != vv.Type() {
+		return true
+	}
+	switch vv.Kind() {
+	case reflect.Map, reflect.Func:
+		return ov.Pointer() != vv.Pointer()
+	case reflect.Slice:
+		return ov.Pointer() != vv.Pointer() || ov.Len() != vv.Len()
+	}
+	if vv.Type().Comparable() {
+		return old != v
+	}
+	return true
+}
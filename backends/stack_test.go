@@ -0,0 +1,222 @@
+package backends
+
+import (
+	"compress/zlib"
+	"errors"
+	"io/ioutil"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/karngyan/go-guerrilla/auth"
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+func TestParseStackConfig(t *testing.T) {
+	for _, config := range []string{
+		"HeadersParser|Header|Debugger",
+		"HeadersParser | Header | Debugger",
+		"HeadersParser|(if header:X-Spam-Flag=YES then Debugger else Hasher|Header)|Debugger",
+		"(if not tls and from~\"@(a|b)\\.com$\" or auth then Debugger)",
+		"Hasher|(Debugger & Header|Debugger)",
+		"((if helo then Debugger) & Header)",
+	} {
+		if _, err := parseStackConfig(config); err != nil {
+			t.Errorf("expecting [%s] to parse, got %s", config, err)
+		}
+	}
+	for _, config := range []string{
+		"HeadersParser|",
+		"|Debugger",
+		"(Debugger & Header",
+		"Debugger)",
+		"(if then Debugger)",
+		"(if helo Debugger)",
+		"(if unknown=1 then Debugger)",
+		"(if header=1 then Debugger)",
+		"(if subject~\"[\" then Debugger)",
+		"\"Debugger\"",
+		"(if helo=\"abc then Debugger)",
+	} {
+		if _, err := parseStackConfig(config); err == nil {
+			t.Errorf("expecting [%s] to be an error", config)
+		}
+	}
+}
+
+func TestStackCondition(t *testing.T) {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Helo = "mx.example.com"
+	e.MailFrom = mail.Address{User: "sender", Host: "example.com"}
+	e.PushRcpt(mail.Address{User: "a", Host: "grr.la"})
+	e.PushRcpt(mail.Address{User: "b", Host: "example.org"})
+	e.Subject = "[SPAM] hello"
+	e.TLS = true
+	e.Auth = auth.Auth{Username: "joe"}
+	e.Header = textproto.MIMEHeader{"X-Spam-Flag": {"YES"}}
+	e.Values["score"] = 7
+
+	for cond, expect := range map[string]bool{
+		"header:x-spam-flag=yes":              true,
+		"header:X-Spam-Flag!=YES":             false,
+		"header:X-Other":                      false,
+		"not header:X-Other":                  true,
+		"from=sender@example.com":             true,
+		"rcpt=b@example.org":                  true,
+		"rcpt=c@example.org":                  false,
+		"rcpt~@grr\\.la$":                     true,
+		"helo~^mx\\.":                         true,
+		"ip=127.0.0.1":                        true,
+		"tls":                                 true,
+		"auth=joe":                            true,
+		"subject~\"(?i)^\\[(spam|bulk)\\] \"": true,
+		"value:score=7":                       true,
+		"value:missing":                       false,
+		"tls and auth=bob":                    false,
+		"tls and auth=bob or value:score=7":   true,
+		"auth=bob or tls and helo=x":          false,
+	} {
+		node, err := parseStackConfig("(if " + cond + " then Debugger)")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if matched := node.steps[0].cond.match(e); matched != expect {
+			t.Errorf("expecting [%s] to be %v", cond, expect)
+		}
+	}
+}
+
+// TestStackBranchAndFanOut should be run with -race, the stacks of the fan-outs write to the envelope
+func TestStackBranchAndFanOut(t *testing.T) {
+	var mu sync.Mutex
+	var ran []string
+	mark := func(name string, err error) ProcessorConstructor {
+		return func() Decorator {
+			return func(p Processor) Processor {
+				return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+					mu.Lock()
+					ran = append(ran, name)
+					mu.Unlock()
+					e.Values[name] = true
+					e.Values["last"] = name
+					if err != nil {
+						MarkRcptFailed(e, e.RcptTo[0], nil)
+						return NewResult("554 5.3.0 Error: " + err.Error()), err
+					}
+					return p.Process(e, task)
+				})
+			}
+		}
+	}
+	Svc.AddProcessor("MarkA", mark("a", nil))
+	Svc.AddProcessor("MarkB", mark("b", nil))
+	Svc.AddProcessor("MarkD", mark("d", nil))
+	Svc.AddProcessor("FailC", mark("c", errors.New("storage failed")))
+	defer func() {
+		for _, name := range []string{"marka", "markb", "markd", "failc"} {
+			delete(processors, name)
+		}
+	}()
+
+	run := func(config string, e *mail.Envelope) (string, error) {
+		ran = ran[:0]
+		p, err := newStack(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.Process(e, TaskSaveMail)
+		sort.Strings(ran)
+		return strings.Join(ran, ""), err
+	}
+	spam := mail.NewEnvelope("127.0.0.1", 1)
+	spam.Header = textproto.MIMEHeader{"X-Spam-Flag": {"YES"}}
+	ham := func() *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+		e.Values["last"] = "none"
+		return e
+	}
+
+	branch := "(if header:X-Spam-Flag=YES then MarkA else MarkB)|MarkD"
+	if got, _ := run(branch, spam); got != "ad" {
+		t.Error("expecting the then stack to run, got", got)
+	}
+	if got, _ := run(branch, ham()); got != "bd" {
+		t.Error("expecting the else stack to run, got", got)
+	}
+	if got, _ := run("(if header:X-Spam-Flag=YES then MarkA)|MarkD", ham()); got != "d" {
+		t.Error("expecting only MarkD to run, got", got)
+	}
+	e := ham()
+	if got, err := run("(MarkA & MarkB|MarkB & MarkD)", e); got != "abbd" || err != nil {
+		t.Error("expecting all stacks of the fan-out to run, got", got, err)
+	}
+	// the values of each stack are kept, the last stack wins
+	if e.Values["a"] != true || e.Values["b"] != true || e.Values["d"] != true || e.Values["last"] != "d" {
+		t.Error("expecting the values of the stacks to be kept, got", e.Values)
+	}
+	e = ham()
+	if got, err := run("(MarkA & FailC)|MarkD", e); got != "ac" || err == nil {
+		t.Error("expecting the fan-out to fail and not carry on, got", got, err)
+	}
+	if rcpts := RcptStatuses(e); len(rcpts) != 1 || rcpts[0].Status != RcptFailed {
+		t.Error("expecting the recipient marked by the stack to be kept, got", rcpts)
+	}
+	if e.Values["last"] != "c" {
+		t.Error("expecting the value of the last stack, got", e.Values["last"])
+	}
+}
+
+func TestStackFanOutBranchValues(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		compressed []string
+	)
+	// Deflate reads the compressor, which can only be done once
+	Svc.AddProcessor("Deflate", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if c, ok := e.Values["zlib-compressor"].(*DataCompressor); ok {
+					s := c.String()
+					mu.Lock()
+					compressed = append(compressed, s)
+					mu.Unlock()
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	defer delete(processors, "deflate")
+
+	p, err := newStack("Compressor|(Deflate & Deflate)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	e.DeliveryHeader = "Delivered-To: test@example.com\n"
+	e.Data.WriteString("Subject: Test\n\nThis is a test.")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) != 2 {
+		t.Fatal("expecting both stacks to read a compressor, got", len(compressed))
+	}
+	// each stack has its own compressor, so both get all of the email
+	for _, s := range compressed {
+		r, err := zlib.NewReader(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		if string(b) != "Delivered-To: test@example.com\nSubject: Test\n\nThis is a test." {
+			t.Errorf("expecting the compressed email, got %q", b)
+		}
+	}
+	if c, ok := e.Values["zlib-compressor"].(*DataCompressor); !ok || c.String() == "" {
+		t.Error("expecting the compressor of the envelope to be kept, and not read, got", e.Values["zlib-compressor"])
+	}
+}
@@ -0,0 +1,338 @@
+package redigo_driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/karngyan/go-guerrilla/backends"
+)
+
+const (
+	clusterSlots = 16384
+	// how many MOVED or ASK redirects a command can get
+	maxRedirects = 5
+)
+
+var errClusterClosed = errors.New("redis cluster pool is closed")
+
+// cluster sends each command to the node that has the slot of its key. It has a pool for each node
+type cluster struct {
+	sync.Mutex
+	network string
+	seeds   []string
+	do      *backends.RedisDialOptions
+	config  backends.RedisPoolConfig
+	// slots has the address of the node of each slot, it's empty until the slots are read
+	slots      [clusterSlots]string
+	hasSlots   bool
+	refreshing bool
+	pools      map[string]*redigo.Pool
+	closed     bool
+}
+
+// newCluster returns a cluster that finds the nodes with seeds, a comma separated list of addresses
+func newCluster(network, seeds string, config backends.RedisPoolConfig, do *backends.RedisDialOptions) *cluster {
+	c := &cluster{
+		network: network,
+		do:      do,
+		config:  config,
+		pools:   make(map[string]*redigo.Pool),
+	}
+	for _, addr := range strings.Split(seeds, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			c.seeds = append(c.seeds, addr)
+		}
+	}
+	return c
+}
+
+// Get returns a connection which gets a connection to a node for each command
+func (c *cluster) Get(ctx context.Context) (backends.RedisConn, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil, errClusterClosed
+	}
+	return &clusterConn{c: c}, nil
+}
+
+func (c *cluster) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	var err error
+	for addr, p := range c.pools {
+		if closeErr := p.Close(); err == nil {
+			err = closeErr
+		}
+		delete(c.pools, addr)
+	}
+	return err
+}
+
+// pool returns the pool of the node at addr
+func (c *cluster) pool(addr string) (*redigo.Pool, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil, errClusterClosed
+	}
+	p, ok := c.pools[addr]
+	if !ok {
+		p = newPool(c.config, func() (redigo.Conn, error) {
+			return dial(c.network, addr, c.do)
+		})
+		c.pools[addr] = p
+	}
+	return p, nil
+}
+
+// nodeFor returns the address of the node that has key, or any node if key is empty
+func (c *cluster) nodeFor(key string) string {
+	c.Lock()
+	defer c.Unlock()
+	if key != "" {
+		if addr := c.slots[slot(key)]; addr != "" {
+			return addr
+		}
+	}
+	for addr := range c.pools {
+		return addr
+	}
+	if len(c.seeds) == 0 {
+		return ""
+	}
+	return c.seeds[0]
+}
+
+// moved records that slot is now at addr, and reads the slots again in the background
+func (c *cluster) moved(s int, addr string) {
+	c.Lock()
+	c.slots[s] = addr
+	c.Unlock()
+	go func() {
+		_ = c.refresh(context.Background())
+	}()
+}
+
+// refresh reads the slots of the nodes with CLUSTER SLOTS, asking the known nodes in turn
+func (c *cluster) refresh(ctx context.Context) error {
+	c.Lock()
+	if c.refreshing || c.closed {
+		c.Unlock()
+		return nil
+	}
+	c.refreshing = true
+	addrs := append([]string{}, c.seeds...)
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		c.refreshing = false
+		c.Unlock()
+	}()
+	var errs []string
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		slots, err := c.clusterSlots(ctx, addr)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+			continue
+		}
+		c.Lock()
+		c.slots = *slots
+		c.hasSlots = true
+		c.Unlock()
+		return nil
+	}
+	return fmt.Errorf("could not read the cluster slots (%s)", strings.Join(errs, ", "))
+}
+
+// clusterSlots asks the node at addr which node has each slot
+func (c *cluster) clusterSlots(ctx context.Context, addr string) (*[clusterSlots]string, error) {
+	p, err := c.pool(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	ranges, err := redigo.Values(doContext(ctx, conn, "CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	slots := new([clusterSlots]string)
+	for _, r := range ranges {
+		// start, end, then the master as ip, port, id
+		fields, err := redigo.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, fmt.Errorf("unexpected slot range %v", r)
+		}
+		start, err1 := redigo.Int(fields[0], nil)
+		end, err2 := redigo.Int(fields[1], nil)
+		master, err3 := redigo.Values(fields[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(master) < 2 || start < 0 || end >= clusterSlots {
+			return nil, fmt.Errorf("unexpected slot range %v", r)
+		}
+		ip, _ := redigo.String(master[0], nil)
+		port, err := redigo.Int(master[1], nil)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected slot range %v", r)
+		}
+		if ip == "" {
+			// the node doesn't know its ip, so it's the one that was asked
+			ip = host
+		}
+		node := net.JoinHostPort(ip, strconv.Itoa(port))
+		for s := start; s <= end; s++ {
+			slots[s] = node
+		}
+	}
+	return slots, nil
+}
+
+// send sends the command to the node that has its key, following MOVED and ASK redirects
+func (c *cluster) send(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	c.Lock()
+	hasSlots := c.hasSlots
+	c.Unlock()
+	if !hasSlots {
+		if err := c.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+	addr := c.nodeFor(clusterKey(commandName, args))
+	asking := false
+	for i := 0; ; i++ {
+		reply, err := c.doOn(ctx, addr, asking, commandName, args...)
+		e, ok := err.(redigo.Error)
+		if !ok || i == maxRedirects {
+			if err != nil && !ok && ctx.Err() == nil {
+				// the node could be down, and a replica promoted
+				go func() {
+					_ = c.refresh(context.Background())
+				}()
+			}
+			return reply, err
+		}
+		// MOVED <slot> <addr> or ASK <slot> <addr>
+		redirect := strings.Fields(string(e))
+		if len(redirect) != 3 || (redirect[0] != "MOVED" && redirect[0] != "ASK") {
+			return reply, err
+		}
+		s, convErr := strconv.Atoi(redirect[1])
+		if convErr != nil || s < 0 || s >= clusterSlots {
+			return reply, err
+		}
+		addr = redirect[2]
+		asking = redirect[0] == "ASK"
+		if !asking {
+			c.moved(s, addr)
+		}
+	}
+}
+
+// doOn sends the command to the node at addr, after ASKING if asking
+func (c *cluster) doOn(ctx context.Context, addr string, asking bool, commandName string, args ...interface{}) (interface{}, error) {
+	p, err := c.pool(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if asking {
+		if _, err = doContext(ctx, conn, "ASKING"); err != nil {
+			return nil, err
+		}
+	}
+	return doContext(ctx, conn, commandName, args...)
+}
+
+// clusterKey returns the key of a command, the first argument, or "" for the commands that have none
+func clusterKey(commandName string, args []interface{}) string {
+	if len(args) == 0 {
+		return ""
+	}
+	switch strings.ToUpper(commandName) {
+	case "PING", "ECHO", "INFO", "TIME", "CLUSTER", "ROLE":
+		return ""
+	}
+	switch key := args[0].(type) {
+	case string:
+		return key
+	case []byte:
+		return string(key)
+	default:
+		return fmt.Sprint(key)
+	}
+}
+
+// slot returns the hash slot of key. If the key has a {hash tag}, only the tag is hashed
+func slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CRC-16/XMODEM checksum that redis cluster uses
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// clusterConn sends each command through the cluster. It doesn't keep a connection, so closing it
+// does nothing, unless it owns the cluster
+type clusterConn struct {
+	c     *cluster
+	owner bool
+}
+
+func (c *clusterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return c.c.send(context.Background(), commandName, args...)
+}
+
+func (c *clusterConn) DoContext(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	return c.c.send(ctx, commandName, args...)
+}
+
+func (c *clusterConn) Close() error {
+	if c.owner {
+		return c.c.Close()
+	}
+	return nil
+}
@@ -1,12 +1,148 @@
 package redigo_driver
 
 import (
+	"context"
+	"time"
+
 	redigo "github.com/gomodule/redigo/redis"
 	"github.com/karngyan/go-guerrilla/backends"
 )
 
+const (
+	// idle connections are checked with a PING if they were not used for this long
+	testOnBorrowAfter = time.Minute
+	connectTimeout    = time.Second * 10
+)
+
 func init() {
 	backends.RedisDialer = func(network, address string, options ...backends.RedisDialOption) (backends.RedisConn, error) {
-		return redigo.Dial(network, address)
+		do := backends.NewRedisDialOptions(options...)
+		if do.Cluster {
+			c := newCluster(network, address, backends.RedisPoolConfig{MaxIdle: 1}, do)
+			return &clusterConn{c: c, owner: true}, nil
+		}
+		return dialer(network, address, do)()
+	}
+	backends.RedisPooler = func(network, address string, config backends.RedisPoolConfig, options ...backends.RedisDialOption) backends.RedisPool {
+		do := backends.NewRedisDialOptions(options...)
+		if do.Cluster {
+			return newCluster(network, address, config, do)
+		}
+		return &pool{newPool(config, dialer(network, address, do))}
+	}
+}
+
+// newPool returns a redigo pool that makes connections with dial
+func newPool(config backends.RedisPoolConfig, dial func() (redigo.Conn, error)) *redigo.Pool {
+	return &redigo.Pool{
+		Dial: dial,
+		TestOnBorrow: func(c redigo.Conn, t time.Time) error {
+			if time.Since(t) < testOnBorrowAfter {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+		MaxIdle:     config.MaxIdle,
+		MaxActive:   config.MaxActive,
+		IdleTimeout: config.IdleTimeout,
+		// workers wait for a connection instead of failing when MaxActive are in use
+		Wait: true,
+	}
+}
+
+// dialer returns a func that connects to the server at address, or to the master the sentinels know of
+func dialer(network, address string, do *backends.RedisDialOptions) func() (redigo.Conn, error) {
+	if do.SentinelMaster != "" {
+		return func() (redigo.Conn, error) {
+			return dialMaster(network, do)
+		}
+	}
+	return func() (redigo.Conn, error) {
+		return dial(network, address, do)
+	}
+}
+
+// dial connects to a server, and sends AUTH and SELECT
+func dial(network, address string, do *backends.RedisDialOptions) (redigo.Conn, error) {
+	options := []redigo.DialOption{redigo.DialConnectTimeout(connectTimeout)}
+	if do.ReadTimeout > 0 {
+		options = append(options, redigo.DialReadTimeout(do.ReadTimeout))
+	}
+	if do.WriteTimeout > 0 {
+		options = append(options, redigo.DialWriteTimeout(do.WriteTimeout))
+	}
+	if do.Dial != nil {
+		options = append(options, redigo.DialNetDial(do.Dial))
+	}
+	if do.TLSConfig != nil {
+		options = append(options, redigo.DialUseTLS(true), redigo.DialTLSConfig(do.TLSConfig))
+	}
+	c, err := redigo.Dial(network, address, options...)
+	if err != nil {
+		return nil, err
+	}
+	if err = auth(c, do.Username, do.Password); err != nil {
+		_ = c.Close()
+		return nil, err
 	}
+	if do.DB != 0 {
+		if _, err = c.Do("SELECT", do.DB); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// auth sends AUTH with the username too if it's set, which needs redis 6
+func auth(c redigo.Conn, username, password string) (err error) {
+	switch {
+	case password == "":
+	case username == "":
+		_, err = c.Do("AUTH", password)
+	default:
+		_, err = c.Do("AUTH", username, password)
+	}
+	return err
+}
+
+// doContext sends the command with a read timeout of ctx's deadline. If it times out, the connection
+// has an error, so the pool drops it when it's closed
+func doContext(ctx context.Context, c redigo.Conn, commandName string, args ...interface{}) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return c.Do(commandName, args...)
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return redigo.DoWithTimeout(c, timeout, commandName, args...)
+}
+
+// pool is a backends.RedisPool using redigo's pool
+type pool struct {
+	p *redigo.Pool
+}
+
+func (p *pool) Get(ctx context.Context) (backends.RedisConn, error) {
+	c, err := p.p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{c}, nil
+}
+
+func (p *pool) Close() error {
+	return p.p.Close()
+}
+
+// conn is a connection from the pool, closing it returns it to the pool
+type conn struct {
+	redigo.Conn
+}
+
+func (c *conn) DoContext(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	return doContext(ctx, c.Conn, commandName, args...)
 }
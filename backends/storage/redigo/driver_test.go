@@ -0,0 +1,327 @@
+package redigo_driver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karngyan/go-guerrilla/backends"
+)
+
+// fakeRedis is a stand-in for a redis server. handle returns the reply to a command, a string is
+// sent as a status, fakeRedisError as an error, []string as an array and nil as a nil bulk string
+type fakeRedis struct {
+	sync.Mutex
+	l        net.Listener
+	handle   func(cmd []string) interface{}
+	commands [][]string
+}
+
+type fakeRedisError string
+
+func newFakeRedis(t *testing.T, handle func(cmd []string) interface{}) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{l: l, handle: handle}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.l.Addr().String()
+}
+
+func (f *fakeRedis) close() {
+	_ = f.l.Close()
+}
+
+// received returns the commands named name
+func (f *fakeRedis) received(name string) [][]string {
+	f.Lock()
+	defer f.Unlock()
+	var cmds [][]string
+	for _, cmd := range f.commands {
+		if cmd[0] == name {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+func writeRESP(w *bufio.Writer, reply interface{}) {
+	switch r := reply.(type) {
+	case nil:
+		_, _ = w.WriteString("$-1\r\n")
+	case string:
+		_, _ = w.WriteString("+" + r + "\r\n")
+	case fakeRedisError:
+		_, _ = w.WriteString("-" + string(r) + "\r\n")
+	case int:
+		_, _ = fmt.Fprintf(w, ":%d\r\n", r)
+	case []byte:
+		_, _ = fmt.Fprintf(w, "$%d\r\n%s\r\n", len(r), r)
+	case []string:
+		_, _ = fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, s := range r {
+			writeRESP(w, []byte(s))
+		}
+	case []interface{}:
+		_, _ = fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, v := range r {
+			writeRESP(w, v)
+		}
+	}
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		// commands are arrays of bulk strings
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "*") {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		cmd := make([]string, n)
+		for i := range cmd {
+			if line, err = r.ReadString('\n'); err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, size+2)
+			if _, err = io.ReadFull(r, buf); err != nil {
+				return
+			}
+			cmd[i] = string(buf[:size])
+		}
+		cmd[0] = strings.ToUpper(cmd[0])
+		f.Lock()
+		f.commands = append(f.commands, cmd)
+		f.Unlock()
+		writeRESP(w, f.handle(cmd))
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		demoted bool
+	)
+	master := func(role *bool) func(cmd []string) interface{} {
+		return func(cmd []string) interface{} {
+			lock.Lock()
+			defer lock.Unlock()
+			switch cmd[0] {
+			case "AUTH", "SELECT":
+				return "OK"
+			case "ROLE":
+				if *role {
+					return []interface{}{"master", 0, []interface{}{}}
+				}
+				return []interface{}{"slave", "127.0.0.1", 6379, "connected", 0}
+			case "SETEX":
+				if !*role {
+					return fakeRedisError("READONLY You can't write against a read only replica.")
+				}
+				return "OK"
+			}
+			return "PONG"
+		}
+	}
+	isMaster1, isMaster2 := true, false
+	master1 := newFakeRedis(t, master(&isMaster1))
+	defer master1.close()
+	master2 := newFakeRedis(t, master(&isMaster2))
+	defer master2.close()
+	sentinel := newFakeRedis(t, func(cmd []string) interface{} {
+		lock.Lock()
+		defer lock.Unlock()
+		if cmd[0] == "AUTH" {
+			return "OK"
+		}
+		if cmd[0] != "SENTINEL" || cmd[2] != "mymaster" {
+			return fakeRedisError("ERR unknown command")
+		}
+		addr := master1.addr()
+		if demoted {
+			addr = master2.addr()
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		return []string{host, port}
+	})
+	defer sentinel.close()
+	// the first sentinel is down
+	down := newFakeRedis(t, nil)
+	down.close()
+
+	p := backends.RedisPooler("tcp", "", backends.RedisPoolConfig{MaxIdle: 2},
+		backends.RedisDialSentinel("mymaster", []string{down.addr(), sentinel.addr()}, "sentinelpass"),
+		backends.RedisDialPassword("mailer", "secret"),
+		backends.RedisDialDatabase(2),
+	)
+	defer func() {
+		_ = p.Close()
+	}()
+	setex := func() error {
+		conn, err := p.Get(context.Background())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		_, err = conn.(backends.RedisContextConn).DoContext(ctx, "SETEX", "abc", 60, "data")
+		return err
+	}
+	if err := setex(); err != nil {
+		t.Fatal(err)
+	}
+	if auth := master1.received("AUTH"); len(auth) != 1 || auth[0][1] != "mailer" || auth[0][2] != "secret" {
+		t.Error("expecting AUTH mailer secret, got", auth)
+	}
+	if sel := master1.received("SELECT"); len(sel) != 1 || sel[0][1] != "2" {
+		t.Error("expecting SELECT 2, got", sel)
+	}
+	if auth := sentinel.received("AUTH"); len(auth) != 1 || auth[0][1] != "sentinelpass" {
+		t.Error("expecting the sentinel password, got", auth)
+	}
+
+	// master2 is promoted, and master1 is now a replica
+	lock.Lock()
+	demoted, isMaster1, isMaster2 = true, false, true
+	lock.Unlock()
+	if err := setex(); err == nil || !strings.HasPrefix(err.Error(), "READONLY") {
+		t.Error("expecting READONLY from the old master, got", err)
+	}
+	// the connection to the old master was dropped, so the new master is asked for
+	if err := setex(); err != nil {
+		t.Fatal(err)
+	}
+	if len(master1.received("SETEX")) != 2 || len(master2.received("SETEX")) != 1 {
+		t.Error("expecting the SETEX to go to the new master")
+	}
+}
+
+func TestSlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31c3 {
+		t.Errorf("expecting the crc of 123456789 to be 0x31c3, got %#x", crc)
+	}
+	if s := slot("foo"); s != 12182 {
+		t.Error("expecting foo in slot 12182, got", s)
+	}
+	if slot("{user1000}.following") != slot("user1000") {
+		t.Error("expecting only the hash tag to be hashed")
+	}
+	if slot("foo{}{bar}") == slot("bar") {
+		t.Error("expecting an empty hash tag to hash the whole key")
+	}
+}
+
+func TestCluster(t *testing.T) {
+	var node1, node2 *fakeRedis
+	slots := func() interface{} {
+		host1, port1, _ := net.SplitHostPort(node1.addr())
+		_, port2, _ := net.SplitHostPort(node2.addr())
+		p1, _ := strconv.Atoi(port1)
+		p2, _ := strconv.Atoi(port2)
+		return []interface{}{
+			[]interface{}{0, 8191, []interface{}{host1, p1, "node1"}},
+			// the node doesn't know its ip
+			[]interface{}{8192, clusterSlots - 1, []interface{}{"", p2, "node2"}},
+		}
+	}
+	node1 = newFakeRedis(t, func(cmd []string) interface{} {
+		switch cmd[0] {
+		case "CLUSTER":
+			return slots()
+		case "XADD":
+			if cmd[1] == "migrating" {
+				return fakeRedisError(fmt.Sprintf("ASK %d %s", slot("migrating"), node2.addr()))
+			}
+			return []byte("1-1")
+		}
+		return "OK"
+	})
+	defer node1.close()
+	node2 = newFakeRedis(t, func(cmd []string) interface{} {
+		switch cmd[0] {
+		case "CLUSTER":
+			return slots()
+		case "SETEX":
+			if cmd[1] == "moved2" {
+				return fakeRedisError(fmt.Sprintf("MOVED %d %s", slot("moved2"), node1.addr()))
+			}
+		case "XADD":
+			return []byte("2-1")
+		}
+		return "OK"
+	})
+	defer node2.close()
+	if slot("foo") < 8192 || slot("moved2") < 8192 || slot("migrating") >= 8192 {
+		t.Fatal("the keys are expected to be in other slots")
+	}
+
+	p := backends.RedisPooler("tcp", node1.addr(), backends.RedisPoolConfig{MaxIdle: 2}, backends.RedisDialCluster())
+	defer func() {
+		_ = p.Close()
+	}()
+	do := func(cmd string, args ...interface{}) (interface{}, error) {
+		conn, err := p.Get(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		return conn.Do(cmd, args...)
+	}
+	if _, err := do("SETEX", "foo", 60, "data"); err != nil {
+		t.Fatal(err)
+	}
+	if len(node2.received("SETEX")) != 1 {
+		t.Error("expecting foo to be set on node2")
+	}
+	if _, err := do("SETEX", "moved2", 60, "data"); err != nil {
+		t.Fatal(err)
+	}
+	if len(node1.received("SETEX")) != 1 {
+		t.Error("expecting the MOVED key to be set on node1")
+	}
+	reply, err := do("XADD", "migrating", "*", "queued_id", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.([]byte)) != "2-1" || len(node2.received("ASKING")) != 1 {
+		t.Error("expecting the XADD to be sent to node2 after ASKING, got", string(reply.([]byte)))
+	}
+	// ASK is only for that command, the slot stays with node1
+	if p.(*cluster).nodeFor("migrating") != node1.addr() {
+		t.Error("expecting the slot to stay with node1")
+	}
+}
@@ -0,0 +1,134 @@
+package redigo_driver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/karngyan/go-guerrilla/backends"
+)
+
+const sentinelTimeout = time.Second * 5
+
+var errDemoted = errors.New("redis master was demoted to a replica")
+
+// masterAddr asks the sentinels where the master is, trying each in turn
+func masterAddr(network string, do *backends.RedisDialOptions) (string, error) {
+	var errs []string
+	for _, addr := range do.SentinelAddrs {
+		master, err := askSentinel(network, addr, do)
+		if err == nil {
+			return master, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+	}
+	return "", fmt.Errorf("no sentinel knows where master [%s] is (%s)", do.SentinelMaster, strings.Join(errs, ", "))
+}
+
+func askSentinel(network, addr string, do *backends.RedisDialOptions) (string, error) {
+	options := []redigo.DialOption{
+		redigo.DialConnectTimeout(sentinelTimeout),
+		redigo.DialReadTimeout(sentinelTimeout),
+		redigo.DialWriteTimeout(sentinelTimeout),
+	}
+	if do.Dial != nil {
+		options = append(options, redigo.DialNetDial(do.Dial))
+	}
+	if do.TLSConfig != nil {
+		options = append(options, redigo.DialUseTLS(true), redigo.DialTLSConfig(do.TLSConfig))
+	}
+	c, err := redigo.Dial(network, addr, options...)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+	if err = auth(c, "", do.SentinelPassword); err != nil {
+		return "", err
+	}
+	reply, err := redigo.Strings(c.Do("SENTINEL", "get-master-addr-by-name", do.SentinelMaster))
+	if err == redigo.ErrNil {
+		return "", errors.New("unknown master")
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("unexpected reply %v", reply)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// dialMaster connects to the master the sentinels know of. It's asked each time, so that a new
+// connection goes to the new master after a failover
+func dialMaster(network string, do *backends.RedisDialOptions) (redigo.Conn, error) {
+	addr, err := masterAddr(network, do)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dial(network, addr, do)
+	if err != nil {
+		return nil, err
+	}
+	// during a failover, the sentinels can still give the old master for a while
+	role, err := redigo.Values(c.Do("ROLE"))
+	if err == nil && len(role) > 0 {
+		var name string
+		if name, err = redigo.String(role[0], nil); err == nil && name != "master" {
+			err = fmt.Errorf("%s is a %s, not the master", addr, name)
+		}
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return &masterConn{Conn: c}, nil
+}
+
+// masterConn is a connection to the master. When a command gets a READONLY error, the server
+// was made a replica, so Err returns an error for the pool to drop the connection
+type masterConn struct {
+	redigo.Conn
+	err error
+}
+
+func (c *masterConn) check(err error) {
+	if e, ok := err.(redigo.Error); ok && strings.HasPrefix(string(e), "READONLY") {
+		c.err = errDemoted
+	}
+}
+
+func (c *masterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(commandName, args...)
+	c.check(err)
+	return reply, err
+}
+
+func (c *masterConn) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := redigo.DoWithTimeout(c.Conn, timeout, commandName, args...)
+	c.check(err)
+	return reply, err
+}
+
+func (c *masterConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+	return reply, err
+}
+
+func (c *masterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := redigo.ReceiveWithTimeout(c.Conn, timeout)
+	c.check(err)
+	return reply, err
+}
+
+func (c *masterConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Conn.Err()
+}
@@ -0,0 +1,65 @@
+package backends
+
+import (
+	"io"
+
+	"github.com/karngyan/go-guerrilla/mail"
+)
+
+// StreamProcessor is like Processor, except that it receives the message data as an io.Reader
+// while it is still arriving from the client, rather than after it was buffered to e.Data.
+type StreamProcessor interface {
+	ProcessStream(r io.Reader, e *mail.Envelope) (Result, error)
+}
+
+// Signature of StreamProcessor
+type StreamProcessWith func(r io.Reader, e *mail.Envelope) (Result, error)
+
+// Make StreamProcessWith will satisfy the StreamProcessor interface
+func (f StreamProcessWith) ProcessStream(r io.Reader, e *mail.Envelope) (Result, error) {
+	// delegate to the anonymous function
+	return f(r, e)
+}
+
+// StreamDecorator is what a decorator for a StreamProcessor looks like.
+// Typically, a stream decorator would wrap r in its own reader to inspect the data as it
+// passes through, then pass the new reader on to the next processor
+type StreamDecorator func(StreamProcessor) StreamProcessor
+
+type StreamProcessorConstructor func() StreamDecorator
+
+// DecorateStream will decorate a stream processor with a slice of passed decorators
+func DecorateStream(c StreamProcessor, ds ...StreamDecorator) StreamProcessor {
+	decorated := c
+	for _, decorate := range ds {
+		decorated = decorate(decorated)
+	}
+	return decorated
+}
+
+// StreamBackend is implemented by backends that are able to process the message data as it
+// arrives from the client.
+type StreamBackend interface {
+	Backend
+	// ProcessStream processes then saves the mail envelope, reading the message data from r
+	ProcessStream(r io.Reader, e *mail.Envelope) Result
+	// StreamEnabled returns true if the backend was configured to use ProcessStream
+	StreamEnabled() bool
+}
+
+// DefaultStreamProcessor is the last processor in a stream stack. It reads what is left of
+// the data in to the envelope, spilling to a temporary file once more than SpillThreshold
+// bytes were read, so that the data is available to the save_process stack.
+type DefaultStreamProcessor struct {
+	// SpillThreshold is the number of bytes to keep in memory, 0 means no limit
+	SpillThreshold int64
+	// SpillDir is where to create the temporary files, defaults to os.TempDir()
+	SpillDir string
+}
+
+func (w DefaultStreamProcessor) ProcessStream(r io.Reader, e *mail.Envelope) (Result, error) {
+	if _, err := e.ReadDataFrom(r, w.SpillThreshold, w.SpillDir); err != nil {
+		return nil, err
+	}
+	return BackendResultOK, nil
+}
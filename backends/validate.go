@@ -2,6 +2,8 @@ package backends
 
 import (
 	"errors"
+
+	"github.com/karngyan/go-guerrilla/response"
 )
 
 type RcptError error
@@ -15,3 +17,147 @@ var (
 	UserSuspended       = RcptError(errors.New("user suspended"))
 	StorageError        = RcptError(errors.New("storage error"))
 )
+
+// rcptErrorResponses maps the errors above to the reply for the RCPT command
+var rcptErrorResponses = map[RcptError]*response.Response{
+	NoSuchUser: response.Canned.FailRcptCmd,
+	StorageNotAvailable: {
+		EnhancedCode: response.OtherOrUndefinedMailSystemStatus,
+		BasicCode:    451,
+		Class:        response.ClassTransientFailure,
+		Comment:      "Error: storage not available",
+	},
+	StorageTooBusy: response.Canned.FailBackendBusy,
+	StorageTimeout: {
+		EnhancedCode: response.OtherOrUndefinedMailSystemStatus,
+		BasicCode:    451,
+		Class:        response.ClassTransientFailure,
+		Comment:      "Error: storage timeout",
+	},
+	QuotaExceeded: {
+		EnhancedCode: response.MailboxFull,
+		BasicCode:    452,
+		Class:        response.ClassTransientFailure,
+		Comment:      "Mailbox full, quota exceeded",
+	},
+	UserSuspended: {
+		EnhancedCode: response.MailboxDisabled,
+		BasicCode:    550,
+		Class:        response.ClassPermanentFailure,
+		Comment:      "Mailbox disabled, user suspended",
+	},
+	StorageError: {
+		EnhancedCode: response.OtherOrUndefinedMailSystemStatus,
+		BasicCode:    451,
+		Class:        response.ClassTransientFailure,
+		Comment:      "Error: storage error",
+	},
+}
+
+// rcptError is a RcptError that has its own reply for the RCPT command
+type rcptError struct {
+	msg      string
+	response *response.Response
+}
+
+func (e *rcptError) Error() string {
+	return e.msg
+}
+
+// Response returns the reply for the RCPT command
+func (e *rcptError) Response() *response.Response {
+	return e.response
+}
+
+// NewRcptError returns a RcptError that gives r as the reply to the RCPT command.
+// Validator processors can use it when none of the errors above have the right code
+func NewRcptError(msg string, r *response.Response) RcptError {
+	return &rcptError{msg: msg, response: r}
+}
+
+// rcptErrorResponse returns the reply of an error made by NewRcptError, or one of the errors above.
+// isRcptErr is true if it's one of the errors above
+func rcptErrorResponse(err error) (r *response.Response, isRcptErr bool, ok bool) {
+	if re, ok := err.(interface{ Response() *response.Response }); ok && re.Response() != nil {
+		return re.Response(), false, true
+	}
+	// not a map lookup, since err could be of a type that is not comparable
+	for rcptErr, r := range rcptErrorResponses {
+		if rcptErr == err {
+			return r, true, true
+		}
+	}
+	return nil, false, false
+}
+
+// isStorageError is true if err is one of the errors above that says storage is not working
+func isStorageError(err error) bool {
+	switch err {
+	case StorageNotAvailable, StorageTooBusy, StorageTimeout, StorageError:
+		return true
+	}
+	return false
+}
+
+// isVerdict is true if err is an answer about the email or a recipient, such as NoSuchUser, from a stack
+// that is working. Trying again won't change it. The storage errors above, and other errors, are failures
+// that could go away
+func isVerdict(err error) bool {
+	if err == errBreakerOpen {
+		// whatever its reply, the stack was not tried. It's a failure of a retry group inside this one
+		return false
+	}
+	r, isRcptErr, ok := rcptErrorResponse(err)
+	if !ok {
+		return false
+	}
+	if isRcptErr {
+		return !isStorageError(err)
+	}
+	return r.Class == response.ClassPermanentFailure
+}
+
+// RcptErrorResponse returns the reply to the RCPT command for err.
+// Errors that were not made by NewRcptError, and are not one of the errors above, get a 550 reply
+func RcptErrorResponse(err RcptError) *response.Response {
+	if r, _, ok := rcptErrorResponse(err); ok {
+		return r
+	}
+	return withErrorText(response.Canned.FailRcptCmd, err)
+}
+
+// SessionErrorResponse returns the reply for err, which was returned when validating the connection,
+// HELO or MAIL FROM. Errors made by NewRcptError use their own reply, the storage errors above give a
+// temporary failure, and anything else is a permanent failure.
+// A rejected connection gets a 421 instead of other temporary failures, since that's the only
+// temporary failure allowed in the greeting
+func SessionErrorResponse(task SelectTask, err error) *response.Response {
+	r, isRcptErr, ok := rcptErrorResponse(err)
+	if ok && isRcptErr && r.Class != response.ClassTransientFailure {
+		// the reply of a recipient error, such as NoSuchUser, is not right for other commands
+		ok = false
+	}
+	if ok {
+		if task == TaskValidateConnect && r.Class == response.ClassTransientFailure {
+			return response.Canned.ErrorBackendBusy
+		}
+		return r
+	}
+	switch task {
+	case TaskValidateConnect:
+		return withErrorText(response.Canned.FailConnectRejected, err)
+	case TaskValidateHelo:
+		return withErrorText(response.Canned.FailHeloRejected, err)
+	}
+	return withErrorText(response.Canned.FailSenderRejected, err)
+}
+
+// withErrorText returns a copy of r with the text of err appended to the comment
+func withErrorText(r *response.Response, err error) *response.Response {
+	return &response.Response{
+		EnhancedCode: r.EnhancedCode,
+		BasicCode:    r.BasicCode,
+		Class:        r.Class,
+		Comment:      r.Comment + " " + err.Error(),
+	}
+}
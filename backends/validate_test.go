@@ -0,0 +1,67 @@
+package backends
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/karngyan/go-guerrilla/response"
+)
+
+func TestRcptErrorResponse(t *testing.T) {
+	custom := NewRcptError("greylisted", &response.Response{
+		EnhancedCode: response.OtherOrUndefinedMailboxStatus,
+		BasicCode:    450,
+		Class:        response.ClassTransientFailure,
+		Comment:      "Greylisted, try again later",
+	})
+	tests := []struct {
+		err    RcptError
+		expect string
+	}{
+		{NoSuchUser, "550 5.1.1 User unknown in local recipient table"},
+		{StorageNotAvailable, "451 4.3.0 Error: storage not available"},
+		{StorageTooBusy, "451 4.3.2 Error: backend is too busy, try again later"},
+		{StorageTimeout, "451 4.3.0 Error: storage timeout"},
+		{QuotaExceeded, "452 4.2.2 Mailbox full, quota exceeded"},
+		{UserSuspended, "550 5.2.1 Mailbox disabled, user suspended"},
+		{StorageError, "451 4.3.0 Error: storage error"},
+		{custom, "450 4.2.0 Greylisted, try again later"},
+		{errors.New("not allowed"), "550 5.1.1 User unknown in local recipient table not allowed"},
+	}
+	for _, test := range tests {
+		if got := RcptErrorResponse(test.err).String(); got != test.expect {
+			t.Errorf("expecting %q for %q, got %q", test.expect, test.err, got)
+		}
+	}
+	if custom.Error() != "greylisted" {
+		t.Error("expecting the error text to be greylisted, got", custom.Error())
+	}
+}
+
+func TestSessionErrorResponse(t *testing.T) {
+	custom := NewRcptError("greylisted", &response.Response{
+		EnhancedCode: response.OtherOrUndefinedMailboxStatus,
+		BasicCode:    450,
+		Class:        response.ClassTransientFailure,
+		Comment:      "Greylisted, try again later",
+	})
+	tests := []struct {
+		task   SelectTask
+		err    error
+		expect string
+	}{
+		{TaskValidateConnect, errors.New("no rDNS"), "554 5.7.1 Connection rejected no rDNS"},
+		{TaskValidateConnect, StorageTimeout, "421 4.3.2 Server is too busy. Please try again later."},
+		{TaskValidateConnect, custom, "421 4.3.2 Server is too busy. Please try again later."},
+		{TaskValidateHelo, errors.New("bad helo"), "550 5.7.1 Helo rejected bad helo"},
+		{TaskValidateHelo, StorageTimeout, "451 4.3.0 Error: storage timeout"},
+		{TaskValidateMailFrom, NoSuchUser, "550 5.7.1 Sender rejected no such user"},
+		{TaskValidateMailFrom, custom, "450 4.2.0 Greylisted, try again later"},
+		{TaskValidateMailFrom, Errors{errors.New("blocked")}, "550 5.7.1 Sender rejected blocked"},
+	}
+	for _, test := range tests {
+		if got := SessionErrorResponse(test.task, test.err).String(); got != test.expect {
+			t.Errorf("expecting %q for %s %q, got %q", test.expect, test.task, test.err, got)
+		}
+	}
+}
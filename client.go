@@ -56,6 +56,8 @@ type client struct {
 	connGuard sync.Mutex
 	log       log.Logger
 	parser    rfc5321.Parser
+	// heloRejected is set when the HELO or EHLO was rejected, MAIL is refused until one is accepted
+	heloRejected bool
 }
 
 // NewClient allocates a new client.
@@ -173,6 +175,7 @@ func (c *client) init(conn net.Conn, clientID uint64, ep *mail.Pool) {
 	c.ConnectedAt = time.Now()
 	c.ID = clientID
 	c.errors = 0
+	c.heloRejected = false
 	// borrow an envelope from the envelope pool
 	c.Envelope = ep.Borrow(getRemoteAddr(conn), clientID)
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/karngyan/go-guerrilla"
+	"github.com/karngyan/go-guerrilla/backends"
+)
+
+var (
+	deadLetterBackend string
+	reinjectAll       bool
+
+	deadLettersCmd = &cobra.Command{
+		Use:   "deadletters",
+		Short: "List or re-inject the email that could not be saved",
+		Long: `Email that the save_process stack returned an error for is kept in the dead_letter_dir
+directory of the backend. These commands read the same config file as serve`,
+	}
+
+	deadLettersListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the dead letters",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openDeadLetters()
+			if err != nil {
+				return err
+			}
+			return listDeadLetters(cmd.OutOrStdout(), store)
+		},
+	}
+
+	deadLettersInjectCmd = &cobra.Command{
+		Use:   "inject [id...]",
+		Short: "Save the dead letters again, using the save_process stack of the config",
+		Long: `Starts the backend from the config, then saves each dead letter with it.
+The dead letters that were saved are removed, the others are kept.
+The spool is not started, so this can be run while the daemon is running`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 && !reinjectAll {
+				return errors.New("give the ids of the dead letters, or --all")
+			}
+			cfg, err := deadLetterConfig()
+			if err != nil {
+				return err
+			}
+			return reinjectDeadLetters(cmd.OutOrStdout(), cfg, args)
+		},
+	}
+)
+
+func init() {
+	deadLettersCmd.PersistentFlags().StringVarP(&configPath, "config", "c",
+		defaultConfigFile(), "Path to the configuration file")
+	deadLettersCmd.PersistentFlags().StringVarP(&deadLetterBackend, "backend", "b",
+		"", "Name of the backend in the backends config, the default is backend_config")
+	deadLettersInjectCmd.Flags().BoolVar(&reinjectAll, "all", false, "re-inject all the dead letters")
+	deadLettersCmd.AddCommand(deadLettersListCmd, deadLettersInjectCmd)
+	rootCmd.AddCommand(deadLettersCmd)
+}
+
+// deadLetterConfig returns the config of the backend chosen with the backend flag
+func deadLetterConfig() (backends.BackendConfig, error) {
+	ac, err := readConfig(configPath, pidFile)
+	if err != nil {
+		return nil, err
+	}
+	return backendConfigNamed(ac, deadLetterBackend)
+}
+
+// backendConfigNamed returns the config of the named backend, or backend_config if name is empty
+func backendConfigNamed(ac *guerrilla.AppConfig, name string) (backends.BackendConfig, error) {
+	if name == "" {
+		return ac.BackendConfig, nil
+	}
+	cfg, ok := ac.Backends[name]
+	if !ok {
+		return nil, fmt.Errorf("backend [%s] is not in the backends config", name)
+	}
+	return cfg, nil
+}
+
+func openDeadLetters() (*backends.DeadLetterStore, error) {
+	cfg, err := deadLetterConfig()
+	if err != nil {
+		return nil, err
+	}
+	dir, _ := cfg["dead_letter_dir"].(string)
+	if dir == "" {
+		return nil, errors.New("dead letters are not kept, dead_letter_dir is not set")
+	}
+	return backends.OpenDeadLetters(dir)
+}
+
+func listDeadLetters(out io.Writer, store *backends.DeadLetterStore) error {
+	list, err := store.List()
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Fprintf(out, "no dead letters in %s\n", store.Dir())
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tQUEUED ID\tFROM\tTO\tERROR")
+	for _, dl := range list {
+		rcpts := make([]string, 0, len(dl.Envelope.RcptTo))
+		for i := range dl.Envelope.RcptTo {
+			rcpts = append(rcpts, dl.Envelope.RcptTo[i].String())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			dl.ID,
+			dl.Time.Format("2006-01-02 15:04:05"),
+			dl.Envelope.QueuedId,
+			dl.Envelope.MailFrom.String(),
+			strings.Join(rcpts, ","),
+			dl.Error)
+	}
+	return w.Flush()
+}
+
+// startInjectBackend starts a backend with cfg, without its spool since the daemon may be running
+func startInjectBackend(cfg backends.BackendConfig) (backends.Backend, error) {
+	c := make(backends.BackendConfig, len(cfg))
+	for k, v := range cfg {
+		if k != "spool_dir" {
+			c[k] = v
+		}
+	}
+	b, err := backends.New(c, mainlog)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.Start(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// reinjectDeadLetters starts a backend with cfg and saves the dead letters with the given ids, or all of them
+func reinjectDeadLetters(out io.Writer, cfg backends.BackendConfig, ids []string) error {
+	if dir, _ := cfg["dead_letter_dir"].(string); dir == "" {
+		return errors.New("dead letters are not kept, dead_letter_dir is not set")
+	}
+	b, err := startInjectBackend(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = b.Shutdown()
+	}()
+	dl, ok := b.(backends.DeadLetterer)
+	if !ok {
+		return errors.New("the backend does not keep dead letters")
+	}
+	if len(ids) == 0 {
+		list, err := dl.DeadLetters().List()
+		if err != nil {
+			return err
+		}
+		for i := range list {
+			ids = append(ids, list[i].ID)
+		}
+	}
+	failed := 0
+	for _, id := range ids {
+		result, err := dl.Reinject(id)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(out, "%s: %s\n", id, err)
+		case result.Code() >= 300:
+			failed++
+			fmt.Fprintf(out, "%s: kept, %s\n", id, strings.TrimSpace(result.String()))
+		default:
+			fmt.Fprintf(out, "%s: saved, %s\n", id, strings.TrimSpace(result.String()))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d dead letters could not be saved", failed, len(ids))
+	}
+	return nil
+}
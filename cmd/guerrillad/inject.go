@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/karngyan/go-guerrilla/backends"
+)
+
+var (
+	injectBackend string
+
+	injectCmd = &cobra.Command{
+		Use:   "inject [file.eml|dir...]",
+		Short: "Save .eml files written by the EmlFile processor, using the save_process stack of the config",
+		Long: `Starts the backend from the config, then saves each .eml or .eml.gz file with it, using the
+envelope from the .json file next to it. Directories are searched for .eml files.
+The spool is not started, so this can be run while the daemon is running`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("give the .eml files or directories to inject")
+			}
+			ac, err := readConfig(configPath, pidFile)
+			if err != nil {
+				return err
+			}
+			cfg, err := backendConfigNamed(ac, injectBackend)
+			if err != nil {
+				return err
+			}
+			files, err := findEmlFiles(args)
+			if err != nil {
+				return err
+			}
+			return injectEmlFiles(cmd.OutOrStdout(), cfg, files)
+		},
+	}
+)
+
+func init() {
+	injectCmd.Flags().StringVarP(&configPath, "config", "c",
+		defaultConfigFile(), "Path to the configuration file")
+	injectCmd.Flags().StringVarP(&injectBackend, "backend", "b",
+		"", "Name of the backend in the backends config, the default is backend_config")
+	rootCmd.AddCommand(injectCmd)
+}
+
+// isEmlFile returns true if the name is of an email written by the EmlFile processor
+func isEmlFile(name string) bool {
+	return strings.HasSuffix(name, ".eml") || strings.HasSuffix(name, ".eml.gz")
+}
+
+// findEmlFiles returns the files in paths, and the .eml files in the directories of paths
+func findEmlFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && isEmlFile(name) {
+				files = append(files, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// injectEmlFiles starts a backend with cfg and saves each of the files
+func injectEmlFiles(out io.Writer, cfg backends.BackendConfig, files []string) error {
+	b, err := startInjectBackend(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = b.Shutdown()
+	}()
+	injector, ok := b.(backends.Injector)
+	if !ok {
+		return errors.New("the backend cannot inject email")
+	}
+	failed := 0
+	for _, file := range files {
+		result, err := injectEmlFile(injector, file)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(out, "%s: %s\n", file, err)
+		case result.Code() >= 300:
+			failed++
+			fmt.Fprintf(out, "%s: not saved, %s\n", file, strings.TrimSpace(result.String()))
+		default:
+			fmt.Fprintf(out, "%s: saved, %s\n", file, strings.TrimSpace(result.String()))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be saved", failed, len(files))
+	}
+	return nil
+}
+
+func injectEmlFile(injector backends.Injector, file string) (backends.Result, error) {
+	meta, data, err := backends.ReadEmlFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	// the delivery header is already in the file
+	envelope := *meta.EnvelopeMeta
+	envelope.DeliveryHeader = ""
+	return injector.Inject(&envelope, data)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/karngyan/go-guerrilla/backends"
+)
+
+var processorsCmd = &cobra.Command{
+	Use:   "processors",
+	Short: "List the processors and their config options",
+	Long: `Lists the backend options, then each processor that can be used in a stack,
+with the options it reads from backend_config`,
+	Run: func(cmd *cobra.Command, args []string) {
+		printProcessors(cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(processorsCmd)
+}
+
+func printProcessors(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	printSchema(w, backends.GatewaySchema, "backend")
+	for _, info := range backends.Svc.Processors() {
+		fmt.Fprintln(w)
+		if !info.HasSchema {
+			fmt.Fprintf(w, "%s (%s)\n  options are not described\n", info.Name, info.Kind)
+			continue
+		}
+		printSchema(w, info.ProcessorSchema, info.Kind)
+	}
+	_ = w.Flush()
+}
+
+func printSchema(w io.Writer, schema backends.ProcessorSchema, kind string) {
+	fmt.Fprintf(w, "%s (%s)", schema.Name, kind)
+	if schema.Description != "" {
+		fmt.Fprintf(w, " - %s", schema.Description)
+	}
+	fmt.Fprintln(w)
+	if len(schema.Options) == 0 {
+		fmt.Fprintln(w, "  no options")
+		return
+	}
+	for _, option := range schema.Options {
+		notes := "optional"
+		if option.Required {
+			notes = "required"
+		}
+		if option.Default != "" {
+			notes += ", default " + option.Default
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", option.Key, option.Type, notes, option.Description)
+	}
+}
@@ -49,18 +49,23 @@ func init() {
 	if err != nil && mainlog != nil {
 		mainlog.WithError(err).Errorf("Failed creating a logger to %s", log.OutputStderr)
 	}
-	cfgFile := "goguerrilla.conf" // deprecated default name
-	if _, err := os.Stat(cfgFile); err != nil {
-		cfgFile = "goguerrilla.conf.json" // use the new name
-	}
 	serveCmd.PersistentFlags().StringVarP(&configPath, "config", "c",
-		cfgFile, "Path to the configuration file")
+		defaultConfigFile(), "Path to the configuration file")
 	// intentionally didn't specify default pidFile; value from config is used if flag is empty
 	serveCmd.PersistentFlags().StringVarP(&pidFile, "pidFile", "p",
 		"", "Path to the pid file")
 	rootCmd.AddCommand(serveCmd)
 }
 
+// defaultConfigFile returns the name of the config file to use when the config flag is not given
+func defaultConfigFile() string {
+	cfgFile := "goguerrilla.conf" // deprecated default name
+	if _, err := os.Stat(cfgFile); err != nil {
+		cfgFile = "goguerrilla.conf.json" // use the new name
+	}
+	return cfgFile
+}
+
 func sigHandler() {
 	signal.Notify(signalChannel,
 		syscall.SIGHUP,
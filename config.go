@@ -32,6 +32,9 @@ type AppConfig struct {
 	LogLevel string `json:"log_level,omitempty"`
 	// BackendConfig configures the email envelope processing backend
 	BackendConfig backends.BackendConfig `json:"backend_config"`
+	// Backends configures more backends, by name. Each has its own processors and workers.
+	// A server uses one of them by setting its backend option, otherwise it uses BackendConfig
+	Backends map[string]backends.BackendConfig `json:"backends,omitempty"`
 }
 
 // ServerConfig specifies config options for a single server
@@ -63,6 +66,9 @@ type ServerConfig struct {
 	XClientOn bool `json:"xclient_on,omitempty"`
 	// AuthConfig defines the Auth type and related configurations inside to authenticate when AUTH command is executed
 	AuthConfig auth.AuthConfig `json:"auth_config,omitempty"`
+	// Backend is the name of the backend in AppConfig.Backends that processes this server's email.
+	// Uses the backend from AppConfig.BackendConfig if empty
+	Backend string `json:"backend,omitempty"`
 }
 
 type ServerTLSConfig struct {
@@ -178,6 +184,10 @@ func (c *AppConfig) Load(jsonBytes []byte) error {
 		if errs := server.Validate(); errs != nil {
 			return errs
 		}
+		if _, ok := c.Backends[server.Backend]; server.Backend != "" && !ok {
+			return fmt.Errorf("server [%s] uses backend [%s], which is not in the backends config",
+				server.ListenInterface, server.Backend)
+		}
 	}
 
 	// read the timestamps for the TLS keys, to determine if they need to be reloaded
@@ -195,6 +205,12 @@ func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 	if !reflect.DeepEqual((*c).BackendConfig, (*oldConfig).BackendConfig) {
 		app.Publish(EventConfigBackendConfig, c)
 	}
+	// named backends that were added or changed, before the servers that may use them
+	for name, bcfg := range c.Backends {
+		if oldBcfg, ok := oldConfig.Backends[name]; !ok || !reflect.DeepEqual(bcfg, oldBcfg) {
+			app.Publish(EventConfigBackendNamedConfig, name, c)
+		}
+	}
 	// has config changed, general check
 	if !reflect.DeepEqual(oldConfig, c) {
 		app.Publish(EventConfigNewConfig, c)
@@ -234,6 +250,12 @@ func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 	for _, oldServer := range oldServers {
 		app.Publish(EventConfigServerRemove, oldServer)
 	}
+	// remove named backends that don't exist anymore, now that no server uses them
+	for name := range oldConfig.Backends {
+		if _, ok := c.Backends[name]; !ok {
+			app.Publish(EventConfigBackendNamedRemove, name, c)
+		}
+	}
 }
 
 // EmitLogReopen emits log reopen events using existing config
@@ -326,40 +348,53 @@ func (c *AppConfig) setDefaults() error {
 
 // setBackendDefaults sets default values for the backend config,
 // if no backend config was added before starting, then use a default config
-// otherwise, see what required values were missed in the config and add any missing with defaults
+// otherwise, see what required values were missed in the config and add any missing with defaults.
+// The named backends get the same defaults
 func (c *AppConfig) setBackendDefaults() error {
+	var err error
+	if c.BackendConfig, err = backendDefaults(c.BackendConfig); err != nil {
+		return err
+	}
+	for name := range c.Backends {
+		if c.Backends[name], err = backendDefaults(c.Backends[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if len(c.BackendConfig) == 0 {
+// backendDefaults returns cfg with the defaults added
+func backendDefaults(cfg backends.BackendConfig) (backends.BackendConfig, error) {
+	if len(cfg) == 0 {
 		h, err := os.Hostname()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		c.BackendConfig = backends.BackendConfig{
+		return backends.BackendConfig{
 			"log_received_mails": true,
 			"save_workers_size":  1,
 			"save_process":       "HeadersParser|Header|Debugger",
 			"primary_mail_host":  h,
+		}, nil
+	}
+	if _, ok := cfg["save_process"]; !ok {
+		cfg["save_process"] = "HeadersParser|Header|Debugger"
+	}
+	if _, ok := cfg["primary_mail_host"]; !ok {
+		h, err := os.Hostname()
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		if _, ok := c.BackendConfig["save_process"]; !ok {
-			c.BackendConfig["save_process"] = "HeadersParser|Header|Debugger"
-		}
-		if _, ok := c.BackendConfig["primary_mail_host"]; !ok {
-			h, err := os.Hostname()
-			if err != nil {
-				return err
-			}
-			c.BackendConfig["primary_mail_host"] = h
-		}
-		if _, ok := c.BackendConfig["save_workers_size"]; !ok {
-			c.BackendConfig["save_workers_size"] = 1
-		}
+		cfg["primary_mail_host"] = h
+	}
+	if _, ok := cfg["save_workers_size"]; !ok {
+		cfg["save_workers_size"] = 1
+	}
 
-		if _, ok := c.BackendConfig["log_received_mails"]; !ok {
-			c.BackendConfig["log_received_mails"] = false
-		}
+	if _, ok := cfg["log_received_mails"]; !ok {
+		cfg["log_received_mails"] = false
 	}
-	return nil
+	return cfg, nil
 }
 
 // Emits any configuration change events on the server.
@@ -380,6 +415,10 @@ func (sc *ServerConfig) emitChangeEvents(oldServer *ServerConfig, app Guerrilla)
 		app.Publish(EventConfigServerConfig, sc)
 	}
 
+	// backend changed
+	if _, ok := changes["Backend"]; ok {
+		app.Publish(EventConfigServerBackend, sc)
+	}
 	// enable or disable?
 	if _, ok := changes["IsEnabled"]; ok {
 		if sc.IsEnabled {
@@ -41,6 +41,14 @@ const (
 	EventConfigServerMaxClients
 	// when a server's TLS config changed
 	EventConfigServerTLSConfig
+	// when a named backend was added, or its config changed
+	EventConfigBackendNamedConfig
+	// when a named backend was removed
+	EventConfigBackendNamedRemove
+	// when a server was switched to a different backend
+	EventConfigServerBackend
+	// when a circuit breaker of a retry group changed its state, see backends.BreakerEvent
+	EventBackendBreaker
 )
 
 var eventList = [...]string{
@@ -61,6 +69,10 @@ var eventList = [...]string{
 	"server_change:timeout",
 	"server_change:max_clients",
 	"server_change:tls_config",
+	"config_change:named_backend_config",
+	"config_change:remove_named_backend",
+	"server_change:backend",
+	"backend_change:breaker",
 }
 
 func (e Event) String() string {
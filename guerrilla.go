@@ -53,6 +53,12 @@ type guerrilla struct {
 	EventHandler
 	logStore
 	backendStore
+	// namedBackends has a backend for each of Config.Backends
+	namedBackends map[string]backends.Backend
+	// backendGuard controls access to g.namedBackends
+	backendGuard sync.Mutex
+	// removeBreakerListener stops publishing EventBackendBreaker
+	removeBreakerListener func()
 }
 
 type logStore struct {
@@ -65,6 +71,7 @@ type backendStore struct {
 
 type daemonEvent func(c *AppConfig)
 type serverEvent func(sc *ServerConfig)
+type backendEvent func(name string, c *AppConfig)
 
 // Get loads the log.logger in an atomic operation. Returns a stderr logger if not able to load
 func (ls *logStore) mainlog() log.Logger {
@@ -83,11 +90,23 @@ func (ls *logStore) setMainlog(log log.Logger) {
 // Returns a new instance of Guerrilla with the given config, not yet running. Backend started.
 func New(ac *AppConfig, b backends.Backend, l log.Logger) (Guerrilla, error) {
 	g := &guerrilla{
-		Config:  *ac, // take a local copy
-		servers: make(map[string]*server, len(ac.Servers)),
+		Config:        *ac, // take a local copy
+		servers:       make(map[string]*server, len(ac.Servers)),
+		namedBackends: make(map[string]backends.Backend, len(ac.Backends)),
 	}
 	g.backendStore.Store(b)
 	g.setMainlog(l)
+	for name, cfg := range ac.Backends {
+		nb, err := backends.NewNamed(name, cfg, l)
+		if err != nil {
+			// shut down the ones made so far, their processors may have opened connections
+			g.mapBackends(func(_ string, b backends.Backend) {
+				_ = b.Shutdown()
+			})
+			return g, fmt.Errorf("cannot make backend [%s]: %s", name, err)
+		}
+		g.namedBackends[name] = nb
+	}
 
 	if ac.LogLevel != "" {
 		if h, ok := l.(*log.HookedLogger); ok {
@@ -111,9 +130,18 @@ func New(ac *AppConfig, b backends.Backend, l log.Logger) (Guerrilla, error) {
 	if err != nil {
 		return g, err
 	}
+	g.mapBackends(func(name string, b backends.Backend) {
+		if startErr := b.Start(); startErr != nil && err == nil {
+			err = fmt.Errorf("cannot start backend [%s]: %s", name, startErr)
+		}
+	})
+	if err != nil {
+		return g, err
+	}
 
 	// subscribe for any events that may come in while running
 	g.subscribeEvents()
+	g.listenBreakers()
 
 	return g, err
 }
@@ -133,7 +161,14 @@ func (g *guerrilla) makeServers() error {
 			continue
 		} else {
 			sc := sc // pin!
-			server, err := newServer(&sc, g.backend(), g.mainlog())
+			b := g.serverBackend(sc.Backend)
+			if b == nil {
+				err := fmt.Errorf("backend [%s] of server [%s] not found", sc.Backend, sc.ListenInterface)
+				g.mainlog().WithError(err).Errorf("Failed to create server [%s]", sc.ListenInterface)
+				errs = append(errs, err)
+				continue
+			}
+			server, err := newServer(&sc, b, g.mainlog())
 			if err != nil {
 				g.mainlog().WithError(err).Errorf("Failed to create server [%s]", sc.ListenInterface)
 				errs = append(errs, err)
@@ -405,6 +440,63 @@ func (g *guerrilla) subscribeEvents() {
 			g.storeBackend(newBackend)
 		}
 	})
+	// when a named backend was added or changed, only that backend is restarted
+	events[EventConfigBackendNamedConfig] = backendEvent(func(name string, appConfig *AppConfig) {
+		logger, _ := log.GetLogger(appConfig.LogFile, appConfig.LogLevel)
+		oldBackend := g.namedBackend(name)
+		if oldBackend != nil {
+			if err := oldBackend.Shutdown(); err != nil {
+				logger.WithError(err).Warnf("Backend [%s] failed to shutdown", name)
+				return
+			}
+		}
+		// init a new backend, Revert to old backend config if it fails
+		newBackend, err := backends.NewNamed(name, appConfig.Backends[name], logger)
+		if err != nil {
+			logger.WithError(err).Errorf("Error while loading backend [%s]", name)
+			if oldBackend == nil {
+				return
+			}
+			if err = oldBackend.Reinitialize(); err != nil {
+				logger.WithError(err).Fatalf("failed to revert to old backend [%s] config", name)
+				return
+			}
+			if err = oldBackend.Start(); err != nil {
+				logger.WithError(err).Fatalf("failed to start backend [%s] with old config", name)
+				return
+			}
+			logger.Infof("reverted to old backend [%s] config", name)
+			return
+		}
+		if err := newBackend.Start(); err != nil {
+			logger.WithError(err).Errorf("backend [%s] could not start", name)
+		}
+		logger.Infof("new backend [%s] started", name)
+		g.storeNamedBackend(name, newBackend)
+	})
+	// named backend was removed from config
+	events[EventConfigBackendNamedRemove] = backendEvent(func(name string, appConfig *AppConfig) {
+		if b := g.namedBackend(name); b != nil {
+			g.removeNamedBackend(name)
+			if err := b.Shutdown(); err != nil {
+				g.mainlog().WithError(err).Warnf("Backend [%s] failed to shutdown", name)
+				return
+			}
+			g.mainlog().Infof("Backend [%s] removed from config, shut it down.", name)
+		}
+	})
+	// a server was switched to a different backend
+	events[EventConfigServerBackend] = serverEvent(func(sc *ServerConfig) {
+		if server, err := g.findServer(sc.ListenInterface); err == nil {
+			b := g.serverBackend(sc.Backend)
+			if b == nil {
+				g.mainlog().Errorf("Server [%s] backend [%s] not found", sc.ListenInterface, sc.Backend)
+				return
+			}
+			server.setBackend(b)
+			g.mainlog().Infof("Server [%s] now uses backend [%s]", sc.ListenInterface, sc.Backend)
+		}
+	})
 	var err error
 	for topic, fn := range events {
 		switch f := fn.(type) {
@@ -412,6 +504,8 @@ func (g *guerrilla) subscribeEvents() {
 			err = g.Subscribe(topic, f)
 		case serverEvent:
 			err = g.Subscribe(topic, f)
+		case backendEvent:
+			err = g.Subscribe(topic, f)
 		}
 		if err != nil {
 			g.mainlog().WithError(err).Errorf("failed to subscribe on topic [%s]", topic)
@@ -421,10 +515,13 @@ func (g *guerrilla) subscribeEvents() {
 
 }
 
+// storeBackend sets the backend of the servers that don't use a named backend
 func (g *guerrilla) storeBackend(b backends.Backend) {
 	g.backendStore.Store(b)
 	g.mapServers(func(server *server) {
-		server.setBackend(b)
+		if server.backendName() == "" {
+			server.setBackend(b)
+		}
 	})
 }
 
@@ -435,6 +532,50 @@ func (g *guerrilla) backend() backends.Backend {
 	return nil
 }
 
+// storeNamedBackend sets the backend called name, and of the servers that use it
+func (g *guerrilla) storeNamedBackend(name string, b backends.Backend) {
+	g.backendGuard.Lock()
+	g.namedBackends[name] = b
+	g.backendGuard.Unlock()
+	g.mapServers(func(server *server) {
+		if server.backendName() == name {
+			server.setBackend(b)
+		}
+	})
+}
+
+// namedBackend returns the backend called name, or nil if there is none
+func (g *guerrilla) namedBackend(name string) backends.Backend {
+	g.backendGuard.Lock()
+	defer g.backendGuard.Unlock()
+	return g.namedBackends[name]
+}
+
+// removeNamedBackend removes a backend from the named backends
+func (g *guerrilla) removeNamedBackend(name string) {
+	g.backendGuard.Lock()
+	defer g.backendGuard.Unlock()
+	delete(g.namedBackends, name)
+}
+
+// serverBackend returns the backend that a server uses, given the backend name from its config.
+// Returns nil if there is no backend with that name
+func (g *guerrilla) serverBackend(name string) backends.Backend {
+	if name == "" {
+		return g.backend()
+	}
+	return g.namedBackend(name)
+}
+
+// mapBackends calls a callback on each of the named backends
+func (g *guerrilla) mapBackends(callback func(name string, b backends.Backend)) {
+	g.backendGuard.Lock()
+	defer g.backendGuard.Unlock()
+	for name, b := range g.namedBackends {
+		callback(name, b)
+	}
+}
+
 // Entry point for the application. Starts all servers.
 func (g *guerrilla) Start() error {
 	var startErrors Errors
@@ -447,6 +588,7 @@ func (g *guerrilla) Start() error {
 		return append(startErrors, errors.New("no servers to start, please check the config"))
 	}
 	if g.state == daemonStateStopped {
+		g.listenBreakers()
 		// when a backend is shutdown, we need to re-initialize before it can be started again
 		if err := g.backend().Reinitialize(); err != nil {
 			startErrors = append(startErrors, err)
@@ -454,6 +596,14 @@ func (g *guerrilla) Start() error {
 		if err := g.backend().Start(); err != nil {
 			startErrors = append(startErrors, err)
 		}
+		g.mapBackends(func(name string, b backends.Backend) {
+			if err := b.Reinitialize(); err != nil {
+				startErrors = append(startErrors, err)
+			}
+			if err := b.Start(); err != nil {
+				startErrors = append(startErrors, err)
+			}
+		})
 	}
 	// channel for reading errors
 	errs := make(chan error, len(g.servers))
@@ -508,11 +658,32 @@ func (g *guerrilla) Shutdown() {
 		g.state = daemonStateStopped
 		defer g.guard.Unlock()
 	}()
+	if g.removeBreakerListener != nil {
+		g.removeBreakerListener()
+		g.removeBreakerListener = nil
+	}
 	if err := g.backend().Shutdown(); err != nil {
 		g.mainlog().WithError(err).Warn("Backend failed to shutdown")
 	} else {
 		g.mainlog().Infof("Backend shutdown completed")
 	}
+	g.mapBackends(func(name string, b backends.Backend) {
+		if err := b.Shutdown(); err != nil {
+			g.mainlog().WithError(err).Warnf("Backend [%s] failed to shutdown", name)
+		} else {
+			g.mainlog().Infof("Backend [%s] shutdown completed", name)
+		}
+	})
+}
+
+// listenBreakers publishes EventBackendBreaker when a circuit breaker of the backends changes its state
+func (g *guerrilla) listenBreakers() {
+	if g.removeBreakerListener != nil {
+		return
+	}
+	g.removeBreakerListener = backends.Svc.AddBreakerListener(func(ev backends.BreakerEvent) {
+		g.Publish(EventBackendBreaker, ev)
+	})
 }
 
 // SetLogger sets the logger for the app and propagates it to sub-packages (eg.
@@ -7,9 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net"
 	"net/textproto"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -152,6 +154,10 @@ type Envelope struct {
 	Auth auth.Auth
 	// When locked, it means that the envelope is being processed by the backend
 	sync.Mutex
+	// dataFile holds the message data once it grew past the spill threshold, see ReadDataFrom
+	dataFile *os.File
+	// dataFileSize is the number of bytes written to dataFile
+	dataFileSize int64
 }
 
 func NewEnvelope(remoteAddr string, clientID uint64) *Envelope {
@@ -171,19 +177,39 @@ func queuedID(clientID uint64) string {
 // It assumes that at most 30kb of email data can be a header
 // Decoding of encoding to UTF is only done on the Subject, where the result is assigned to the Subject field
 func (e *Envelope) ParseHeaders() error {
-	var err error
 	if e.Header != nil {
 		return errors.New("headers already parsed")
 	}
 	buf := e.Data.Bytes()
+	if e.dataFile != nil {
+		// the data was spilled to a file, only read in the part where the header could be
+		buf = make([]byte, maxHeaderChunk)
+		n, err := io.ReadFull(e.DataReader(), buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		buf = buf[:n]
+	}
+	return e.ParseHeaderBlock(buf)
+}
+
+// ParseHeaderBlock parses the headers from b into the Header field of the Envelope struct.
+// b holds the beginning of the message data, and needs to be at least as long as the header.
+// It's used when the data is not available in e.Data, for example when the header is being
+// parsed while the data is still streaming in
+func (e *Envelope) ParseHeaderBlock(b []byte) error {
+	var err error
+	if e.Header != nil {
+		return errors.New("headers already parsed")
+	}
 	// find where the header ends, assuming that over 30 kb would be max
-	if len(buf) > maxHeaderChunk {
-		buf = buf[:maxHeaderChunk]
+	if len(b) > maxHeaderChunk {
+		b = b[:maxHeaderChunk]
 	}
 
-	headerEnd := bytes.Index(buf, []byte{'\n', '\n'}) // the first two new-lines chars are the End Of Header
+	headerEnd := bytes.Index(b, []byte{'\n', '\n'}) // the first two new-lines chars are the End Of Header
 	if headerEnd > -1 {
-		header := buf[0 : headerEnd+2]
+		header := b[0 : headerEnd+2]
 		headerReader := textproto.NewReader(bufio.NewReader(bytes.NewBuffer(header)))
 		e.Header, err = headerReader.ReadMIMEHeader()
 		if err == nil || err == io.EOF {
@@ -198,25 +224,137 @@ func (e *Envelope) ParseHeaders() error {
 	return err
 }
 
+// ReadDataFrom reads the message data from r until EOF or an error, appending it to the envelope.
+// Once more than threshold bytes were read, the data is moved out of e.Data to a temporary file
+// in dir, and the rest of the data is written there. This keeps large messages off the heap.
+// A threshold of 0 or less keeps all data in e.Data. If dir is empty, os.TempDir() is used.
+// Returns the number of bytes read from r.
+func (e *Envelope) ReadDataFrom(r io.Reader, threshold int64, dir string) (int64, error) {
+	if threshold <= 0 {
+		return e.Data.ReadFrom(r)
+	}
+	var total int64
+	if e.dataFile == nil {
+		// buffer in memory until the threshold is reached
+		n, err := e.Data.ReadFrom(io.LimitReader(r, threshold-int64(e.Data.Len())+1))
+		total += n
+		if err != nil || int64(e.Data.Len()) <= threshold {
+			return total, err
+		}
+		if err = e.spill(dir); err != nil {
+			return total, err
+		}
+	}
+	n, err := io.Copy(e.dataFile, r)
+	e.dataFileSize += n
+	total += n
+	return total, err
+}
+
+// spill moves the contents of e.Data to a new temporary file in dir
+func (e *Envelope) spill(dir string) error {
+	f, err := ioutil.TempFile(dir, "guerrilla-data-")
+	if err != nil {
+		return err
+	}
+	n, err := e.Data.WriteTo(f)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	e.dataFile = f
+	e.dataFileSize = n
+	e.Data.Reset()
+	return nil
+}
+
+// DataSpilled returns true if the message data was moved to a temporary file by ReadDataFrom
+func (e *Envelope) DataSpilled() bool {
+	return e.dataFile != nil
+}
+
+// DataReader returns a new reader for reading the message data, without the delivery headers.
+// The data could be in e.Data, or in a temporary file if it was spilled by ReadDataFrom
+func (e *Envelope) DataReader() io.Reader {
+	if e.dataFile != nil {
+		return io.NewSectionReader(e.dataFile, 0, e.dataFileSize)
+	}
+	return bytes.NewReader(e.Data.Bytes())
+}
+
 // Len returns the number of bytes that would be in the reader returned by NewReader()
 func (e *Envelope) Len() int {
-	return len(e.DeliveryHeader) + e.Data.Len()
+	return len(e.DeliveryHeader) + e.Data.Len() + int(e.dataFileSize)
 }
 
 // NewReader returns a new reader for reading the email contents, including the delivery headers
 func (e *Envelope) NewReader() io.Reader {
 	return io.MultiReader(
 		strings.NewReader(e.DeliveryHeader),
-		bytes.NewReader(e.Data.Bytes()),
+		e.DataReader(),
 	)
 }
 
 // String converts the email to string.
 // Typically, you would want to use the compressor guerrilla.Processor for more efficiency, or use NewReader
+// Note that if the data was spilled to a file, the entire file will be read in to memory
 func (e *Envelope) String() string {
+	if e.dataFile != nil {
+		var sb strings.Builder
+		sb.Grow(e.Len())
+		_, _ = io.Copy(&sb, e.NewReader())
+		return sb.String()
+	}
 	return e.DeliveryHeader + e.Data.String()
 }
 
+// Branch returns a copy of the envelope, for a processor stack that runs at the same time as others.
+// The copy has its own recipients, header, values and hashes, so they can be changed without locking.
+// The message data is shared, and must not be changed while the copy is in use
+func (e *Envelope) Branch() *Envelope {
+	data := e.Data.Bytes()
+	b := &Envelope{
+		RemoteIP: e.RemoteIP,
+		Helo:     e.Helo,
+		MailFrom: e.MailFrom,
+		RcptTo:   append([]Address(nil), e.RcptTo...),
+		// capped, so that a write to the copy doesn't reach the data of e
+		Data:           *bytes.NewBuffer(data[:len(data):len(data)]),
+		Subject:        e.Subject,
+		TLS:            e.TLS,
+		Values:         make(map[string]interface{}, len(e.Values)),
+		Hashes:         append([]string(nil), e.Hashes...),
+		DeliveryHeader: e.DeliveryHeader,
+		QueuedId:       e.QueuedId,
+		ESMTP:          e.ESMTP,
+		Auth:           e.Auth,
+		dataFile:       e.dataFile,
+		dataFileSize:   e.dataFileSize,
+	}
+	if e.Header != nil {
+		b.Header = make(textproto.MIMEHeader, len(e.Header))
+		for k, v := range e.Header {
+			b.Header[k] = v
+		}
+	}
+	for k, v := range e.Values {
+		b.Values[k] = v
+	}
+	return b
+}
+
+// removeDataFile closes and removes the temporary file that the data may have been spilled to
+func (e *Envelope) removeDataFile() {
+	if e.dataFile == nil {
+		return
+	}
+	_ = e.dataFile.Close()
+	_ = os.Remove(e.dataFile.Name())
+	e.dataFile = nil
+	e.dataFileSize = 0
+}
+
 // ResetTransaction is called when the transaction is reset (keeping the connection open)
 func (e *Envelope) ResetTransaction() {
 
@@ -229,6 +367,7 @@ func (e *Envelope) ResetTransaction() {
 	e.RcptTo = []Address{}
 	// reset the data buffer, keep it allocated
 	e.Data.Reset()
+	e.removeDataFile()
 
 	// todo: these are probably good candidates for buffers / use sync.Pool (after profiling)
 	e.Subject = ""
@@ -3,6 +3,7 @@ package mail
 import (
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 )
@@ -129,6 +130,31 @@ func TestEnvelope(t *testing.T) {
 
 }
 
+func TestEnvelopeBranch(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.PushRcpt(Address{User: "test", Host: "example.com"})
+	e.Values["key"] = "value"
+	e.Data.WriteString("Subject: Test\n\nThis is a test.")
+	if err := e.ParseHeaders(); err != nil && err != io.EOF {
+		t.Fatal("cannot parse headers:", err)
+	}
+
+	b := e.Branch()
+	b.Values["key"] = "changed"
+	b.Header.Set("Subject", "Changed")
+	b.RcptTo[0].User = "changed"
+	b.Data.WriteString(" More data.")
+	if e.Values["key"] != "value" || e.Header.Get("Subject") != "Test" || e.RcptTo[0].User != "test" {
+		t.Error("expecting the envelope not to change with its branch, got", e.Values, e.Header, e.RcptTo)
+	}
+	if e.String() != "Subject: Test\n\nThis is a test." {
+		t.Error("expecting the data not to change with its branch, got", e.String())
+	}
+	if b.String() != "Subject: Test\n\nThis is a test. More data." || b.QueuedId != e.QueuedId {
+		t.Error("expecting the branch to have the data and queued id, got", b.String(), b.QueuedId)
+	}
+}
+
 func TestEncodedWordAhead(t *testing.T) {
 	str := "=?ISO-8859-1?Q?Andr=E9?= Pirard <PIRARD@vm1.ulg.ac.be>"
 	if hasEncodedWordAhead(str, 24) != -1 {
@@ -146,3 +172,90 @@ func TestEncodedWordAhead(t *testing.T) {
 	}
 
 }
+
+func TestEnvelopeReadDataFrom(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	data := "Subject: Test\n\nThis is a test nbnb nbnb hgghgh nnnbnb nbnbnb nbnbn."
+	e.DeliveryHeader = "Delivered-To: test@example.com\n"
+
+	n, err := e.ReadDataFrom(strings.NewReader(data), 10, "")
+	if err != nil {
+		t.Error("cannot read data:", err)
+		return
+	}
+	if n != int64(len(data)) {
+		t.Error("expecting", len(data), "bytes read, got", n)
+	}
+	if !e.DataSpilled() {
+		t.Error("expecting the data to be spilled to a file")
+	}
+	if e.Data.Len() != 0 {
+		t.Error("e.Data should be empty after spilling, it has", e.Data.Len())
+	}
+	r := e.NewReader()
+	b, _ := ioutil.ReadAll(r)
+	if len(b) != e.Len() {
+		t.Error("e.Len() is incorrect, it shown ", e.Len(), " but we wanted ", len(b))
+	}
+	if string(b) != e.DeliveryHeader+data {
+		t.Error("unexpected data read back:", string(b))
+	}
+	if err := e.ParseHeaders(); err != nil && err != io.EOF {
+		t.Error("cannot parse headers:", err)
+	}
+	if e.Subject != "Test" {
+		t.Error("Subject expecting: Test, got:", e.Subject)
+	}
+	name := e.dataFile.Name()
+	e.ResetTransaction()
+	if e.DataSpilled() {
+		t.Error("data file should be removed after ResetTransaction")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("data file still exists:", name)
+	}
+
+	// below the threshold, the data is kept in memory
+	if _, err := e.ReadDataFrom(strings.NewReader(data), 1024, ""); err != nil {
+		t.Error("cannot read data:", err)
+	}
+	if e.DataSpilled() || e.Data.String() != data {
+		t.Error("expecting the data to be in e.Data")
+	}
+}
+
+func TestEnvelopeMeta(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.QueuedId = "abc123"
+	e.Helo = "helo.example.com"
+	e.MailFrom = Address{User: "test", Host: "example.com"}
+	e.PushRcpt(Address{User: "test", Host: "[64.233.160.71]", IP: []byte{64, 233, 160, 71}})
+	e.TLS = true
+	e.Auth.Username = "test"
+	e.Auth.Password = "secret"
+	b, err := e.MarshalMeta()
+	if err != nil {
+		t.Error("cannot marshal meta:", err)
+		return
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Error("the password should not be marshaled")
+	}
+	e2 := NewEnvelope("", 0)
+	if err := e2.UnmarshalMeta(b); err != nil {
+		t.Error("cannot unmarshal meta:", err)
+		return
+	}
+	if e2.QueuedId != e.QueuedId || e2.RemoteIP != e.RemoteIP || e2.Helo != e.Helo || !e2.TLS {
+		t.Error("meta was not restored, got", e2.Meta())
+	}
+	if e2.MailFrom.String() != "test@example.com" {
+		t.Error("expecting test@example.com, got", e2.MailFrom.String())
+	}
+	if len(e2.RcptTo) != 1 || !e2.RcptTo[0].IP.Equal(e.RcptTo[0].IP) {
+		t.Error("recipients were not restored, got", e2.RcptTo)
+	}
+	if e2.Auth.Username != "test" || e2.Auth.Password != "" {
+		t.Error("expecting only the username to be restored, got", e2.Auth)
+	}
+}
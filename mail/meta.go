@@ -0,0 +1,64 @@
+package mail
+
+import (
+	"encoding/json"
+)
+
+// EnvelopeMeta holds the fields of an Envelope that describe the SMTP transaction, without the message data.
+// It's used when the envelope needs to be saved outside of memory, for example to a spool directory,
+// and then loaded back later.
+// The password used to authenticate is never included.
+type EnvelopeMeta struct {
+	QueuedId       string    `json:"queued_id"`
+	RemoteIP       string    `json:"remote_ip"`
+	Helo           string    `json:"helo"`
+	MailFrom       Address   `json:"mail_from"`
+	RcptTo         []Address `json:"rcpt_to"`
+	TLS            bool      `json:"tls"`
+	ESMTP          bool      `json:"esmtp"`
+	DeliveryHeader string    `json:"delivery_header,omitempty"`
+	AuthUsername   string    `json:"auth_username,omitempty"`
+}
+
+// Meta returns the meta-data of the envelope
+func (e *Envelope) Meta() *EnvelopeMeta {
+	return &EnvelopeMeta{
+		QueuedId:       e.QueuedId,
+		RemoteIP:       e.RemoteIP,
+		Helo:           e.Helo,
+		MailFrom:       e.MailFrom,
+		RcptTo:         e.RcptTo,
+		TLS:            e.TLS,
+		ESMTP:          e.ESMTP,
+		DeliveryHeader: e.DeliveryHeader,
+		AuthUsername:   e.Auth.Username,
+	}
+}
+
+// SetMeta sets the envelope's fields from m
+func (e *Envelope) SetMeta(m *EnvelopeMeta) {
+	e.QueuedId = m.QueuedId
+	e.RemoteIP = m.RemoteIP
+	e.Helo = m.Helo
+	e.MailFrom = m.MailFrom
+	e.RcptTo = m.RcptTo
+	e.TLS = m.TLS
+	e.ESMTP = m.ESMTP
+	e.DeliveryHeader = m.DeliveryHeader
+	e.Auth.Username = m.AuthUsername
+}
+
+// MarshalMeta encodes the envelope's meta-data to JSON
+func (e *Envelope) MarshalMeta() ([]byte, error) {
+	return json.Marshal(e.Meta())
+}
+
+// UnmarshalMeta decodes the meta-data encoded by MarshalMeta and sets the envelope's fields
+func (e *Envelope) UnmarshalMeta(b []byte) error {
+	m := &EnvelopeMeta{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return err
+	}
+	e.SetMeta(m)
+	return nil
+}
@@ -3,6 +3,7 @@ package guerrilla
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -62,3 +63,32 @@ func newSMTPBufferedReader(rd io.Reader) *smtpBufferedReader {
 	s := &smtpBufferedReader{bufio.NewReader(alr), alr}
 	return s
 }
+
+// dataSizeReader counts the message data as it's read, and fails once more than max bytes were read.
+// The first error is kept in err and returned on all following reads
+type dataSizeReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+	err error
+}
+
+func (d *dataSizeReader) Read(p []byte) (n int, err error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err = d.r.Read(p)
+	d.n += int64(n)
+	if d.n > d.max {
+		err = fmt.Errorf("maximum DATA size exceeded (%d)", d.max)
+	}
+	if err != nil && err != io.EOF {
+		d.err = err
+	}
+	return
+}
+
+// allocate a new dataSizeReader
+func newDataSizeReader(r io.Reader, max int64) *dataSizeReader {
+	return &dataSizeReader{r: r, max: max}
+}
@@ -2,6 +2,7 @@ package response
 
 import (
 	"fmt"
+	"sync"
 )
 
 const (
@@ -125,6 +126,7 @@ type Responses struct {
 	// The 500's
 	FailLineTooLong              *Response
 	FailNestedMailCmd            *Response
+	FailHeloFirstMailCmd         *Response
 	FailNoSenderDataCmd          *Response
 	FailNoRecipientsDataCmd      *Response
 	FailUnrecognizedCmd          *Response
@@ -142,11 +144,23 @@ type Responses struct {
 	FailBackendTransaction       *Response
 	FailBackendTimeout           *Response
 	FailRcptCmd                  *Response
+	FailRcptDelivery             *Response
+	FailConnectRejected          *Response
+	FailHeloRejected             *Response
+	FailSenderRejected           *Response
+	FailNoRoute                  *Response
+	FailMailboxName              *Response
 
 	// The 400's
 	ErrorTooManyRecipients *Response
 	ErrorRelayDenied       *Response
 	ErrorShutdown          *Response
+	ErrorBackendBusy       *Response
+	FailBackendBusy        *Response
+	FailRcptDeferred       *Response
+	FailBackendUnavailable *Response
+	FailMailboxFull        *Response
+	FailStorageFull        *Response
 
 	// The 200's
 	SuccessMailCmd       *Response
@@ -183,6 +197,13 @@ func init() {
 		Comment:      "Error: nested MAIL command",
 	}
 
+	Canned.FailHeloFirstMailCmd = &Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    503,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: send HELO/EHLO first",
+	}
+
 	Canned.FailInvalidAuth = &Response{
 		EnhancedCode: AuthLoginInvalid,
 		BasicCode:    403,
@@ -295,6 +316,27 @@ func init() {
 		Comment:      "Server is shutting down. Please try again later. Sayonara!",
 	}
 
+	Canned.ErrorBackendBusy = &Response{
+		EnhancedCode: SystemNotAcceptingNetworkMessages,
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Server is too busy. Please try again later.",
+	}
+
+	Canned.FailBackendBusy = &Response{
+		EnhancedCode: SystemNotAcceptingNetworkMessages,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: backend is too busy, try again later",
+	}
+
+	Canned.FailRcptDeferred = &Response{
+		EnhancedCode: OtherOrUndefinedMailboxStatus,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: could not deliver to the recipient, try again later",
+	}
+
 	Canned.FailSyntaxError = &Response{
 		EnhancedCode: SyntaxError,
 		BasicCode:    550,
@@ -386,6 +428,69 @@ func init() {
 		Comment:      "User unknown in local recipient table",
 	}
 
+	Canned.FailRcptDelivery = &Response{
+		EnhancedCode: OtherOrUndefinedMailboxStatus,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: could not deliver to the recipient",
+	}
+
+	Canned.FailConnectRejected = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Connection rejected",
+	}
+
+	Canned.FailHeloRejected = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Helo rejected",
+	}
+
+	Canned.FailSenderRejected = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Sender rejected",
+	}
+
+	Canned.FailNoRoute = &Response{
+		EnhancedCode: BadDestinationSystemAddress,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: no route for the recipient's domain",
+	}
+
+	Canned.FailBackendUnavailable = &Response{
+		EnhancedCode: OtherOrUndefinedMailSystemStatus,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: storage is unavailable, try again later",
+	}
+
+	Canned.FailMailboxName = &Response{
+		EnhancedCode: BadDestinationMailboxAddressSyntax,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: invalid mailbox name",
+	}
+
+	Canned.FailMailboxFull = &Response{
+		EnhancedCode: MailboxFull,
+		BasicCode:    452,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: mailbox is full, try again later",
+	}
+
+	Canned.FailStorageFull = &Response{
+		EnhancedCode: MailSystemFull,
+		BasicCode:    452,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: insufficient system storage, try again later",
+	}
+
 }
 
 // DefaultMap contains defined default codes (RfC 3463)
@@ -432,6 +537,7 @@ const (
 	ConversionWithLossPerformed             = ".6.4"
 	ConversionFailed                        = ".6.5"
 	AuthLoginValid                          = ".7.0" // According to rfc4954
+	DeliveryNotAuthorized                   = ".7.1"
 )
 
 var defaultTexts = struct {
@@ -453,7 +559,9 @@ type Response struct {
 	Class        class
 	// Comment is optional
 	Comment string
-	cached  string
+	// the canned responses are shared by all the clients, so the string is made once
+	once   sync.Once
+	cached string
 }
 
 // it looks like this ".5.4"
@@ -472,12 +580,15 @@ func (e EnhancedStatusCode) String() string {
 
 // String returns a custom Response as a string
 func (r *Response) String() string {
+	r.once.Do(func() {
+		r.cached = r.format()
+	})
+	return r.cached
+}
 
-	if r.cached != "" {
-		return r.cached
-	}
+// format makes the string of the response
+func (r *Response) format() string {
 	if r.EnhancedCode == "" {
-		r.cached = r.Comment
 		return r.Comment
 	}
 
@@ -500,8 +611,7 @@ func (r *Response) String() string {
 	if r.BasicCode == 0 {
 		basicCode = getBasicStatusCode(e)
 	}
-	r.cached = fmt.Sprintf("%d %s %s", basicCode, e.String(), comment)
-	return r.cached
+	return fmt.Sprintf("%d %s %s", basicCode, e.String(), comment)
 }
 
 // getBasicStatusCode gets the basic status code from codeMap, or fallback code if not mapped
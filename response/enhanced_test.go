@@ -1,6 +1,7 @@
 package response
 
 import (
+	"sync"
 	"testing"
 )
 
@@ -42,6 +43,26 @@ func TestCustomString(t *testing.T) {
 	}
 }
 
+// the canned responses are used by all the clients at once, run with -race
+func TestConcurrentString(t *testing.T) {
+	resp := &Response{
+		EnhancedCode: OtherStatus,
+		Class:        ClassTransientFailure,
+		Comment:      "Busy",
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s := resp.String(); s != "400 4.0.0 Busy" {
+				t.Errorf("String failed. String \"%s\" not expected.", s)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 func TestBuildEnhancedResponseFromDefaultStatus(t *testing.T) {
 	//a := buildEnhancedResponseFromDefaultStatus(ClassPermanentFailure, InvalidCommand)
 	a := EnhancedStatusCode{ClassPermanentFailure, InvalidCommand}.String()
@@ -197,6 +197,36 @@ func (s *server) backend() backends.Backend {
 	return nil
 }
 
+// backendBusy returns true if the backend is too busy to accept more work
+func (s *server) backendBusy() bool {
+	if lr, ok := s.backend().(backends.LoadReporter); ok {
+		return lr.Busy()
+	}
+	return false
+}
+
+// validateSession asks the backend to validate the client's connection, HELO or MAIL FROM, depending on the task.
+// Returns nil if the backend does not validate sessions
+func (s *server) validateSession(client *client, task backends.SelectTask) error {
+	sv, ok := s.backend().(backends.SessionValidator)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch task {
+	case backends.TaskValidateConnect:
+		err = sv.ValidateConnect(client.Envelope)
+	case backends.TaskValidateHelo:
+		err = sv.ValidateHelo(client.Envelope)
+	case backends.TaskValidateMailFrom:
+		err = sv.ValidateMailFrom(client.Envelope)
+	}
+	if err != nil {
+		s.log().WithError(err).Infof("[%s] %s rejected", client.RemoteIP, task)
+	}
+	return err
+}
+
 // Set the timeout for the server and all clients
 func (s *server) setTimeout(seconds int) {
 	duration := time.Duration(int64(seconds))
@@ -215,6 +245,12 @@ func (s *server) isEnabled() bool {
 	return sc.IsEnabled
 }
 
+// backendName returns the name of the backend from the server's config, goroutine safe
+func (s *server) backendName() string {
+	sc := s.configStore.Load().(ServerConfig)
+	return sc.Backend
+}
+
 // Set the allowed hosts for the server
 func (s *server) setAllowedHosts(allowedHosts []string) {
 	s.hosts.Lock()
@@ -412,6 +448,17 @@ func (s *server) handleClient(client *client) {
 	for client.isAlive() {
 		switch client.state {
 		case ClientGreeting:
+			if s.backendBusy() {
+				// turn away new connections until the backend catches up
+				client.sendResponse(r.ErrorBackendBusy)
+				client.kill()
+				break
+			}
+			if err := s.validateSession(client, backends.TaskValidateConnect); err != nil {
+				client.sendResponse(backends.SessionErrorResponse(backends.TaskValidateConnect, err))
+				client.kill()
+				break
+			}
 			client.sendResponse(greeting)
 			client.state = ClientCmd
 		case ClientCmd:
@@ -453,6 +500,13 @@ func (s *server) handleClient(client *client) {
 					break
 				}
 				client.resetTransaction()
+				if err := s.validateSession(client, backends.TaskValidateHelo); err != nil {
+					client.Helo = ""
+					client.heloRejected = true
+					client.sendResponse(backends.SessionErrorResponse(backends.TaskValidateHelo, err))
+					break
+				}
+				client.heloRejected = false
 				client.sendResponse(helo)
 
 			case cmdEHLO.match(cmd):
@@ -466,6 +520,13 @@ func (s *server) handleClient(client *client) {
 				}
 				client.ESMTP = true
 				client.resetTransaction()
+				if err := s.validateSession(client, backends.TaskValidateHelo); err != nil {
+					client.Helo = ""
+					client.heloRejected = true
+					client.sendResponse(backends.SessionErrorResponse(backends.TaskValidateHelo, err))
+					break
+				}
+				client.heloRejected = false
 				client.sendResponse(ehlo,
 					messageSize,
 					pipelining,
@@ -558,6 +619,11 @@ func (s *server) handleClient(client *client) {
 					client.sendResponse(r.FailNestedMailCmd)
 					break
 				}
+				if client.heloRejected {
+					// otherwise the HELO policy could be skipped by carrying on without one
+					client.sendResponse(r.FailHeloFirstMailCmd)
+					break
+				}
 				client.MailFrom, err = client.parsePath(input[10:], client.parser.MailFrom)
 				if err != nil {
 					s.log().WithError(err).Error("MAIL parse error", "["+string(input[10:])+"]")
@@ -567,6 +633,11 @@ func (s *server) handleClient(client *client) {
 					// bounce has empty from address
 					client.MailFrom = mail.Address{}
 				}
+				if err := s.validateSession(client, backends.TaskValidateMailFrom); err != nil {
+					client.MailFrom = mail.Address{}
+					client.sendResponse(backends.SessionErrorResponse(backends.TaskValidateMailFrom, err))
+					break
+				}
 				client.sendResponse(r.SuccessMailCmd)
 
 			case cmdRCPT.match(cmd):
@@ -588,7 +659,7 @@ func (s *server) handleClient(client *client) {
 					rcptError := s.backend().ValidateRcpt(client.Envelope)
 					if rcptError != nil {
 						client.PopRcpt()
-						client.sendResponse(r.FailRcptCmd, " ", rcptError.Error())
+						client.sendResponse(backends.RcptErrorResponse(rcptError))
 					} else {
 						client.sendResponse(r.SuccessRcptCmd)
 					}
@@ -616,6 +687,10 @@ func (s *server) handleClient(client *client) {
 					client.sendResponse(r.FailNoRecipientsDataCmd)
 					break
 				}
+				if s.backendBusy() {
+					client.sendResponse(r.FailBackendBusy)
+					break
+				}
 				client.sendResponse(r.SuccessDataCmd)
 				client.state = ClientData
 
@@ -710,9 +785,21 @@ func (s *server) handleClient(client *client) {
 			// if the client goes a little over. Anything above will err
 			client.bufin.setLimit(sc.MaxSize + 1024000) // This a hard limit.
 
-			n, err := client.Data.ReadFrom(client.smtpReader.DotReader())
-			if n > sc.MaxSize {
-				err = fmt.Errorf("maximum DATA size exceeded (%d)", sc.MaxSize)
+			var res backends.Result
+			var err error
+			if sb, ok := s.backend().(backends.StreamBackend); ok && sb.StreamEnabled() {
+				// the backend reads the data while it arrives
+				dr := newDataSizeReader(client.smtpReader.DotReader(), sc.MaxSize)
+				res = sb.ProcessStream(dr, client.Envelope)
+				// consume anything the processors did not read, up to the terminating dot
+				_, _ = io.Copy(ioutil.Discard, dr)
+				err = dr.err
+			} else {
+				var n int64
+				n, err = client.Data.ReadFrom(client.smtpReader.DotReader())
+				if n > sc.MaxSize {
+					err = fmt.Errorf("maximum DATA size exceeded (%d)", sc.MaxSize)
+				}
 			}
 			if err != nil {
 				if err == LineLimitExceeded {
@@ -730,10 +817,21 @@ func (s *server) handleClient(client *client) {
 				break
 			}
 
-			res := s.backend().Process(client.Envelope)
+			if res == nil {
+				res = s.backend().Process(client.Envelope)
+			}
 			if res.Code() < 300 {
 				client.messagesSent++
 			}
+			if rr, ok := res.(*backends.RcptResults); ok {
+				// the client only gets one reply, so log the recipients that the email was not delivered to
+				for _, rcpt := range rr.Rcpts {
+					if rcpt.Status != backends.RcptDelivered {
+						s.log().Infof("[%s] email %s for <%s>: %s",
+							client.RemoteIP, rcpt.Status, rcpt.Rcpt.String(), rcpt.Result)
+					}
+				}
+			}
 			client.sendResponse(res)
 			client.state = ClientCmd
 			if s.isShuttingDown() {
@@ -1,6 +1,7 @@
 package guerrilla
 
 import (
+	"errors"
 	"os"
 	"testing"
 
@@ -1148,3 +1149,250 @@ func TestAllowsHosts(t *testing.T) {
 	s.setAllowedHosts([]string{"grr.la", "example.com"})
 
 }
+
+// The data should be streamed to the backend, and the size limit should still apply
+func TestStreamData(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	bcfg := backends.BackendConfig{
+		"save_workers_size":      1,
+		"save_process":           "Debugger",
+		"stream_save_process":    "HeadersParser",
+		"stream_spill_threshold": 64,
+		"log_received_mails":     true,
+		"primary_mail_host":      "example.com",
+	}
+
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"grr.la"},
+		Servers: []ServerConfig{
+			{
+				IsEnabled:       true,
+				ListenInterface: "127.0.0.1:2525",
+				MaxSize:         1024,
+			},
+		},
+	}
+	cfg.BackendConfig = bcfg
+
+	d := Daemon{Config: cfg}
+	err := d.Start()
+
+	if err != nil {
+		t.Error("server didn't start")
+	} else {
+
+		conn, err := net.Dial("tcp", "127.0.0.1:2525")
+		if err != nil {
+
+			return
+		}
+		in := bufio.NewReader(conn)
+		str, err := in.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+		}
+		if _, err := fmt.Fprint(conn, "HELO host\r\n"); err != nil {
+			t.Error(err)
+		}
+		str, err = in.ReadString('\n')
+		// the first transaction is within the size limit, the second is over
+		bodies := []string{"A an email body\r\n", strings.Repeat("A an email body\r\n", 100)}
+		expects := []string{"250 2.0.0 OK", "451 4.3.0 Error: maximum DATA size exceeded"}
+		for i := 0; i < 2; i++ {
+			if _, err := fmt.Fprint(conn, "MAIL FROM:<test@example.com>r\r\n"); err != nil {
+				t.Error(err)
+			}
+			if str, err = in.ReadString('\n'); err != nil {
+				t.Error(err)
+			}
+			if _, err := fmt.Fprint(conn, "RCPT TO:<test@grr.la>\r\n"); err != nil {
+				t.Error(err)
+			}
+			if str, err = in.ReadString('\n'); err != nil {
+				t.Error(err)
+			}
+			if _, err := fmt.Fprint(conn, "DATA\r\n"); err != nil {
+				t.Error(err)
+			}
+			if str, err = in.ReadString('\n'); err != nil {
+				t.Error(err)
+			}
+			if _, err := fmt.Fprint(conn, "Subject: Test subject\r\n\r\n"+bodies[i]+".\r\n"); err != nil {
+				t.Error(err)
+			}
+			str, err = in.ReadString('\n')
+			if err != nil {
+				t.Error(err)
+			} else if strings.Index(str, expects[i]) != 0 {
+				t.Error("Expected the reply to start with'", expects[i], "'but got", str)
+			}
+		}
+		_ = str
+
+		d.Shutdown()
+	}
+}
+
+func TestSessionValidation(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	// no certificates needed
+	sc.TLS.StartTLSOn = false
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	backends.Svc.AddProcessor("SessionPolicy", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskValidateHelo && e.Helo == "bad.example.com" {
+					return nil, errors.New("bad helo")
+				}
+				if task == backends.TaskValidateMailFrom && e.MailFrom.User == "spammer" {
+					return nil, errors.New("blocked")
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	backend, err := backends.New(backends.BackendConfig{
+		"save_process":             "HeadersParser",
+		"validate_connect_process": "SessionPolicy",
+		"validate_sender_process":  "SessionPolicy",
+	}, mainlog)
+	if err != nil {
+		t.Fatal("new backend failed because:", err)
+	}
+	if err := backend.Start(); err != nil {
+		t.Fatal("backend did not start because:", err)
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	server, err := newServer(sc, backend, mainlog)
+	if err != nil {
+		t.Fatal("new server failed because:", err)
+	}
+	conn := mocks.NewConn()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	// greeting
+	if line, _ := r.ReadLine(); !strings.HasPrefix(line, "220") {
+		t.Error("expected a 220 greeting, got", line)
+	}
+	expect := []struct {
+		cmd, reply string
+	}{
+		{"HELO bad.example.com", "550 5.7.1 Helo rejected bad helo"},
+		{"MAIL FROM:<test@example.com>", "503 5.5.1 Error: send HELO/EHLO first"},
+		{"HELO mx.example.com", "250"},
+		{"MAIL FROM:<spammer@example.com>", "550 5.7.1 Sender rejected blocked"},
+		{"MAIL FROM:<test@example.com>", "250"},
+		{"EHLO bad.example.com", "550 5.7.1 Helo rejected bad helo"},
+		{"MAIL FROM:<test@example.com>", "503 5.5.1 Error: send HELO/EHLO first"},
+		{"QUIT", "221"},
+	}
+	for _, e := range expect {
+		if err := w.PrintfLine("%s", e.cmd); err != nil {
+			t.Error(err)
+		}
+		if line, _ := r.ReadLine(); !strings.HasPrefix(line, e.reply) {
+			t.Errorf("expected %q after %s, got %q", e.reply, e.cmd, line)
+		}
+	}
+	wg.Wait()
+}
+
+// A recipient that failed is not lost when the email was delivered to the others
+func TestRcptFailedReply(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	// no certificates needed
+	sc.TLS.StartTLSOn = false
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	// Quota fails the recipients called "full"
+	backends.Svc.AddProcessor("Quota", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					for _, rcpt := range e.RcptTo {
+						if rcpt.User == "full" {
+							backends.MarkRcptFailed(e, rcpt, backends.NewResult("552 5.2.2 Mailbox full"))
+						}
+					}
+					backends.DropFailedRcpts(e)
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	backend, err := backends.New(backends.BackendConfig{
+		"save_process":      "HeadersParser|Quota",
+		"save_workers_size": 1,
+	}, mainlog)
+	if err != nil {
+		t.Fatal("new backend failed because:", err)
+	}
+	if err := backend.Start(); err != nil {
+		t.Fatal("backend did not start because:", err)
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	server, err := newServer(sc, backend, mainlog)
+	if err != nil {
+		t.Fatal("new server failed because:", err)
+	}
+	server.setAllowedHosts([]string{"test.com"})
+	conn := mocks.NewConn()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	// greeting
+	if line, _ := r.ReadLine(); !strings.HasPrefix(line, "220") {
+		t.Error("expected a 220 greeting, got", line)
+	}
+	expect := []struct {
+		cmd, reply string
+	}{
+		{"HELO mx.example.com", "250"},
+		{"MAIL FROM:<test@example.com>", "250"},
+		{"RCPT TO:<test@test.com>", "250"},
+		{"RCPT TO:<full@test.com>", "250"},
+		{"DATA", "354"},
+		// the client bounces it to the sender, rather than being told it was delivered to all of them
+		{"Subject: Test\r\n\r\nThis is a test.\r\n.", "552 5.2.2 Mailbox full"},
+		// delivered to all of the recipients
+		{"MAIL FROM:<test@example.com>", "250"},
+		{"RCPT TO:<test@test.com>", "250"},
+		{"DATA", "354"},
+		{"Subject: Test\r\n\r\nThis is a test.\r\n.", "250"},
+		{"QUIT", "221"},
+	}
+	for _, e := range expect {
+		if err := w.PrintfLine("%s", e.cmd); err != nil {
+			t.Error(err)
+		}
+		if line, _ := r.ReadLine(); !strings.HasPrefix(line, e.reply) {
+			t.Errorf("expected %q after %s, got %q", e.reply, e.cmd, line)
+		}
+	}
+	wg.Wait()
+}